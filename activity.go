@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// activityPoll is how often the command's processes are sampled for signs
+// of progress other than output
+const activityPoll = time.Second
+
+// counterProbe reads a counter of pid that only grows while it makes
+// progress, such as its CPU time, reporting false if pid is gone
+type counterProbe func(pid int) (uint64, bool)
+
+// counterSource polls probe across the process tree of the command that
+// pid reports, counting it as activity whenever one of the processes
+// advanced its counter
+func counterSource(pid func() int, probe counterProbe) watchdog.ActivitySource {
+	last := map[int]uint64{}
+	return watchdog.NewPollSource(activityPoll, func() bool {
+		root := pid()
+		if root == 0 {
+			return false // not started yet
+		}
+		active := false
+		seen := map[int]uint64{}
+		for _, p := range processTree(root) {
+			if v, ok := probe(p); ok {
+				active = active || v > last[p]
+				seen[p] = v
+			}
+		}
+		last = seen
+		return active
+	})
+}
+
+// meterReading holds rates per second of the command's process tree, by
+// metric: CPU time in clock ticks, which at Linux's 100 ticks a second is
+// percent of one CPU, and disk and TCP traffic in bytes
+type meterReading map[string]float64
+
+func (r meterReading) String() string {
+	var parts []string
+	for name, v := range r {
+		if name == "cpu" {
+			parts = append(parts, fmt.Sprintf("cpu %.0f%%", v))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s %s/s", name, formatByteSize(int64(v))))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// meterProbes are the counters behind each metric
+var meterProbes = map[string]func() counterProbe{
+	"cpu": func() counterProbe { return cpuTime },
+	"io":  func() counterProbe { return diskIO },
+	"net": newNetProbe,
+}
+
+// treeMeter samples the rates of the command's process tree for --require
+type treeMeter struct {
+	mu      sync.Mutex
+	reading meterReading
+}
+
+// watchMeter measures the given metrics of the process tree below the
+// command that pid reports, once per activityPoll, until ctx is done
+func watchMeter(ctx context.Context, wg *sync.WaitGroup, pid func() int, metrics map[string]bool) *treeMeter {
+	m := &treeMeter{reading: meterReading{}}
+	probes := map[string]counterProbe{}
+	last := map[string]map[int]uint64{}
+	for name := range metrics {
+		probes[name] = meterProbes[name]()
+		m.reading[name] = 0
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(activityPoll)
+		defer ticker.Stop()
+		prev := time.Now()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				root := pid()
+				if root == 0 {
+					prev = now
+					continue
+				}
+				tree := processTree(root)
+				reading := meterReading{}
+				for name, probe := range probes {
+					// Processes that started within the window count whole
+					var delta uint64
+					seen := map[int]uint64{}
+					for _, p := range tree {
+						if v, ok := probe(p); ok {
+							if v > last[name][p] {
+								delta += v - last[name][p]
+							}
+							seen[p] = v
+						}
+					}
+					last[name] = seen
+					reading[name] = float64(delta) / now.Sub(prev).Seconds()
+				}
+				prev = now
+				m.mu.Lock()
+				m.reading = reading
+				m.mu.Unlock()
+			}
+		}
+	}()
+	return m
+}
+
+// read returns the rates over the latest window
+func (m *treeMeter) read() meterReading {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.reading
+}
+
+// formatByteSize renders n with a binary unit, as parseByteSize reads it
+func formatByteSize(n int64) string {
+	v, unit := float64(n), ""
+	for _, u := range []string{"K", "M", "G", "T"} {
+		if v < 1024 {
+			break
+		}
+		v, unit = v/1024, u
+	}
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", v), ".0") + unit
+}
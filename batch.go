@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// batchEntry is one line of a batch file
+type batchEntry struct {
+	line    int
+	command string        // shell command line
+	timeout time.Duration // 0 for the default given to batch
+}
+
+// readBatch reads a batch file: a shell command per line, optionally
+// starting with its own timeout in brackets such as "[10m] make test".
+// Blank lines and lines starting with # are skipped.
+func readBatch(path string) ([]batchEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []batchEntry
+	sc := bufio.NewScanner(f)
+	for num := 1; sc.Scan(); num++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e := batchEntry{line: num, command: line}
+		// "[ -f x ]" is a shell test, not a timeout: only a duration counts
+		if budget, rest, ok := strings.Cut(strings.TrimPrefix(line, "["), "]"); ok && strings.HasPrefix(line, "[") {
+			if d, err := parseDuration(budget); err == nil {
+				if d < watchdog.Resolution {
+					return nil, fmt.Errorf("line %d: invalid timeout %q: expected at least %v", num, budget, watchdog.Resolution)
+				}
+				e.timeout, e.command = d, strings.TrimSpace(rest)
+				if e.command == "" {
+					return nil, fmt.Errorf("line %d: missing command", num)
+				}
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// batchMain runs the commands of a batch file one after another, each
+// under its own idle timeout, and sums up how each of them went
+func batchMain(args []string) int {
+	fset := flag.NewFlagSet("batch", flag.ExitOnError)
+	keepGoing := fset.Bool("keep-going", false, "run the rest of the batch after a command fails or times out, instead of stopping there")
+	var warnAt warnThreshold
+	fset.Var(&warnAt, "warn-at", "warn once per idle episode after this much inactivity, as a `percentage` of the timeout (80%) or a duration")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout batch [options] [duration] <file>\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout batch 5m --keep-going nightly.txt\n")
+		fmt.Fprintf(os.Stderr, "\nThe file has a shell command per line, which may start with a timeout of its own: [30m] make test\n")
+		fmt.Fprintf(os.Stderr, "The duration is the timeout of commands that don't give their own.\n")
+		fmt.Fprintf(os.Stderr, "The exit status is 124 if a command timed out, else that of the first command to fail, else 0.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() > 0 {
+		// Options may follow the duration
+		first := fset.Arg(0)
+		fset.Parse(fset.Args()[1:])
+		args = append([]string{first}, fset.Args()...)
+	} else {
+		args = nil
+	}
+	if len(args) < 1 || len(args) > 2 {
+		fset.Usage()
+		return 1
+	}
+	var timeout time.Duration
+	if len(args) == 2 {
+		var err error
+		if timeout, err = parseDuration(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", args[0], err)
+			return 1
+		}
+		if timeout < watchdog.Resolution {
+			fmt.Fprintf(os.Stderr, "Invalid duration %q: below the watchdog's %v resolution\n", args[0], watchdog.Resolution)
+			return 1
+		}
+	}
+	path := args[len(args)-1]
+	entries, err := readBatch(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid batch file %s: %v\n", path, err)
+		return 1
+	}
+	for i, e := range entries {
+		if e.timeout == 0 {
+			if timeout == 0 {
+				fmt.Fprintf(os.Stderr, "No timeout for line %d of %s: give a duration or start the line with one, e.g. [5m]\n", e.line, path)
+				return 1
+			}
+			entries[i].timeout = timeout
+		}
+	}
+
+	inv := newInvocation("")
+	env := append(os.Environ(), inv.env()...)
+
+	// Signals reach the command running at the time
+	var mu sync.Mutex
+	var current *watchdog.Runner
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, forwardedSignals...)
+	defer signal.Stop(sigChan)
+	go func() {
+		for sig := range sigChan {
+			mu.Lock()
+			if current != nil {
+				current.Signal(sig)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	results := make([]watchdog.Result, 0, len(entries))
+	for _, e := range entries {
+		r := watchdog.New(watchdog.Config{
+			Path:    shellCommand[0],
+			Args:    append(shellCommand[1:], e.command),
+			Env:     env,
+			Timeout: e.timeout,
+			WarnAt:  warnAt.resolve(e.timeout),
+			Stdout:  con,
+			Stderr:  con.stderr(),
+			OnEvent: func(ev watchdog.Event) {
+				switch ev.Kind {
+				case watchdog.Warned:
+					con.Logf("No output for %v, killing in %v...", idleFor(ev.Idle), timeLeft(ev.Timeout-ev.Idle))
+				case watchdog.TimedOut:
+					con.Logf("No output for %v, killing process...", ev.Timeout)
+				}
+			},
+		})
+		con.Printf("spawn %s\n", e.command)
+		mu.Lock()
+		current = r
+		mu.Unlock()
+		res := r.Run(context.Background())
+		mu.Lock()
+		current = nil
+		mu.Unlock()
+		if res.Err != nil {
+			con.Logf("Failed to run command: %v", res.Err)
+		}
+		results = append(results, res)
+		if (res.ExitCode != 0 || res.Err != nil) && !*keepGoing {
+			break
+		}
+	}
+
+	// The summary: one row per command, those not reached included
+	width := 0
+	for _, e := range entries {
+		width = max(width, len(e.command))
+	}
+	width = min(width, 50)
+	code, timedOut := 0, false
+	con.Logf("Batch %s: %d of %d commands run", path, len(results), len(entries))
+	for i, e := range entries {
+		command := e.command
+		if len(command) > width {
+			command = command[:width-3] + "..."
+		}
+		if i >= len(results) {
+			con.Logf("  %-*s  not run", width, command)
+			continue
+		}
+		res := results[i]
+		took := res.Duration.Round(100 * time.Millisecond)
+		switch {
+		case res.Err != nil:
+			con.Logf("  %-*s  failed to start", width, command)
+		case res.TimedOut:
+			con.Logf("  %-*s  killed idle after %v (timeout %v)", width, command, took, e.timeout)
+		default:
+			con.Logf("  %-*s  exit %d after %v", width, command, res.ExitCode, took)
+		}
+		if res.TimedOut {
+			timedOut = true
+		} else if res.ExitCode != 0 && code == 0 {
+			code = res.ExitCode
+		}
+	}
+	if timedOut {
+		return watchdog.ExitTimedOut
+	}
+	return code
+}
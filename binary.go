@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBinaryThreshold is the activity threshold of --binary without
+// --activity-threshold: enough bytes that a stray control byte or two
+// doesn't count
+const defaultBinaryThreshold = "64/1s"
+
+// activityFloor counts output as activity only once enough of it
+// comes in an interval, for --activity-threshold: a command dribbling the
+// odd byte, such as a keep-alive NUL, is idle all the same
+type activityFloor struct {
+	bytes    int64
+	interval time.Duration
+
+	mu    sync.Mutex // stdout and stderr are read apart in pipe mode
+	start time.Time  // of the interval under way
+	seen  int64      // bytes in it so far
+}
+
+// parseActivityThreshold parses --activity-threshold, a byte count with an
+// optional interval, 1s by default, such as 4K/10s
+func parseActivityThreshold(s string) (*activityFloor, error) {
+	size, interval, hasInterval := strings.Cut(s, "/")
+	n, err := parseByteSize(size)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("invalid size %q: expected a byte count such as 512 or 4K", size)
+	}
+	t := &activityFloor{bytes: n, interval: time.Second}
+	if hasInterval {
+		if t.interval, err = parseDuration(interval); err != nil || t.interval <= 0 {
+			return nil, fmt.Errorf("invalid interval %q: expected a duration such as 10s", interval)
+		}
+	}
+	return t, nil
+}
+
+// counts reports whether chunk brings the output of the interval under
+// way up to the threshold, which starts the next one
+func (t *activityFloor) counts(chunk []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.start) > t.interval {
+		t.start, t.seen = now, 0
+	}
+	t.seen += int64(len(chunk))
+	if t.seen < t.bytes {
+		return false
+	}
+	t.start, t.seen = now, 0
+	return true
+}
+
+// errBinary is why --binary leaves out the options that work on lines
+var errBinary = errors.New("it works on lines, and -binary output has none")
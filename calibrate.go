@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// calibrateMain runs a command several times without a timeout, pools the
+// silences between its bursts of output, and recommends a timeout from a
+// high percentile of them with a safety factor, in place of a guess
+func calibrateMain(args []string) int {
+	fset := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	pct := percentFlag(99.9)
+	fset.Var(&pct, "percentile", "base the timeout on this `percentile` of the gaps of all runs")
+	factor := fset.Float64("factor", 2, "multiply the percentile gap by this safety `factor`")
+	foreground := fset.Bool("foreground", false, "run the command on pipes instead of a pseudo-terminal, as run -foreground does")
+	quiet := fset.Bool("quiet", false, "don't show the command's output")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout calibrate [options] <runs> [--] <command> [args...]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout calibrate 10 -- make -j8\n")
+		fmt.Fprintf(os.Stderr, "\nRuns the command one time after another with no timeout, then reports the\n")
+		fmt.Fprintf(os.Stderr, "gaps in its output and recommends a timeout. Ctrl-C stops early and reports\n")
+		fmt.Fprintf(os.Stderr, "on the runs so far.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	var positional []string
+	for fset.NArg() > 0 && len(positional) < 1 {
+		positional = append(positional, fset.Arg(0))
+		fset.Parse(fset.Args()[1:])
+	}
+	command := fset.Args()
+	if len(positional) != 1 || len(command) == 0 {
+		fset.Usage()
+		return 1
+	}
+	runs, err := strconv.Atoi(positional[0])
+	if err != nil || runs < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid run count %q: expected a positive number\n", positional[0])
+		return 1
+	}
+	if pct <= 0 || pct > 100 {
+		fmt.Fprintf(os.Stderr, "Invalid percentile %v: expected one above 0%% and up to 100%%\n", &pct)
+		return 1
+	}
+	if *factor < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid factor %v: expected 1 or more\n", *factor)
+		return 1
+	}
+	var out, errOut io.Writer = con, con.stderr()
+	if *quiet {
+		out, errOut = io.Discard, io.Discard
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	inv := newInvocation("")
+	var gaps []time.Duration
+	var longest []time.Duration // the longest gap of each run
+	failed := 0
+	for ; inv.seq <= runs && ctx.Err() == nil; inv.seq++ {
+		con.Printf("spawn (%d/%d): %s\n", inv.seq, runs, strings.Join(command, " "))
+		start := time.Now()
+		stats := newGapStats(start)
+		cols, rows := terminalSize(uintptr(syscall.Stdout))
+		res := watchdog.New(watchdog.Config{
+			Path:    command[0],
+			Args:    command[1:],
+			Env:     append(os.Environ(), inv.env()...),
+			Timeout: time.Duration(math.MaxInt64), // no enforcement
+			PTY:     !*foreground,
+			Cols:    cols,
+			Rows:    rows,
+			Stdout:  io.MultiWriter(out, stats),
+			Stderr:  io.MultiWriter(errOut, stats),
+		}).Run(ctx)
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run command: %v\n", res.Err)
+			return 1
+		}
+		if ctx.Err() != nil {
+			con.Logf("Run %d of %d interrupted, left out", inv.seq, runs)
+			break
+		}
+		run := stats.until(time.Now())
+		gaps = append(gaps, run...)
+		var worst time.Duration
+		for _, gap := range run {
+			worst = max(worst, gap)
+		}
+		longest = append(longest, worst)
+		if res.ExitCode != 0 {
+			failed++
+		}
+		con.Logf("Run %d of %d exited with status %d after %v; gaps: %d, longest %v",
+			inv.seq, runs, res.ExitCode, time.Since(start).Round(time.Millisecond), len(run), roundGap(worst))
+	}
+	if len(longest) == 0 {
+		return 1
+	}
+	calibration{
+		runs: len(longest), failed: failed, gaps: gaps, longest: longest,
+		percentile: float64(pct), factor: *factor, command: command,
+	}.report(os.Stdout)
+	return 0
+}
+
+// calibration is what calibrate measured, and how to turn it into a timeout
+type calibration struct {
+	runs, failed int
+	gaps         []time.Duration // of all runs
+	longest      []time.Duration // the longest gap of each run
+	percentile   float64
+	factor       float64
+	command      []string
+}
+
+// report prints the gaps and the recommended timeout
+func (c calibration) report(w io.Writer) {
+	sorted := append([]time.Duration(nil), c.gaps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		if len(sorted) == 0 {
+			return 0
+		}
+		i := int(math.Ceil(float64(len(sorted))*p/100)) - 1
+		return sorted[min(max(i, 0), len(sorted)-1)]
+	}
+	runs := fmt.Sprintf("%d, all exited 0", c.runs)
+	if c.failed > 0 {
+		runs = fmt.Sprintf("%d, %d of them failed (their gaps count all the same)", c.runs, c.failed)
+	}
+	fmt.Fprintf(w, "%-13s %s\n", "Runs:", runs)
+	if len(sorted) == 0 {
+		fmt.Fprintf(w, "%-13s none of %v or more, output never paused\n", "Gaps:", watchdog.Resolution)
+	} else {
+		fmt.Fprintf(w, "%-13s %d of %v or more, p50 %v, p95 %v, p99 %v, max %v\n", "Gaps:", len(sorted), watchdog.Resolution,
+			roundGap(at(50)), roundGap(at(95)), roundGap(at(99)), roundGap(sorted[len(sorted)-1]))
+	}
+
+	base := at(c.percentile)
+	timeout := roundUpTimeout(time.Duration(float64(base) * c.factor))
+	killed := 0
+	for _, gap := range c.longest {
+		if gap >= timeout {
+			killed++
+		}
+	}
+	fmt.Fprintf(w, "%-13s %v (the p%s gap of %v × %s, rounded up)\n", "Recommended:", timeout,
+		strconv.FormatFloat(c.percentile, 'g', -1, 64), roundGap(base), strconv.FormatFloat(c.factor, 'g', -1, 64))
+	if killed > 0 {
+		fmt.Fprintf(w, "%-13s %d of the %d runs had a gap that long and would have been killed\n", "", killed, c.runs)
+	}
+	fmt.Fprintf(w, "%-13s idle-timeout %v %s\n", "", timeout, shellJoin(c.command))
+}
+
+// roundUpTimeout rounds a recommended timeout up to a whole second, ten
+// seconds past a minute, or a minute past ten, at least one second
+func roundUpTimeout(d time.Duration) time.Duration {
+	unit := time.Second
+	switch {
+	case d > 10*time.Minute:
+		unit = time.Minute
+	case d > time.Minute:
+		unit = 10 * time.Second
+	}
+	return max(time.Second, (d+unit-1)/unit*unit)
+}
+
+// shellJoin joins args into a command line for a POSIX shell, quoting
+// those that need it
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = a
+		if a == "" || strings.IndexFunc(a, func(r rune) bool { return !strings.ContainsRune(shellSafe, r) }) >= 0 {
+			quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellSafe are the characters that need no quoting in a shell word
+const shellSafe = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_@%+=:,./-"
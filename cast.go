@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// castHeader is the first line of an asciinema v2 recording
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// castRecorder writes output as asciinema v2 "o" events so sessions can be
+// replayed and searched with their timing
+type castRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	start   time.Time
+	pending []byte // incomplete UTF-8 sequence held back from the last write
+}
+
+// casts holds open recordings by path, so attempts without {seq} in the
+// template keep appending to one continuous session
+var casts = map[string]*castRecorder{}
+
+// openCast returns the recorder for the attempt's expanded path
+func openCast(tmpl string, inv invocation, command []string, cfg config) (*castRecorder, error) {
+	path := inv.expand(tmpl)
+	if c, ok := casts[path]; ok {
+		return c, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	cols, rows := cfg.ptySize()
+	c := &castRecorder{f: f, w: bufio.NewWriter(f), start: time.Now()}
+	hdr, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: c.start.Unix(),
+		Command:   strings.Join(command, " "),
+		Env:       map[string]string{"TERM": os.Getenv("TERM")},
+	})
+	c.w.Write(append(hdr, '\n'))
+	casts[path] = c
+	return c, nil
+}
+
+// closeCasts flushes and closes every open recording, returning what failed
+func closeCasts() []error {
+	var errs []error
+	for path, c := range casts {
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("recording %s: %w", path, err))
+		}
+		delete(casts, path)
+	}
+	return errs
+}
+
+func (c *castRecorder) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := append(c.pending, p...)
+	// Hold back a trailing partial rune so it isn't mangled into U+FFFD
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	c.pending = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return len(p), nil
+	}
+
+	ev, err := json.Marshal([]any{time.Since(c.start).Seconds(), "o", string(data[:cut])})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.w.Write(append(ev, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), c.w.Flush()
+}
+
+// Mark records an asciinema marker event, used for wrapper lifecycle events
+// so the silence before a kill or exit is visible in the recording
+func (c *castRecorder) Mark(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ev, _ := json.Marshal([]any{time.Since(c.start).Seconds(), "m", label})
+	c.w.Write(append(ev, '\n'))
+	c.w.Flush()
+}
+
+func (c *castRecorder) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.w.Flush(); err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
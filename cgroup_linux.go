@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// newCgroup creates a cgroup v2 directory called name below the wrapper's
+// own cgroup, for --cgroup
+func newCgroup(name string) (string, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	own, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	var rel string
+	for _, line := range strings.Split(string(own), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			rel = p
+		}
+	}
+	dir := filepath.Join(mount, rel, name)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cgroup.kill")); err != nil {
+		os.Remove(dir)
+		return "", errors.New("cgroup.kill is not supported (needs Linux 5.14)")
+	}
+	return dir, nil
+}
+
+// checkCgroup reports whether --cgroup can work, by creating and removing
+// a cgroup
+func checkCgroup() error {
+	dir, err := newCgroup(fmt.Sprintf("idle-timeout.%d.probe", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	return removeCgroup(dir)
+}
+
+// cgroup2Mount finds where the unified hierarchy is mounted: usually
+// /sys/fs/cgroup, or /sys/fs/cgroup/unified on hybrid systems
+func cgroup2Mount() (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// id parent major:minor root mountpoint options ... - fstype source superoptions
+		fields := strings.Fields(sc.Text())
+		for i, f := range fields {
+			if f == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no cgroup v2 hierarchy is mounted")
+}
+
+// removeCgroup deletes a cgroup once its processes are gone; after
+// cgroup.kill they exit asynchronously
+func removeCgroup(dir string) error {
+	deadline := time.Now().Add(time.Second)
+	for {
+		err := os.Remove(dir)
+		if err == nil || !errors.Is(err, syscall.EBUSY) || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNoCgroups = errors.New("cgroups are only supported on Linux")
+
+// checkCgroup fails: cgroups exist only on Linux
+func checkCgroup() error {
+	return errNoCgroups
+}
+
+// newCgroup fails: cgroups exist only on Linux
+func newCgroup(name string) (string, error) {
+	return "", errNoCgroups
+}
+
+func removeCgroup(dir string) error {
+	return nil
+}
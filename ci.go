@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ciEscape escapes an annotation message as GitHub Actions workflow
+// commands expect
+var ciEscape = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+
+// annotation prints a --ci github workflow command into the output, which
+// the Actions UI shows as a warning or error on the step
+func (c *console) annotation(priority int, text string) {
+	level := "error"
+	if priority == prioWarning {
+		level = "warning"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.message(c.out, c.outTTY, fmt.Sprintf("::%s title=idle-timeout::%s", level, ciEscape.Replace(text)))
+}
+
+// stepSummary appends a section per attempt to the GitHub Actions step
+// summary for --ci github: how it ended and, when output paused, the idle
+// gaps against the timeout
+type stepSummary struct {
+	path    string // $GITHUB_STEP_SUMMARY
+	command string
+	session string
+}
+
+// newStepSummary returns nil outside GitHub Actions
+func newStepSummary(command []string, session string) *stepSummary {
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if path == "" {
+		return nil
+	}
+	return &stepSummary{path: path, command: strings.Join(command, " "), session: session}
+}
+
+func (s *stepSummary) add(a attempt, gaps gapSummary) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "### idle-timeout: `%s`", strings.ReplaceAll(s.command, "`", "'"))
+	if a.Seq > 1 {
+		fmt.Fprintf(&b, " (attempt %d)", a.Seq)
+	}
+	b.WriteString("\n\n")
+	took := time.Duration(a.Duration * float64(time.Second)).Round(time.Second)
+	switch {
+	case a.OverLimit != "":
+		fmt.Fprintf(&b, ":x: Killed over the %s limit after %v\n\n", a.OverLimit, took)
+	case a.TimedOut:
+		fmt.Fprintf(&b, ":x: Killed after %v without output, %v in\n\n", gaps.timeout, took)
+	case a.ExitCode != 0:
+		fmt.Fprintf(&b, ":x: Exited with status %d after %v\n\n", a.ExitCode, took)
+	default:
+		fmt.Fprintf(&b, ":white_check_mark: Exited with status 0 after %v\n\n", took)
+	}
+	fmt.Fprintf(&b, "Session: `%s`\n\n", s.session)
+	if a.Warnings > 0 {
+		fmt.Fprintf(&b, "Idle warnings: %d\n\n", a.Warnings)
+	}
+	if gaps.count == 0 {
+		b.WriteString("Output never paused\n\n")
+	} else {
+		b.WriteString("| Output gaps | p50 | p95 | max | near misses | longest gap |\n")
+		b.WriteString("| --: | --: | --: | --: | --: | --: |\n")
+		fmt.Fprintf(&b, "| %d | %v | %v | %v | %d | %.0f%% of the %v timeout |\n\n", gaps.count, roundGap(gaps.p50), roundGap(gaps.p95), roundGap(gaps.longest), gaps.near, gaps.used(), gaps.timeout)
+		fmt.Fprintf(&b, "Gaps by share of the timeout: %s\n\n", strings.Join(gaps.hist, ", "))
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		con.Logf("Failed to write the step summary: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(b.String()); err != nil {
+		con.Logf("Failed to write the step summary: %v", err)
+	}
+}
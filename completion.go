@@ -0,0 +1,264 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The completion scripts hand the words typed so far to
+// 'idle-timeout completion --complete', which answers with a directive line
+// followed by candidates:
+//
+//	words      complete the candidates on the following lines
+//	files      complete file names
+//	command N  complete the wrapped command, which starts at word N
+//
+// Keeping the logic here means the scripts never go stale as options are
+// added.
+
+const bashCompletion = `_idle_timeout() {
+	local cur=${COMP_WORDS[COMP_CWORD]} IFS=$'\n'
+	local out=($(idle-timeout completion --complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+	case ${out[0]} in
+	files)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		;;
+	command*)
+		local start=$((${out[0]#command } + 1))
+		if declare -F _command_offset >/dev/null; then
+			_command_offset $start
+		elif ((COMP_CWORD == start)); then
+			COMPREPLY=($(compgen -c -- "$cur"))
+		else
+			COMPREPLY=($(compgen -f -- "$cur"))
+		fi
+		;;
+	*)
+		COMPREPLY=($(compgen -W "${out[*]:1}" -- "$cur"))
+		;;
+	esac
+}
+complete -o default -F _idle_timeout idle-timeout
+`
+
+const zshCompletion = `#compdef idle-timeout
+
+_idle_timeout() {
+	local -a out
+	out=("${(@f)$(idle-timeout completion --complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	case $out[1] in
+	files)
+		_files
+		;;
+	command*)
+		local start=$(( ${out[1]#command } + 2 ))
+		words=("${(@)words[start,-1]}")
+		CURRENT=$(( CURRENT - start + 1 ))
+		_normal
+		;;
+	*)
+		compadd -- "${(@)out[2,-1]}"
+		;;
+	esac
+}
+
+if [[ $zsh_eval_context[-1] == loadautofunc ]]; then
+	_idle_timeout "$@"
+else
+	compdef _idle_timeout idle-timeout
+fi
+`
+
+const fishCompletion = `function __idle_timeout_complete
+	set -l tokens (commandline -opc) (commandline -ct)
+	set -l out (idle-timeout completion --complete -- $tokens[2..-1] 2>/dev/null)
+	switch "$out[1]"
+	case files
+		__fish_complete_path (commandline -ct)
+	case 'command *'
+		set -l start (math (string split ' ' -- $out[1])[2] + 2)
+		if test $start -lt (count $tokens)
+			complete -C (string join ' ' -- (string escape -- $tokens[$start..-2]) (commandline -ct))
+		else
+			complete -C (commandline -ct)
+		end
+	case '*'
+		printf '%s\n' $out[2..-1]
+	end
+end
+complete -c idle-timeout -f -a '(__idle_timeout_complete)'
+`
+
+// completionMain prints a completion script, or with --complete answers
+// one of its queries
+func completionMain(args []string) int {
+	fset := flag.NewFlagSet("completion", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout completion bash|zsh|fish\n")
+		fmt.Fprintf(os.Stderr, "Example: source <(idle-timeout completion bash)\n")
+		fmt.Fprintf(os.Stderr, "         idle-timeout completion fish > ~/.config/fish/completions/idle-timeout.fish\n")
+	}
+	if len(args) > 0 && args[0] == "--complete" {
+		if len(args) > 1 && args[1] == "--" {
+			args = args[1:]
+		}
+		complete(args[1:])
+		return 0
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 1
+	}
+	switch fset.Arg(0) {
+	case "bash":
+		os.Stdout.WriteString(bashCompletion)
+	case "zsh":
+		os.Stdout.WriteString(zshCompletion)
+	case "fish":
+		os.Stdout.WriteString(fishCompletion)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown shell %q: bash, zsh and fish are supported\n", fset.Arg(0))
+		return 1
+	}
+	return 0
+}
+
+// complete prints the completions for the last of words, the arguments
+// typed so far
+func complete(words []string) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur, words := words[len(words)-1], words[:len(words)-1]
+
+	start := 0
+	sub, explicit := subcommand{}, false
+	if len(words) > 0 {
+		sub, explicit = findSubcommand(words[0])
+	}
+	if explicit {
+		start = 1
+	} else {
+		sub, _ = findSubcommand("run")
+		if len(words) == 0 && !strings.HasPrefix(cur, "-") {
+			var names []string
+			for _, s := range subcommands {
+				if s.summary != "" {
+					names = append(names, s.name)
+				}
+			}
+			printCompletions(names)
+			return
+		}
+	}
+	if sub.name == "completion" {
+		printCompletions([]string{"bash", "zsh", "fish"})
+		return
+	}
+	if sub.flags == nil {
+		fmt.Println("files")
+		return
+	}
+	fset := sub.flags()
+
+	// Walk the words before cur the way run parses them, to tell whether
+	// cur is an option, an option's value, or part of the wrapped command
+	haveTimeout := sub.name == "auto"
+	var pending *flag.Flag // the option whose value cur is
+	for i := start; i < len(words); i++ {
+		w := words[i]
+		if pending != nil {
+			fset.Set(pending.Name, w)
+			pending = nil
+			continue
+		}
+		if w == "--" {
+			fmt.Printf("command %d\n", i+1)
+			return
+		}
+		if strings.HasPrefix(w, "-") && w != "-" {
+			name, value, hasValue := strings.Cut(strings.TrimLeft(w, "-"), "=")
+			f := fset.Lookup(name)
+			switch {
+			case f == nil:
+			case hasValue:
+				fset.Set(name, value)
+			case isBoolFlag(f):
+				fset.Set(name, "true")
+			default:
+				pending = f
+			}
+			continue
+		}
+		if !haveTimeout {
+			if _, err := parseDuration(w); err == nil {
+				haveTimeout = true
+				continue
+			}
+		}
+		fmt.Printf("command %d\n", i)
+		return
+	}
+
+	// The options typed so far are set in fset, so what they say about the
+	// config file and the timeout is at hand
+	set := map[string]bool{}
+	fset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	applyEnv(fset, set)
+	c, err := loadConfig(fset.Lookup("config").Value.String(), false)
+	if err == nil {
+		c.apply(fset, fset.Lookup("profile").Value.String(), set)
+	}
+	if fset.Lookup("timeout").Value.String() != "" || fset.Lookup("c").Value.String() != "" {
+		haveTimeout = true
+	}
+
+	switch {
+	case pending != nil:
+		completeValue(pending, c)
+	case strings.HasPrefix(cur, "-"):
+		var names []string
+		fset.VisitAll(func(f *flag.Flag) { names = append(names, "--"+f.Name) })
+		printCompletions(names)
+	case haveTimeout:
+		fmt.Printf("command %d\n", len(words))
+	default:
+		printCompletions(nil) // a duration comes next
+	}
+}
+
+// completeValue prints the completions for the value of an option; c is
+// the config file, if it could be read
+func completeValue(f *flag.Flag, c *fileConfig) {
+	if f.Name == "profile" {
+		if c != nil {
+			printCompletions(c.profiles())
+		} else {
+			printCompletions(nil)
+		}
+		return
+	}
+	switch kind, _ := flag.UnquoteUsage(f); kind {
+	case "path", "file":
+		fmt.Println("files")
+	default:
+		printCompletions(nil)
+	}
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+func printCompletions(words []string) {
+	sort.Strings(words)
+	fmt.Println("words")
+	for _, w := range words {
+		fmt.Println(w)
+	}
+}
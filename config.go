@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configPath is where the config file lives by default,
+// ~/.config/idle-timeout/config.toml on Linux
+func configPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "idle-timeout", "config.toml")
+}
+
+// fileConfig is the parsed config file. Root keys are defaults for every
+// run; [profiles.NAME] tables are selected with --profile. Keys are the
+// names of run's options, with values as they'd be given on the command
+// line. The [timeouts] table maps command names to the timeout the auto
+// subcommand uses for them.
+type fileConfig struct {
+	path   string
+	tables map[string]map[string]string
+}
+
+// loadConfig reads the config file at path. A missing file is an empty
+// config unless it was asked for explicitly.
+func loadConfig(path string, explicit bool) (*fileConfig, error) {
+	c := &fileConfig{path: path, tables: map[string]map[string]string{"": {}}}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.tables, err = parseTOML(string(data)); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name := range c.tables {
+		if p, ok := strings.CutPrefix(name, "profiles."); name != "" && name != "timeouts" && (!ok || strings.Contains(p, ".")) {
+			return nil, fmt.Errorf("%s: unknown table [%s]", path, name)
+		}
+	}
+	for command, v := range c.tables["timeouts"] {
+		if _, err := parseDuration(v); err != nil {
+			return nil, fmt.Errorf("%s: invalid timeout %q for %s: %v", path, v, command, err)
+		}
+	}
+	return c, nil
+}
+
+// profiles lists the names of the configured profiles
+func (c *fileConfig) profiles() []string {
+	var names []string
+	for name := range c.tables {
+		if p, ok := strings.CutPrefix(name, "profiles."); ok && !strings.Contains(p, ".") {
+			names = append(names, p)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandName is the name per-command settings are keyed by: the base name
+// of the program
+func commandName(command string) string {
+	return strings.TrimSuffix(filepath.Base(command), ".exe")
+}
+
+// commandTimeout returns the [timeouts] entry for a command
+func (c *fileConfig) commandTimeout(command string) (string, bool) {
+	t, ok := c.tables["timeouts"][commandName(command)]
+	return t, ok
+}
+
+// envName is the environment variable that sets an option: IDLE_TIMEOUT for
+// the timeout, IDLE_TIMEOUT_LOG_FILE for -log-file and so on
+func envName(option string) string {
+	if option == "timeout" {
+		return "IDLE_TIMEOUT"
+	}
+	return "IDLE_TIMEOUT_" + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// exportedEnv are the IDLE_TIMEOUT_ variables the wrapper sets for the
+// command and its hooks, which a wrapper they start sees but takes for no
+// option
+var exportedEnv = []string{"IDLE_TIMEOUT_ID", "IDLE_TIMEOUT_SESSION", "IDLE_TIMEOUT_SEQ", "IDLE_TIMEOUT_PID", "IDLE_TIMEOUT_FILE"}
+
+// applyEnv sets the options of fset whose environment variable is set and
+// not empty, leaving alone those in set, and adds them to set so the config
+// file doesn't override them. Any other IDLE_TIMEOUT_ variable, such as a
+// misspelt one, is an error.
+func applyEnv(fset *flag.FlagSet, set map[string]bool) error {
+	known := map[string]bool{}
+	for _, name := range exportedEnv {
+		known[name] = true
+	}
+	fset.VisitAll(func(f *flag.Flag) {
+		if f.Name != "c" {
+			known[envName(f.Name)] = true
+		}
+	})
+	for _, kv := range os.Environ() {
+		name, v, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "IDLE_TIMEOUT_") && v != "" && !known[name] {
+			return fmt.Errorf("%s doesn't set any option", name)
+		}
+	}
+	var err error
+	fset.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == "c" {
+			return
+		}
+		name := envName(f.Name)
+		v := os.Getenv(name)
+		if v == "" {
+			return
+		}
+		if serr := fset.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, name, serr)
+			return
+		}
+		set[f.Name] = true
+	})
+	return err
+}
+
+// apply sets the options of fset from the defaults and then the named
+// profile, leaving alone those in set, which came from the command line or
+// the environment, and adds them to set
+func (c *fileConfig) apply(fset *flag.FlagSet, profile string, set map[string]bool) error {
+	settings := map[string]string{}
+	layers := []string{""}
+	if profile != "" {
+		if _, ok := c.tables["profiles."+profile]; !ok {
+			return fmt.Errorf("no profile %q in %s (have: %s)", profile, c.path, strings.Join(c.profiles(), ", "))
+		}
+		layers = append(layers, "profiles."+profile)
+	}
+	for _, layer := range layers {
+		for k, v := range c.tables[layer] {
+			name := strings.ReplaceAll(k, "_", "-")
+			switch name {
+			case "profile", "config":
+				return fmt.Errorf("%s: %q can't be set in the config file", c.path, k)
+			}
+			if fset.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown option %q", c.path, k)
+			}
+			settings[name] = v
+		}
+	}
+	for name, v := range settings {
+		if set[name] {
+			continue
+		}
+		if err := fset.Set(name, v); err != nil {
+			return fmt.Errorf("%s: invalid value %q for %s: %v", c.path, v, name, err)
+		}
+		set[name] = true
+	}
+	return nil
+}
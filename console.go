@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Escape-sequence parser states, tracked so wrapper messages never land in
+// the middle of a sequence the child was writing
+const (
+	escGround = iota
+	escEscape // after ESC
+	escCSI    // ESC [ ... up to the final byte
+	escString // OSC/DCS/APC/PM/SOS, terminated by BEL or ESC \
+	escStringEscape
+)
+
+// defaultSize stands in for the terminal size when there is no terminal or
+// it reports zero: $COLUMNS and $LINES if set, as CI runners often do,
+// otherwise 80x24
+func defaultSize() (cols, rows int) {
+	cols, rows = 80, 24
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		cols = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("LINES")); err == nil && n > 0 {
+		rows = n
+	}
+	return cols, rows
+}
+
+// console serializes the child's output and the wrapper's own messages so
+// that messages always start on a clean line without disturbing the
+// child's screen, which is reset once the child is done with it
+type console struct {
+	mu        sync.Mutex
+	out       io.Writer // child output destination
+	msg       io.Writer // wrapper messages
+	msgTTY    bool      // msg is a terminal, so reset sequences are safe to emit
+	outTTY    bool      // and out is one
+	plain     bool      // --plain: messages carry no control sequences at all
+	colorMsg  bool      // --color lets messages to msg be colored, unless plain
+	colorOut  bool      // and those to out
+	format    string    // --message-format of tagged messages, "" for the default
+	lineStart bool      // nothing written yet, or the last byte was a newline
+	esc       int
+	csi       []byte // parameters of the CSI sequence being parsed
+	sgr       []byte // the child's SGR sequences since its last reset, to put its colors back
+	altScreen bool
+	footer    int           // terminal rows while a status line holds the last one, else 0
+	regionSet bool          // the child set a scroll region, which the footer must reclaim
+	titled    bool          // --title saved the previous title, to restore at exit
+	target    logTarget     // receives lifecycle events instead of msg, see Eventf
+	buf       *bufio.Writer // coalesces output into fewer writes, see bufferOutput; nil writes it through
+	lines     bool          // buf is written out at the end of every line
+	flushStop chan struct{} // closed to stop the periodic flush of buf
+	annotate  bool          // --ci github: warnings and errors become workflow annotations
+	binary    bool          // --binary: out carries the command's bytes and nothing else
+	quiet     bool          // --quiet: only warnings and errors go to msg
+}
+
+var con = newConsole(os.Stdout, os.Stderr)
+
+func newConsole(out, msg *os.File) *console {
+	c := &console{
+		out:       out,
+		msg:       msg,
+		msgTTY:    isTerminal(msg.Fd()),
+		outTTY:    isTerminal(out.Fd()),
+		lineStart: true,
+	}
+	c.setColor("auto")
+	return c
+}
+
+// setColor applies --color: "auto" colors messages going to a terminal
+// unless NO_COLOR is set, "always" and "never" regardless. --plain turns
+// colors off whatever this says.
+func (c *console) setColor(mode string) error {
+	switch mode {
+	case "auto":
+		noColor := os.Getenv("NO_COLOR") != ""
+		c.colorMsg, c.colorOut = c.msgTTY && !noColor, c.outTTY && !noColor
+	case "always":
+		c.colorMsg, c.colorOut = true, true
+	case "never":
+		c.colorMsg, c.colorOut = false, false
+	default:
+		return fmt.Errorf("%q: expected auto, always or never", mode)
+	}
+	return nil
+}
+
+// setFormat applies --message-format, a template of the tagged messages in
+// which {tag}, {level}, {time} and {message} are expanded, and {id} and
+// {session} once the invocation is known
+func (c *console) setFormat(format string) error {
+	if !strings.Contains(format, "{message}") {
+		return fmt.Errorf("no {message} in %q", format)
+	}
+	c.format = format
+	return nil
+}
+
+// priorityColors are the SGR colors of messages by priority: errors red,
+// warnings yellow, lifecycle information dim
+var priorityColors = map[int]string{prioErr: "31", prioWarning: "33", prioInfo: "2"}
+
+var priorityLevels = map[int]string{prioErr: "error", prioWarning: "warning", prioNotice: "notice", prioInfo: "info"}
+
+// tagged formats a wrapper message of the given priority
+func (c *console) tagged(priority int, text string) string {
+	if c.format == "" {
+		return tag + " " + text
+	}
+	r := strings.NewReplacer("{tag}", tag, "{level}", priorityLevels[priority], "{time}", time.Now().Format(time.TimeOnly), "{message}", text)
+	return r.Replace(c.format)
+}
+
+// colored wraps line in the color of priority, if color is on
+func (c *console) colored(color bool, priority int, line string) string {
+	if sgr := priorityColors[priority]; color && !c.plain && sgr != "" {
+		return "\x1b[" + sgr + "m" + line + "\x1b[0m"
+	}
+	return line
+}
+
+// Write forwards child output, tracking line and escape-sequence state
+func (c *console) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.binary {
+		c.track(p) // binary output has no lines or sequences to mind
+	}
+	if c.buf == nil {
+		return c.out.Write(p)
+	}
+	if i := bytes.LastIndexByte(p, '\n'); c.lines && i >= 0 {
+		c.buf.Write(p[:i+1])
+		if err := c.buf.Flush(); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+		n, err := c.buf.Write(p)
+		return i + 1 + n, err
+	}
+	return c.buf.Write(p)
+}
+
+// partialFlush is how long --line-buffer holds a partial line, such as a
+// prompt, without --flush-interval
+const partialFlush = time.Second
+
+// bufferOutput makes Write coalesce the command's output into fewer,
+// larger writes, for output to a file or pipe: it is written out at least
+// every interval, and with lines at the end of every line too, until
+// unbufferOutput
+func (c *console) bufferOutput(lines bool, interval time.Duration) {
+	c.unbufferOutput()
+	stop := make(chan struct{})
+	c.mu.Lock()
+	c.buf = bufio.NewWriterSize(c.out, 64<<10)
+	c.lines = lines
+	c.flushStop = stop
+	c.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.Flush()
+			}
+		}
+	}()
+}
+
+// unbufferOutput writes out the output bufferOutput held back and stops
+// its flushes; Write writes through again
+func (c *console) unbufferOutput() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+	if c.flushStop != nil {
+		close(c.flushStop)
+	}
+	c.buf, c.flushStop = nil, nil
+}
+
+// Flush writes out output held back by bufferOutput
+func (c *console) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+}
+
+func (c *console) flush() {
+	if c.buf != nil {
+		c.buf.Flush()
+	}
+}
+
+func (c *console) track(p []byte) {
+	for len(p) > 0 {
+		if c.esc == escGround {
+			// Text up to the next escape is skipped in one go: only its
+			// last byte matters
+			i := bytes.IndexByte(p, 0x1b)
+			if i < 0 {
+				c.lineStart = p[len(p)-1] == '\n'
+				return
+			}
+			if i > 0 {
+				c.lineStart = p[i-1] == '\n'
+			}
+			c.esc = escEscape
+			p = p[i+1:]
+			continue
+		}
+		b := p[0]
+		p = p[1:]
+		switch c.esc {
+		case escEscape:
+			switch b {
+			case '[':
+				c.esc = escCSI
+				c.csi = c.csi[:0]
+			case ']', 'P', 'X', '^', '_':
+				c.esc = escString
+			default:
+				c.esc = escGround
+			}
+		case escCSI:
+			if b >= 0x40 && b <= 0x7e {
+				c.finishCSI(b)
+				c.esc = escGround
+			} else if len(c.csi) < 32 {
+				c.csi = append(c.csi, b)
+			}
+		case escString:
+			if b == 0x07 {
+				c.esc = escGround
+			} else if b == 0x1b {
+				c.esc = escStringEscape
+			}
+		case escStringEscape:
+			if b == '\\' {
+				c.esc = escGround
+			} else {
+				c.esc = escString
+			}
+		}
+	}
+}
+
+// finishCSI records alternate-screen switches, scroll regions and colors
+func (c *console) finishCSI(final byte) {
+	if final == 'r' && (len(c.csi) == 0 || c.csi[0] != '?') {
+		c.regionSet = true
+	}
+	if final == 'm' {
+		if params := string(c.csi); params == "" || params == "0" {
+			c.sgr = c.sgr[:0]
+		} else if len(c.sgr) < 256 {
+			c.sgr = append(append(append(c.sgr, "\x1b["...), c.csi...), 'm')
+		}
+	}
+	switch string(c.csi) {
+	case "?1049", "?1047", "?47":
+		if final == 'h' {
+			c.altScreen = true
+		} else if final == 'l' {
+			c.altScreen = false
+		}
+	}
+}
+
+// Logf prints a wrapper message on a clean line. On a terminal it first
+// cancels any half-written escape sequence, and leaves the child's colors,
+// cursor and alternate screen as they were, see message. In plain mode it
+// only starts a new line.
+func (c *console) Logf(format string, args ...any) {
+	c.logf(prioNotice, format, args...)
+}
+
+// logf is Logf for a message of the given priority, which sets its color
+func (c *console) logf(priority int, format string, args ...any) {
+	if c.quiet && priority > prioWarning {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.message(c.msg, c.msgTTY, c.colored(c.colorMsg, priority, c.tagged(priority, fmt.Sprintf(format, args...))))
+}
+
+// Outf prints a wrapper message like Logf, but into the output stream, for
+// readers of the command's output such as a CI log collector; with binary
+// output it is an ordinary message
+func (c *console) Outf(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.binary {
+		c.message(c.msg, c.msgTTY, c.colored(c.colorMsg, prioNotice, c.tagged(prioNotice, fmt.Sprintf(format, args...))))
+		return
+	}
+	c.message(c.out, c.outTTY, c.colored(c.colorOut, prioNotice, c.tagged(prioNotice, fmt.Sprintf(format, args...))))
+}
+
+// fullScreen reports whether the child holds the alternate screen of the
+// terminal its output goes to
+func (c *console) fullScreen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outTTY && c.altScreen
+}
+
+// message writes line to w on a clean line; tty says whether w is a
+// terminal. The child keeps running, so its screen is left as it was: the
+// line is written in the default colors and the child's are put back after
+// it, and on the alternate screen, which the child redraws, it goes over
+// the cursor's row and the cursor goes back where the child left it.
+func (c *console) message(w io.Writer, tty bool, line string) {
+	c.flush()
+	styled := tty && !c.plain
+	var b []byte
+	if styled && c.esc != escGround {
+		b = append(b, 0x18) // CAN aborts the pending sequence
+		c.esc = escGround
+	}
+	if styled && c.altScreen {
+		// DECSC saves the cursor and colors, DECRC puts them back
+		b = append(b, "\x1b7\x1b[0m\r\x1b[K"...)
+		b = append(b, line...)
+		w.Write(append(b, "\x1b8"...))
+		return
+	}
+	if !c.lineStart {
+		if c.plain {
+			b = append(b, '\n')
+		} else {
+			b = append(b, "\r\n"...)
+		}
+		c.lineStart = true
+	}
+	if styled && len(c.sgr) > 0 {
+		b = append(b, "\x1b[0m"...)
+	}
+	b = append(append(b, line...), '\n')
+	if styled {
+		b = append(b, c.sgr...)
+	}
+	w.Write(b)
+}
+
+// resetScreen puts the terminal back in order once the child is being
+// killed or has exited, before its final notices, as the child can no
+// longer do it: it cancels a half-written escape sequence, leaves the
+// alternate screen, resets colors and shows the cursor
+func (c *console) resetScreen() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+	w, tty := c.msg, c.msgTTY
+	if !tty && !c.binary {
+		w, tty = c.out, c.outTTY
+	}
+	if !tty || c.plain {
+		return
+	}
+	var b []byte
+	if c.esc != escGround {
+		b = append(b, 0x18)
+		c.esc = escGround
+	}
+	if c.altScreen {
+		b = append(b, "\x1b[?1049l"...)
+		c.altScreen = false
+	}
+	w.Write(append(b, "\x1b[0m\x1b[?25h"...))
+	c.sgr = c.sgr[:0]
+}
+
+// Eventf reports a lifecycle event: to the --log-target with its structured
+// fields if one is set, otherwise as a message like Logf. With --ci github
+// warnings and errors are workflow annotations instead of messages.
+func (c *console) Eventf(priority int, fields []string, format string, args ...any) {
+	text := fmt.Sprintf(format, args...)
+	if c.annotate && priority <= prioWarning {
+		c.annotation(priority, text)
+		if c.target == nil {
+			return
+		}
+	}
+	if c.target == nil {
+		c.logf(priority, "%s", text)
+		return
+	}
+	if err := c.target.send(priority, text, fields); err != nil {
+		c.Logf("Logging to the log target failed: %v", err)
+	}
+}
+
+// stderr returns a writer for the child's stderr, for --foreground where
+// it isn't merged into a PTY
+func (c *console) stderr() io.Writer {
+	return stderrWriter{c}
+}
+
+type stderrWriter struct{ c *console }
+
+func (w stderrWriter) Write(p []byte) (int, error) {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	w.c.track(p)
+	return w.c.msg.Write(p)
+}
+
+// Printf writes wrapper output (such as the spawn line) to the output
+// stream, dim if colors are on, or with binary output to the messages
+func (c *console) Printf(format string, args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := fmt.Sprintf(format, args...)
+	if c.binary {
+		c.message(c.msg, c.msgTTY, c.colored(c.colorMsg, prioInfo, strings.TrimSuffix(s, "\n")))
+		return
+	}
+	start := c.lineStart
+	c.track([]byte(s))
+	c.flush()
+	if line, ok := strings.CutSuffix(s, "\n"); ok && start {
+		s = c.colored(c.colorOut, prioInfo, line) + "\n"
+	}
+	io.WriteString(c.out, s)
+}
+
+// openFooter reserves the last of the terminal's rows for a status line,
+// scrolling output in the region above it. The cursor stays where it was,
+// one line up if the screen had to scroll to make room.
+func (c *console) openFooter(rows int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.footer = rows
+	fmt.Fprintf(c.out, "\n\x1b7\x1b[1;%dr\x1b8\x1b[1A", rows-1)
+}
+
+// resizeFooter moves the status line to the last row after a resize
+func (c *console) resizeFooter(rows int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.footer != 0 {
+		c.footer = rows
+		c.regionSet = true
+	}
+}
+
+// paintFooter draws the status line, unless the child is in the middle of
+// an escape sequence or owns the screen. A scroll region the child set is
+// replaced by the footer's again.
+func (c *console) paintFooter(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.footer == 0 || c.esc != escGround || c.altScreen {
+		return
+	}
+	if c.regionSet {
+		fmt.Fprintf(c.out, "\x1b7\x1b[1;%dr\x1b8", c.footer-1)
+		c.regionSet = false
+	}
+	fmt.Fprintf(c.out, "\x1b7\x1b[%d;1H\x1b[2K\x1b[7m%s\x1b[0m\x1b8", c.footer, text)
+}
+
+// closeFooter gives the last row back to output
+func (c *console) closeFooter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.footer == 0 {
+		return
+	}
+	fmt.Fprintf(c.out, "\x1b7\x1b[r\x1b[%d;1H\x1b[2K\x1b8", c.footer)
+	c.footer = 0
+}
+
+// setTitle sets the terminal's window title unless the child is in the
+// middle of an escape sequence, reporting whether it did. The first title
+// saves the one before on the terminal's title stack.
+func (c *console) setTitle(title string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.esc != escGround {
+		return false
+	}
+	if !c.titled {
+		io.WriteString(c.out, "\x1b[22;0t")
+		c.titled = true
+	}
+	fmt.Fprintf(c.out, "\x1b]0;%s\x07", title)
+	return true
+}
+
+// restoreTitle brings back the title from before setTitle
+func (c *console) restoreTitle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.titled {
+		io.WriteString(c.out, "\x1b[23;0t")
+		c.titled = false
+	}
+}
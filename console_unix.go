@@ -0,0 +1,62 @@
+//go:build unix
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// termState is a terminal's settings, saved to be restored later
+type termState = syscall.Termios
+
+// isTerminal reports whether fd refers to a terminal
+func isTerminal(fd uintptr) bool {
+	_, err := getTermState(fd)
+	return err == nil
+}
+
+// getTermState returns the terminal settings of fd
+func getTermState(fd uintptr) (*termState, error) {
+	var t termState
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlGetTermios, uintptr(unsafe.Pointer(&t)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return &t, nil
+}
+
+// setTermState applies terminal settings to fd
+func setTermState(fd uintptr, t *termState) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlSetTermios, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeRawInput switches the terminal on fd to raw input so every keystroke,
+// including ^C and ^Z, reaches the child's terminal unprocessed. Output
+// processing stays on so wrapper messages keep their carriage returns.
+func makeRawInput(fd uintptr, t *termState) error {
+	raw := *t
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	return setTermState(fd, &raw)
+}
+
+// terminalSize returns the size of the terminal on fd, or defaultSize if
+// it's unknown or zero
+func terminalSize(fd uintptr) (cols, rows int) {
+	var ws struct{ Row, Col, Xpixel, Ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.Col == 0 || ws.Row == 0 {
+		return defaultSize()
+	}
+	return int(ws.Col), int(ws.Row)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+)
+
+// Console mode flags
+const (
+	enableProcessedInput      = 0x0001
+	enableLineInput           = 0x0002
+	enableEchoInput           = 0x0004
+	enableVirtualTerminalIn   = 0x0200
+	enableVirtualTerminalProc = 0x0004 // output handles
+)
+
+// termState is a console handle's mode, saved to be restored later
+type termState struct {
+	mode uint32
+}
+
+// The child's output comes from a pseudo console as VT sequences, which the
+// console has to interpret rather than print
+func init() {
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		if t, err := getTermState(f.Fd()); err == nil {
+			setTermState(f.Fd(), &termState{t.mode | enableVirtualTerminalProc})
+		}
+	}
+}
+
+// isTerminal reports whether fd is a console handle
+func isTerminal(fd uintptr) bool {
+	_, err := getTermState(fd)
+	return err == nil
+}
+
+// getTermState returns the console mode of fd
+func getTermState(fd uintptr) (*termState, error) {
+	var t termState
+	if err := syscall.GetConsoleMode(syscall.Handle(fd), &t.mode); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// setTermState applies a console mode to fd
+func setTermState(fd uintptr, t *termState) error {
+	if ok, _, err := procSetConsoleMode.Call(fd, uintptr(t.mode)); ok == 0 {
+		return err
+	}
+	return nil
+}
+
+// makeRawInput makes the console deliver every keystroke, including ^C, as
+// VT input for the child's pseudo console
+func makeRawInput(fd uintptr, t *termState) error {
+	raw := termState{t.mode&^(enableProcessedInput|enableLineInput|enableEchoInput) | enableVirtualTerminalIn}
+	return setTermState(fd, &raw)
+}
+
+// terminalSize returns the visible size of the console window, or
+// defaultSize if unknown. Only output handles carry a size, so stdout stands in for stdin.
+func terminalSize(fd uintptr) (cols, rows int) {
+	var info struct {
+		Size, CursorPosition     struct{ X, Y int16 }
+		Attributes               uint16
+		Left, Top, Right, Bottom int16
+		MaximumWindowSize        struct{ X, Y int16 }
+	}
+	for _, h := range []uintptr{fd, os.Stdout.Fd()} {
+		if ok, _, _ := procGetConsoleScreenBufferInfo.Call(h, uintptr(unsafe.Pointer(&info))); ok != 0 {
+			return int(info.Right-info.Left) + 1, int(info.Bottom-info.Top) + 1
+		}
+	}
+	return defaultSize()
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// control lets an operator adjust the idle budget of the attempt in flight
+// without restarting it, through --control-socket, --control-listen, the
+// signals in controlSignals and --pause-on. Adjustments last for that
+// attempt.
+type control struct {
+	step    time.Duration // what a signal adjusts by: the command-line timeout
+	pauseOn os.Signal     // pauses and resumes the idle clock, nil for none
+	ln      net.Listener  // nil without --control-socket
+	path    string
+	tlsLn   net.Listener // nil without --control-listen
+	grpc    *http.Server // the gRPC service of tlsLn
+
+	mu     sync.Mutex
+	runner *watchdog.Runner // attempt in flight, nil between attempts
+	paused time.Time        // when its idle clock was paused, zero while it runs
+}
+
+// errNotRunning is what the commands get between attempts
+var errNotRunning = errors.New("no command running")
+
+// controlCommands lists the commands, for the usage and error messages
+const controlCommands = "extend, set-timeout, pause, resume, kill, status or watch"
+
+// controlIdle is how long a control connection may keep quiet, from its
+// TLS handshake on, before it is hung up on. A watch, which only receives,
+// has as long for each status line to be taken in.
+const controlIdle = time.Minute
+
+func newControl(step time.Duration) *control {
+	return &control{step: step}
+}
+
+// listen serves control commands on a unix socket at path. A socket left
+// behind by a wrapper that died is taken over; a live one is kept.
+func (c *control) listen(path string) error {
+	if conn, err := net.DialTimeout("unix", path, coordTimeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	c.ln, c.path = ln, path
+	go c.accept(ln)
+	return nil
+}
+
+// listenTLS serves the same commands over TCP at addr, for managing
+// wrappers from another host: as the gRPC service of control.proto to
+// clients that negotiate HTTP/2, and as the line protocol to the rest. Only
+// clients with a certificate signed by a CA in the clientCA file are let in.
+func (c *control) listenTLS(addr, certFile, keyFile, clientCA string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	pool, err := loadCertPool(clientCA)
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2"},
+	})
+	if err != nil {
+		return err
+	}
+	grpc := newConnListener(ln.Addr())
+	c.tlsLn = ln
+	c.grpc = &http.Server{
+		Handler:     c,
+		IdleTimeout: controlIdle,
+		ErrorLog:    log.New(io.Discard, "", 0), // not over the command's output
+	}
+	go c.grpc.Serve(grpc)
+	go c.acceptTLS(ln, grpc)
+	return nil
+}
+
+// loadCertPool reads the PEM certificates of a CA bundle
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+func (c *control) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.serve(conn)
+	}
+}
+
+// acceptTLS hands the connections that negotiate HTTP/2 in their TLS
+// handshake to the gRPC service, and serves the line protocol on the rest
+func (c *control) acceptTLS(ln net.Listener, grpc *connListener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			tc := conn.(*tls.Conn)
+			tc.SetDeadline(time.Now().Add(controlIdle))
+			if err := tc.Handshake(); err != nil {
+				tc.Close()
+				return
+			}
+			tc.SetDeadline(time.Time{})
+			if tc.ConnectionState().NegotiatedProtocol == "h2" {
+				grpc.hand(tc)
+				return
+			}
+			c.serve(tc)
+		}()
+	}
+}
+
+// close removes the socket and stops listening, reporting a socket file
+// left behind; closing again does nothing
+func (c *control) close() error {
+	var err error
+	if c.ln != nil {
+		c.ln.Close()
+		if rerr := os.Remove(c.path); rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+			err = rerr
+		}
+		c.ln = nil
+	}
+	if c.tlsLn != nil {
+		c.tlsLn.Close()
+		c.grpc.Close()
+		c.tlsLn, c.grpc = nil, nil
+	}
+	return err
+}
+
+func (c *control) attach(r *watchdog.Runner) {
+	c.mu.Lock()
+	c.runner = r
+	c.paused = time.Time{}
+	c.mu.Unlock()
+}
+
+func (c *control) current() *watchdog.Runner {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.runner
+}
+
+// serve answers one line per command, starting with "ok" or "error".
+// "watch" instead answers with a status line every second until the
+// client hangs up. A client quiet for controlIdle is hung up on.
+func (c *control) serve(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(controlIdle))
+		if !sc.Scan() {
+			return
+		}
+		if strings.TrimSpace(sc.Text()) == "watch" {
+			c.watch(conn)
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(controlIdle))
+		if _, err := fmt.Fprintf(conn, "%s\n", c.handle(sc.Text())); err != nil {
+			return
+		}
+	}
+}
+
+// watch streams the status of whichever attempt is in flight
+func (c *control) watch(conn net.Conn) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		conn.SetWriteDeadline(time.Now().Add(controlIdle))
+		if _, err := fmt.Fprintf(conn, "%s\n", c.handle("status")); err != nil {
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// handle carries out one command line, answering "ok: ..." or "error: ..."
+func (c *control) handle(line string) string {
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	msg, err := c.do(cmd, strings.TrimSpace(arg))
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return "ok: " + msg
+}
+
+// do carries out one command: "extend <duration>" lets the current silence
+// last that much longer, "set-timeout <duration>" changes the idle timeout,
+// "pause" and "resume" stop and restart the idle clock, "kill" times the
+// command out now, and "status" shows how the idle clock stands
+func (c *control) do(cmd, arg string) (string, error) {
+	r := c.current()
+	if r == nil {
+		return "", errNotRunning
+	}
+	switch cmd {
+	case "status":
+		return c.status(r).String(), nil
+	case "pause", "resume":
+		return c.setPaused(cmd == "pause", "through the control API")
+	case "kill":
+		con.Logf("Timeout forced through the control API")
+		r.Expire()
+		return "killing", nil
+	case "extend", "set-timeout":
+		d, err := parseDuration(arg)
+		if err != nil || d < watchdog.Resolution {
+			return "", badDuration(arg)
+		}
+		if cmd == "extend" {
+			return extendIdle(r, d), nil
+		}
+		return setIdleTimeout(r, d), nil
+	default:
+		return "", fmt.Errorf("unknown command %q: expected %s", cmd, controlCommands)
+	}
+}
+
+// badDuration is the argument of an extend or set-timeout that isn't a
+// duration the idle clock can tell
+type badDuration string
+
+func (d badDuration) Error() string {
+	return fmt.Sprintf("invalid duration %q", string(d))
+}
+
+// controlStatus is how the idle clock of an attempt stands
+type controlStatus struct {
+	pid       int
+	idle      time.Duration
+	limit     time.Duration // of the current silence
+	paused    bool
+	pausedFor time.Duration
+}
+
+func (c *control) status(r *watchdog.Runner) controlStatus {
+	s := controlStatus{pid: r.PID(), idle: time.Since(r.LastActivity()), limit: r.IdleLimit()}
+	if paused := c.pausedAt(); !paused.IsZero() {
+		s.idle = max(paused.Sub(r.LastActivity()), 0)
+		s.paused, s.pausedFor = true, time.Since(paused)
+	}
+	return s
+}
+
+// String is the status line of the control socket
+func (s controlStatus) String() string {
+	if s.paused {
+		return fmt.Sprintf("idle %v / %v, paused for %v", s.idle.Truncate(time.Second), s.limit, s.pausedFor.Truncate(time.Second))
+	}
+	return fmt.Sprintf("idle %v / %v", s.idle.Truncate(time.Second), s.limit)
+}
+
+// pausedAt is when the idle clock of the attempt in flight was paused, or
+// zero
+func (c *control) pausedAt() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
+// setPaused pauses or resumes the idle clock of the attempt in flight, for
+// silences that are expected, such as while a debugger holds the command;
+// via says what asked for it in the log
+func (c *control) setPaused(pause bool, via string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.runner == nil {
+		return "", errNotRunning
+	}
+	if pause {
+		if !c.paused.IsZero() {
+			return "idle clock already paused", nil
+		}
+		c.runner.Pause()
+		c.paused = time.Now()
+		con.Logf("Idle clock paused %s", via)
+		return "idle clock paused", nil
+	}
+	if c.paused.IsZero() {
+		return "idle clock not paused", nil
+	}
+	c.runner.Resume()
+	held := time.Since(c.paused).Round(time.Second)
+	c.paused = time.Time{}
+	con.Logf("Idle clock resumed %s after %v", via, held)
+	return fmt.Sprintf("idle clock resumed after %v", held), nil
+}
+
+// watchSignals carries out control signals for the rest of the wrapper's
+// life: with adjust, the first of controlSignals extends the current
+// silence by a step and the second raises the idle timeout by one, and
+// pauseOn pauses the idle clock, or resumes it if paused
+func (c *control) watchSignals(adjust bool) {
+	var watched []os.Signal
+	if adjust {
+		watched = append(watched, controlSignals...)
+	}
+	if c.pauseOn != nil {
+		watched = append(watched, c.pauseOn)
+	}
+	if len(watched) == 0 {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, watched...)
+	go func() {
+		for sig := range sigs {
+			r := c.current()
+			switch {
+			case r == nil:
+			case sig == c.pauseOn:
+				c.setPaused(c.pausedAt().IsZero(), "on "+signalName(sig))
+			case sig == controlSignals[0]:
+				extendIdle(r, c.step)
+			default:
+				setIdleTimeout(r, r.Timeout()+c.step)
+			}
+		}
+	}()
+}
+
+// extendIdle lets the current silence of r last d longer, and logs it
+func extendIdle(r *watchdog.Runner, d time.Duration) string {
+	limit := r.IdleLimit() + d
+	r.Extend(limit)
+	msg := fmt.Sprintf("this silence may last %v", limit)
+	con.Logf("Idle budget extended by %v: %s", d, msg)
+	return msg
+}
+
+// setIdleTimeout changes the idle timeout of r, and logs it
+func setIdleTimeout(r *watchdog.Runner, d time.Duration) string {
+	r.SetTimeout(d)
+	msg := fmt.Sprintf("idle timeout now %v", d)
+	con.Logf("Idle timeout changed: %s", msg)
+	return msg
+}
+
+// controlMain sends one command to the --control-socket or --control-listen
+// address of a running wrapper and prints the answer, or the stream of
+// answers for watch
+func controlMain(args []string) int {
+	fset := flag.NewFlagSet("control", flag.ExitOnError)
+	certFile := fset.String("tls-cert", "", "call the gRPC service of a -control-listen `address` instead, with this client certificate")
+	keyFile := fset.String("tls-key", "", "the private key `file` of -tls-cert")
+	caFile := fset.String("tls-ca", "", "verify the wrapper's certificate against the CAs in `file` (default: the system's)")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout control [options] <socket|address> extend|set-timeout <duration>\n")
+		fmt.Fprintf(os.Stderr, "       idle-timeout control [options] <socket|address> pause|resume|status|watch|kill\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout control /tmp/job.sock extend 30m\n")
+		fmt.Fprintf(os.Stderr, "         idle-timeout control --tls-cert me.pem --tls-key me.key --tls-ca ca.pem worker3:7070 watch\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 2 {
+		fset.Usage()
+		return 1
+	}
+	target, command := fset.Arg(0), strings.Join(fset.Args()[1:], " ")
+	if *certFile != "" || *keyFile != "" {
+		return controlGRPC(target, command, *certFile, *keyFile, *caFile)
+	}
+	conn, err := net.DialTimeout("unix", target, coordTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(coordTimeout))
+	if _, err := fmt.Fprintf(conn, "%s\n", command); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to send command: %v\n", err)
+		return 1
+	}
+	br := bufio.NewReader(conn)
+	if strings.TrimSpace(command) == "watch" {
+		// Until the wrapper exits or the watcher is interrupted
+		conn.SetDeadline(time.Time{})
+		for {
+			line, err := br.ReadString('\n')
+			fmt.Print(line)
+			if err != nil {
+				return 0
+			}
+		}
+	}
+	reply, err := br.ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read reply: %v\n", err)
+		return 1
+	}
+	fmt.Print(reply)
+	if strings.HasPrefix(reply, "error") {
+		return 1
+	}
+	return 0
+}
+
+// controlTLS is the TLS config of a client of --control-listen
+func controlTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tls-cert and -tls-key go together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		if cfg.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
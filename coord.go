@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coordTimeout bounds every exchange with the coordinator, so a wedged
+// coordinator delays a wrapper by at most this much
+const coordTimeout = time.Second
+
+// coordRequest is one line a wrapper sends to the coordinator
+type coordRequest struct {
+	Op      string  `json:"op"` // "retry", "timeout" or "policy"
+	ID      string  `json:"id"`
+	Backoff float64 `json:"backoff_seconds,omitempty"`
+	Command string  `json:"command,omitempty"` // for policy: the command's name
+	User    string  `json:"user,omitempty"`    // for policy
+}
+
+// coordReply is the coordinator's answer to a coordRequest
+type coordReply struct {
+	Delay    float64   `json:"delay_seconds,omitempty"` // for retry: how long to wait
+	Open     bool      `json:"open"`                    // the circuit breaker is open
+	Until    time.Time `json:"until,omitempty"`         // when it closes again
+	Timeouts int       `json:"timeouts"`                // timeouts within the window
+
+	Options map[string]string `json:"options,omitempty"` // for policy: option defaults
+}
+
+// defaultCoordSocket is the host-local socket the coordinator listens on
+func defaultCoordSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "idle-timeout.sock")
+	}
+	return filepath.Join(os.TempDir(), "idle-timeout-"+strconv.Itoa(os.Getuid())+".sock")
+}
+
+// coordinator staggers the retries of the wrappers on a host and runs a
+// shared circuit breaker: when many of them time out within a window, as
+// in an outage of a shared dependency, kills turn into warnings for a
+// cooldown instead of piling restarts onto the struggling service
+type coordinator struct {
+	stagger  time.Duration
+	trip     int
+	window   time.Duration
+	cooldown time.Duration
+	policy   string // TOML file with the site policy, read on every request
+
+	mu       sync.Mutex
+	nextSlot time.Time   // earliest time the next retry may start
+	timeouts []time.Time // within the window
+	openTill time.Time
+}
+
+func (c *coordinator) handle(req coordRequest) coordReply {
+	if req.Op == "policy" {
+		return coordReply{Options: c.policyFor(req.Command, req.User)}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var reply coordReply
+	switch req.Op {
+	case "retry":
+		start := now.Add(time.Duration(req.Backoff * float64(time.Second)))
+		if start.Before(c.nextSlot) {
+			start = c.nextSlot
+		}
+		c.nextSlot = start.Add(c.stagger)
+		reply.Delay = start.Sub(now).Seconds()
+	case "timeout":
+		if now.After(c.openTill) {
+			c.timeouts = append(c.timeouts, now)
+		}
+	}
+	for len(c.timeouts) > 0 && now.Sub(c.timeouts[0]) > c.window {
+		c.timeouts = c.timeouts[1:]
+	}
+	if c.trip > 0 && len(c.timeouts) >= c.trip && now.After(c.openTill) {
+		c.openTill = now.Add(c.cooldown)
+		c.timeouts = nil
+		fmt.Fprintf(os.Stderr, "%s Circuit breaker open until %s\n", tag, c.openTill.Format(time.TimeOnly))
+	}
+	reply.Open = now.Before(c.openTill)
+	if reply.Open {
+		reply.Until = c.openTill
+	}
+	reply.Timeouts = len(c.timeouts)
+	return reply
+}
+
+// policyFor returns the option defaults of the site policy for a command
+// run by a user: the root table, then [commands.NAME], then [users.NAME]
+func (c *coordinator) policyFor(command, user string) map[string]string {
+	if c.policy == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.policy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read policy: %v\n", err)
+		return nil
+	}
+	tables, err := parseTOML(string(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read policy: %s: %v\n", c.policy, err)
+		return nil
+	}
+	options := map[string]string{}
+	for _, layer := range []string{"", "commands." + command, "users." + user} {
+		for k, v := range tables[layer] {
+			options[k] = v
+		}
+	}
+	return options
+}
+
+func (c *coordinator) serve(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	enc := json.NewEncoder(conn)
+	for sc.Scan() {
+		var req coordRequest
+		if json.Unmarshal(sc.Bytes(), &req) != nil {
+			return
+		}
+		if enc.Encode(c.handle(req)) != nil {
+			return
+		}
+	}
+}
+
+// coordinatorMain runs the host-local coordinator that wrappers started
+// with --coordinate talk to
+func coordinatorMain(args []string) int {
+	fset := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	socket := fset.String("socket", defaultCoordSocket(), "listen on the unix socket at `path`")
+	c := &coordinator{}
+	stagger := durationFlag(5 * time.Second)
+	fset.Var(&stagger, "stagger", "minimum `delay` between two retries of any wrappers")
+	fset.IntVar(&c.trip, "trip", 5, "open the circuit breaker after `N` timeouts within -window (0 disables it)")
+	window := durationFlag(time.Minute)
+	fset.Var(&window, "window", "`duration` within which -trip timeouts open the breaker")
+	cooldown := durationFlag(5 * time.Minute)
+	fset.Var(&cooldown, "cooldown", "how long the open breaker turns kills into warnings (`duration`)")
+	fset.StringVar(&c.policy, "policy", "", "serve option defaults to wrappers started with -policy from the TOML `file`, re-read on every request")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout coordinator [options]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout coordinator --stagger 10s --trip 3 &\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 0 {
+		fset.Usage()
+		return 1
+	}
+	c.stagger, c.window, c.cooldown = time.Duration(stagger), time.Duration(window), time.Duration(cooldown)
+
+	// A socket left behind by a coordinator that died is taken over; a live
+	// one answers and keeps it
+	if conn, err := net.DialTimeout("unix", *socket, coordTimeout); err == nil {
+		conn.Close()
+		fmt.Fprintf(os.Stderr, "A coordinator is already listening on %s\n", *socket)
+		return 1
+	}
+	os.Remove(*socket)
+	ln, err := net.Listen("unix", *socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to listen: %v\n", err)
+		return 1
+	}
+	defer ln.Close()
+	fmt.Fprintf(os.Stderr, "%s Coordinating wrappers on %s\n", tag, *socket)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to accept: %v\n", err)
+			return 1
+		}
+		go c.serve(conn)
+	}
+}
+
+// coordClient is a wrapper's connection to the coordinator. Without a
+// reachable coordinator every call reports an error and the wrapper acts
+// on its own.
+type coordClient struct {
+	socket string
+}
+
+func (c *coordClient) ask(req coordRequest) (coordReply, error) {
+	var reply coordReply
+	conn, err := net.DialTimeout("unix", c.socket, coordTimeout)
+	if err != nil {
+		return reply, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(coordTimeout))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return reply, err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return reply, err
+	}
+	if err := json.Unmarshal(line, &reply); err != nil {
+		return reply, errors.New("malformed reply from coordinator")
+	}
+	return reply, nil
+}
+
+// retryDelay returns when the next attempt may start, given the backoff
+// this wrapper would use on its own
+func (c *coordClient) retryDelay(id string, backoff time.Duration) (time.Duration, error) {
+	reply, err := c.ask(coordRequest{Op: "retry", ID: id, Backoff: backoff.Seconds()})
+	if err != nil {
+		return backoff, err
+	}
+	return time.Duration(reply.Delay * float64(time.Second)).Round(time.Millisecond), nil
+}
+
+// policy asks for the site policy's option defaults for a command
+func (c *coordClient) policy(command string) (map[string]string, error) {
+	req := coordRequest{Op: "policy", Command: command}
+	if u, err := user.Current(); err == nil {
+		req.User = u.Username
+	}
+	reply, err := c.ask(req)
+	return reply.Options, err
+}
+
+// applyPolicy sets the options of fset from a site policy, leaving alone
+// those in set. Options this version doesn't have are skipped, so one
+// policy can serve wrappers of different versions.
+func applyPolicy(fset *flag.FlagSet, options map[string]string, set map[string]bool) error {
+	for k, v := range options {
+		name := strings.ReplaceAll(k, "_", "-")
+		switch name {
+		case "c", "config", "profile", "policy":
+			continue
+		}
+		if set[name] || fset.Lookup(name) == nil {
+			continue
+		}
+		if err := fset.Set(name, v); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", v, name, err)
+		}
+		set[name] = true
+	}
+	return nil
+}
+
+// timedOut reports a timeout and returns the circuit breaker state
+func (c *coordClient) timedOut(id string) (coordReply, error) {
+	return c.ask(coordRequest{Op: "timeout", ID: id})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// account is who --user and --group run the command as
+type account struct {
+	cred *watchdog.Credential
+	env  []string // HOME, USER and LOGNAME of the --user, as su sets them
+}
+
+// lookupAccount resolves --user and --group, each a name or a numeric ID.
+// The user brings their primary and supplementary groups, which --group
+// overrides; --group alone changes only the group.
+func lookupAccount(userName, groupName string) (*account, error) {
+	a := &account{cred: &watchdog.Credential{UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}}
+	if groups, err := os.Getgroups(); err == nil {
+		for _, g := range groups {
+			a.cred.Groups = append(a.cred.Groups, uint32(g))
+		}
+	}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil && isID(userName) {
+			u, err = user.LookupId(userName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %q", userName)
+		}
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q has no numeric ID", userName)
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q has no numeric group ID", userName)
+		}
+		a.cred.UID, a.cred.GID, a.cred.Groups = uint32(uid), uint32(gid), nil
+		ids, _ := u.GroupIds()
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				a.cred.Groups = append(a.cred.Groups, uint32(g))
+			}
+		}
+		a.env = []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil && isID(groupName) {
+			g, err = user.LookupGroupId(groupName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unknown group %q", groupName)
+		}
+		gid, err := strconv.ParseUint(g.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("group %q has no numeric ID", groupName)
+		}
+		a.cred.GID = uint32(gid)
+	}
+	return a, nil
+}
+
+// isID reports whether s is a numeric user or group ID
+func isID(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 32)
+	return err == nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// D-Bus names of the --dbus signals
+const (
+	dbusPath      = "/io/github/gavlooth/IdleTimeout"
+	dbusInterface = "io.github.gavlooth.IdleTimeout1"
+)
+
+// dbusSignals emits lifecycle signals on the session bus for --dbus, so
+// status bars and other desktop automation can follow wrapped jobs:
+//
+//	Started(s id, s session, i seq, as command, i pid)
+//	Warned(s id, s session, i seq, d idle_seconds, d timeout_seconds)
+//	Killed(s id, s session, i seq, d idle_seconds)
+//	Finished(s id, s session, i seq, i exit_code, b timed_out, d runtime_seconds)
+//
+// Signals go out through gdbus in the background, in order; wait blocks
+// until all of them are sent.
+type dbusSignals struct {
+	queue chan []string
+	done  chan struct{}
+}
+
+// checkDBus reports whether signals can be emitted
+func checkDBus() error {
+	if _, err := exec.LookPath("gdbus"); err != nil {
+		return fmt.Errorf("gdbus not found")
+	}
+	return nil
+}
+
+func newDBusSignals() *dbusSignals {
+	d := &dbusSignals{queue: make(chan []string, 64), done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		for args := range d.queue {
+			cmd := append([]string{"emit", "--session", "--object-path", dbusPath, "--signal", dbusInterface + "." + args[0]}, args[1:]...)
+			if out, err := exec.Command("gdbus", cmd...).CombinedOutput(); err != nil {
+				con.Logf("D-Bus signal %s failed: %v %s", args[0], err, strings.TrimSpace(string(out)))
+			}
+		}
+	}()
+	return d
+}
+
+// observe emits the signal for a watchdog event
+func (d *dbusSignals) observe(e watchdog.Event, cfg config, inv invocation, started time.Time) {
+	id, session, seq := gvariantString(inv.id), gvariantString(inv.session), strconv.Itoa(inv.seq)
+	var args []string
+	switch e.Kind {
+	case watchdog.Started:
+		args = []string{"Started", id, session, seq, gvariantStrings(cfg.command), strconv.Itoa(e.PID)}
+	case watchdog.Warned:
+		args = []string{"Warned", id, session, seq, gvariantDouble(e.Idle.Seconds()), gvariantDouble(e.Timeout.Seconds())}
+	case watchdog.TimedOut:
+		args = []string{"Killed", id, session, seq, gvariantDouble(e.Idle.Seconds())}
+	case watchdog.Exited:
+		args = []string{"Finished", id, session, seq, strconv.Itoa(e.ExitCode), strconv.FormatBool(e.TimedOut), gvariantDouble(e.Time.Sub(started).Seconds())}
+	default:
+		return
+	}
+	d.queue <- args
+}
+
+func (d *dbusSignals) wait() {
+	close(d.queue)
+	<-d.done
+}
+
+// gvariantString quotes s in GVariant text format
+func gvariantString(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch {
+		case r == '\'' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+func gvariantStrings(ss []string) string {
+	if len(ss) == 0 {
+		return "@as []"
+	}
+	quoted := make([]string, len(ss))
+	for i, s := range ss {
+		quoted[i] = gvariantString(s)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// gvariantDouble formats v so it parses as a double, not an integer
+func gvariantDouble(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
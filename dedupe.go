@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// dedupe collapses runs of identical lines in the forwarded output for
+// --dedupe, such as a client logging the same retry over and over: the
+// first line of a run is passed on, the repeats are only counted, and
+// "<line> (xN)" follows once the run ends. Only lines written whole are
+// compared; one that arrives in pieces, like a prompt, passes through.
+type dedupe struct {
+	mu      sync.Mutex
+	w       io.Writer
+	last    []byte // the last line passed on, without its line ending
+	eol     string // and its line ending
+	count   int    // times in a row it was seen, 0 once its run is reported
+	midLine bool   // part of a line was passed on
+}
+
+func newDedupe(w io.Writer) *dedupe {
+	return &dedupe{w: w}
+}
+
+func (d *dedupe) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if out := d.filter(p); len(out) > 0 {
+		if _, err := d.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// fresh reports whether p has output other than repeats, for
+// --dedupe-quiet; the dedupe must be one of its own, as it tracks p
+func (d *dedupe) fresh(p []byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.filter(p)) > 0
+}
+
+// filter returns what is left of p to pass on
+func (d *dedupe) filter(p []byte) []byte {
+	var out []byte
+	for len(p) > 0 {
+		nl := bytes.IndexByte(p, '\n')
+		if nl < 0 {
+			out = append(d.end(out), p...)
+			d.midLine = true
+			break
+		}
+		line := p[:nl+1]
+		p = p[nl+1:]
+		text := bytes.TrimSuffix(line[:nl], []byte{'\r'})
+		switch {
+		case d.midLine:
+			out = append(out, line...)
+			d.midLine = false
+			continue
+		case d.count > 0 && len(text) > 0 && bytes.Equal(text, d.last):
+			d.count++
+			continue
+		}
+		out = append(d.end(out), line...)
+		d.last, d.eol, d.count = append(d.last[:0], text...), string(line[len(text):]), 1
+	}
+	return out
+}
+
+// end appends the report of the run of repeats that ended, if any
+func (d *dedupe) end(out []byte) []byte {
+	if d.count > 1 {
+		out = fmt.Appendf(out, "%s (x%d)%s", d.last, d.count, d.eol)
+	}
+	d.count = 0
+	return out
+}
+
+// Flush reports the run of repeats the output ended with
+func (d *dedupe) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if out := d.end(nil); len(out) > 0 {
+		_, err := d.w.Write(out)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// dockerAPI is the Engine API version asked for, old enough for any
+// daemon still in use
+const dockerAPI = "/v1.40"
+
+// dockerClient talks to the Docker daemon over its unix socket
+type dockerClient struct {
+	socket string
+	http   *http.Client
+}
+
+// newDockerClient connects to the daemon at DOCKER_HOST, or at the default
+// socket; only unix sockets are supported
+func newDockerClient() (*dockerClient, error) {
+	socket := "/var/run/docker.sock"
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		path, ok := strings.CutPrefix(host, "unix://")
+		if !ok {
+			return nil, fmt.Errorf("DOCKER_HOST %s: only unix:// sockets are supported", host)
+		}
+		socket = path
+	}
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socket)
+	}
+	return &dockerClient{socket: socket, http: &http.Client{Transport: &http.Transport{DialContext: dial}}}, nil
+}
+
+// call sends a request with an optional JSON body and decodes a JSON
+// reply into out, if given
+func (c *dockerClient) call(method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://docker"+dockerAPI+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e struct{ Message string }
+		json.NewDecoder(resp.Body).Decode(&e)
+		if e.Message == "" {
+			e.Message = resp.Status
+		}
+		return errors.New(e.Message)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// inspectExec reports the state of an exec
+func (c *dockerClient) inspectExec(id string) (execState, error) {
+	var st execState
+	err := c.call("GET", "/exec/"+url.PathEscape(id)+"/json", nil, &st)
+	return st, err
+}
+
+// runExec runs a short command in a container as user and waits for it,
+// failing with its output unless it exits 0
+func (c *dockerClient) runExec(container, user string, command ...string) error {
+	var created struct{ Id string }
+	err := c.call("POST", "/containers/"+url.PathEscape(container)+"/exec", map[string]any{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          command,
+		"User":         user,
+	}, &created)
+	if err != nil {
+		return err
+	}
+	stream, err := c.startExec(created.Id, false)
+	if err != nil {
+		return err
+	}
+	giveUp := time.AfterFunc(remoteKillWait, func() { stream.Close() })
+	defer giveUp.Stop()
+	var out bytes.Buffer
+	err = demux(stream, &out, &out)
+	stream.Close()
+	if err != nil {
+		return err
+	}
+	st, err := c.inspectExec(created.Id)
+	if err != nil {
+		return err
+	}
+	if st.Running || st.ExitCode != 0 {
+		return fmt.Errorf("%s exited with status %d: %s", command[0], st.ExitCode, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
+
+// startExec starts an exec and returns its output stream, taken over from
+// the HTTP connection the way the docker CLI attaches
+func (c *dockerClient) startExec(id string, tty bool) (io.ReadCloser, error) {
+	conn, err := net.DialTimeout("unix", c.socket, coordTimeout)
+	if err != nil {
+		return nil, err
+	}
+	body := fmt.Sprintf(`{"Detach":false,"Tty":%v}`, tty)
+	fmt.Fprintf(conn, "POST %s/exec/%s/start HTTP/1.1\r\nHost: docker\r\nContent-Type: application/json\r\nConnection: Upgrade\r\nUpgrade: tcp\r\nContent-Length: %d\r\n\r\n%s",
+		dockerAPI, url.PathEscape(id), len(body), body)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("start exec: %s", resp.Status)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, conn}, nil
+}
+
+// demux copies a stream without a TTY, where stdout and stderr come in
+// frames with an 8-byte header naming the stream and the length
+func demux(r io.Reader, stdout, stderr io.Writer) error {
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
+
+// activityWriter notes when output last passed through it
+type activityWriter struct {
+	w    io.Writer
+	last *atomic.Int64 // UnixNano of the last write
+}
+
+func (a activityWriter) Write(p []byte) (int, error) {
+	a.last.Store(time.Now().UnixNano())
+	return a.w.Write(p)
+}
+
+// execState is what the daemon reports about an exec
+type execState struct {
+	Running  bool
+	ExitCode int
+}
+
+// dockerMain runs a command in a running container through the Docker API
+// and watches its output for inactivity. Unlike wrapping 'docker exec',
+// a timeout reaches the command inside the container, not only the client.
+func dockerMain(args []string) int {
+	fset := flag.NewFlagSet("docker", flag.ExitOnError)
+	tty := fset.Bool("tty", isTerminal(uintptr(syscall.Stdout)), "give the command a terminal in the container (default: if output is a terminal)")
+	killContainer := fset.Bool("kill-container", false, "on timeout, kill the whole container rather than only the command")
+	user := fset.String("user", "", "run the command as `user` in the container")
+	workdir := fset.String("workdir", "", "run the command in `directory` in the container")
+	var warnAt warnThreshold
+	fset.Var(&warnAt, "warn-at", "warn once per idle episode after this much inactivity, as a `percentage` of the timeout (80%) or a duration")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout docker [options] <duration> <container> [--] <command> [args...]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout docker 5m web -- ./manage.py migrate\n")
+		fmt.Fprintf(os.Stderr, "\nConnects to the daemon at $DOCKER_HOST (unix sockets only) or /var/run/docker.sock.\n")
+		fmt.Fprintf(os.Stderr, "The command runs under sh in the container, which kill must be found in as well,\n")
+		fmt.Fprintf(os.Stderr, "unless -kill-container is given.\n")
+		fmt.Fprintf(os.Stderr, "The exit status is 124 after a timeout, else the command's.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	var positional []string
+	for fset.NArg() > 0 && len(positional) < 2 {
+		positional = append(positional, fset.Arg(0))
+		fset.Parse(fset.Args()[1:])
+	}
+	command := fset.Args()
+	if len(positional) != 2 || len(command) == 0 {
+		fset.Usage()
+		return 1
+	}
+	timeout, err := parseDuration(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", positional[0], err)
+		return 1
+	}
+	if timeout < watchdog.Resolution {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: below the watchdog's %v resolution\n", positional[0], watchdog.Resolution)
+		return 1
+	}
+	container := positional[1]
+	client, err := newDockerClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect to Docker: %v\n", err)
+		return 1
+	}
+
+	// Signals reach the command through a second exec in the container,
+	// which takes its PID there; the daemon only knows the one on its own
+	// host, which may be another machine or PID namespace than the wrapper's.
+	// -kill-container needs neither, and spares images without a shell.
+	cmd := command
+	if !*killContainer {
+		cmd = append([]string{"sh", "-c", remoteShim, "sh"}, command...)
+	}
+	inv := newInvocation("")
+	var created struct{ Id string }
+	err = client.call("POST", "/containers/"+url.PathEscape(container)+"/exec", map[string]any{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          *tty,
+		"Cmd":          cmd,
+		"Env":          inv.env(),
+		"User":         *user,
+		"WorkingDir":   *workdir,
+	}, &created)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create exec in %s: %v\n", container, err)
+		return 1
+	}
+	stream, err := client.startExec(created.Id, *tty)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start exec in %s: %v\n", container, err)
+		return 1
+	}
+	defer stream.Close()
+	con.Printf("spawn %s: %s\n", container, strings.Join(command, " "))
+	if *tty {
+		cols, rows := terminalSize(uintptr(syscall.Stdout))
+		client.call("POST", fmt.Sprintf("/exec/%s/resize?h=%d&w=%d", url.PathEscape(created.Id), rows, cols), nil, nil)
+	}
+	// The shim's PID line comes on stderr, which a terminal merges into
+	// stdout
+	var stdout, stderr io.Writer = con, con.stderr()
+	pids := &pidCatcher{w: stderr, done: *killContainer}
+	if *tty {
+		pids.w = stdout
+		stdout = pids
+	} else {
+		stderr = pids
+	}
+	// signalCommand sends sig to the command in the container and its
+	// process group, if it leads one
+	signalCommand := func(sig os.Signal) error {
+		pid := pids.remotePID()
+		if pid == 0 {
+			return fmt.Errorf("the command's PID in the container is unknown")
+		}
+		if st, err := client.inspectExec(created.Id); err != nil || !st.Running {
+			return err
+		}
+		name := strings.TrimPrefix(signalName(sig), "SIG")
+		script := fmt.Sprintf("kill -%s -%d 2>/dev/null || kill -%s %d", name, pid, name, pid)
+		return client.runExec(container, *user, "sh", "-c", script)
+	}
+
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	done := make(chan error, 1)
+	go func() {
+		out := activityWriter{stdout, &last}
+		if *tty {
+			_, err := io.Copy(out, stream)
+			done <- err
+			return
+		}
+		done <- demux(stream, out, activityWriter{stderr, &last})
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, forwardedSignals...)
+	defer signal.Stop(sigChan)
+	warn := warnAt.resolve(timeout)
+	warned := false
+	ticker := time.NewTicker(watchdog.Resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				con.Logf("Lost the output stream: %v", err)
+			}
+			st, err := client.inspectExec(created.Id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to get the exit status: %v\n", err)
+				return 1
+			}
+			return st.ExitCode
+		case sig := <-sigChan:
+			if err := signalCommand(sig); err != nil {
+				con.Logf("Failed to pass on %v: %v", sig, err)
+			}
+			continue
+		case <-ticker.C:
+		}
+		idle := time.Since(time.Unix(0, last.Load()))
+		switch {
+		case idle < warn || warn == 0:
+			warned = false
+		case !warned:
+			warned = true
+			con.Logf("No output for %v, killing in %v...", idleFor(idle), timeLeft(timeout-idle))
+		}
+		if idle < timeout {
+			continue
+		}
+		// A command that can't be killed in the container, or outlives the
+		// kill, takes the container with it rather than run on unwatched
+		if *killContainer {
+			con.Logf("No output for %v, killing container %s...", timeout, container)
+		} else {
+			con.Logf("No output for %v, killing process...", timeout)
+			err := signalCommand(os.Kill)
+			for deadline := time.Now().Add(remoteKillWait); err == nil; time.Sleep(watchdog.Resolution) {
+				var st execState
+				if st, err = client.inspectExec(created.Id); err == nil && !st.Running {
+					stream.Close()
+					return watchdog.ExitTimedOut
+				}
+				if time.Now().After(deadline) {
+					err = fmt.Errorf("still running %v after the kill", remoteKillWait)
+				}
+			}
+			con.Logf("Failed to kill the command (%v), killing container %s...", err, container)
+		}
+		stream.Close()
+		if err := client.call("POST", "/containers/"+url.PathEscape(container)+"/kill", nil, nil); err != nil {
+			con.Logf("Failed to kill container %s: %v; the command may still be running there", container, err)
+			return 1
+		}
+		return watchdog.ExitTimedOut
+	}
+}
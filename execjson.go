@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// maxCapture bounds the output of each stream returned by exec-json
+const maxCapture = 16 << 20
+
+// execRequest is the JSON document exec-json reads from stdin
+type execRequest struct {
+	ID         string            `json:"id"`
+	Command    string            `json:"command"`
+	Args       []string          `json:"args"`
+	Env        map[string]string `json:"env"` // added to the inherited environment
+	Dir        string            `json:"dir"`
+	Stdin      string            `json:"stdin"`
+	Timeout    jsonDuration      `json:"timeout"`
+	WarnAt     jsonDuration      `json:"warn_at"`
+	ResetBytes int               `json:"reset_bytes"`
+	PTY        bool              `json:"pty"` // stderr is then merged into stdout
+	LogFile    string            `json:"log_file"`
+	WebhookURL string            `json:"webhook_url"`
+}
+
+// execResponse is the JSON document exec-json writes to stdout
+type execResponse struct {
+	ID        string    `json:"id"`
+	Session   string    `json:"session"`
+	Command   []string  `json:"command"`
+	Started   time.Time `json:"started"`
+	Duration  float64   `json:"duration_seconds"`
+	ExitCode  int       `json:"exit_code"`
+	TimedOut  bool      `json:"timed_out"`
+	Warnings  int       `json:"warnings,omitempty"`
+	Stdout    string    `json:"stdout"`
+	Stderr    string    `json:"stderr,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"` // output beyond 16 MiB per stream was dropped
+	Error     string    `json:"error,omitempty"`
+}
+
+// jsonDuration is a duration given as seconds or as a string in the
+// timeout argument's syntax ("5m", "1.5d")
+type jsonDuration time.Duration
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var secs float64
+		if err := json.Unmarshal(b, &secs); err != nil {
+			return errors.New("duration must be a number of seconds or a string")
+		}
+		s = fmt.Sprint(secs)
+	}
+	v, err := parseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	*d = jsonDuration(v)
+	return nil
+}
+
+// capture keeps the first maxCapture bytes written to it
+type capture struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	if room := maxCapture - c.buf.Len(); len(p) > room {
+		c.buf.Write(p[:room])
+		c.truncated = true
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// execJSONMain runs the command described by a JSON request on stdin and
+// reports the outcome as JSON on stdout, for orchestrators that would
+// rather not build command lines. It exits with the command's status.
+func execJSONMain(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout exec-json < request.json\n")
+		return 1
+	}
+	var req execRequest
+	dec := json.NewDecoder(os.Stdin)
+	dec.DisallowUnknownFields()
+	resp := execResponse{ExitCode: 1}
+	err := dec.Decode(&req)
+	switch {
+	case err != nil:
+		err = fmt.Errorf("invalid request: %v", err)
+	case req.Command == "":
+		err = errors.New("invalid request: command is required")
+	case req.Timeout <= 0:
+		err = errors.New("invalid request: timeout is required")
+	case req.WarnAt >= req.Timeout:
+		err = errors.New("invalid request: warn_at must be shorter than the timeout")
+	case req.ResetBytes < 0:
+		err = errors.New("invalid request: reset_bytes must not be negative")
+	}
+	if err != nil {
+		resp.Error = err.Error()
+		return writeExecResponse(resp)
+	}
+
+	inv := newInvocation("")
+	if req.ID != "" {
+		inv.id = req.ID
+	}
+	resp.ID = inv.id
+	resp.Session = inv.session
+	resp.Command = append([]string{req.Command}, req.Args...)
+	timeout := time.Duration(req.Timeout)
+
+	var stdout, stderr capture
+	out, errOut := io.Writer(&stdout), io.Writer(&stderr)
+	if req.LogFile != "" {
+		f, err := os.OpenFile(inv.expand(req.LogFile), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+		if err != nil {
+			resp.Error = fmt.Sprintf("open log file: %v", err)
+			return writeExecResponse(resp)
+		}
+		defer f.Close()
+		out, errOut = io.MultiWriter(out, f), io.MultiWriter(errOut, f)
+	}
+	var hook *webhook
+	if req.WebhookURL != "" {
+		hook = newWebhook(req.WebhookURL)
+		defer hook.wait()
+	}
+
+	env := append(os.Environ(), inv.env()...)
+	keys := make([]string, 0, len(req.Env))
+	for k := range req.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+req.Env[k])
+	}
+	cfg := config{timeout: timeout, command: resp.Command}
+	res := watchdog.Run(context.Background(), watchdog.Config{
+		Path:       req.Command,
+		Args:       req.Args,
+		Env:        env,
+		Dir:        req.Dir,
+		Timeout:    timeout,
+		WarnAt:     time.Duration(req.WarnAt),
+		ResetBytes: req.ResetBytes,
+		PTY:        req.PTY,
+		Stdin:      strings.NewReader(req.Stdin),
+		Stdout:     out,
+		Stderr:     errOut,
+		OnEvent: func(e watchdog.Event) {
+			if p, ok := lifecyclePayload(e, cfg, inv); ok && hook != nil {
+				hook.send(p)
+			}
+		},
+	})
+	resp.Started = res.Started
+	resp.Duration = res.Duration.Seconds()
+	resp.ExitCode = res.ExitCode
+	resp.TimedOut = res.TimedOut
+	resp.Warnings = res.Warnings
+	resp.Stdout = stdout.buf.String()
+	resp.Stderr = stderr.buf.String()
+	resp.Truncated = stdout.truncated || stderr.truncated
+	if res.Err != nil {
+		resp.Error = res.Err.Error()
+	}
+	return writeExecResponse(resp)
+}
+
+// writeExecResponse prints resp and returns the exit status to use
+func writeExecResponse(resp execResponse) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(resp); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write response: %v\n", err)
+		return 1
+	}
+	return resp.ExitCode
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// expectStep is one line of an --expect-script: a pattern to wait for, or
+// input to type
+type expectStep struct {
+	line    int
+	pattern *regexp.Regexp // nil for a send
+	send    []byte
+	timeout time.Duration // how long the pattern may take, 0 for no limit
+}
+
+// parseExpectScript reads an --expect-script file. Each line is one of
+//
+//	expect <pattern>     wait for output matching the regular expression
+//	send <input>         type input, with Go escapes such as \r
+//	timeout <duration>   limit how long each following expect may wait
+//
+// with blank lines and # comments ignored. Patterns and input may be
+// double-quoted Go strings, to keep leading or trailing spaces.
+func parseExpectScript(path string) ([]expectStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var steps []expectStep
+	var timeout time.Duration
+	sc := bufio.NewScanner(f)
+	for num := 1; sc.Scan(); num++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		switch cmd {
+		case "expect":
+			if strings.HasPrefix(arg, `"`) {
+				if arg, err = strconv.Unquote(arg); err != nil {
+					return nil, fmt.Errorf("line %d: malformed string", num)
+				}
+			}
+			re, err := regexp.Compile(arg)
+			if err != nil || arg == "" {
+				return nil, fmt.Errorf("line %d: invalid pattern %q", num, arg)
+			}
+			steps = append(steps, expectStep{line: num, pattern: re, timeout: timeout})
+		case "send":
+			input, err := parseSend(arg)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: malformed input", num)
+			}
+			steps = append(steps, expectStep{line: num, send: input})
+		case "timeout":
+			if timeout, err = parseDuration(arg); err != nil {
+				return nil, fmt.Errorf("line %d: %v", num, err)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown command %q: expected expect, send or timeout", num, cmd)
+		}
+	}
+	return steps, sc.Err()
+}
+
+// expecter plays an --expect-script against one run of the command. It
+// watches the output cleaned of escape sequences, typing each send as soon
+// as the expect before it matched; an expect that runs out of time expires
+// the command like an idle timeout. After the last step the command runs on
+// under the idle timeout alone.
+type expecter struct {
+	mu      sync.Mutex
+	steps   []expectStep
+	pos     int
+	matcher *streamMatcher // for the expect at pos
+	runner  *watchdog.Runner
+	timer   *time.Timer
+	failed  *expectStep
+}
+
+func newExpecter(steps []expectStep) *expecter {
+	return &expecter{steps: steps, matcher: newStreamMatcher(true)}
+}
+
+// start runs the script up to its first expect once the command is running
+func (x *expecter) start(r *watchdog.Runner) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.runner = r
+	x.advance()
+}
+
+func (x *expecter) Write(p []byte) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.runner == nil || x.failed != nil || x.pos == len(x.steps) {
+		return len(p), nil
+	}
+	x.matcher.feed(p, x.matched)
+	return len(p), nil
+}
+
+// matched moves on past the expect that matched
+func (x *expecter) matched(int, [][]byte) {
+	x.stopTimer()
+	x.pos++
+	x.advance()
+}
+
+// advance types the sends at the current position and arms the time limit
+// of the expect after them
+func (x *expecter) advance() {
+	for ; x.pos < len(x.steps); x.pos++ {
+		step := &x.steps[x.pos]
+		if step.pattern == nil {
+			x.runner.Write(step.send)
+			continue
+		}
+		x.matcher.setRules(step.pattern)
+		x.timer = nil
+		if step.timeout > 0 {
+			x.timer = time.AfterFunc(step.timeout, func() { x.expire(step) })
+		}
+		return
+	}
+	x.matcher.setRules()
+}
+
+func (x *expecter) expire(step *expectStep) {
+	x.mu.Lock()
+	if x.pos == len(x.steps) || &x.steps[x.pos] != step {
+		x.mu.Unlock()
+		return // matched meanwhile
+	}
+	x.failed = step
+	x.mu.Unlock()
+	x.runner.Expire()
+}
+
+// stop disarms the time limit once the run is over
+func (x *expecter) stop() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.stopTimer()
+}
+
+func (x *expecter) stopTimer() {
+	if x.timer != nil {
+		x.timer.Stop()
+	}
+}
+
+// failure returns the expect that ran out of time, if one did; a nil
+// expecter never fails
+func (x *expecter) failure() (*expectStep, bool) {
+	if x == nil {
+		return nil, false
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.failed, x.failed != nil
+}
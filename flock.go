@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// exitLocked is the exit status when --flock finds the job already running
+// and neither waiting nor replacing gets the lock
+const exitLocked = 122
+
+// lockReplaceWait is how long --flock-replace gives the holder to exit on
+// SIGTERM before it is killed
+const lockReplaceWait = 10 * time.Second
+
+// errLockHeld is why the lock wasn't taken
+var errLockHeld = errors.New("held by another run of the job")
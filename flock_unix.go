@@ -0,0 +1,101 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// acquireLock takes the --flock lock at path for the life of the wrapper,
+// which holds it through the returned file, and writes its PID into it.
+// If another run holds it, acquireLock fails at once, waits up to wait
+// for it, or with replace stops the holder and takes over.
+func acquireLock(path string, wait time.Duration, replace bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLock(f)
+	if !locked && err == nil {
+		holder := lockHolder(f)
+		switch {
+		case replace:
+			err = replaceHolder(f, path, holder, wait)
+		case wait > 0:
+			con.Logf("Lock %s is held by PID %d, waiting up to %v", path, holder, wait)
+			if locked, err = waitLock(f, wait); !locked && err == nil {
+				err = fmt.Errorf("%w (PID %d), still after %v", errLockHeld, holder, wait)
+			}
+		default:
+			err = fmt.Errorf("%w (PID %d)", errLockHeld, holder)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return f, nil
+}
+
+// tryLock takes the lock if it is free
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// waitLock polls for the lock for up to wait
+func waitLock(f *os.File, wait time.Duration) (bool, error) {
+	for deadline := time.Now().Add(wait); time.Now().Before(deadline); {
+		time.Sleep(watchdog.Resolution)
+		if locked, err := tryLock(f); locked || err != nil {
+			return locked, err
+		}
+	}
+	return false, nil
+}
+
+// lockHolder reads the PID the holder of the lock wrote, 0 if there is none
+func lockHolder(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, _ := strconv.Atoi(string(bytes.TrimSpace(buf[:n])))
+	return pid
+}
+
+// replaceHolder stops the wrapper holding the lock, which passes SIGTERM
+// on to its command, and takes the lock once it lets go: after wait, or
+// lockReplaceWait by default, the holder is killed outright
+func replaceHolder(f *os.File, path string, holder int, wait time.Duration) error {
+	if holder <= 0 {
+		return fmt.Errorf("%w, which wrote no PID to replace", errLockHeld)
+	}
+	if wait <= 0 {
+		wait = lockReplaceWait
+	}
+	con.Logf("Lock %s is held by PID %d, replacing it", path, holder)
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		if err := syscall.Kill(holder, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("stop PID %d: %w", holder, err)
+		}
+		if locked, err := waitLock(f, wait); locked || err != nil {
+			return err
+		}
+		if sig == syscall.SIGTERM {
+			con.Logf("PID %d still holds lock %s after %v, killing it", holder, path, wait)
+		}
+	}
+	return fmt.Errorf("%w (PID %d), even after it was killed", errLockHeld, holder)
+}
@@ -0,0 +1,12 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// acquireLock fails: --flock takes flock(2)
+func acquireLock(path string, wait time.Duration, replace bool) (*os.File, error) {
+	return nil, errors.New("-flock is not supported on Windows")
+}
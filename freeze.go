@@ -0,0 +1,50 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// checkFreeze reports whether --on-timeout stop can work here
+func checkFreeze() error { return nil }
+
+// freeze stops the command's process group for --on-timeout stop and waits
+// for a verdict, reporting whether the command was resumed. SIGCONT sent
+// to the wrapper resumes it, and so does resuming the command directly,
+// which shows as new output; SIGINT, SIGTERM or SIGHUP to the wrapper, or
+// the command exiting, mean it is to be killed.
+func freeze(r *watchdog.Runner, pid int) bool {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCONT, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	if err := r.SignalGroup(syscall.SIGSTOP); err != nil {
+		return false
+	}
+	stopped := time.Now()
+
+	ticker := time.NewTicker(watchdog.Resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case sig := <-sigs:
+			if sig != syscall.SIGCONT {
+				return false
+			}
+			r.SignalGroup(syscall.SIGCONT)
+			return true
+		case <-ticker.C:
+			if !processAlive(pid) || zombie(pid) {
+				return false
+			}
+			if r.LastActivity().After(stopped) {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// checkFreeze fails on Windows, which has no way to stop a process tree
+// and resume it later
+func checkFreeze() error { return errors.New("not supported on Windows") }
+
+func freeze(r *watchdog.Runner, pid int) bool { return false }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// gapBuckets are the --gap-report histogram bounds, as fractions of the
+// timeout
+var gapBuckets = []float64{0.1, 0.25, 0.5, 0.8, 1}
+
+// gapStats measures the silences between bursts of output for --gap-report.
+// Chunks closer together than the watchdog's resolution make up one burst,
+// so the gaps are the ones the idle clock actually sees.
+type gapStats struct {
+	mu   sync.Mutex
+	last time.Time // end of the latest burst, or the start
+	gaps []time.Duration
+}
+
+func newGapStats(start time.Time) *gapStats {
+	return &gapStats{last: start}
+}
+
+func (g *gapStats) Write(p []byte) (int, error) {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if gap := now.Sub(g.last); gap >= watchdog.Resolution {
+		g.gaps = append(g.gaps, gap)
+	}
+	g.last = now
+	return len(p), nil
+}
+
+// gapSummary is what report shows
+type gapSummary struct {
+	count             int
+	p50, p95, longest time.Duration
+	hist              []string // gaps per histogram bucket, e.g. "0%-10%: 4"
+	nearMiss          time.Duration
+	near              int
+	timeout           time.Duration
+}
+
+// summary summarizes the gaps, counting the silence from the last output
+// until end, against timeout; gaps of nearMiss or longer that weren't
+// killed are near misses. The count is 0 if output never paused.
+func (g *gapStats) summary(end time.Time, timeout, nearMiss time.Duration) gapSummary {
+	gaps := g.until(end)
+	sum := gapSummary{count: len(gaps), nearMiss: nearMiss, timeout: timeout}
+	if len(gaps) == 0 {
+		return sum
+	}
+	sorted := append([]time.Duration(nil), gaps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)*p+99)/100-1]
+	}
+	sum.p50, sum.p95, sum.longest = percentile(50), percentile(95), sorted[len(sorted)-1]
+
+	counts := make([]int, len(gapBuckets)+1)
+	for _, gap := range gaps {
+		i := sort.SearchFloat64s(gapBuckets, float64(gap)/float64(timeout))
+		if i < len(gapBuckets) && float64(gap) == gapBuckets[i]*float64(timeout) {
+			i++ // bounds belong to the bucket above
+		}
+		counts[i]++
+		if gap >= nearMiss && gap < timeout {
+			sum.near++
+		}
+	}
+	lower := "0%"
+	for i, bound := range gapBuckets {
+		upper := fmt.Sprintf("%.0f%%", bound*100)
+		sum.hist = append(sum.hist, fmt.Sprintf("%s-%s: %d", lower, upper, counts[i]))
+		lower = upper
+	}
+	sum.hist = append(sum.hist, fmt.Sprintf("killed: %d", counts[len(gapBuckets)]))
+	return sum
+}
+
+// until returns the gaps, counting the silence from the last output until
+// end
+func (g *gapStats) until(end time.Time) []time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gaps := append([]time.Duration(nil), g.gaps...)
+	if gap := end.Sub(g.last); gap >= watchdog.Resolution {
+		gaps = append(gaps, gap)
+	}
+	return gaps
+}
+
+// used is the share of the timeout the longest gap took, in percent
+func (s gapSummary) used() float64 {
+	return 100 * float64(s.longest) / float64(s.timeout)
+}
+
+// report logs the summary of the gaps
+func (g *gapStats) report(end time.Time, timeout, nearMiss time.Duration) {
+	sum := g.summary(end, timeout, nearMiss)
+	if sum.count == 0 {
+		con.Logf("Output gaps: none, output never paused")
+		return
+	}
+	con.Logf("Output gaps: %d, p50 %v, p95 %v, max %v", sum.count, roundGap(sum.p50), roundGap(sum.p95), roundGap(sum.longest))
+	con.Logf("  of the %v timeout: %s", timeout, strings.Join(sum.hist, ", "))
+	con.Logf("  near misses (%v or more, short of a kill): %d; the longest gap used %.0f%% of the timeout", roundGap(nearMiss), sum.near, sum.used())
+}
+
+// roundGap rounds d for display, keeping short gaps distinguishable
+func roundGap(d time.Duration) time.Duration {
+	if d < 10*time.Second {
+		return d.Round(10 * time.Millisecond)
+	}
+	return d.Round(100 * time.Millisecond)
+}
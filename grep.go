@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ansiPattern matches CSI, OSC and two-byte escape sequences for stripping
+var ansiPattern = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+
+// sessionLine is one line of recorded output with its timing. Gaps are -1
+// when unknown (plain logs); before is also -1 for the first output.
+type sessionLine struct {
+	num    int
+	at     time.Duration // offset from the start of the recording
+	text   string
+	before time.Duration // silence before the chunk that completed this line
+	after  time.Duration // silence after it, up to the next chunk or the end
+}
+
+func grepMain(args []string) int {
+	fset := flag.NewFlagSet("grep", flag.ExitOnError)
+	ignoreCase := fset.Bool("i", false, "match case-insensitively")
+	minGap := durationFlag(0)
+	fset.Var(&minGap, "min-gap", "only show matches followed by at least this much `silence`")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout grep [options] <pattern> <artifacts-dir|cast|log>...\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout grep --min-gap 1m 'connecting' ./artifacts\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 2 {
+		fset.Usage()
+		return 1
+	}
+
+	expr := fset.Arg(0)
+	if *ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid pattern %q: %v\n", fset.Arg(0), err)
+		return 1
+	}
+
+	var files []string
+	for _, root := range fset.Args()[1:] {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && (path == root || isSessionFile(path)) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", root, err)
+			return 2
+		}
+	}
+
+	status := 1 // like grep(1): 0 if anything matched
+	for _, path := range files {
+		lines, err := readSession(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", path, err)
+			status = 2
+			continue
+		}
+		for _, l := range lines {
+			if !re.MatchString(l.text) || minGap > 0 && l.after < time.Duration(minGap) {
+				continue
+			}
+			if status == 1 {
+				status = 0
+			}
+			fmt.Printf("%s:%s: %s\n", path, formatPosition(l), l.text)
+		}
+	}
+	return status
+}
+
+// isSessionFile reports whether a file found while walking a directory looks
+// like a recording or log
+func isSessionFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".cast", ".log", ".txt":
+		return true
+	}
+	return false
+}
+
+// formatPosition renders where a line sits in its session
+func formatPosition(l sessionLine) string {
+	if l.after < 0 {
+		return fmt.Sprintf("%d", l.num)
+	}
+	after := l.after.Round(time.Millisecond)
+	if l.before < 0 {
+		return fmt.Sprintf("%d: +%v (first output, idle %v after)", l.num, l.at.Round(time.Millisecond), after)
+	}
+	return fmt.Sprintf("%d: +%v (idle %v before, %v after)",
+		l.num, l.at.Round(time.Millisecond), l.before.Round(time.Millisecond), after)
+}
+
+// readSession splits a recording or plain log into lines
+func readSession(path string) ([]sessionLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !sc.Scan() {
+		return nil, sc.Err()
+	}
+	var hdr castHeader
+	if json.Unmarshal(sc.Bytes(), &hdr) == nil && hdr.Version == 2 {
+		return readCast(sc)
+	}
+
+	// Plain log: no timing available
+	var lines []sessionLine
+	for n := 1; ; n++ {
+		lines = append(lines, sessionLine{num: n, text: cleanLine(sc.Text()), before: -1, after: -1})
+		if !sc.Scan() {
+			break
+		}
+	}
+	return lines, sc.Err()
+}
+
+// readCast reassembles lines from asciinema v2 output events
+func readCast(sc *bufio.Scanner) ([]sessionLine, error) {
+	var (
+		lines   []sessionLine
+		partial strings.Builder
+		prev    = time.Duration(-1)
+		before  time.Duration
+		open    []int // lines completed by the latest chunk, awaiting their "after" gap
+	)
+	for sc.Scan() {
+		var ev []any
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil || len(ev) != 3 {
+			continue
+		}
+		secs, _ := ev[0].(float64)
+		kind, _ := ev[1].(string)
+		data, _ := ev[2].(string)
+		at := time.Duration(secs * float64(time.Second))
+		// Any event, including the wrapper's exit markers, ends the silence
+		for _, i := range open {
+			lines[i].after = at - lines[i].at
+		}
+		open = open[:0]
+		if kind != "o" {
+			continue
+		}
+
+		before = -1
+		if prev >= 0 {
+			before = at - prev
+		}
+		prev = at
+
+		for {
+			nl := strings.IndexByte(data, '\n')
+			if nl < 0 {
+				partial.WriteString(data)
+				break
+			}
+			partial.WriteString(data[:nl])
+			lines = append(lines, sessionLine{num: len(lines) + 1, at: at, text: cleanLine(partial.String()), before: before})
+			open = append(open, len(lines)-1)
+			partial.Reset()
+			data = data[nl+1:]
+		}
+	}
+	if partial.Len() > 0 {
+		lines = append(lines, sessionLine{num: len(lines) + 1, at: prev, text: cleanLine(partial.String()), before: before})
+		open = append(open, len(lines)-1)
+	}
+	// Without a closing marker the end of the recording is unknown
+	for _, i := range open {
+		lines[i].after = 0
+	}
+	return lines, sc.Err()
+}
+
+// cleanLine strips escape sequences and carriage-return overwrites
+func cleanLine(s string) string {
+	s = ansiPattern.ReplaceAllString(s, "")
+	s = strings.TrimRight(s, "\r")
+	if i := strings.LastIndexByte(s, '\r'); i >= 0 {
+		s = s[i+1:]
+	}
+	return s
+}
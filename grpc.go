@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The gRPC service of --control-listen, whose schema is control.proto. It
+// runs on the HTTP/2 server of net/http, with its few messages encoded by
+// hand, so the wrapper keeps going without dependencies.
+
+// grpcService is the path prefix of the service's methods
+const grpcService = "/idletimeout.v1.Control/"
+
+// grpcMethods maps the commands of the line protocol to the methods of the
+// service that carry them out
+var grpcMethods = map[string]string{
+	"extend":      "Extend",
+	"set-timeout": "SetTimeout",
+	"pause":       "Pause",
+	"resume":      "Resume",
+	"kill":        "Kill",
+	"status":      "Status",
+	"watch":       "Watch",
+}
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+)
+
+// grpcMaxMessage bounds the size of a message read; those of the service
+// take a few dozen bytes
+const grpcMaxMessage = 64 << 10
+
+// grpcError is a call the service answered with a status other than OK
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return fmt.Sprintf("%s (gRPC status %d)", e.msg, e.code)
+}
+
+// ServeHTTP answers a call to the service. The status of the call goes in
+// the grpc-status and grpc-message trailers.
+func (c *control) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "this is a gRPC service", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	code, msg := c.call(w, req)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(msg))
+	}
+}
+
+// call carries out the method of req, returning the status it ends with
+func (c *control) call(w http.ResponseWriter, req *http.Request) (int, string) {
+	method, _ := strings.CutPrefix(req.URL.Path, grpcService)
+	cmd := ""
+	for name, m := range grpcMethods {
+		if m == method {
+			cmd = name
+		}
+	}
+	if cmd == "" {
+		return grpcUnimplemented, fmt.Sprintf("unknown method %s", req.URL.Path)
+	}
+	in, err := readGRPC(req.Body)
+	if err != nil {
+		return grpcInternal, fmt.Sprintf("reading the request: %v", err)
+	}
+	switch cmd {
+	case "watch":
+		c.watchGRPC(req.Context(), w)
+		return grpcOK, ""
+	case "status":
+		if c.current() == nil {
+			return grpcFailedPrecondition, errNotRunning.Error()
+		}
+		if err := writeGRPC(w, c.statusMessage()); err != nil {
+			return grpcInternal, err.Error()
+		}
+		return grpcOK, ""
+	}
+	var arg string
+	if err := protoFields(in, func(field int, _ uint64, data []byte) {
+		if field == 1 {
+			arg = string(data)
+		}
+	}); err != nil {
+		return grpcInvalidArgument, err.Error()
+	}
+	msg, err := c.do(cmd, arg)
+	var bad badDuration
+	switch {
+	case errors.Is(err, errNotRunning):
+		return grpcFailedPrecondition, err.Error()
+	case errors.As(err, &bad):
+		return grpcInvalidArgument, err.Error()
+	case err != nil:
+		return grpcInternal, err.Error()
+	}
+	var reply protoMessage
+	reply.string(1, msg)
+	if err := writeGRPC(w, reply); err != nil {
+		return grpcInternal, err.Error()
+	}
+	return grpcOK, ""
+}
+
+// watchGRPC streams a Status message every second until the client cancels
+func (c *control) watchGRPC(ctx context.Context, w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		rc.SetWriteDeadline(time.Now().Add(controlIdle))
+		if writeGRPC(w, c.statusMessage()) != nil || rc.Flush() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// statusMessage encodes the Status message of the attempt in flight, with
+// running left unset between attempts
+func (c *control) statusMessage() protoMessage {
+	var m protoMessage
+	r := c.current()
+	if r == nil {
+		return m
+	}
+	s := c.status(r)
+	m.bool(1, true)
+	m.uint(2, uint64(s.pid))
+	m.double(3, s.idle.Seconds())
+	m.double(4, s.limit.Seconds())
+	m.bool(5, s.paused)
+	m.double(6, s.pausedFor.Seconds())
+	m.string(7, s.String())
+	return m
+}
+
+// grpcEscape percent-encodes a grpc-message, as the protocol asks for
+// anything beyond printable ASCII
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if ch := s[i]; ch < ' ' || ch > '~' || ch == '%' {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		} else {
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// writeGRPC sends msg as one length-prefixed, uncompressed message
+func writeGRPC(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// readGRPC reads one length-prefixed message, returning io.EOF at the end
+// of the stream
+func readGRPC(r io.Reader) ([]byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != 0 {
+		return nil, errors.New("compressed messages aren't supported")
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > grpcMaxMessage {
+		return nil, fmt.Errorf("message of %d bytes is too large", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return msg, nil
+}
+
+// protoMessage is a protobuf message being encoded. As in proto3, fields
+// at their zero value are left out.
+type protoMessage []byte
+
+func (m *protoMessage) key(field, wire int) {
+	*m = binary.AppendUvarint(*m, uint64(field)<<3|uint64(wire))
+}
+
+func (m *protoMessage) uint(field int, v uint64) {
+	if v != 0 {
+		m.key(field, 0)
+		*m = binary.AppendUvarint(*m, v)
+	}
+}
+
+func (m *protoMessage) bool(field int, v bool) {
+	if v {
+		m.uint(field, 1)
+	}
+}
+
+func (m *protoMessage) double(field int, v float64) {
+	if v != 0 {
+		m.key(field, 1)
+		*m = binary.LittleEndian.AppendUint64(*m, math.Float64bits(v))
+	}
+}
+
+func (m *protoMessage) string(field int, s string) {
+	if s != "" {
+		m.key(field, 2)
+		*m = binary.AppendUvarint(*m, uint64(len(s)))
+		*m = append(*m, s...)
+	}
+}
+
+// errBadProto is a message that doesn't decode
+var errBadProto = errors.New("malformed protobuf message")
+
+// protoFields calls fn with each field of an encoded protobuf message:
+// varints and fixed-size values as num, length-delimited ones as data
+func protoFields(msg []byte, fn func(field int, num uint64, data []byte)) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errBadProto
+		}
+		msg = msg[n:]
+		var num uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			if num, n = binary.Uvarint(msg); n <= 0 {
+				return errBadProto
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				return errBadProto
+			}
+			num, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return errBadProto
+			}
+			data, msg = msg[n:n+int(size)], msg[n+int(size):]
+		case 5:
+			if len(msg) < 4 {
+				return errBadProto
+			}
+			num, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		default:
+			return errBadProto
+		}
+		fn(int(key>>3), num, data)
+	}
+	return nil
+}
+
+// connListener is a net.Listener for connections accepted elsewhere: those
+// of --control-listen that negotiate HTTP/2
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// hand passes conn on to Accept, or closes it if the listener is closed
+func (l *connListener) hand(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+// controlGRPC makes command a call to the gRPC service at addr, and prints
+// the answer the way the line protocol words it
+func controlGRPC(addr, command, certFile, keyFile, caFile string) int {
+	cfg, err := controlTLS(certFile, keyFile, caFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect: %v\n", err)
+		return 1
+	}
+	cmd, arg, _ := strings.Cut(strings.TrimSpace(command), " ")
+	method, ok := grpcMethods[cmd]
+	if !ok {
+		fmt.Printf("error: unknown command %q: expected %s\n", cmd, controlCommands)
+		return 1
+	}
+	var req protoMessage
+	req.string(1, strings.TrimSpace(arg))
+	client := grpcClient(cfg)
+	ctx := context.Background()
+	if cmd != "watch" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, coordTimeout)
+		defer cancel()
+	}
+	status := cmd == "status" || cmd == "watch"
+	err = callGRPC(ctx, client, addr, method, req, func(msg []byte) error {
+		// A Reply's message and a Status's text are what the line
+		// protocol answers after "ok: "
+		running, text := !status, ""
+		err := protoFields(msg, func(field int, num uint64, data []byte) {
+			switch {
+			case status && field == 1:
+				running = num != 0
+			case status && field == 7, !status && field == 1:
+				text = string(data)
+			}
+		})
+		if !running {
+			text = "error: " + errNotRunning.Error()
+		} else {
+			text = "ok: " + text
+		}
+		fmt.Println(text)
+		return err
+	})
+	var gerr *grpcError
+	switch {
+	case errors.As(err, &gerr):
+		fmt.Printf("error: %s\n", gerr.msg)
+		return 1
+	case err != nil && cmd == "watch":
+		// Until the wrapper exits or the watcher is interrupted
+		return 0
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "Failed to call %s: %v\n", method, err)
+		return 1
+	}
+	return 0
+}
+
+// grpcClient makes calls over HTTP/2 with the TLS config of controlTLS
+func grpcClient(cfg *tls.Config) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: coordTimeout}).DialContext,
+		TLSClientConfig:     cfg,
+		TLSHandshakeTimeout: coordTimeout,
+		ForceAttemptHTTP2:   true,
+	}}
+}
+
+// callGRPC calls method of the service at addr with the request message
+// req, and each with every message the answer streams
+func callGRPC(ctx context.Context, client *http.Client, addr, method string, req []byte, each func([]byte) error) error {
+	var body bytes.Buffer
+	writeGRPC(&body, req)
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+addr+grpcService+method, &body)
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("TE", "trailers")
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	for {
+		msg, err := readGRPC(resp.Body)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := each(msg); err != nil {
+			return err
+		}
+	}
+	// A call that fails at once may answer with headers alone
+	trailer := resp.Trailer
+	if trailer.Get("Grpc-Status") == "" {
+		trailer = resp.Header
+	}
+	code, err := strconv.Atoi(trailer.Get("Grpc-Status"))
+	if err != nil {
+		return errors.New("no gRPC status in the answer")
+	}
+	if code != grpcOK {
+		msg, err := url.PathUnescape(trailer.Get("Grpc-Message"))
+		if err != nil {
+			msg = trailer.Get("Grpc-Message")
+		}
+		return &grpcError{code: code, msg: msg}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// writeCerts writes a CA to dir as ca.pem, and server and client
+// certificates for localhost it signs as {server,client}.{pem,key}
+func writeCerts(t *testing.T, dir string) {
+	t.Helper()
+	write := func(name, kind string, der []byte) {
+		data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("ca.pem", "CERTIFICATE", der)
+	for i, name := range []string{"server", "client"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(name+".pem", "CERTIFICATE", der)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(name+".key", "EC PRIVATE KEY", keyDER)
+	}
+}
+
+func TestProtoFields(t *testing.T) {
+	var m protoMessage
+	m.bool(1, true)
+	m.uint(2, 300)
+	m.double(3, 1.5)
+	m.bool(5, false) // left out
+	m.string(7, "idle 1s / 5m0s")
+	got := map[int]any{}
+	if err := protoFields(m, func(field int, num uint64, data []byte) {
+		switch field {
+		case 3:
+			got[field] = math.Float64frombits(num)
+		case 7:
+			got[field] = string(data)
+		default:
+			got[field] = num
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]any{1: uint64(1), 2: uint64(300), 3: 1.5, 7: "idle 1s / 5m0s"}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %v, want %v", got, want)
+	}
+	for field, v := range want {
+		if got[field] != v {
+			t.Errorf("field %d = %v, want %v", field, got[field], v)
+		}
+	}
+	if err := protoFields(m[:len(m)-1], func(int, uint64, []byte) {}); err != errBadProto {
+		t.Errorf("truncated message decoded with error %v", err)
+	}
+}
+
+func TestGRPCService(t *testing.T) {
+	dir := t.TempDir()
+	writeCerts(t, dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	c := newControl(time.Minute)
+	if err := c.listenTLS("127.0.0.1:0", path("server.pem"), path("server.key"), path("ca.pem")); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	addr := c.tlsLn.Addr().String()
+	cfg, err := controlTLS(path("client.pem"), path("client.key"), path("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := grpcClient(cfg)
+	call := func(method string, req protoMessage) (string, error) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		var text string
+		err := callGRPC(ctx, client, addr, method, req, func(msg []byte) error {
+			return protoFields(msg, func(field int, _ uint64, data []byte) {
+				if field == 1 || field == 7 {
+					text = string(data)
+				}
+			})
+		})
+		return text, err
+	}
+	code := func(err error) int {
+		var gerr *grpcError
+		if !errors.As(err, &gerr) {
+			t.Fatalf("got %v, want a gRPC status", err)
+		}
+		return gerr.code
+	}
+
+	if _, err := call("Status", nil); code(err) != grpcFailedPrecondition {
+		t.Errorf("Status between attempts: %v", err)
+	}
+	if _, err := call("Frob", nil); code(err) != grpcUnimplemented {
+		t.Errorf("unknown method: %v", err)
+	}
+
+	r := watchdog.New(watchdog.Config{Path: "sleep", Args: []string{"10"}, Timeout: time.Minute})
+	done := make(chan watchdog.Result)
+	go func() { done <- r.Run(context.Background()) }()
+	for r.PID() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	c.attach(r)
+	defer c.attach(nil)
+
+	var extend protoMessage
+	extend.string(1, "30m")
+	if msg, err := call("Extend", extend); err != nil || msg != "this silence may last 31m0s" {
+		t.Errorf("Extend: %q, %v", msg, err)
+	}
+	var bad protoMessage
+	bad.string(1, "soon")
+	if _, err := call("SetTimeout", bad); code(err) != grpcInvalidArgument {
+		t.Errorf("SetTimeout with a bad duration: %v", err)
+	}
+	if msg, err := call("Status", nil); err != nil || msg != "idle 0s / 31m0s" {
+		t.Errorf("Status: %q, %v", msg, err)
+	}
+
+	// A watch streams until cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	statuses := 0
+	err = callGRPC(ctx, client, addr, "Watch", nil, func([]byte) error {
+		if statuses++; statuses == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if statuses != 2 || !errors.Is(err, context.Canceled) {
+		t.Errorf("watch ended after %d statuses with %v", statuses, err)
+	}
+
+	if msg, err := call("Kill", nil); err != nil || msg != "killing" {
+		t.Errorf("Kill: %q, %v", msg, err)
+	}
+	select {
+	case res := <-done:
+		if !res.TimedOut {
+			t.Errorf("command not timed out: %+v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Kill didn't kill the command")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// heartbeat prints a line into the output every interval the command stays
+// silent within its budget, so log collectors that kill quiet jobs see
+// progress, until ctx is done. A full-screen program on the terminal gets
+// none: each line would land over its display.
+func heartbeat(ctx context.Context, wg *sync.WaitGroup, r *watchdog.Runner, interval time.Duration) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(watchdog.Resolution)
+		defer ticker.Stop()
+		var beat time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if r.PID() == 0 || con.fullScreen() {
+				continue // not started yet, or not for a full-screen program
+			}
+			last := r.LastActivity()
+			idle := time.Since(last)
+			if idle < interval || idle >= r.IdleLimit() || time.Since(beat) < interval && beat.After(last) {
+				continue
+			}
+			beat = time.Now()
+			con.Outf("Still running, idle %v", idle.Round(time.Second))
+		}
+	}()
+}
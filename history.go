@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// historyEntry is one invocation in the --history store
+type historyEntry struct {
+	ID        string    `json:"id"`
+	Session   string    `json:"session"`
+	Dir       string    `json:"dir"`
+	Command   []string  `json:"command"`
+	Started   time.Time `json:"started"`
+	Duration  float64   `json:"duration_seconds"`
+	Timeout   float64   `json:"timeout_seconds"`
+	Attempts  int       `json:"attempts"`
+	ExitCode  int       `json:"exit_code"`
+	TimedOut  bool      `json:"timed_out"`
+	OverLimit string    `json:"over_limit,omitempty"`
+	Warnings  int       `json:"warnings,omitempty"`        // over every attempt
+	MaxGap    float64   `json:"max_gap_seconds,omitempty"` // likewise
+}
+
+// historyPath is the history store, under the XDG data directory
+func historyPath() (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if !filepath.IsAbs(dir) {
+		if runtime.GOOS == "windows" {
+			if dir = os.Getenv("LocalAppData"); dir == "" {
+				return "", errors.New("%LocalAppData% is not defined")
+			}
+		} else {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			dir = filepath.Join(home, ".local", "share")
+		}
+	}
+	return filepath.Join(dir, "idle-timeout", "history.jsonl"), nil
+}
+
+// recordHistory appends the invocation to the history store as a line of
+// JSON. One write to a file opened for appending keeps the lines of
+// wrappers finishing together whole.
+func recordHistory(inv invocation, command []string, history []attempt, timeout time.Duration) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	final := history[len(history)-1]
+	e := historyEntry{
+		ID:        inv.id,
+		Session:   inv.session,
+		Dir:       dir,
+		Command:   command,
+		Started:   history[0].Started,
+		Duration:  time.Since(history[0].Started).Seconds(),
+		Timeout:   timeout.Seconds(),
+		Attempts:  len(history),
+		ExitCode:  final.ExitCode,
+		TimedOut:  final.TimedOut,
+		OverLimit: final.OverLimit,
+	}
+	for _, a := range history {
+		e.Warnings += a.Warnings
+		e.MaxGap = max(e.MaxGap, a.MaxGap)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// outcome describes how the invocation ended, for the history table
+func (e historyEntry) outcome() string {
+	switch {
+	case e.TimedOut:
+		return "timed out"
+	case e.OverLimit != "":
+		return "over " + e.OverLimit
+	case e.ExitCode == 0:
+		return "ok"
+	}
+	return fmt.Sprintf("exit %d", e.ExitCode)
+}
+
+// historyMain lists the invocations recorded with --history, oldest first
+func historyMain(args []string) int {
+	fset := flag.NewFlagSet("history", flag.ExitOnError)
+	failed := fset.Bool("failed", false, "only list invocations that failed, timed out included")
+	timedOut := fset.Bool("timed-out", false, "only list invocations killed for inactivity")
+	here := fset.Bool("here", false, "only list invocations started in the current directory")
+	limit := fset.Int("limit", 20, "list the last `n` matching invocations, 0 for all")
+	asJSON := fset.Bool("json", false, "print the matching records as JSON lines")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout history [options]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout history --timed-out --limit 5\n")
+		fmt.Fprintf(os.Stderr, "\nInvocations are recorded when run with --history.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() > 0 {
+		fset.Usage()
+		return 1
+	}
+	if *limit < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid limit %d: expected 0 or more\n", *limit)
+		return 1
+	}
+	var cwd string
+	if *here {
+		var err error
+		if cwd, err = os.Getwd(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get the current directory: %v\n", err)
+			return 1
+		}
+	}
+
+	path, err := historyPath()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to locate the history: %v\n", err)
+		return 1
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the history: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	type line struct {
+		raw   string
+		entry historyEntry
+	}
+	var matches []line
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var e historyEntry
+		// A line cut short by a full disk is skipped, not fatal
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || len(e.Command) == 0 {
+			continue
+		}
+		if (*failed && e.ExitCode == 0) || (*timedOut && !e.TimedOut) || (*here && e.Dir != cwd) {
+			continue
+		}
+		matches = append(matches, line{scanner.Text(), e})
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the history: %v\n", err)
+		return 1
+	}
+	if *limit > 0 && len(matches) > *limit {
+		matches = matches[len(matches)-*limit:]
+	}
+
+	for _, m := range matches {
+		if *asJSON {
+			fmt.Println(m.raw)
+			continue
+		}
+		e := m.entry
+		ran := time.Duration(e.Duration * float64(time.Second)).Round(time.Second)
+		detail := ""
+		if e.Attempts > 1 {
+			detail = fmt.Sprintf(", %d attempts", e.Attempts)
+		}
+		if e.MaxGap > 0 {
+			detail += fmt.Sprintf(", longest gap %v", roundGap(time.Duration(e.MaxGap*float64(time.Second))))
+		}
+		fmt.Printf("%s  %-9s  %8v  %s  (%s%s)\n", e.Started.Local().Format("2006-01-02 15:04"), e.outcome(), ran,
+			shellJoin(e.Command), e.Dir, detail)
+	}
+	return 0
+}
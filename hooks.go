@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hookTimeout bounds how long a hook may delay the wrapper, so a hung hook
+// can't keep a stalled child alive indefinitely
+const hookTimeout = 30 * time.Second
+
+// hookEnv describes the supervised child to a hook
+func hookEnv(inv invocation, pid int, idle, limit time.Duration) []string {
+	return append(inv.env(),
+		"IDLE_TIMEOUT_PID="+strconv.Itoa(pid),
+		"IDLE_ELAPSED="+formatSeconds(idle),
+		"IDLE_LIMIT="+formatSeconds(limit),
+	)
+}
+
+// formatSeconds renders a duration as fractional seconds for shell consumers
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// runHook runs a user hook through the shell and waits for it to finish.
+// Its output goes to stderr so it never counts as activity of the child.
+func runHook(name, command string, env []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, shellCommand[0], append(shellCommand[1:], command)...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		con.Logf("%s hook failed: %v", name, err)
+	}
+}
+
+// warnThreshold is a flag.Value for --warn-at: a percentage of the idle
+// timeout ("80%") or an absolute duration ("4m")
+type warnThreshold struct {
+	percent float64
+	after   time.Duration
+}
+
+func (w *warnThreshold) String() string {
+	if w.percent > 0 {
+		return strconv.FormatFloat(w.percent, 'g', -1, 64) + "%"
+	}
+	if w.after > 0 {
+		return w.after.String()
+	}
+	return ""
+}
+
+func (w *warnThreshold) Set(s string) error {
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		v, err := strconv.ParseFloat(pct, 64)
+		if err != nil || v <= 0 || v >= 100 {
+			return fmt.Errorf("percentage must be between 0 and 100 exclusive")
+		}
+		*w = warnThreshold{percent: v}
+		return nil
+	}
+	d, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("must be positive")
+	}
+	*w = warnThreshold{after: d}
+	return nil
+}
+
+// resolve returns the idle duration at which to warn, or 0 if disabled
+func (w warnThreshold) resolve(timeout time.Duration) time.Duration {
+	if w.percent > 0 {
+		return time.Duration(float64(timeout) * w.percent / 100)
+	}
+	return w.after
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// input forwards the wrapper's stdin to the running attempt. It is the only
+// reader of stdin, which is switched to non-blocking mode so the runtime
+// poller can interrupt reads: the copier stops with its attempt instead of
+// staying blocked in Read, and it can be paused to hand the terminal over.
+type input struct {
+	f   *os.File
+	tty bool // stdin is a terminal, where end of input is a ^D in cooked mode
+
+	mu      sync.Mutex
+	copying chan struct{} // closed when the current copy returns; nil if none
+	paused  bool
+	parked  chan struct{} // the copier acknowledges a pause
+	resumed chan struct{}
+}
+
+// openInput takes over stdin; restore puts it back in blocking mode
+func openInput() (in *input, restore func()) {
+	if err := syscall.SetNonblock(syscall.Stdin, true); err != nil {
+		return &input{f: os.Stdin, tty: isTerminal(uintptr(syscall.Stdin)), parked: make(chan struct{}), resumed: make(chan struct{}, 1)}, func() {}
+	}
+	in = &input{
+		f:       os.NewFile(uintptr(syscall.Stdin), "/dev/stdin"),
+		tty:     isTerminal(uintptr(syscall.Stdin)),
+		parked:  make(chan struct{}),
+		resumed: make(chan struct{}, 1),
+	}
+	return in, func() { syscall.SetNonblock(syscall.Stdin, false) }
+}
+
+// copy forwards input to r until ctx is done or stdin is exhausted, which
+// the command sees as the end of its input too. A terminal's end of input
+// is passed on and reading goes on, as it only ends the line.
+func (in *input) copy(ctx context.Context, r *watchdog.Runner) {
+	done := make(chan struct{})
+	in.mu.Lock()
+	in.copying = done
+	in.mu.Unlock()
+	defer close(done)
+
+	stop := context.AfterFunc(ctx, func() { in.f.SetReadDeadline(time.Now()) })
+	defer stop()
+	defer in.f.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := in.f.Read(buf)
+		if n > 0 {
+			r.Write(buf[:n])
+		}
+		if err == io.EOF {
+			r.CloseInput()
+			if in.tty {
+				continue
+			}
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if ctx.Err() != nil {
+				return
+			}
+			in.mu.Lock()
+			paused := in.paused
+			in.mu.Unlock()
+			if paused {
+				in.parked <- struct{}{}
+				select {
+				case <-in.resumed:
+				case <-ctx.Done():
+					return
+				}
+			}
+			in.f.SetReadDeadline(time.Time{})
+			continue
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pause stops the copier from reading stdin until resume is called. If
+// stdin can't be interrupted the pause is best effort.
+func (in *input) pause() (resume func()) {
+	in.mu.Lock()
+	done := in.copying
+	in.paused = true
+	in.mu.Unlock()
+
+	unpause := func() {
+		in.mu.Lock()
+		in.paused = false
+		in.mu.Unlock()
+	}
+	if done == nil || in.f.SetReadDeadline(time.Now()) != nil {
+		return unpause
+	}
+	select {
+	case <-in.parked:
+		return func() {
+			unpause()
+			in.resumed <- struct{}{}
+		}
+	case <-done:
+		return unpause
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tag prefixes every wrapper message; see invocation.tag
+var tag = "[idle-timeout]"
+
+// invocation identifies one wrapper run and the attempt currently in flight
+type invocation struct {
+	id      string // stable per-invocation ID, from --id-from-env or the wrapper PID
+	session string // random, so unique across hosts and reboots where PIDs aren't
+	seq     int    // 1-based attempt number
+}
+
+// newInvocation derives the invocation ID from the named environment variable,
+// falling back to the wrapper PID when the variable is unset or empty, and
+// generates the session ID
+func newInvocation(envVar string) invocation {
+	inv := invocation{id: strconv.Itoa(os.Getpid()), session: randomHex(8), seq: 1}
+	if envVar != "" {
+		if v := os.Getenv(envVar); v != "" {
+			inv.id = v
+		}
+	}
+	return inv
+}
+
+// tag is the prefix of wrapper messages, which gains the invocation ID when
+// one is taken from the environment, and the session ID when messages don't
+// go to a terminal, so lines of interleaved parallel jobs in a log can be
+// told apart
+func (inv invocation) tag(withID, terminal bool) string {
+	t := "[idle-timeout"
+	if withID {
+		t += " " + inv.id
+	}
+	if !terminal {
+		t += " " + inv.session
+	}
+	return t + "]"
+}
+
+// expand substitutes {id}, {session} and {seq} in a naming template
+func (inv invocation) expand(tmpl string) string {
+	r := strings.NewReplacer("{id}", inv.id, "{session}", inv.session, "{seq}", strconv.Itoa(inv.seq))
+	return r.Replace(tmpl)
+}
+
+// env returns the variables exported to the child describing this attempt
+func (inv invocation) env() []string {
+	return []string{
+		"IDLE_TIMEOUT_ID=" + inv.id,
+		"IDLE_TIMEOUT_SESSION=" + inv.session,
+		"IDLE_TIMEOUT_SEQ=" + strconv.Itoa(inv.seq),
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// ioprioWhoProcess makes ioprio_set apply to one process
+const ioprioWhoProcess = 1
+
+// checkIONice reports whether --ionice can work here
+func checkIONice() error {
+	return nil
+}
+
+// setIOPrio sets the I/O priority of this process, and so of the command
+func setIOPrio(prio int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNoIONice = errors.New("I/O priorities are only supported on Linux")
+
+// checkIONice fails: I/O priorities exist only on Linux
+func checkIONice() error {
+	return errNoIONice
+}
+
+func setIOPrio(prio int) error {
+	return errNoIONice
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// remotePIDMarker starts the line the shell in the pod writes to stderr
+// with its PID before it execs the command, so the command can be killed
+// in the pod and not only the local kubectl
+const remotePIDMarker = "idle-timeout-remote-pid="
+
+// remoteShim runs the command in the pod as the shell that reported its
+// PID, which exec keeps
+const remoteShim = `echo "` + remotePIDMarker + `$$" >&2; exec "$@"`
+
+// remoteKillWait is how long the kill in the pod may take
+const remoteKillWait = 10 * time.Second
+
+// pidCatcher passes stderr on, except for the remotePIDMarker line at its
+// start, which gives the command's PID in the pod
+type pidCatcher struct {
+	w    io.Writer
+	mu   sync.Mutex
+	head []byte // stderr so far while the marker may still come
+	done bool
+	pid  int
+}
+
+func (c *pidCatcher) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return c.w.Write(p)
+	}
+	c.head = append(c.head, p...)
+	nl := bytes.IndexByte(c.head, '\n')
+	if nl < 0 && len(c.head) < len(remotePIDMarker)+20 {
+		return len(p), nil
+	}
+	c.done = true
+	rest := c.head
+	if line, ok := bytes.CutPrefix(c.head[:max(nl, 0)], []byte(remotePIDMarker)); ok && nl >= 0 {
+		c.pid, _ = strconv.Atoi(string(bytes.TrimSpace(line)))
+		rest = c.head[nl+1:]
+	}
+	c.head = nil
+	if len(rest) > 0 {
+		if _, err := c.w.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *pidCatcher) remotePID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pid
+}
+
+// kubeMain runs a command in a Kubernetes pod through kubectl exec and
+// watches its output for inactivity. Killing kubectl alone would leave the
+// command running in the pod, so a timeout kills it there first.
+func kubeMain(args []string) int {
+	fset := flag.NewFlagSet("kube", flag.ExitOnError)
+	kubectl := fset.String("kubectl", "kubectl", "the kubectl `command` to use")
+	namespace := fset.String("namespace", "", "the pod's `namespace` (default: the context's)")
+	container := fset.String("container", "", "run in this `container` of the pod (default: kubectl's choice)")
+	kubeContext := fset.String("context", "", "the kubeconfig `context` to use")
+	var warnAt warnThreshold
+	fset.Var(&warnAt, "warn-at", "warn once per idle episode after this much inactivity, as a `percentage` of the timeout (80%) or a duration")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout kube [options] <duration> <pod> [--] <command> [args...]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout kube 5m --namespace prod deploy/web -- ./manage.py migrate\n")
+		fmt.Fprintf(os.Stderr, "\nThe command runs under sh in the pod, which kill must be found in as well.\n")
+		fmt.Fprintf(os.Stderr, "The exit status is 124 after a timeout, else kubectl's, which is the command's.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	var positional []string
+	for fset.NArg() > 0 && len(positional) < 2 {
+		positional = append(positional, fset.Arg(0))
+		fset.Parse(fset.Args()[1:])
+	}
+	command := fset.Args()
+	if len(positional) != 2 || len(command) == 0 {
+		fset.Usage()
+		return 1
+	}
+	timeout, err := parseDuration(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", positional[0], err)
+		return 1
+	}
+	if timeout < watchdog.Resolution {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: below the watchdog's %v resolution\n", positional[0], watchdog.Resolution)
+		return 1
+	}
+	pod := positional[1]
+
+	// kubectl exec [options] <pod> -- <command>, for the command and for
+	// the kill
+	execArgs := func(command ...string) []string {
+		a := []string{"exec"}
+		if *kubeContext != "" {
+			a = append(a, "--context", *kubeContext)
+		}
+		if *namespace != "" {
+			a = append(a, "--namespace", *namespace)
+		}
+		if *container != "" {
+			a = append(a, "--container", *container)
+		}
+		return append(append(a, pod, "--"), command...)
+	}
+	stderr := &pidCatcher{w: con.stderr()}
+	// signalRemote sends sig to the command in the pod and its process
+	// group, if it leads one
+	signalRemote := func(sig string) error {
+		pid := stderr.remotePID()
+		if pid == 0 {
+			return fmt.Errorf("the command's PID in the pod is unknown")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), remoteKillWait)
+		defer cancel()
+		script := fmt.Sprintf("kill -%s -%d 2>/dev/null || kill -%s %d", sig, pid, sig, pid)
+		out, err := exec.CommandContext(ctx, *kubectl, execArgs("sh", "-c", script)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+
+	inv := newInvocation("")
+	runner := watchdog.New(watchdog.Config{
+		Path:    *kubectl,
+		Args:    execArgs(append([]string{"sh", "-c", remoteShim, "sh"}, command...)...),
+		Env:     append(os.Environ(), inv.env()...),
+		Timeout: timeout,
+		WarnAt:  warnAt.resolve(timeout),
+		Stdout:  con,
+		Stderr:  stderr,
+		OnEvent: func(e watchdog.Event) {
+			switch e.Kind {
+			case watchdog.Warned:
+				con.Logf("No output for %v, killing in %v...", idleFor(e.Idle), timeLeft(e.Timeout-e.Idle))
+			case watchdog.TimedOut:
+				con.Logf("No output for %v, killing process in %s...", e.Timeout, pod)
+				if err := signalRemote("KILL"); err != nil {
+					con.Logf("Failed to kill the command in %s (%v); it may still be running there", pod, err)
+				}
+			}
+		},
+	})
+	con.Printf("spawn %s: %s\n", pod, strings.Join(command, " "))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, forwardedSignals...)
+	defer signal.Stop(sigChan)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigChan:
+				name := strings.TrimPrefix(signalName(sig), "SIG")
+				if err := signalRemote(name); err != nil {
+					con.Logf("Failed to pass on %s to %s: %v", signalName(sig), pod, err)
+				}
+			}
+		}
+	}()
+
+	res := runner.Run(ctx)
+	if res.Err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run %s: %v\n", *kubectl, res.Err)
+		return 1
+	}
+	return res.ExitCode
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rlimits are the kernel resource limits set for the command by the
+// --limit-* options, by resource name
+type rlimits map[string]uint64
+
+// limitFlag is a flag.Value for one of them
+type limitFlag struct {
+	limits rlimits
+	name   string
+	parse  func(string) (uint64, error)
+}
+
+func (f limitFlag) String() string {
+	if v, ok := f.limits[f.name]; ok {
+		return strconv.FormatUint(v, 10)
+	}
+	return ""
+}
+
+func (f limitFlag) Set(s string) error {
+	v, err := f.parse(s)
+	if err != nil {
+		return err
+	}
+	f.limits[f.name] = v
+	return nil
+}
+
+// parseCPUTime parses --limit-cpu, a duration rounded up to whole seconds
+// as the kernel counts them
+func parseCPUTime(s string) (uint64, error) {
+	d, err := parseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("expected a duration such as 10m")
+	}
+	return uint64((d + time.Second - 1) / time.Second), nil
+}
+
+// parseLimitSize parses a byte size for --limit-fsize, --limit-as and
+// --limit-core, where 0 is allowed: it turns core dumps off
+func parseLimitSize(s string) (uint64, error) {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("expected a byte count such as 500M")
+	}
+	return uint64(n), nil
+}
+
+func parseLimitCount(s string) (uint64, error) {
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("expected a positive count")
+	}
+	return n, nil
+}
+
+// String encodes the limits as settings for limit-exec, e.g.
+// "cpu=60,nofile=256"
+func (l rlimits) String() string {
+	var parts []string
+	for name, v := range l {
+		parts = append(parts, name+"="+strconv.FormatUint(v, 10))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// ioClasses are the I/O scheduling classes --ionice accepts, by name
+var ioClasses = map[string]int{"realtime": 1, "best-effort": 2, "idle": 3}
+
+// parseIONice parses --ionice class[:level] into the kernel's I/O
+// priority: the class by name or number, and a level from 0 (highest) to
+// 7, 4 by default, which the idle class has none of
+func parseIONice(s string) (int, error) {
+	name, level, hasLevel := strings.Cut(s, ":")
+	class, ok := ioClasses[name]
+	if !ok {
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 1 || n > 3 {
+			return 0, fmt.Errorf("unknown class %q: expected realtime, best-effort or idle", name)
+		}
+		class = n
+	}
+	prio := 4
+	if hasLevel {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 || class == ioClasses["idle"] {
+			return 0, fmt.Errorf("invalid level %q: expected 0 to 7, and none for the idle class", level)
+		}
+		prio = n
+	}
+	if class == ioClasses["idle"] {
+		prio = 0
+	}
+	return class<<13 | prio, nil
+}
+
+// childSetup encodes what limit-exec sets up for the command: the
+// --limit-* limits, the --nice niceness, the --ionice I/O priority and the
+// sandbox, or "" if there is nothing to set
+func (cfg config) childSetup() string {
+	var parts []string
+	if len(cfg.limits) > 0 {
+		parts = append(parts, cfg.limits.String())
+	}
+	if cfg.nice != 0 {
+		parts = append(parts, "nice="+strconv.Itoa(cfg.nice))
+	}
+	if cfg.ioPrio != 0 {
+		parts = append(parts, "ionice="+strconv.Itoa(cfg.ioPrio))
+	}
+	parts = append(parts, cfg.sandbox.settings()...)
+	return strings.Join(parts, ",")
+}
+
+// limitedCommand returns the command line that runs path with args after
+// the setup: a copy of this binary running limit-exec, which sets it up
+// and then execs the command in its place, so it applies from the
+// command's first instruction. The command is looked up in PATH here, as
+// it would be otherwise, in case -clear-env leaves the child without one.
+func limitedCommand(setup string, path string, args []string) (string, []string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+	if filepath.Base(path) == path {
+		if path, err = exec.LookPath(path); err != nil {
+			return "", nil, err
+		}
+	}
+	return self, append([]string{"limit-exec", setup, "--", path}, args...), nil
+}
+
+// limitExecMain is the child side of the --limit-*, --nice, --ionice and
+// sandboxing options: it applies the settings given as its first argument
+// and execs the command after "--"
+func limitExecMain(args []string) int {
+	if len(args) < 3 || args[1] != "--" {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout limit-exec <settings> -- <command> [args...]\n")
+		return 1
+	}
+	// The niceness, no_new_privs and the seccomp filter are the thread's,
+	// and only the thread that execs passes them on
+	runtime.LockOSThread()
+	var box sandbox
+	for _, setting := range strings.Split(args[0], ",") {
+		name, value, _ := strings.Cut(setting, "=")
+		if ok, err := box.set(name, value); ok {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set %s: %v\n", setting, err)
+				return 1
+			}
+			continue
+		}
+		var err error
+		switch name {
+		case "nice":
+			var n int
+			if n, err = strconv.Atoi(value); err == nil {
+				err = setNice(n)
+			}
+		case "ionice":
+			var prio int
+			if prio, err = strconv.Atoi(value); err == nil {
+				err = setIOPrio(prio)
+			}
+		default:
+			var v uint64
+			if _, known := rlimitResources[name]; !known {
+				err = fmt.Errorf("unknown setting")
+			} else if v, err = strconv.ParseUint(value, 10, 64); err == nil {
+				err = setLimit(name, v)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to set %s: %v\n", setting, err)
+			return 1
+		}
+	}
+	if box.enabled() {
+		if err := box.apply(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to confine command: %v\n", err)
+			return 1
+		}
+	}
+	err := execCommand(args[2], args[2:])
+	fmt.Fprintf(os.Stderr, "Failed to run command: %v\n", err)
+	return 127
+}
@@ -0,0 +1,14 @@
+//go:build unix && !openbsd
+
+package main
+
+import "syscall"
+
+// rlimitResources are the resources the --limit-* options cap
+var rlimitResources = map[string]int{
+	"cpu":    syscall.RLIMIT_CPU,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"as":     syscall.RLIMIT_AS,
+	"core":   syscall.RLIMIT_CORE,
+}
@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// rlimitResources are the resources the --limit-* options cap. OpenBSD has
+// no address space limit, so --limit-as is unsupported there.
+var rlimitResources = map[string]int{
+	"cpu":    syscall.RLIMIT_CPU,
+	"fsize":  syscall.RLIMIT_FSIZE,
+	"nofile": syscall.RLIMIT_NOFILE,
+	"core":   syscall.RLIMIT_CORE,
+}
@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// checkLimits reports whether the --limit-* options can work here
+func checkLimits() error {
+	return nil
+}
+
+// setLimit lowers the soft and hard limit of a resource to v, or as near
+// as an unprivileged process may: a hard limit can't be raised
+func setLimit(name string, v uint64) error {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(rlimitResources[name], &lim); err != nil {
+		return err
+	}
+	lim.Max = lowered(lim.Max, v)
+	lim.Cur = lim.Max
+	return syscall.Setrlimit(rlimitResources[name], &lim)
+}
+
+// lowered is limit, or v if that is lower; Rlimit has uint64 fields on
+// most systems and int64 ones on others, such as FreeBSD
+func lowered[T int64 | uint64](limit T, v uint64) T {
+	if uint64(limit) > v {
+		return T(v)
+	}
+	return limit
+}
+
+// setNice sets the niceness of this process, and so of the command
+func setNice(n int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, n)
+}
+
+// execCommand replaces this process with the command
+func execCommand(path string, argv []string) error {
+	return syscall.Exec(path, argv, os.Environ())
+}
@@ -0,0 +1,25 @@
+package main
+
+import "errors"
+
+var errNoLimits = errors.New("resource limits and priorities are not supported on Windows")
+
+// rlimitResources are the resources the --limit-* options cap: none here
+var rlimitResources = map[string]int{}
+
+// checkLimits reports whether the --limit-* options can work here
+func checkLimits() error {
+	return errNoLimits
+}
+
+func setLimit(name string, v uint64) error {
+	return errNoLimits
+}
+
+func setNice(n int) error {
+	return errNoLimits
+}
+
+func execCommand(path string, argv []string) error {
+	return errNoLimits
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLogKeep is how many rotated log files --log-rotate keeps unless
+// keep= says otherwise
+const defaultLogKeep = 5
+
+// logRotation is when --log-rotate starts a new log file, and how many of
+// the old ones it keeps
+type logRotation struct {
+	size int64         // rotate once the file reaches this many bytes; 0 for no limit
+	age  time.Duration // rotate once the file has been written for this long; 0 for no limit
+	keep int           // old files kept, <path>.1 being the newest
+}
+
+// parseLogRotation parses --log-rotate, comma-separated settings: a size
+// such as 100M, age=<duration> and keep=<count>
+func parseLogRotation(s string) (*logRotation, error) {
+	rot := &logRotation{keep: defaultLogKeep}
+	for _, part := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			key, value = "size", key
+		}
+		switch key {
+		case "size":
+			n, err := parseByteSize(value)
+			if err != nil || n == 0 {
+				return nil, fmt.Errorf("invalid size %q: expected a byte count such as 100M", value)
+			}
+			rot.size = n
+		case "age":
+			d, err := parseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid age %q: expected a duration such as 1d", value)
+			}
+			rot.age = d
+		case "keep":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid count %q: expected the number of old files to keep", value)
+			}
+			rot.keep = n
+		default:
+			return nil, fmt.Errorf("unknown setting %q: expected a size, age=<duration> or keep=<count>", key)
+		}
+	}
+	if rot.size == 0 && rot.age == 0 {
+		return nil, fmt.Errorf("expected a size, age=<duration> or both to rotate at")
+	}
+	return rot, nil
+}
+
+// rotatingLog is a log file that moves itself aside to <path>.1 once it is
+// too big or too old, shifting the older ones up to <path>.<keep> and
+// dropping the oldest. A line under way when rotation is due is finished
+// in the old file, so lines aren't split between files unless the output
+// comes without line endings.
+type rotatingLog struct {
+	mu      sync.Mutex
+	path    string
+	rot     logRotation
+	f       *os.File // nil once reopening failed
+	size    int64
+	opened  time.Time
+	midLine bool // the last write didn't end a line
+}
+
+// newRotatingLog rotates f, opened at path, which it may be appending to
+func newRotatingLog(f *os.File, path string, rot logRotation) *rotatingLog {
+	l := &rotatingLog{path: path, rot: rot, f: f, opened: time.Now()}
+	if st, err := f.Stat(); err == nil {
+		l.size = st.Size()
+	}
+	return l
+}
+
+func (l *rotatingLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	done := 0
+	for len(p) > 0 {
+		chunk := p
+		nl := bytes.IndexByte(p, '\n')
+		if l.due() {
+			if l.midLine && nl >= 0 {
+				chunk = p[:nl+1] // finish the line under way first
+			} else {
+				l.rotate()
+			}
+		} else if room := l.rot.size - l.size; l.rot.size > 0 && int64(len(p)) > room {
+			// Fill the file up to the last line end that fits, or else
+			// finish the line
+			if end := bytes.LastIndexByte(p[:room], '\n'); end >= 0 {
+				chunk = p[:end+1]
+			} else if nl >= 0 {
+				chunk = p[:nl+1]
+			}
+		}
+		n, err := l.write(chunk)
+		done += n
+		if err != nil {
+			return done, err
+		}
+		p = p[len(chunk):]
+	}
+	return done, nil
+}
+
+// due reports whether the file should be rotated before more is written
+func (l *rotatingLog) due() bool {
+	if l.f == nil || l.size == 0 {
+		return false
+	}
+	return l.rot.size > 0 && l.size >= l.rot.size || l.rot.age > 0 && time.Since(l.opened) >= l.rot.age
+}
+
+func (l *rotatingLog) write(p []byte) (int, error) {
+	if l.f == nil || len(p) == 0 {
+		return len(p), nil
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	l.midLine = p[len(p)-1] != '\n'
+	return n, err
+}
+
+// rotate moves the file aside and starts a new one; failures are reported,
+// and only failing to open the new file stops the logging
+func (l *rotatingLog) rotate() {
+	if err := l.f.Close(); err != nil {
+		con.Logf("Failed to write log file: %v", err)
+	}
+	for i := l.rot.keep; i > 0; i-- {
+		from := l.path
+		if i > 1 {
+			from = l.path + "." + strconv.Itoa(i-1)
+		}
+		if err := os.Rename(from, l.path+"."+strconv.Itoa(i)); err != nil && !os.IsNotExist(err) {
+			con.Logf("Failed to rotate log file: %v", err)
+		}
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		con.Logf("Failed to rotate log file, logging stopped: %v", err)
+		l.f = nil
+		return
+	}
+	l.f, l.size, l.opened, l.midLine = f, 0, time.Now(), false
+}
+
+func (l *rotatingLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Message priorities, as in syslog(3)
+const (
+	prioErr     = 3
+	prioWarning = 4
+	prioNotice  = 5
+	prioInfo    = 6
+)
+
+// journalSocket is where journald accepts native-protocol datagrams
+const journalSocket = "/run/systemd/journal/socket"
+
+// logTarget receives lifecycle events for --log-target in place of stderr.
+// fields are KEY=value pairs in journald's naming.
+type logTarget interface {
+	send(priority int, msg string, fields []string) error
+}
+
+func openLogTarget(name string) (logTarget, error) {
+	switch name {
+	case "journald":
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		return journal{conn}, nil
+	case "syslog":
+		return openSyslog()
+	}
+	return nil, fmt.Errorf("unknown log target %q (want journald or syslog)", name)
+}
+
+// journal speaks journald's native protocol, so every field is queryable,
+// e.g. journalctl SYSLOG_IDENTIFIER=idle-timeout IDLE_TIMEOUT_EVENT=timed_out
+type journal struct {
+	conn *net.UnixConn
+}
+
+func (j journal) send(priority int, msg string, fields []string) error {
+	var b bytes.Buffer
+	field := func(k, v string) {
+		if !strings.Contains(v, "\n") {
+			b.WriteString(k + "=" + v + "\n")
+			return
+		}
+		// Multi-line values are length-prefixed
+		b.WriteString(k + "\n")
+		binary.Write(&b, binary.LittleEndian, uint64(len(v)))
+		b.WriteString(v + "\n")
+	}
+	field("MESSAGE", msg)
+	field("PRIORITY", strconv.Itoa(priority))
+	field("SYSLOG_IDENTIFIER", "idle-timeout")
+	for _, kv := range fields {
+		k, v, _ := strings.Cut(kv, "=")
+		field(k, v)
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
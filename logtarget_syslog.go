@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/syslog"
+	"strconv"
+	"strings"
+)
+
+func openSyslog() (logTarget, error) {
+	w, err := syslog.New(syslog.LOG_USER|syslog.LOG_NOTICE, "idle-timeout")
+	if err != nil {
+		return nil, err
+	}
+	return syslogTarget{w}, nil
+}
+
+// syslogTarget appends the fields to the message as key=value pairs
+type syslogTarget struct {
+	w *syslog.Writer
+}
+
+func (s syslogTarget) send(priority int, msg string, fields []string) error {
+	for _, kv := range fields {
+		k, v, _ := strings.Cut(kv, "=")
+		if strings.ContainsAny(v, " \"\n") {
+			v = strconv.Quote(v)
+		}
+		msg += " " + k + "=" + v
+	}
+	switch priority {
+	case prioErr:
+		return s.w.Err(msg)
+	case prioWarning:
+		return s.w.Warning(msg)
+	case prioNotice:
+		return s.w.Notice(msg)
+	}
+	return s.w.Info(msg)
+}
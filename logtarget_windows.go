@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func openSyslog() (logTarget, error) {
+	return nil, errors.New("syslog is not available on Windows")
+}
@@ -1,169 +1,1347 @@
 // idle-timeout - Kill a process if no stdout/stderr output for a specified duration
 //
-// Usage: idle-timeout <duration> <command> [args...]
+// Usage: idle-timeout [run] [options] <duration> [options] [--] <command> [args...]
+//        idle-timeout attach|grep|replay|exec-json|perf-check|prompt-status|version ...
 // Example: idle-timeout 30s curl -s https://example.com
 //          idle-timeout 300 crush run "my prompt"
+//          idle-timeout --retries 3 5m ./flaky-download.sh
+//          idle-timeout run 5m --log-file build.log -- make -j8
+//          idle-timeout --id-from-env PARALLEL_SEQ --log-file 'job-{id}.{seq}.log' 5m ./job.sh
 //
 // Exit codes:
-//   - 124: Process killed due to inactivity timeout
+//   - 123: Process killed for going over -max-rss, -max-output or -max-lines
+//   - 124: Process killed due to inactivity timeout (after the last retry)
+//   - 125: -strict found a requested option unavailable
 //   - Otherwise: Exit code of the wrapped command
 
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"math"
 	"os"
-	"os/exec"
-	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
 )
 
-// parseDuration parses a duration string, defaulting to seconds if no unit
+// maxDuration is the longest duration representable, about 292 years
+const maxDuration = time.Duration(math.MaxInt64)
+
+// dayComponent matches a leading day or week count, which Go durations lack
+var dayComponent = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([dw])`)
+
+// isoDuration matches an ISO 8601 duration of weeks, days, hours, minutes
+// and seconds, such as PT1H30M or P1DT12H
+var isoDuration = regexp.MustCompile(`^P(?:([0-9.,]+)W)?(?:([0-9.,]+)D)?(?:T(?:([0-9.,]+)H)?(?:([0-9.,]+)M)?(?:([0-9.,]+)S)?)?$`)
+
+// parseDuration parses a duration string, defaulting to seconds if no unit.
+// Besides Go's units (ns, us, ms, s, m, h) it accepts days and weeks as
+// leading components, e.g. 1w2d or 1.5d12h, and ISO 8601 durations.
 func parseDuration(s string) (time.Duration, error) {
 	if secs, err := strconv.ParseFloat(s, 64); err == nil {
-		return time.Duration(secs * float64(time.Second)), nil
+		return fromSeconds(secs, 0)
+	}
+	if strings.HasPrefix(s, "P") || strings.HasPrefix(s, "p") {
+		return parseISODuration(strings.ToUpper(s))
 	}
-	return time.ParseDuration(s)
+
+	days, rest := 0.0, s
+	for {
+		m := dayComponent.FindStringSubmatch(rest)
+		if m == nil {
+			break
+		}
+		n, _ := strconv.ParseFloat(m[1], 64)
+		if m[2] == "w" {
+			n *= 7
+		}
+		days += n
+		rest = rest[len(m[0]):]
+	}
+	var d time.Duration
+	if rest != "" || rest == s {
+		var err error
+		if d, err = time.ParseDuration(rest); err != nil {
+			return 0, err
+		}
+	}
+	return fromSeconds(days*24*60*60, d)
 }
 
-func main() {
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Usage: idle-timeout <duration> <command> [args...]\n")
-		fmt.Fprintf(os.Stderr, "Example: idle-timeout 30s mycommand arg1 arg2\n")
-		os.Exit(1)
+// parseISODuration parses an ISO 8601 duration such as PT1H30M. Years and
+// months are refused, as their length varies.
+func parseISODuration(s string) (time.Duration, error) {
+	m := isoDuration.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		if date, _, _ := strings.Cut(s, "T"); strings.ContainsAny(date, "YM") {
+			return 0, errors.New("years and months have no fixed length, use weeks or days")
+		}
+		return 0, errors.New("expected an ISO 8601 duration such as PT1H30M or P1DT12H")
 	}
+	units := []float64{7 * 24 * 60 * 60, 24 * 60 * 60, 60 * 60, 60, 1}
+	secs := 0.0
+	for i, v := range m[1:] {
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.Replace(v, ",", ".", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number %q", v)
+		}
+		secs += n * units[i]
+	}
+	return fromSeconds(secs, 0)
+}
+
+// fromSeconds adds secs to d, rejecting negative and unrepresentable results
+func fromSeconds(secs float64, d time.Duration) (time.Duration, error) {
+	switch {
+	case math.IsNaN(secs) || secs < 0 || d < 0:
+		return 0, errors.New("negative or not a number")
+	case secs >= (maxDuration - d).Seconds():
+		return 0, errors.New("too long, the maximum is about 292 years")
+	}
+	return d + time.Duration(secs*float64(time.Second)), nil
+}
 
-	timeout, err := parseDuration(os.Args[1])
+// durationFlag is a flag.Value accepting the same syntax as the timeout argument
+type durationFlag time.Duration
+
+func (d *durationFlag) String() string { return time.Duration(*d).String() }
+
+func (d *durationFlag) Set(s string) error {
+	v, err := parseDuration(s)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", os.Args[1], err)
-		fmt.Fprintf(os.Stderr, "Examples: 30, 30s, 1m, 2m30s\n")
-		os.Exit(1)
+		return err
 	}
+	*d = durationFlag(v)
+	return nil
+}
 
-	cmdName := os.Args[2]
-	cmdArgs := os.Args[3:]
+// sizeFlag is a terminal size given as COLSxROWS
+type sizeFlag struct{ cols, rows int }
 
-	exitCode := run(cmdName, cmdArgs, timeout)
-	os.Exit(exitCode)
+func (s *sizeFlag) String() string {
+	if s.cols == 0 && s.rows == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", s.cols, s.rows)
 }
 
-func run(cmdName string, cmdArgs []string, timeout time.Duration) int {
-	// Print spawn line like expect does
-	fmt.Printf("spawn %s", cmdName)
-	for _, arg := range cmdArgs {
-		fmt.Printf(" %s", arg)
+func (s *sizeFlag) Set(v string) error {
+	c, r, ok := strings.Cut(strings.ToLower(v), "x")
+	cols, cerr := strconv.Atoi(c)
+	rows, rerr := strconv.Atoi(r)
+	if !ok || cerr != nil || rerr != nil || cols <= 0 || rows <= 0 {
+		return errors.New("expected COLSxROWS, e.g. 80x24")
 	}
-	fmt.Println()
+	s.cols, s.rows = cols, rows
+	return nil
+}
 
-	// Build the command string for script
-	cmdStr := cmdName
-	for _, arg := range cmdArgs {
-		// Quote arguments that contain spaces
-		if strings.ContainsAny(arg, " \t\n'\"") {
-			cmdStr += " " + "'" + strings.ReplaceAll(arg, "'", "'\\''") + "'"
-		} else {
-			cmdStr += " " + arg
+// envList is a flag.Value for --env, given once per variable as K=V, or
+// as K to pass on the wrapper's own value
+type envList []string
+
+func (e *envList) String() string { return strings.Join(*e, " ") }
+
+func (e *envList) Set(s string) error {
+	key, _, ok := strings.Cut(s, "=")
+	if key == "" || strings.ContainsRune(key, 0) {
+		return errors.New("expected NAME=value or NAME, e.g. CI=1")
+	}
+	if !ok {
+		v, found := os.LookupEnv(key)
+		if !found {
+			return nil // like env(1) with a variable that isn't set
 		}
+		s = key + "=" + v
 	}
+	*e = append(*e, s)
+	return nil
+}
 
-	// Use 'script' command for perfect TTY emulation
-	// -q = quiet, -c = command, /dev/null = don't save typescript
-	cmd := exec.Command("script", "-q", "-c", cmdStr, "/dev/null")
-	cmd.Env = os.Environ()
+// subcommand is an entry point along with what help and completion know
+// about it
+type subcommand struct {
+	name    string
+	main    func(args []string) int
+	summary string               // empty for aliases, which help doesn't list
+	flags   func() *flag.FlagSet // its options for completion, if they are worth completing
+}
 
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to create stdout pipe: %v\n", err)
-		return 1
-	}
+// subcommands in the order help lists them, set by init because
+// completion refers back to the list
+var subcommands []subcommand
 
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+func init() {
+	subcommands = []subcommand{
+		{"run", runMain, "run a command under the watchdog (the default)", runFlagSet("run")},
+		{"auto", autoMain, "run with the timeout configured for the command", runFlagSet("auto")},
+		{"attach", peekMain, "watch a process that is already running", nil},
+		{"peek", peekMain, "", nil}, // the original name of attach
+		{"coordinator", coordinatorMain, "stagger the retries of wrappers on this host, with a shared circuit breaker", nil},
+		{"grep", grepMain, "search recordings and logs with the idle gaps around matches", nil},
+		{"exec-json", execJSONMain, "run a command described by a JSON request on stdin", nil},
+		{"watch-file", watchFileMain, "act when a log file stops changing", nil},
+		{"pair", pairMain, "run a producer piped into a consumer, killing both when the flow stalls", nil},
+		{"pipe", pipeMain, "run a pipeline, killing every stage when it stalls", nil},
+		{"multi", multiMain, "run several commands at once, each under its own idle timeout", nil},
+		{"batch", batchMain, "run the commands in a file one after another, each under its own idle timeout", nil},
+		{"docker", dockerMain, "run a command in a container, killing it inside the container when idle", nil},
+		{"kube", kubeMain, "run a command in a Kubernetes pod, killing it inside the pod when idle", nil},
+		{"ssh", sshMain, "run a command on another host over ssh, killing it on the host when idle", nil},
+		{"replay", replayMain, "play back a -record typescript or -cast recording", nil},
+		{"control", controlMain, "extend, change, pause, watch or force the idle timeout of a run with -control-socket or -control-listen", nil},
+		{"ring", ringMain, "show the state and last output kept in a -ring-file", nil},
+		{"systemd-unit", systemdUnitMain, "print a systemd service unit that runs a command under the wrapper", nil},
+		{"calibrate", calibrateMain, "run a command several times without a timeout and recommend one from its output gaps", nil},
+		{"perf-check", perfCheckMain, "measure the watchdog's overhead against a bare pipe on this machine", nil},
+		{"perf-emit", perfEmitMain, "", nil},   // the child side of perf-check
+		{"limit-exec", limitExecMain, "", nil}, // the child side of --limit-*
+		{"history", historyMain, "list the invocations recorded with --history", nil},
+		{"prompt-status", promptStatusMain, "print the last run's outcome for a shell prompt", nil},
+		{"completion", completionMain, "print a bash, zsh or fish completion script", nil},
+		{"version", versionMain, "print the version", nil},
+	}
+}
 
-	if err := cmd.Start(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to start command: %v\n", err)
-		return 1
+// findSubcommand looks up a subcommand by name
+func findSubcommand(name string) (subcommand, bool) {
+	for _, sub := range subcommands {
+		if sub.name == name {
+			return sub, true
+		}
 	}
+	return subcommand{}, false
+}
 
-	// Handle interrupt signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigChan
-		if cmd.Process != nil {
-			cmd.Process.Signal(sig.(syscall.Signal))
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: idle-timeout [run] [options] <duration> [options] [--] <command> [args...]\n")
+	fmt.Fprintf(os.Stderr, "       idle-timeout <subcommand> [options] ...\n")
+	fmt.Fprintf(os.Stderr, "\nSubcommands:\n")
+	for _, sub := range subcommands {
+		if sub.summary != "" {
+			fmt.Fprintf(os.Stderr, "  %-14s %s\n", sub.name, sub.summary)
 		}
-	}()
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'idle-timeout <subcommand> -h' for its options.\n")
+}
 
-	// Activity tracker
-	var mu sync.Mutex
-	lastActivity := time.Now()
+func runUsage(fset *flag.FlagSet, auto bool) {
+	if auto {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout auto [options] [--] <command> [args...]\n")
+		fmt.Fprintf(os.Stderr, "The timeout is the command's entry in the [timeouts] table of the config file.\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout auto terraform apply\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Usage: idle-timeout [run] [options] <duration> [options] [--] <command> [args...]\n")
+	fmt.Fprintf(os.Stderr, "       idle-timeout [run] -timeout <duration> [options] [--] <command> [args...]\n")
+	fmt.Fprintf(os.Stderr, "       idle-timeout [run] [options] <duration> [options] -c <command line> [args...]\n")
+	fmt.Fprintf(os.Stderr, "Example: idle-timeout 30s mycommand arg1 arg2\n")
+	fmt.Fprintf(os.Stderr, "         idle-timeout run -retries 3 5m -- make -j8\n")
+	fmt.Fprintf(os.Stderr, "\nOptions:\n")
+	fset.PrintDefaults()
+}
 
-	resetTimer := func() {
-		mu.Lock()
-		lastActivity = time.Now()
-		mu.Unlock()
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	switch os.Args[1] {
+	case "help", "-h", "-help", "--help":
+		usage()
+		os.Exit(0)
+	}
+	// Without a subcommand the arguments are for run, as they always were
+	if sub, ok := findSubcommand(os.Args[1]); ok {
+		os.Exit(sub.main(os.Args[2:]))
 	}
+	os.Exit(runMain(os.Args[1:]))
+}
 
-	// Timeout checker
-	done := make(chan struct{})
-	timedOut := false
+// runMain runs a command under the watchdog, retrying as configured
+func runMain(args []string) int {
+	return runCommand("run", args)
+}
 
-	go func() {
-		ticker := time.NewTicker(100 * time.Millisecond)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-done:
-				return
-			case <-ticker.C:
-				mu.Lock()
-				elapsed := time.Since(lastActivity)
-				mu.Unlock()
+// autoMain is run with the timeout taken from the config file's [timeouts]
+// entry for the command
+func autoMain(args []string) int {
+	return runCommand("auto", args)
+}
 
-				if elapsed >= timeout {
-					timedOut = true
-					fmt.Fprintf(os.Stderr, "\n[idle-timeout] No output for %v, killing process...\n", timeout)
-					if cmd.Process != nil {
-						cmd.Process.Kill()
-					}
-					return
-				}
+// runOptions holds the options of run and auto
+type runOptions struct {
+	retries       *int
+	retryBackoff  durationFlag
+	retryOn       retryPolicy
+	resultFile    *string
+	history       *bool
+	idFromEnv     *string
+	logFile       *string
+	logRotate     *string
+	castFile      *string
+	record        *string
+	recordTiming  *string
+	snapFile      *string
+	snapEvery     durationFlag
+	ringFile      *string
+	ringSize      *int
+	minSize       sizeFlag
+	ptySize       sizeFlag
+	noRaw         *bool
+	noEcho        *bool
+	user          *string
+	group         *string
+	chdir         *string
+	env           envList
+	clearEnv      *bool
+	limits        rlimits
+	nice          *int
+	ionice        *string
+	landlockRO    pathList
+	landlockRW    pathList
+	seccomp       *string
+	noNewPrivs    *bool
+	tailLines     *int
+	tailFile      *string
+	gapReport     *bool
+	rusage        *bool
+	cpuActivity   *bool
+	ioActivity    *bool
+	netActivity   *bool
+	require       *string
+	maxRSS        *string
+	maxOutput     *string
+	minRate       *string
+	maxLines      *int64
+	killOnRepeat  *int
+	dedupe        *bool
+	dedupeQuiet   *bool
+	binary        *bool
+	actThreshold  *string
+	onTimeout     *string
+	dryRun        *bool
+	nudges        *int
+	expectScript  *string
+	stdinFile     *string
+	stdinDelay    durationFlag
+	respond       respondRules
+	onPattern     patternRules
+	warnAt        warnThreshold
+	firstOutput   durationFlag
+	watchStream   *string
+	resetBytes    *int
+	onWarn        *string
+	notifyChild   *string
+	takeoverMenu  *bool
+	takeoverWait  durationFlag
+	debugger      *string
+	webhookURL    *string
+	metricsAddr   *string
+	controlSocket *string
+	controlListen *string
+	controlCert   *string
+	controlKey    *string
+	controlCA     *string
+	mirrorSocket  *string
+	ctlSignals    *bool
+	noForward     signalList
+	dumpSignal    *string
+	killSignal    *string
+	killGrace     durationFlag
+	quiet         *bool
+	pauseOn       *string
+	dumpWait      durationFlag
+	checkInterval durationFlag
+	lineBuffer    *bool
+	flushInterval durationFlag
+	statusLine    *bool
+	title         *bool
+	heartbeat     durationFlag
+	ci            *string
+	logTargetName *string
+	sdNotify      *bool
+	useCgroup     *bool
+	subreaper     *bool
+	trackSubjobs  *string
+	foreground    *bool
+	drain         durationFlag
+	linger        *bool
+	coordinate    *bool
+	flock         *string
+	flockWait     durationFlag
+	flockReplace  *bool
+	coordSocket   *string
+	usePolicy     *bool
+	strict        *bool
+	force         *bool
+	plain         *bool
+	color         *string
+	msgFormat     *string
+	notify        *bool
+	dbus          *bool
+	shellLine     *string
+	timeoutArg    *string
+	configFile    *string
+	profile       *string
+}
+
+// newRunFlags defines the options of run and auto. Completion reads them
+// from here too, so every option of run is defined in this function.
+func newRunFlags(name string) (*flag.FlagSet, *runOptions) {
+	fset := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &runOptions{}
+	o.retries = fset.Int("retries", 0, "re-spawn the command up to `N` times after a retryable failure (see -retry-on-exit)")
+	o.retryBackoff = durationFlag(time.Second)
+	fset.Var(&o.retryBackoff, "retry-backoff", "initial `delay` before a retry, doubled after each attempt")
+	o.retryOn = retryPolicy{{timeout: true}}
+	fset.Var(&o.retryOn, "retry-on-exit", "`outcomes` that are retried: exit codes and/or \"timeout\", each with an optional \":delay\" backoff override")
+	o.resultFile = fset.String("result-file", "", "write a JSON summary including every attempt to `path`; {id} is expanded")
+	o.history = fset.Bool("history", false, "record the invocation, its outcome and idle stats in the local history that the history subcommand lists")
+	o.idFromEnv = fset.String("id-from-env", "", "take the invocation ID from environment variable `VAR` (default: wrapper PID)")
+	o.logFile = fset.String("log-file", "", "also write the command's output to `path`; {id} and {seq} are expanded")
+	o.logRotate = fset.String("log-rotate", "", "rotate the -log-file to <path>.1, <path>.2 ... once it reaches a size or age, keeping 5 old files: `settings` such as 100M,keep=5 or age=1d")
+	o.castFile = fset.String("cast", "", "record the session with timing as an asciinema v2 file at `path`; {id} and {seq} are expanded")
+	o.record = fset.String("record", "", "record the session as a script(1) typescript at `path` for scriptreplay; {id} and {seq} are expanded")
+	o.recordTiming = fset.String("record-timing", "", "write the -record timing data to `path` (default: the typescript's path with .tm appended)")
+	o.snapFile = fset.String("snapshot-file", "idle-timeout-{id}.screens", "append -snapshot-every screens to `path`; {id} and {seq} are expanded")
+	fset.Var(&o.snapEvery, "snapshot-every", "render the command's terminal and append a text snapshot of the screen at most once per `duration` while it changes, and on timeout")
+	o.ringFile = fset.String("ring-file", "", "keep the last output and the wrapper's state in a memory-mapped file at `path` that survives the wrapper being killed; read it with 'idle-timeout ring'. {id} is expanded")
+	o.ringSize = fset.Int("ring-size", 64, "size of the -ring-file output ring in `KiB`")
+	fset.Var(&o.ptySize, "pty-size", "give the command's terminal exactly this `size` (e.g. 200x50) whatever the wrapper's terminal is, for output formatted to the width that doesn't change between machines")
+	o.noRaw = fset.Bool("no-raw", false, "leave the terminal in cooked mode, with its line editing and ^C, ^Z handled by it, instead of passing every keystroke to the command")
+	o.noEcho = fset.Bool("no-echo", false, "turn off the echo of the command's terminal, so input isn't shown twice with -no-raw (commands such as shells may turn it back on)")
+	o.user = fset.String("user", "", "run the command as `user` (a name or ID) with the user's groups, HOME, USER and LOGNAME, for a wrapper running as root that stays in control of the kill (not on Windows)")
+	o.group = fset.String("group", "", "run the command with `group` (a name or ID) as its group, instead of the -user's or the wrapper's")
+	o.chdir = fset.String("chdir", "", "run the command in `directory` instead of the current one")
+	fset.Var(&o.env, "env", "set `NAME=value` in the command's environment, or pass on NAME with -clear-env (repeatable)")
+	o.clearEnv = fset.Bool("clear-env", false, "start the command with an empty environment, but for -env variables and the IDLE_TIMEOUT_* ones")
+	o.limits = rlimits{}
+	fset.Var(limitFlag{o.limits, "cpu", parseCPUTime}, "limit-cpu", "let the command and each process it starts use at most this `duration` of CPU time, after which the kernel kills it (not on Windows)")
+	fset.Var(limitFlag{o.limits, "fsize", parseLimitSize}, "limit-fsize", "keep the command from writing files larger than `size`, e.g. 1G (not on Windows)")
+	fset.Var(limitFlag{o.limits, "nofile", parseLimitCount}, "limit-nofile", "let each of the command's processes have at most `N` files open (not on Windows)")
+	fset.Var(limitFlag{o.limits, "as", parseLimitSize}, "limit-as", "limit the virtual memory of each of the command's processes to `size`, e.g. 4G (not on Windows)")
+	fset.Var(limitFlag{o.limits, "core", parseLimitSize}, "limit-core", "limit the core dumps of the command to `size`; 0 turns them off (not on Windows)")
+	o.nice = fset.Int("nice", 0, "run the command at niceness `N`, from 19 (lowest priority) to -20 (highest, for root only), so a heavy background job doesn't starve interactive work (not on Windows)")
+	o.ionice = fset.String("ionice", "", "on Linux, run the command in the I/O scheduling `class[:level]`: idle, best-effort or realtime (root only), with a level from 0 (highest) to 7")
+	fset.Var(&o.landlockRO, "landlock-ro", "on Linux, let the command read and run only the files beneath `path`, and write none (repeatable; Landlock, Linux 5.13)")
+	fset.Var(&o.landlockRW, "landlock-rw", "with -landlock-ro, let the command also write beneath `path` (repeatable)")
+	o.seccomp = fset.String("seccomp-profile", "", "on Linux, refuse the command the system calls of seccomp `profile` default: mounting, module loading, ptrace and the like")
+	o.noNewPrivs = fset.Bool("no-new-privs", false, "on Linux, keep setuid programs and file capabilities from giving the command more privileges")
+	fset.Var(&o.minSize, "min-size", "give the command's terminal at least this `size` (e.g. 80x24), for CI runners that report tiny or zero sizes")
+	o.tailLines = fset.Int("tail-on-timeout", 0, "when the timeout fires, show the last `N` lines of output with the message, cleaned of escape sequences")
+	o.tailFile = fset.String("tail-file", "", "save the -tail-on-timeout lines to `path` instead of showing them; {id} and {seq} are expanded")
+	o.rusage = fset.Bool("rusage", false, "on exit, report the command's wall and CPU time, peak memory and page faults (these are in -result-file anyway)")
+	o.gapReport = fset.Bool("gap-report", false, "on exit, summarize the silences between bursts of output (percentiles, a histogram against the timeout, near misses) to help choose a timeout")
+	o.cpuActivity = fset.Bool("cpu-activity", false, "on Linux, count CPU use by the command and its descendants as activity, so a busy but quiet command isn't killed")
+	o.ioActivity = fset.Bool("io-activity", false, "on Linux, count disk reads and writes by the command and its descendants as activity, so a quiet backup isn't killed")
+	o.netActivity = fset.Bool("net-activity", false, "on Linux, count TCP traffic of the command and its descendants as activity, so a silent download isn't killed")
+	o.maxRSS = fset.String("max-rss", "", "on Linux, kill the command if its processes together use more than `size` of resident memory, e.g. 2G, exiting with 123")
+	o.minRate = fset.String("min-rate", "", "time the command out once its output falls below `rate` over a sliding window, e.g. 100K/s@30s for output that slows to a trickle (default window: the timeout)")
+	o.maxOutput = fset.String("max-output", "", "kill the command once it has written more than `size` of output, e.g. 500M, exiting with 123; the output is cut off there")
+	o.maxLines = fset.Int64("max-lines", 0, "kill the command once it has written more than this `number` of lines, exiting with 123")
+	o.dedupe = fset.Bool("dedupe", false, "collapse runs of identical lines in the forwarded output into the first one and '<line> (xN)' (-log-file keeps them all)")
+	o.dedupeQuiet = fset.Bool("dedupe-quiet", false, "with -dedupe, don't count the repeated lines as activity either")
+	o.binary = fset.Bool("binary", false, "the command's output is binary (a tarball, a protobuf dump): pass its bytes on untouched, keep wrapper output off stdout, leave out the options that work on lines, and count output as activity past -activity-threshold, "+defaultBinaryThreshold+" by default")
+	o.actThreshold = fset.String("activity-threshold", "", "count output as activity only once it reaches `size[/interval]` in an interval (default 1s), e.g. 4K/10s, so the odd stray byte doesn't keep a stuck command alive")
+	o.killOnRepeat = fset.Int("kill-on-repeat", 0, "treat the command as hung once it prints the same line `N` times in a row, e.g. a client retrying forever, and kill it as at the idle timeout")
+	o.require = fset.String("require", "", "only kill at the idle timeout if `condition` holds, e.g. 'idle && cpu<5%' (Linux); otherwise the idle clock starts over")
+	o.dryRun = fset.Bool("dry-run", false, "never kill the command, only log when the timeout or a limit would have killed it, to trial them on real jobs")
+	o.onTimeout = fset.String("on-timeout", "", "run shell `command` right before an idle child is killed; 'stop' instead freezes it with SIGSTOP until it is resumed or killed, and 'send:<input>' types input such as '\\r' or '\\x03' into its terminal")
+	o.expectScript = fset.String("expect-script", "", "play the expect/send steps in `file` against the command's terminal; an expect that runs out of its time kills it as at the idle timeout")
+	o.stdinFile = fset.String("stdin-file", "", "type the lines of `file` into the command's terminal, each after -stdin-delay, before passing on what you type")
+	o.stdinDelay = durationFlag(defaultStdinDelay)
+	fset.Var(&o.stdinDelay, "stdin-delay", "the `pause` before each line of -stdin-file, so the command has time to take it in")
+	fset.Var(&o.respond, "respond", "answer a prompt: when output matches the regexp before the = in `pattern=reply`, type the reply and Enter into the command's terminal (repeatable)")
+	fset.Var(&o.onPattern, "on-pattern", "change the idle budget when a line of output matches: '`pattern:extend=10m`' allows one longer silence after it, 'pattern:timeout=2m' sets the timeout from then on (repeatable)")
+	o.nudges = fset.Int("nudges", 1, "with -on-timeout send:..., how many `times` in a row to send the input before killing")
+	o.watchStream = fset.String("watch", "both", "with -foreground, the `stream` whose output counts as activity: stdout, stderr or both; the other is forwarded all the same")
+	fset.Var(&o.firstOutput, "first-output", "the command must produce its first output within this `duration`, e.g. 10s to catch a hang on connect; the idle timeout applies from then on")
+	fset.Var(&o.warnAt, "warn-at", "warn once per idle episode after this much inactivity, as a `percentage` of the timeout (80%) or a duration")
+	o.resetBytes = fset.Int("reset-bytes", 0, "output of `N` bytes buys the full timeout; smaller chunks extend the deadline proportionally (default: any output resets it)")
+	o.onWarn = fset.String("on-warn", "", "run shell `command` when the -warn-at threshold is crossed")
+	o.notifyChild = fset.String("notify-child", "", "type `input` into the command's terminal when the -warn-at threshold is crossed, such as a message or the keys that make a full-screen tool save its state; {idle} and {left} are expanded to seconds, and Go escapes such as \\r or \\x1b work")
+	o.takeoverMenu = fset.Bool("takeover", false, "in an attended terminal, offer a kill/extend/shell/debugger menu at the -warn-at threshold")
+	o.takeoverWait = durationFlag(10 * time.Second)
+	fset.Var(&o.takeoverWait, "takeover-wait", "how long the -takeover menu waits for a `key` before the timeout proceeds")
+	o.debugger = fset.String("debugger", "", "debugger `command` offered by -takeover; {pid} is the child's PID (e.g. 'gdb -p {pid}')")
+	o.webhookURL = fset.String("webhook-url", "", "POST a JSON payload to `url` on start, timeout, and exit")
+	o.controlSocket = fset.String("control-socket", "", "accept 'extend <duration>', 'set-timeout <duration>', 'pause', 'resume' and 'status' on a unix socket at `path` (see 'idle-timeout control'); {id} is expanded")
+	o.controlListen = fset.String("control-listen", "", "accept the -control-socket commands over TLS on `addr` (e.g. :7070), as the gRPC service of control.proto or the line protocol, from clients with a certificate signed by -control-tls-ca")
+	o.controlCert = fset.String("control-tls-cert", "", "the certificate `file` -control-listen presents")
+	o.controlKey = fset.String("control-tls-key", "", "the private key `file` of -control-tls-cert")
+	o.controlCA = fset.String("control-tls-ca", "", "the CA `file` that client certificates of -control-listen must be signed by")
+	o.mirrorSocket = fset.String("mirror-socket", "", "stream a copy of the command's output to every client connected to a unix socket at `path`, read-only; {id} is expanded")
+	o.metricsAddr = fset.String("metrics-addr", "", "serve Prometheus metrics on `addr` (e.g. :9464) at /metrics")
+	o.logTargetName = fset.String("log-target", "", "send lifecycle events (spawn, warning, kill, exit) with structured fields to `target` (journald or syslog) instead of stderr")
+	o.sdNotify = fset.Bool("sd-notify", false, "run as a Type=notify systemd service: report ready once supervising, ping the unit's WatchdogSec watchdog, and show the attempt in systemctl status")
+	o.useCgroup = fset.Bool("cgroup", false, "on Linux, run each attempt in a fresh cgroup v2 and kill all of it on timeout, so no descendant survives (falls back to the process group)")
+	o.subreaper = fset.Bool("subreaper", false, "on Linux, adopt orphaned descendants and supervise until all of them exit; a timeout kills them all")
+	o.trackSubjobs = fset.String("track-subjobs", "", "count sub-job markers matching `regex` in the output and report progress on timeout; named groups start, done and total refine the count")
+	o.foreground = fset.Bool("foreground", false, "run the command on pipes instead of a pseudo-terminal and leave the controlling terminal alone, for commands that must talk to the real TTY (ssh or sudo prompts); a timeout then kills only the command, not processes it started")
+	fset.Var(&o.drain, "drain", "after the command exits, keep copying its output for at most this `duration` (default 1s), for descendants still flushing; the exit status stays the command's")
+	o.linger = fset.Bool("linger", false, "after the command exits, keep supervising descendants still holding its output until the last of them closes it, under the idle timeout")
+	o.coordinate = fset.Bool("coordinate", false, "stagger retries and share a circuit breaker with other wrappers through a running 'idle-timeout coordinator'")
+	o.coordSocket = fset.String("coordinate-socket", defaultCoordSocket(), "unix socket `path` of the coordinator")
+	o.flock = fset.String("flock", "", "run only while holding the lock on file `path`, so one run of the job at a time: another that holds it fails this one with exit status 122")
+	fset.Var(&o.flockWait, "flock-wait", "with -flock, wait up to this `duration` for the lock instead of failing at once")
+	o.flockReplace = fset.Bool("flock-replace", false, "with -flock, stop the run holding the lock with SIGTERM, or SIGKILL after -flock-wait (default 10s), and take over")
+	o.usePolicy = fset.Bool("policy", false, "take defaults for options set nowhere else from the site policy of the coordinator at -coordinate-socket")
+	o.strict = fset.Bool("strict", false, "fail with exit status 125 if a requested option can't work here (e.g. -cgroup off Linux) instead of continuing without it")
+	o.force = fset.Bool("force", false, "accept a timeout shorter than the -check-interval")
+	o.checkInterval = durationFlag(watchdog.Resolution)
+	fset.Var(&o.checkInterval, "check-interval", "how often to sample what gives no notice of changes, such as -subreaper descendants, and the shortest timeout accepted without -force: longer saves wakeups on long jobs, shorter suits sub-second timeouts")
+	o.ctlSignals = fset.Bool("control-signals", true, "adjust the idle budget with SIGUSR1 and SIGUSR2 (see -control-socket); with -control-signals=false they are forwarded to the command instead")
+	fset.Var(&o.noForward, "no-forward", "comma-separated `signals` not to forward to the command, e.g. HUP,QUIT; by default INT, TERM, HUP, QUIT, ALRM, CONT, USR1, USR2 and TSTP (which suspends the wrapper too) reach its process group")
+	o.pauseOn = fset.String("pause-on", "", "pause the idle clock when the wrapper gets `signal` (e.g. USR1), and resume it the next time, for silences that are expected, such as while a debugger holds the command")
+	o.dumpSignal = fset.String("dump-signal", "", "at the idle timeout, send `signal` (e.g. QUIT) to the command's process group and wait -dump-wait before the kill, so Go, Java or Python runtimes leave a stack dump in the output")
+	o.dumpWait = durationFlag(5 * time.Second)
+	fset.Var(&o.dumpWait, "dump-wait", "how long to wait for the -dump-signal stack dump before the kill")
+	o.killSignal = fset.String("signal", "KILL", "kill the command's process group with `signal` (e.g. TERM), then with SIGKILL after -grace if it is still running")
+	o.killGrace = durationFlag(10 * time.Second)
+	fset.Var(&o.killGrace, "grace", "how long a command killed with -signal has to exit before SIGKILL")
+	o.statusLine = fset.Bool("status-line", false, "show a footer with the idle time against the budget (idle 42s / 5m0s) under the command's output, updated live")
+	o.title = fset.Bool("title", false, "show the command and how much of its idle budget is left in the terminal's title, restoring the title at exit")
+	fset.Var(&o.heartbeat, "heartbeat", "while the command is silent, print a line such as '[idle-timeout] Still running, idle 3m0s' into its output every `duration`, for CI systems that kill jobs whose logs go quiet")
+	o.ci = fset.String("ci", "", "report to the CI `system` running the job: 'github' turns warnings and kills into workflow annotations and adds idle gap stats to the step summary")
+	o.lineBuffer = fset.Bool("line-buffer", false, "when output isn't a terminal, write the command's output a line at a time instead of as it arrives (partial lines after -flush-interval, or 1s)")
+	fset.Var(&o.flushInterval, "flush-interval", "when output isn't a terminal, collect the command's output and write it at most this `duration` late, in fewer, larger writes")
+	o.color = fset.String("color", "auto", "color wrapper messages by severity: `when` (auto: if they go to a terminal and NO_COLOR is unset, always, never)")
+	o.msgFormat = fset.String("message-format", "", "`template` of wrapper messages, expanding {tag}, {level}, {time}, {id}, {session} and {message} (default \"{tag} {message}\")")
+	o.quiet = fset.Bool("quiet", false, "print only the wrapper's warnings and errors, such as the kill, not the spawn line and other notices")
+	o.plain = fset.Bool("plain", os.Getenv("TERM") == "dumb", "keep wrapper messages free of colors, cursor movement and other control sequences, for screen readers and dumb terminals (child output is untouched)")
+	o.notify = fset.Bool("notify", false, "show a desktop notification with the exit status and runtime when done")
+	o.dbus = fset.Bool("dbus", false, "emit Started, Warned, Killed and Finished signals on the D-Bus session bus (interface "+dbusInterface+")")
+	o.shellLine = fset.String("c", "", "run the shell `command line` through $SHELL instead of a command with arguments (e.g. -c 'make | tee log'); further arguments become $1, $2, ...")
+	o.timeoutArg = fset.String("timeout", "", "idle `duration`, instead of giving it before the command")
+	o.configFile = fset.String("config", configPath(), "read defaults and profiles from the TOML file at `path`")
+	o.profile = fset.String("profile", "", "apply the named `profile` from the config file")
+	return fset, o
+}
+
+// runFlagSet returns a function that defines the options of run or auto
+func runFlagSet(name string) func() *flag.FlagSet {
+	return func() *flag.FlagSet {
+		fset, _ := newRunFlags(name)
+		return fset
+	}
+}
+
+// runCommand is run and auto, which differ in where the timeout comes from
+func runCommand(name string, args []string) int {
+	auto := name == "auto"
+	fset, o := newRunFlags(name)
+	fset.Usage = func() { runUsage(fset, auto) }
+
+	// The timeout comes first unless given by -timeout or the config file;
+	// more options may follow it, and "--" ends the options before the
+	// command. Options on the command line win over the environment, which
+	// wins over the config file.
+	fset.Parse(args)
+	args = fset.Args()
+	set := map[string]bool{}
+	durationArg := ""
+	if *o.timeoutArg == "" && len(args) > 0 && !auto {
+		if _, err := parseDuration(args[0]); err == nil {
+			durationArg = args[0]
+			set["timeout"] = true
+			fset.Parse(args[1:])
+			args = fset.Args()
+		}
+	}
+	fset.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := applyEnv(fset, set); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid environment: %v\n", err)
+		return 1
+	}
+	explicitTimeout := set["timeout"]
+	fileCfg, err := loadConfig(*o.configFile, set["config"])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read config: %v\n", err)
+		return 1
+	}
+	if err := fileCfg.apply(fset, *o.profile, set); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		return 1
+	}
+	if auto && !explicitTimeout && len(args) > 0 && *o.shellLine == "" {
+		durationArg, _ = fileCfg.commandTimeout(args[0])
+	}
+	if *o.usePolicy {
+		name := ""
+		if len(args) > 0 && *o.shellLine == "" {
+			name = commandName(args[0])
+		}
+		client := &coordClient{socket: *o.coordSocket}
+		if options, err := client.policy(name); err != nil {
+			con.Logf("Coordinator unreachable (%v), continuing without the site policy", err)
+		} else if err := applyPolicy(fset, options, set); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid site policy: %v\n", err)
+			return 1
+		}
+	}
+	con.plain = *o.plain
+	con.binary = *o.binary
+	con.quiet = *o.quiet
+	if err := con.setColor(*o.color); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid color mode %v\n", err)
+		return 1
+	}
+	if *o.msgFormat != "" {
+		if err := con.setFormat(*o.msgFormat); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid message format: %v\n", err)
+			return 1
+		}
+	}
+	if durationArg == "" {
+		durationArg = *o.timeoutArg
+	}
+	if durationArg == "" && len(args) > 0 {
+		if auto {
+			fmt.Fprintf(os.Stderr, "No timeout for %s: add it to [timeouts] in %s or give -timeout\n", args[0], fileCfg.path)
+			return 1
+		}
+		// Not a duration after all; rejected below
+		durationArg, args = args[0], args[1:]
+	}
+	if durationArg == "" || len(args) == 0 && *o.shellLine == "" {
+		fset.Usage()
+		return 1
+	}
+	command := args
+	if *o.shellLine != "" {
+		command = shellArgv(*o.shellLine, args)
+	}
+
+	timeout, err := parseDuration(durationArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", durationArg, err)
+		fmt.Fprintf(os.Stderr, "Examples: 30, 30s, 1m, 2m30s, 1.5d, 2w\n")
+		return 1
+	}
+	check := time.Duration(o.checkInterval)
+	if check <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid check interval %v: must be positive\n", check)
+		return 1
+	}
+	if timeout <= 0 || timeout < check && !*o.force {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: below the %v check interval (use --check-interval to lower it, or --force to run anyway)\n", durationArg, check)
+		return 1
+	}
+	if first := time.Duration(o.firstOutput); first < 0 || first > 0 && first < check && !*o.force {
+		fmt.Fprintf(os.Stderr, "Invalid first output deadline %v: below the %v check interval (use --check-interval to lower it, or --force to run anyway)\n", first, check)
+		return 1
+	}
+	if beat := time.Duration(o.heartbeat); beat < 0 || beat > 0 && beat < watchdog.Resolution {
+		fmt.Fprintf(os.Stderr, "Invalid heartbeat interval %v: must be at least %v\n", beat, watchdog.Resolution)
+		return 1
+	}
+	if *o.retries < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid retry count %d: must not be negative\n", *o.retries)
+		return 1
+	}
+
+	cmdName := command[0]
+	cmdArgs := command[1:]
+
+	inv := newInvocation(*o.idFromEnv)
+	tag = inv.tag(*o.idFromEnv != "", con.msgTTY)
+	con.format = strings.NewReplacer("{id}", inv.id, "{session}", inv.session).Replace(con.format)
+	cfg := config{
+		timeout:    timeout,
+		warnAt:     o.warnAt.resolve(timeout),
+		first:      time.Duration(o.firstOutput),
+		check:      check,
+		heartbeat:  time.Duration(o.heartbeat),
+		resetBytes: *o.resetBytes,
+		cgroup:     *o.useCgroup,
+		subreaper:  *o.subreaper,
+		foreground: *o.foreground,
+		drain:      time.Duration(o.drain),
+		linger:     *o.linger,
+		logFile:    *o.logFile,
+		castFile:   *o.castFile,
+		record:     *o.record,
+		recordTime: *o.recordTiming,
+		snapFile:   *o.snapFile,
+		snapEvery:  time.Duration(o.snapEvery),
+		minSize:    o.minSize,
+		fixedSize:  o.ptySize,
+		dir:        *o.chdir,
+		env:        o.env,
+		clearEnv:   *o.clearEnv,
+		limits:     o.limits,
+		nice:       *o.nice,
+		noEcho:     *o.noEcho,
+		tailLines:  *o.tailLines,
+		tailFile:   *o.tailFile,
+		gapReport:  *o.gapReport,
+		history:    *o.history,
+		rusage:     *o.rusage,
+		cpuActive:  *o.cpuActivity,
+		ioActive:   *o.ioActivity,
+		netActive:  *o.netActivity,
+		maxLines:   *o.maxLines,
+		repeats:    *o.killOnRepeat,
+		dedupe:     *o.dedupe,
+		dedupeIdle: *o.dedupe && *o.dedupeQuiet,
+		binary:     *o.binary,
+		onTimeout:  *o.onTimeout,
+		dryRun:     *o.dryRun,
+		nudges:     *o.nudges,
+		respond:    o.respond,
+		onPattern:  o.onPattern,
+		onWarn:     *o.onWarn,
+		statusLine: *o.statusLine,
+		title:      *o.title,
+		command:    command,
+	}
+	if cfg.dir != "" {
+		if st, err := os.Stat(cfg.dir); err != nil || !st.IsDir() {
+			fmt.Fprintf(os.Stderr, "Invalid directory %q: not a directory\n", cfg.dir)
+			return 1
+		}
+	}
+	if *o.nice < -20 || *o.nice > 19 {
+		fmt.Fprintf(os.Stderr, "Invalid niceness %d: expected -20 to 19\n", *o.nice)
+		return 1
+	}
+	if *o.ionice != "" {
+		if cfg.ioPrio, err = parseIONice(*o.ionice); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid I/O priority %q: %v\n", *o.ionice, err)
+			return 1
+		}
+	}
+	cfg.sandbox = sandbox{readOnly: o.landlockRO, readWrite: o.landlockRW, seccomp: *o.seccomp, noNewPrivs: *o.noNewPrivs}
+	if len(o.landlockRW) > 0 && len(o.landlockRO) == 0 {
+		fmt.Fprintf(os.Stderr, "Invalid options: -landlock-rw needs -landlock-ro\n")
+		return 1
+	}
+	if *o.seccomp != "" && !slices.Contains(seccompProfiles, *o.seccomp) {
+		fmt.Fprintf(os.Stderr, "Invalid seccomp profile %q: expected %s\n", *o.seccomp, strings.Join(seccompProfiles, " or "))
+		return 1
+	}
+	if cfg.sandbox.enabled() {
+		// Unlike other options, a sandbox is never left out
+		if err := checkSandbox(cfg.sandbox); err != nil {
+			fmt.Fprintf(os.Stderr, "Unavailable: %v\n", err)
+			return exitUnavailable
+		}
+	}
+	if *o.user != "" || *o.group != "" {
+		if err := watchdog.CheckCredential(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to switch user: %v\n", err)
+			return 1
+		}
+		if cfg.account, err = lookupAccount(*o.user, *o.group); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to switch user: %v\n", err)
+			return 1
+		}
+	}
+	if *o.trackSubjobs != "" {
+		if cfg.subjobs, err = regexp.Compile(*o.trackSubjobs); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid pattern %q: %v\n", *o.trackSubjobs, err)
+			return 1
+		}
+	}
+	if *o.maxRSS != "" {
+		if cfg.maxRSS, err = parseByteSize(*o.maxRSS); err != nil || cfg.maxRSS == 0 {
+			fmt.Fprintf(os.Stderr, "Invalid size %q: expected a byte count such as 500M\n", *o.maxRSS)
+			return 1
+		}
+	}
+	if *o.maxOutput != "" {
+		if cfg.maxOutput, err = parseByteSize(*o.maxOutput); err != nil || cfg.maxOutput == 0 {
+			fmt.Fprintf(os.Stderr, "Invalid size %q: expected a byte count such as 500M\n", *o.maxOutput)
+			return 1
+		}
+	}
+	if *o.logRotate != "" {
+		if *o.logFile == "" {
+			fmt.Fprintf(os.Stderr, "-log-rotate needs a -log-file to rotate\n")
+			return 1
+		}
+		if cfg.logRotate, err = parseLogRotation(*o.logRotate); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid log rotation %q: %v\n", *o.logRotate, err)
+			return 1
+		}
+	}
+	if *o.minRate != "" {
+		if cfg.minRate, cfg.rateWindow, err = parseMinRate(*o.minRate); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid minimum rate %q: %v\n", *o.minRate, err)
+			return 1
+		}
+		if cfg.rateWindow == 0 {
+			cfg.rateWindow = timeout
+		}
+	}
+	if *o.maxLines < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid line count %d: must not be negative\n", *o.maxLines)
+		return 1
+	}
+	if cfg.onTimeout == "stop" {
+		cfg.onTimeout, cfg.freeze = "", true
+	}
+	if text, ok := strings.CutPrefix(cfg.onTimeout, "send:"); ok {
+		if cfg.send, err = parseSend(text); err != nil || len(cfg.send) == 0 {
+			fmt.Fprintf(os.Stderr, "Invalid input %q: expected text with Go escapes such as \\r or \\x03\n", text)
+			return 1
+		}
+		if *o.foreground {
+			fmt.Fprintf(os.Stderr, "-on-timeout send: needs the command on a pseudo-terminal, which -foreground skips\n")
+			return 1
+		}
+		cfg.onTimeout = ""
+	}
+	if *o.linger && o.drain > 0 {
+		fmt.Fprintf(os.Stderr, "-drain bounds the output after the command exits, which -linger waits out under the idle timeout; use one or the other\n")
+		return 1
+	}
+	if *o.notifyChild != "" {
+		if cfg.notifyChild, err = parseSend(*o.notifyChild); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid input %q: expected text with Go escapes such as \\r or \\x1b\n", *o.notifyChild)
+			return 1
+		}
+		if *o.foreground {
+			fmt.Fprintf(os.Stderr, "-notify-child needs the command on a pseudo-terminal, which -foreground skips\n")
+			return 1
+		}
+		if cfg.warnAt == 0 {
+			fmt.Fprintf(os.Stderr, "-notify-child needs a -warn-at threshold to type its input at\n")
+			return 1
+		}
+	}
+	if *o.expectScript != "" {
+		if *o.foreground {
+			fmt.Fprintf(os.Stderr, "-expect-script needs the command on a pseudo-terminal, which -foreground skips\n")
+			return 1
+		}
+		if cfg.expect, err = parseExpectScript(*o.expectScript); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid expect script %s: %v\n", *o.expectScript, err)
+			return 1
+		}
+	}
+	if len(o.respond) > 0 && *o.foreground {
+		fmt.Fprintf(os.Stderr, "-respond needs the command on a pseudo-terminal, which -foreground skips\n")
+		return 1
+	}
+	if *o.stdinFile != "" {
+		if *o.foreground {
+			fmt.Fprintf(os.Stderr, "-stdin-file needs the command on a pseudo-terminal, which -foreground skips\n")
+			return 1
+		}
+		if o.stdinDelay < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid stdin delay %v: must not be negative\n", time.Duration(o.stdinDelay))
+			return 1
+		}
+		if cfg.typeFirst, err = readStdinScript(*o.stdinFile, time.Duration(o.stdinDelay)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read stdin file: %v\n", err)
+			return 1
+		}
+	}
+	if *o.nudges < 1 {
+		fmt.Fprintf(os.Stderr, "Invalid nudge count %d: must be at least 1\n", *o.nudges)
+		return 1
+	}
+	if threshold := *o.actThreshold; threshold != "" || *o.binary {
+		if threshold == "" {
+			threshold = defaultBinaryThreshold
+		}
+		if cfg.threshold, err = parseActivityThreshold(threshold); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid activity threshold %q: %v\n", threshold, err)
+			return 1
+		}
+	}
+	if *o.killOnRepeat < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid line count %d: must not be negative\n", *o.killOnRepeat)
+		return 1
+	}
+	if *o.require != "" {
+		if cfg.require, err = parseRequirement(*o.require); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid condition %q: %v\n", *o.require, err)
+			return 1
+		}
+	}
+	if *o.resetBytes < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid byte count %d: must not be negative\n", *o.resetBytes)
+		return 1
+	}
+	if *o.tailLines < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid line count %d: must not be negative\n", *o.tailLines)
+		return 1
+	}
+	switch *o.watchStream {
+	case "both":
+	case "stdout", "stderr":
+		if !*o.foreground {
+			fmt.Fprintf(os.Stderr, "-watch %s needs the command on pipes, which takes -foreground: on a pseudo-terminal its stdout and stderr are one\n", *o.watchStream)
+			return 1
+		}
+		cfg.watch = *o.watchStream
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid stream %q: expected stdout, stderr or both\n", *o.watchStream)
+		return 1
+	}
+	if *o.takeoverMenu && *o.foreground {
+		fmt.Fprintf(os.Stderr, "-takeover needs the command on a pseudo-terminal, which -foreground skips\n")
+		return 1
+	}
+	if *o.takeoverMenu && cfg.warnAt == 0 {
+		fmt.Fprintf(os.Stderr, "-takeover needs a -warn-at threshold\n")
+		return 1
+	}
+	if *o.flock != "" {
+		// Taken before any socket or file of the job is, which the run
+		// holding the lock has
+		if time.Duration(o.flockWait) < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid lock wait %v: must not be negative\n", time.Duration(o.flockWait))
+			return 1
+		}
+		lock, err := acquireLock(*o.flock, time.Duration(o.flockWait), *o.flockReplace)
+		if errors.Is(err, errLockHeld) {
+			fmt.Fprintf(os.Stderr, "Lock %s is %v\n", *o.flock, err)
+			return exitLocked
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to take lock: %v\n", err)
+			return 1
+		}
+		defer lock.Close()
+	} else if *o.flockReplace || o.flockWait != 0 {
+		fmt.Fprintf(os.Stderr, "Invalid options: -flock-wait and -flock-replace need -flock\n")
+		return 1
+	}
+	if *o.ringFile != "" {
+		if *o.ringSize <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid ring size %d: must be positive\n", *o.ringSize)
+			return 1
+		}
+		if cfg.ring, err = openRing(inv.expand(*o.ringFile), *o.ringSize<<10, command, inv.session); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open ring file: %v\n", err)
+			return 1
+		}
+		defer func() {
+			if err := cfg.ring.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write ring file: %v\n", err)
 			}
+		}()
+	}
+	if *o.coordinate {
+		cfg.coord = &coordClient{socket: *o.coordSocket}
+	}
+	if *o.webhookURL != "" {
+		cfg.webhook = newWebhook(*o.webhookURL)
+	}
+	switch *o.ci {
+	case "":
+	case "github":
+		con.annotate = true
+		cfg.summary = newStepSummary(command, inv.session)
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid CI system %q: expected github\n", *o.ci)
+		return 1
+	}
+	if interval := time.Duration(o.flushInterval); interval < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid flush interval %v: must not be negative\n", interval)
+		return 1
+	} else if (*o.lineBuffer || interval > 0) && !con.outTTY {
+		if interval == 0 {
+			interval = partialFlush
+		}
+		con.bufferOutput(*o.lineBuffer, interval)
+		defer con.unbufferOutput()
+	}
+	if *o.logTargetName != "" {
+		if con.target, err = openLogTarget(*o.logTargetName); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open log target: %v\n", err)
+			return 1
+		}
+	}
+	if *o.metricsAddr != "" {
+		cfg.metrics = newMetrics(inv.id, inv.session, timeout)
+		if err := cfg.metrics.serve(*o.metricsAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to serve metrics: %v\n", err)
+			return 1
+		}
+	}
+	cfg.control = newControl(timeout)
+	skip := o.noForward
+	if *o.ctlSignals {
+		skip = append(skip, controlSignals...)
+	}
+	if *o.pauseOn != "" {
+		sig, err := parseSignal(*o.pauseOn)
+		if err == nil && (sig == os.Kill || sig == stopSignal || sig == suspendSignal || sig == resumeSignal) {
+			err = fmt.Errorf("%s is taken by job control or can't be caught", signalName(sig))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid pause signal: %v\n", err)
+			return 1
+		}
+		cfg.control.pauseOn = sig
+		skip = append(skip, sig)
+	}
+	cfg.control.watchSignals(*o.ctlSignals)
+	cfg.forward = forwarding(skip)
+	var stopSignals func()
+	cfg.signals, stopSignals = watchSignals(cfg.forward)
+	defer stopSignals()
+	if *o.dumpSignal != "" {
+		if cfg.dumpSignal, err = parseSignal(*o.dumpSignal); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid dump signal: %v\n", err)
+			return 1
+		}
+		cfg.dumpWait = time.Duration(o.dumpWait)
+	}
+	if cfg.killSignal, err = parseSignal(*o.killSignal); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid kill signal: %v\n", err)
+		return 1
+	}
+	cfg.killGrace = time.Duration(o.killGrace)
+	if *o.controlSocket != "" {
+		if err := cfg.control.listen(inv.expand(*o.controlSocket)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to listen on control socket: %v\n", err)
+			return 1
+		}
+		defer cfg.control.close()
+	}
+	if *o.controlListen != "" {
+		if *o.controlCert == "" || *o.controlKey == "" || *o.controlCA == "" {
+			fmt.Fprintf(os.Stderr, "Invalid control address: -control-listen needs -control-tls-cert, -control-tls-key and -control-tls-ca\n")
+			return 1
+		}
+		if err := cfg.control.listenTLS(*o.controlListen, *o.controlCert, *o.controlKey, *o.controlCA); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to listen on control address: %v\n", err)
+			return 1
 		}
-	}()
+		defer cfg.control.close()
+	}
+	if *o.mirrorSocket != "" {
+		if cfg.mirror, err = listenMirror(inv.expand(*o.mirrorSocket)); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to listen on mirror socket: %v\n", err)
+			return 1
+		}
+		defer cfg.mirror.close()
+	}
+	cfg.trace = newTrace(command, inv.session, timeout)
+	if cfg.warnAt >= timeout {
+		fmt.Fprintf(os.Stderr, "Invalid warning threshold %v: must be shorter than the timeout %v\n", cfg.warnAt, timeout)
+		return 1
+	}
 
-	// Read output byte-by-byte for real-time display
-	buf := make([]byte, 4096)
-	for {
-		n, err := stdout.Read(buf)
-		if n > 0 {
-			resetTimer()
-			os.Stdout.Write(buf[:n])
+	// The terminal as the user had it, unless -foreground leaves it alone
+	var initial *termState
+	if !*o.foreground {
+		if st, err := getTermState(uintptr(syscall.Stdin)); err == nil {
+			initial = st
+		}
+	}
+
+	// Options that can't work here are fatal with -strict; otherwise they
+	// are reported once and left out
+	var missing []capability
+	if cfg.cgroup {
+		if err := checkCgroup(); err != nil {
+			missing = append(missing, capability{"cgroup", err})
+			cfg.cgroup = false
+		}
+	}
+	if cfg.subreaper {
+		if err := watchdog.CheckSubreaper(); err != nil {
+			missing = append(missing, capability{"subreaper", err})
+			cfg.subreaper = false
+		}
+	}
+	if cfg.cpuActive {
+		if err := checkProcTree(); err != nil {
+			missing = append(missing, capability{"cpu-activity", err})
+			cfg.cpuActive = false
+		}
+	}
+	if cfg.ioActive {
+		if err := checkProcTree(); err != nil {
+			missing = append(missing, capability{"io-activity", err})
+			cfg.ioActive = false
+		}
+	}
+	if cfg.freeze {
+		if err := checkFreeze(); err != nil {
+			missing = append(missing, capability{"on-timeout stop", err})
+			cfg.freeze = false
+		}
+	}
+	if cfg.binary {
+		if cfg.dedupe {
+			missing = append(missing, capability{"dedupe", errBinary})
+			cfg.dedupe, cfg.dedupeIdle = false, false
+		}
+		if cfg.repeats > 0 {
+			missing = append(missing, capability{"kill-on-repeat", errBinary})
+			cfg.repeats = 0
+		}
+		if cfg.tailLines > 0 {
+			missing = append(missing, capability{"tail-on-timeout", errBinary})
+			cfg.tailLines = 0
+		}
+		if cfg.statusLine {
+			missing = append(missing, capability{"status-line", errors.New("drawing it would land in the middle of -binary output")})
+			cfg.statusLine = false
+		}
+	}
+	if cfg.statusLine {
+		switch {
+		case con.plain:
+			missing = append(missing, capability{"status-line", errors.New("drawing it takes control sequences, which -plain rules out")})
+			cfg.statusLine = false
+		case cfg.foreground || !isTerminal(uintptr(syscall.Stdout)):
+			missing = append(missing, capability{"status-line", errors.New("needs the command on a pseudo-terminal with output to a terminal")})
+			cfg.statusLine = false
+		}
+	}
+	if cfg.title {
+		switch {
+		case con.plain:
+			missing = append(missing, capability{"title", errors.New("setting it takes control sequences, which -plain rules out")})
+			cfg.title = false
+		case !isTerminal(uintptr(syscall.Stdout)):
+			missing = append(missing, capability{"title", errors.New("output isn't a terminal")})
+			cfg.title = false
+		}
+	}
+	if cfg.maxRSS > 0 {
+		if err := watchdog.CheckMaxRSS(); err != nil {
+			missing = append(missing, capability{"max-rss", err})
+			cfg.maxRSS = 0
+		}
+	}
+	if cfg.require != nil && len(cfg.require.metrics) > 0 {
+		err := checkProcTree()
+		if err == nil && cfg.require.metrics["net"] {
+			err = checkNetActivity()
 		}
 		if err != nil {
+			missing = append(missing, capability{"require", err})
+			cfg.require = nil
+		}
+	}
+	if cfg.netActive {
+		if err := checkNetActivity(); err != nil {
+			missing = append(missing, capability{"net-activity", err})
+			cfg.netActive = false
+		}
+	}
+	if len(cfg.limits) > 0 {
+		if err := checkLimits(); err != nil {
+			missing = append(missing, capability{"limit-*", err})
+			cfg.limits = nil
+		}
+		for name := range cfg.limits {
+			if _, ok := rlimitResources[name]; !ok {
+				missing = append(missing, capability{"limit-" + name, fmt.Errorf("not supported on %s", runtime.GOOS)})
+				delete(cfg.limits, name)
+			}
+		}
+	}
+	if cfg.nice != 0 {
+		if err := checkLimits(); err != nil {
+			missing = append(missing, capability{"nice", err})
+			cfg.nice = 0
+		}
+	}
+	if cfg.ioPrio != 0 {
+		if err := checkIONice(); err != nil {
+			missing = append(missing, capability{"ionice", err})
+			cfg.ioPrio = 0
+		}
+	}
+	if *o.takeoverMenu {
+		if cfg.takeover, err = newTakeover(time.Duration(o.takeoverWait), *o.debugger, initial); err != nil {
+			missing = append(missing, capability{"takeover", err})
+		}
+	}
+	if *o.notify {
+		if err := checkNotifier(); err != nil {
+			missing = append(missing, capability{"notify", err})
+			*o.notify = false
+		}
+	}
+	if *o.dbus {
+		if err := checkDBus(); err != nil {
+			missing = append(missing, capability{"dbus", err})
+		} else {
+			cfg.dbus = newDBusSignals()
+		}
+	}
+	var notifier *sdNotifier
+	if *o.sdNotify {
+		if notifier, err = checkSDNotify(); err != nil {
+			missing = append(missing, capability{"sd-notify", err})
+		}
+	}
+	if !reportMissing(missing, *o.strict) {
+		return exitUnavailable
+	}
+	if notifier != nil {
+		notifier.start()
+		defer notifier.stop()
+	}
+
+	// Keystrokes go to the child's terminal unprocessed, unless -no-raw;
+	// the user's terminal is restored before exiting. In -foreground mode the child reads the
+	// terminal itself, so it is left untouched.
+	restoreTerminal := func() {}
+	if !*o.foreground {
+		if initial != nil && !*o.noRaw {
+			makeRawInput(uintptr(syscall.Stdin), initial)
+			cfg.term = initial
+		}
+		in, restoreInput := openInput()
+		cfg.input = in
+		restoreTerminal = func() {
+			restoreInput()
+			if initial != nil {
+				setTermState(uintptr(syscall.Stdin), initial)
+			}
+		}
+	}
+	// Re-spawn on retryable outcomes, backing off exponentially between attempts
+	var history []attempt
+	var stoppedBy os.Signal
+	for ; ; inv.seq++ {
+		if notifier != nil {
+			notifier.status(fmt.Sprintf("Running %s (attempt %d of %d)", cmdName, inv.seq, *o.retries+1))
+		}
+		a := run(cmdName, cmdArgs, cfg, inv)
+		rule, retry := o.retryOn.match(a)
+		if stoppedBy = a.stoppedBy; stoppedBy != nil || !retry || inv.seq > *o.retries {
+			history = append(history, a)
+			break
+		}
+		backoff := time.Duration(o.retryBackoff)
+		if rule.backoff > 0 {
+			backoff = rule.backoff
+		}
+		if shift := inv.seq - 1; shift >= 63 || backoff > maxDuration>>shift {
+			backoff = maxDuration
+		} else {
+			backoff <<= shift
+		}
+		if cfg.coord != nil {
+			if backoff, err = cfg.coord.retryDelay(inv.id, backoff); err != nil {
+				con.Logf("Coordinator unreachable (%v), retrying without it", err)
+			}
+		}
+		a.Backoff = backoff.Seconds()
+		history = append(history, a)
+		if cfg.metrics != nil {
+			cfg.metrics.restarts.Add(1)
+		}
+
+		con.Eventf(prioNotice, inv.env(), "Retrying in %v (attempt %d of %d)...", backoff, inv.seq+1, *o.retries+1)
+		if notifier != nil {
+			notifier.status(fmt.Sprintf("Retrying %s in %v (attempt %d of %d)", cmdName, backoff, inv.seq+1, *o.retries+1))
+		}
+		// The user's terminal settings are back for the wait, so Ctrl-C
+		// interrupts it
+		if cfg.term != nil {
+			setTermState(uintptr(syscall.Stdin), cfg.term)
+		}
+		if stoppedBy = sleepBackoff(backoff, cfg.signals); stoppedBy != nil {
 			break
 		}
+		if cfg.term != nil {
+			makeRawInput(uintptr(syscall.Stdin), cfg.term)
+		}
+	}
+	if stoppedBy != nil {
+		con.Eventf(prioNotice, inv.env(), "Stopped by %s", signalName(stoppedBy))
+	}
+
+	restoreTerminal()
+	con.restoreTitle()
+	var cleanup cleanupErrors
+	for _, a := range history {
+		cleanup = append(cleanup, a.cleanup...)
+	}
+	cleanup = append(cleanup, closeCasts()...)
+	cleanup = append(cleanup, closeScripts()...)
+	if cfg.webhook != nil {
+		cfg.webhook.wait()
+	}
+	if cfg.dbus != nil {
+		cfg.dbus.wait()
 	}
 
-	// Wait for command to finish
-	err = cmd.Wait()
-	close(done)
+	final := history[len(history)-1]
+	cleanup.add("status file", saveStatus(command, history, timeout))
+	if cfg.trace != nil {
+		cfg.trace.end(final, len(history))
+	}
+	if *o.notify {
+		notifyOutcome(command, history, timeout)
+	}
+	if *o.resultFile != "" {
+		r := result{
+			ID:       inv.id,
+			Session:  inv.session,
+			Command:  command,
+			ExitCode: final.ExitCode,
+			TimedOut: final.TimedOut,
+			Attempts: history,
+		}
+		if err := writeResult(inv.expand(*o.resultFile), r); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write result file: %v\n", err)
+		}
+	}
+	if *o.history {
+		if err := recordHistory(inv, command, history, timeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to record history: %v\n", err)
+		}
+	}
+	cleanup.add("control socket", cfg.control.close())
+	if cfg.mirror != nil {
+		cleanup.add("mirror socket", cfg.mirror.close())
+	}
 
-	if timedOut {
-		return 124
+	status := final.ExitCode
+	if stoppedBy != nil {
+		status = signalStatus(stoppedBy)
+	}
+	if len(cleanup) > 0 {
+		con.Logf("Exiting with status %d, but cleaning up failed: %s", status, cleanup)
 	}
+	return status
+}
+
+// cleanupErrors collects what failed while tidying up after the command,
+// such as a log file that didn't close, for the final message
+type cleanupErrors []error
 
+// add records err, if any, about what
+func (c *cleanupErrors) add(what string, err error) {
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return exitErr.ExitCode()
-		}
-		return 1
+		*c = append(*c, fmt.Errorf("%s: %w", what, err))
 	}
+}
 
-	return 0
+func (c cleanupErrors) String() string {
+	msgs := make([]string, len(c))
+	for i, err := range c {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
 }
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"regexp/syntax"
+)
+
+// maxMatchLines is how many lines back a match of a pattern that spans
+// lines may start, within maxTailLine bytes
+const maxMatchLines = 64
+
+// streamMatcher finds the matches of a set of patterns in output as it
+// streams in, whatever chunks it comes in: output is cleaned of escape
+// sequences, one cut off at the end of a chunk being held until the rest
+// arrives, and complete lines of carriage-return overwrites as well, like
+// cleanLine. A pattern is matched line by line, unless it has a \n or
+// makes . match newlines with (?s): such a pattern spans lines, and is
+// matched against the last maxMatchLines of them. The matches are found
+// in the order they appear, the first pattern winning a tie, and each
+// only once: output up to a match is done with, and without prompts so is
+// the rest of its line. Memory stays within a few times maxTailLine.
+type streamMatcher struct {
+	rules   []*regexp.Regexp
+	spans   []bool // whether each rule spans lines
+	multi   bool   // whether any does, so lines are kept for it
+	prompts bool   // match the line under way too, for prompts that don't end theirs
+
+	window    []byte // cleaned output not done with, ending with the line under way
+	lineStart int    // where the line under way starts in window
+	fresh     int    // where the lines the line-by-line rules haven't seen start
+	escape    []byte // an escape sequence cut off at the end of the last chunk
+}
+
+// newStreamMatcher matches rules against complete lines, or with prompts
+// also against the line under way
+func newStreamMatcher(prompts bool, rules ...*regexp.Regexp) *streamMatcher {
+	m := &streamMatcher{prompts: prompts}
+	m.setRules(rules...)
+	return m
+}
+
+// setRules replaces the patterns, which see the output not done with yet
+func (m *streamMatcher) setRules(rules ...*regexp.Regexp) {
+	m.rules, m.spans, m.multi, m.fresh = rules, make([]bool, len(rules)), false, 0
+	for i, re := range rules {
+		m.spans[i] = spansLines(re)
+		m.multi = m.multi || m.spans[i]
+	}
+}
+
+// feed adds a chunk of output, calling found with the index of the rule
+// and the submatches of each match it completes
+func (m *streamMatcher) feed(p []byte, found func(rule int, match [][]byte)) {
+	data := m.clean(p)
+	for len(data) > 0 {
+		nl := bytes.IndexByte(data, '\n')
+		if nl < 0 {
+			m.window = append(m.window, data...)
+			break
+		}
+		m.window = append(m.window, data[:nl+1]...)
+		data = data[nl+1:]
+		m.endLine()
+		m.scan(m.lineStart, found)
+		m.trim()
+	}
+	if m.prompts {
+		m.scan(len(m.window), found)
+	}
+	if over := len(m.window) - m.lineStart - maxTailLine; over > 0 {
+		m.consume(m.lineStart + over) // the line under way never ends
+	}
+}
+
+// clean strips escape sequences from p, holding back one cut off at the end
+func (m *streamMatcher) clean(p []byte) []byte {
+	if len(m.escape) > 0 {
+		p = append(m.escape, p...)
+		m.escape = nil
+	}
+	if i := bytes.LastIndexByte(p, 0x1b); i >= 0 && len(p)-i < maxTailLine && unfinishedEscape(p[i:]) {
+		m.escape = append([]byte(nil), p[i:]...)
+		p = p[:i]
+	}
+	return ansiPattern.ReplaceAll(p, nil)
+}
+
+// unfinishedEscape reports whether seq, starting with ESC, may be the
+// start of a sequence ansiPattern would strip once complete
+func unfinishedEscape(seq []byte) bool {
+	if len(seq) == 1 {
+		return true
+	}
+	switch seq[1] {
+	case '[':
+		for _, c := range seq[2:] {
+			if c < 0x20 || c > 0x3f {
+				return false
+			}
+		}
+		return true
+	case ']':
+		return bytes.IndexByte(seq, 0x07) < 0 && bytes.IndexByte(seq[1:], 0x1b) < 0
+	}
+	return false
+}
+
+// endLine cleans the line just ended of carriage-return overwrites, as
+// cleanLine does, and starts the next one
+func (m *streamMatcher) endLine() {
+	line := bytes.TrimRight(m.window[m.lineStart:len(m.window)-1], "\r")
+	if i := bytes.LastIndexByte(line, '\r'); i >= 0 {
+		line = line[i+1:]
+	}
+	m.window = append(append(m.window[:m.lineStart], line...), '\n')
+	m.lineStart = len(m.window)
+}
+
+// scan reports the matches in window[:end]
+func (m *streamMatcher) scan(end int, found func(rule int, match [][]byte)) {
+	for end > 0 {
+		text := m.window[:end]
+		rule, loc := -1, []int(nil)
+		for i, re := range m.rules {
+			var l []int
+			if m.spans[i] {
+				l = re.FindSubmatchIndex(text)
+			} else {
+				l = findInLines(re, text, m.fresh)
+			}
+			if l != nil && (loc == nil || l[0] < loc[0]) {
+				rule, loc = i, l
+			}
+		}
+		if rule < 0 {
+			break
+		}
+		match := make([][]byte, len(loc)/2)
+		for i := range match {
+			if loc[2*i] >= 0 {
+				match[i] = text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		cut := loc[1]
+		if !m.prompts && (cut == 0 || text[cut-1] != '\n') {
+			if nl := bytes.IndexByte(text[cut:], '\n'); nl >= 0 {
+				cut += nl + 1
+			}
+		}
+		// found may set new rules, which see what follows the match
+		found(rule, match)
+		if cut == 0 {
+			break
+		}
+		m.consume(cut)
+		end -= cut
+	}
+	// The line under way may still grow into a match
+	m.fresh = min(end, m.lineStart)
+}
+
+// findInLines finds the first match of re within one line of text, looking
+// from the line starting at from
+func findInLines(re *regexp.Regexp, text []byte, from int) []int {
+	for start := from; start < len(text); {
+		stop := len(text)
+		if nl := bytes.IndexByte(text[start:], '\n'); nl >= 0 {
+			stop = start + nl
+		}
+		if loc := re.FindSubmatchIndex(text[start:stop]); loc != nil {
+			for i := range loc {
+				if loc[i] >= 0 {
+					loc[i] += start
+				}
+			}
+			return loc
+		}
+		start = stop + 1
+	}
+	return nil
+}
+
+// trim drops the complete lines no rule needs any more
+func (m *streamMatcher) trim() {
+	if !m.multi {
+		m.consume(m.lineStart)
+		return
+	}
+	cut, lines := m.lineStart, 0
+	for cut > 0 && lines < maxMatchLines && m.lineStart-cut < maxTailLine {
+		cut = bytes.LastIndexByte(m.window[:cut-1], '\n') + 1
+		lines++
+	}
+	m.consume(cut)
+}
+
+// consume drops the first n bytes of the window
+func (m *streamMatcher) consume(n int) {
+	m.window = m.window[n:]
+	m.lineStart = max(0, m.lineStart-n)
+	m.fresh = max(0, m.fresh-n)
+}
+
+// spansLines reports whether re can match a newline: it has a \n, or .
+// matches newlines through (?s). Classes such as \s or [^x] don't count,
+// so patterns written for a line keep matching within one.
+func spansLines(re *regexp.Regexp) bool {
+	t, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return false
+	}
+	var walk func(t *syntax.Regexp) bool
+	walk = func(t *syntax.Regexp) bool {
+		switch t.Op {
+		case syntax.OpAnyChar:
+			return true
+		case syntax.OpLiteral:
+			for _, r := range t.Rune {
+				if r == '\n' {
+					return true
+				}
+			}
+		}
+		for _, sub := range t.Sub {
+			if walk(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	return walk(t)
+}
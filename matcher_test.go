@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+// buildLog is output like a build's: colored lines of a few dozen bytes
+func buildLog() []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 1<<20; i++ {
+		fmt.Fprintf(&buf, "\x1b[32m[%5d/9999]\x1b[0m Compiling src/module_%d.c -> build/module_%d.o\r\n", i, i, i)
+	}
+	return buf.Bytes()
+}
+
+// benchmarkMatcher feeds output to a matcher in 4 KiB chunks, as reads of
+// the command's terminal bring it
+func benchmarkMatcher(b *testing.B, prompts bool, patterns ...string) {
+	rules := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		rules[i] = regexp.MustCompile(p)
+	}
+	m := newStreamMatcher(prompts, rules...)
+	out := buildLog()
+	found := func(int, [][]byte) {}
+	b.SetBytes(int64(len(out)))
+	for b.Loop() {
+		for p := out; len(p) > 0; {
+			n := min(len(p), 4096)
+			m.feed(p[:n], found)
+			p = p[n:]
+		}
+	}
+}
+
+// BenchmarkMatchLines is --on-pattern and --track-subjobs: rules matched
+// line by line, one of them matching now and then
+func BenchmarkMatchLines(b *testing.B) {
+	benchmarkMatcher(b, false, `error: `, `\[ *(\d+)0/9999\]`)
+}
+
+// BenchmarkMatchPrompts is --respond: the line under way is matched too
+func BenchmarkMatchPrompts(b *testing.B) {
+	benchmarkMatcher(b, true, `Continue\? \[y/N\]`, `[Pp]assword: ?$`)
+}
+
+// BenchmarkMatchSpanning is a rule that spans lines, matched against the
+// last maxMatchLines of them
+func BenchmarkMatchSpanning(b *testing.B) {
+	benchmarkMatcher(b, false, `Linking\n.*done`)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// metrics collects the counters served in Prometheus text format by
+// --metrics-addr
+type metrics struct {
+	id      string
+	session string
+	timeout time.Duration
+
+	bytes    atomic.Uint64
+	warnings atomic.Uint64
+	timeouts atomic.Uint64
+	restarts atomic.Uint64
+
+	mu        sync.Mutex
+	runner    *watchdog.Runner // attempt in flight, nil between attempts
+	exitCodes map[int]uint64
+}
+
+func newMetrics(id, session string, timeout time.Duration) *metrics {
+	return &metrics{id: id, session: session, timeout: timeout, exitCodes: map[int]uint64{}}
+}
+
+// serve starts the exposition endpoint in the background
+func (m *metrics) serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.handle)
+	go http.Serve(ln, mux)
+	return nil
+}
+
+// Write counts forwarded output bytes
+func (m *metrics) Write(p []byte) (int, error) {
+	m.bytes.Add(uint64(len(p)))
+	return len(p), nil
+}
+
+func (m *metrics) attach(r *watchdog.Runner) {
+	m.mu.Lock()
+	m.runner = r
+	m.mu.Unlock()
+}
+
+// observe updates counters from a watchdog event
+func (m *metrics) observe(e watchdog.Event) {
+	switch e.Kind {
+	case watchdog.Warned:
+		m.warnings.Add(1)
+	case watchdog.TimedOut:
+		m.timeouts.Add(1)
+	case watchdog.Exited:
+		m.mu.Lock()
+		m.exitCodes[e.ExitCode]++
+		m.mu.Unlock()
+	}
+}
+
+func (m *metrics) handle(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	label := `{id="` + escapeLabel(m.id) + `",session="` + m.session + `"}`
+
+	m.mu.Lock()
+	running, idle := 0, 0.0
+	if m.runner != nil && m.runner.PID() != 0 {
+		running = 1
+		idle = time.Since(m.runner.LastActivity()).Seconds()
+	}
+	codes := make([]int, 0, len(m.exitCodes))
+	for code := range m.exitCodes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	exits := make([]uint64, len(codes))
+	for i, code := range codes {
+		exits[i] = m.exitCodes[code]
+	}
+	m.mu.Unlock()
+
+	gauge := func(name, help string, v float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s%s %s\n", name, help, name, name, label, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	counter := func(name, help string, v uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s%s %d\n", name, help, name, name, label, v)
+	}
+	gauge("idle_timeout_seconds_since_activity", "Seconds since the child last produced output.", idle)
+	gauge("idle_timeout_limit_seconds", "Configured idle timeout in seconds.", m.timeout.Seconds())
+	gauge("idle_timeout_child_running", "Whether a child is currently running.", float64(running))
+	counter("idle_timeout_output_bytes_total", "Bytes of child output forwarded.", m.bytes.Load())
+	counter("idle_timeout_warnings_total", "Idle episodes that crossed the warning threshold.", m.warnings.Load())
+	counter("idle_timeout_timeouts_total", "Children killed for inactivity.", m.timeouts.Load())
+	counter("idle_timeout_restarts_total", "Retries of the child.", m.restarts.Load())
+
+	fmt.Fprintf(w, "# HELP idle_timeout_child_exits_total Child exits by exit code.\n# TYPE idle_timeout_child_exits_total counter\n")
+	for i, code := range codes {
+		fmt.Fprintf(w, "idle_timeout_child_exits_total{id=\"%s\",session=\"%s\",code=\"%d\"} %d\n", escapeLabel(m.id), m.session, code, exits[i])
+	}
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// mirrorBacklog is how many writes of output a --mirror-socket client may
+// fall behind by before it is dropped
+const mirrorBacklog = 256
+
+// mirror streams a copy of the command's output, as it comes, to every
+// client connected to a unix socket, for --mirror-socket. Clients only
+// listen: what they send is ignored, and one that falls behind is dropped
+// rather than holding up the command. It serves every attempt.
+type mirror struct {
+	path string
+
+	mu      sync.Mutex
+	ln      net.Listener // nil once closed
+	clients map[net.Conn]chan []byte
+}
+
+// listenMirror serves the mirror on a unix socket at path. A socket left
+// behind by a wrapper that died is taken over; a live one is kept.
+func listenMirror(path string) (*mirror, error) {
+	if conn, err := net.DialTimeout("unix", path, coordTimeout); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use", path)
+	}
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	m := &mirror{ln: ln, path: path, clients: map[net.Conn]chan []byte{}}
+	go m.accept(ln)
+	return m, nil
+}
+
+func (m *mirror) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		queue := make(chan []byte, mirrorBacklog)
+		m.mu.Lock()
+		if m.ln == nil {
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		m.clients[conn] = queue
+		m.mu.Unlock()
+		go m.serve(conn, queue)
+	}
+}
+
+// serve writes out a client's queue until it hangs up or is dropped
+func (m *mirror) serve(conn net.Conn, queue chan []byte) {
+	defer conn.Close()
+	go func() {
+		io.Copy(io.Discard, conn)
+		m.drop(conn)
+	}()
+	for p := range queue {
+		if _, err := conn.Write(p); err != nil {
+			m.drop(conn)
+			return
+		}
+	}
+}
+
+// drop disconnects a client, if it still is connected
+func (m *mirror) drop(conn net.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[conn]; ok {
+		m.disconnect(conn)
+	}
+}
+
+// disconnect drops a client at once, with m.mu held
+func (m *mirror) disconnect(conn net.Conn) {
+	close(m.clients[conn])
+	delete(m.clients, conn)
+	conn.Close()
+}
+
+// Write queues a copy of p for each client; it never blocks or fails
+func (m *mirror) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.clients) == 0 {
+		return len(p), nil
+	}
+	data := append([]byte(nil), p...)
+	for conn, queue := range m.clients {
+		select {
+		case queue <- data:
+		default:
+			m.disconnect(conn)
+			con.Logf("Dropped a -mirror-socket client that fell behind")
+		}
+	}
+	return len(p), nil
+}
+
+// close stops listening and removes the socket, reporting a socket file
+// left behind; clients are sent what is queued for them, then
+// disconnected. Closing again does nothing.
+func (m *mirror) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ln == nil {
+		return nil
+	}
+	m.ln.Close()
+	m.ln = nil
+	for conn, queue := range m.clients {
+		delete(m.clients, conn)
+		close(queue)
+	}
+	if err := os.Remove(m.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// job is one command run by multi, with an idle budget of its own
+type job struct {
+	name    string
+	command string        // shell command line
+	timeout time.Duration // 0 for the default given to multi
+}
+
+// jobList is a flag.Value for --job, given once per job as 'name=command'
+// or 'name:timeout=command'
+type jobList []job
+
+func (l *jobList) String() string {
+	var parts []string
+	for _, j := range *l {
+		parts = append(parts, j.name+"="+j.command)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *jobList) Set(s string) error {
+	head, command, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(command) == "" {
+		return errors.New("expected name=command or name:timeout=command, e.g. 'api:10m=./serve'")
+	}
+	j := job{name: head, command: command}
+	if name, budget, ok := strings.Cut(head, ":"); ok {
+		d, err := parseDuration(budget)
+		if err != nil || d < watchdog.Resolution {
+			return fmt.Errorf("invalid duration %q: expected at least %v", budget, watchdog.Resolution)
+		}
+		j.name, j.timeout = name, d
+	}
+	return l.add(j)
+}
+
+func (l *jobList) add(j job) error {
+	if j.name == "" {
+		return errors.New("missing job name")
+	}
+	for _, other := range *l {
+		if other.name == j.name {
+			return fmt.Errorf("job %q given twice", j.name)
+		}
+	}
+	*l = append(*l, j)
+	return nil
+}
+
+// readJobSpec reads jobs from a file in the config file's TOML subset, one
+// [jobs.<name>] table each with a command and optionally a timeout. The
+// jobs come in order of name.
+func readJobSpec(path string) (jobList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := parseTOML(string(data))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for table := range tables {
+		if name, ok := strings.CutPrefix(table, "jobs."); ok {
+			names = append(names, name)
+		} else if table != "" && table != "jobs" {
+			return nil, fmt.Errorf("unknown table [%s]: expected [jobs.<name>]", table)
+		}
+	}
+	sort.Strings(names)
+	var jobs jobList
+	for _, name := range names {
+		t := tables["jobs."+name]
+		j := job{name: name, command: t["command"]}
+		if j.command == "" {
+			return nil, fmt.Errorf("job %s: missing command", name)
+		}
+		if budget, ok := t["timeout"]; ok {
+			if j.timeout, err = parseDuration(budget); err != nil || j.timeout < watchdog.Resolution {
+				return nil, fmt.Errorf("job %s: invalid timeout %q: expected at least %v", name, budget, watchdog.Resolution)
+			}
+		}
+		for key := range t {
+			if key != "command" && key != "timeout" {
+				return nil, fmt.Errorf("job %s: unknown key %q", name, key)
+			}
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, nil
+}
+
+// labelWriter passes a job's output on a line at a time, each line labeled
+// with the job's name, so lines of jobs running at once don't mix
+type labelWriter struct {
+	mu      sync.Mutex
+	label   string
+	partial []byte
+}
+
+func (w *labelWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	if nl := bytes.LastIndexByte(w.partial, '\n'); nl >= 0 {
+		w.emit(w.partial[:nl+1])
+		w.partial = append(w.partial[:0], w.partial[nl+1:]...)
+	}
+	// A line that never ends is passed on in pieces
+	if len(w.partial) > maxTailLine {
+		w.emit(append(w.partial, '\n'))
+		w.partial = w.partial[:0]
+	}
+	return len(p), nil
+}
+
+// flush passes on a last line without a newline
+func (w *labelWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.emit(append(w.partial, '\n'))
+		w.partial = nil
+	}
+}
+
+func (w *labelWriter) emit(lines []byte) {
+	var b bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			b.WriteString(w.label)
+			b.Write(line)
+		}
+	}
+	con.Write(b.Bytes())
+}
+
+// multiMain runs several commands at once, each under its own idle
+// timeout, with their output merged a line at a time and labeled with the
+// job's name
+func multiMain(args []string) int {
+	fset := flag.NewFlagSet("multi", flag.ExitOnError)
+	var jobs jobList
+	fset.Var(&jobs, "job", "run shell `command` as a job given as 'name=command', or 'name:timeout=command' for a timeout of its own (repeatable)")
+	spec := fset.String("spec", "", "read jobs from the TOML `file`: a [jobs.<name>] table each, with command and optionally timeout")
+	killAll := fset.Bool("kill-all", false, "when a job times out, kill the other jobs too instead of letting them run on")
+	var warnAt warnThreshold
+	fset.Var(&warnAt, "warn-at", "warn once per idle episode of a job after this much inactivity, as a `percentage` of its timeout (80%) or a duration")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout multi [options] [duration] --job <name=command> --job <name=command> ...\n")
+		fmt.Fprintf(os.Stderr, "       idle-timeout multi [options] [duration] --spec <file>\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout multi 5m --job 'api=./serve' --job 'worker:30m=./work' --kill-all\n")
+		fmt.Fprintf(os.Stderr, "\nThe duration is the timeout of jobs that don't set their own.\n")
+		fmt.Fprintf(os.Stderr, "The exit status is 124 if a job timed out, else that of the first job to fail, else 0.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() > 0 {
+		// Options may follow the duration
+		durationArg := fset.Arg(0)
+		fset.Parse(fset.Args()[1:])
+		args = append([]string{durationArg}, fset.Args()...)
+	} else {
+		args = nil
+	}
+	if len(args) > 1 || len(jobs) == 0 && *spec == "" {
+		fset.Usage()
+		return 1
+	}
+	var timeout time.Duration
+	if len(args) == 1 {
+		var err error
+		if timeout, err = parseDuration(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", args[0], err)
+			return 1
+		}
+		if timeout < watchdog.Resolution {
+			fmt.Fprintf(os.Stderr, "Invalid duration %q: below the watchdog's %v resolution\n", args[0], watchdog.Resolution)
+			return 1
+		}
+	}
+	if *spec != "" {
+		more, err := readJobSpec(*spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid job spec %s: %v\n", *spec, err)
+			return 1
+		}
+		for _, j := range more {
+			if err := jobs.add(j); err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid job spec %s: %v\n", *spec, err)
+				return 1
+			}
+		}
+	}
+	width := 0
+	for i, j := range jobs {
+		if j.timeout == 0 {
+			if timeout == 0 {
+				fmt.Fprintf(os.Stderr, "No timeout for job %s: give a duration or set one for the job\n", j.name)
+				return 1
+			}
+			jobs[i].timeout = timeout
+		}
+		width = max(width, len(j.name))
+	}
+
+	inv := newInvocation("")
+	env := append(os.Environ(), inv.env()...)
+	runners := make([]*watchdog.Runner, len(jobs))
+	labels := make([]*labelWriter, len(jobs))
+	// With -kill-all the first job to time out takes the rest down with
+	// it; they are expired rather than idle, so swept tells them apart
+	var killing sync.Once
+	var culprit string
+	swept := make([]atomic.Bool, len(jobs))
+	for i, j := range jobs {
+		labels[i] = &labelWriter{label: fmt.Sprintf("%-*s | ", width, j.name)}
+		runners[i] = watchdog.New(watchdog.Config{
+			Path:    shellCommand[0],
+			Args:    append(shellCommand[1:], j.command),
+			Env:     env,
+			Timeout: j.timeout,
+			WarnAt:  warnAt.resolve(j.timeout),
+			Stdout:  labels[i],
+			Stderr:  labels[i],
+			OnEvent: func(e watchdog.Event) {
+				switch e.Kind {
+				case watchdog.Warned:
+					con.Logf("%s: No output for %v, killing in %v...", j.name, idleFor(e.Idle), timeLeft(e.Timeout-e.Idle))
+				case watchdog.TimedOut:
+					if swept[i].Load() {
+						return
+					}
+					con.Logf("%s: No output for %v, killing process...", j.name, e.Timeout)
+					if *killAll {
+						killing.Do(func() {
+							con.Logf("Killing the other jobs too (-kill-all)...")
+							culprit = j.name
+							for k, r := range runners {
+								if k != i {
+									swept[k].Store(true)
+									r.Expire()
+								}
+							}
+						})
+					}
+				}
+			},
+		})
+		con.Printf("spawn %s: %s\n", j.name, j.command)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, forwardedSignals...)
+	defer signal.Stop(sigChan)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigChan:
+				for _, r := range runners {
+					r.Signal(sig)
+				}
+			}
+		}
+	}()
+
+	results := make([]watchdog.Result, len(jobs))
+	var wg sync.WaitGroup
+	for i := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runners[i].Run(ctx)
+			labels[i].flush()
+		}()
+	}
+	wg.Wait()
+
+	code, timedOut := 0, false
+	for i, res := range results {
+		name := jobs[i].name
+		switch {
+		case res.Err != nil:
+			con.Logf("%s: Failed to run command: %v", name, res.Err)
+		case res.TimedOut && swept[i].Load():
+			con.Logf("%s: killed after %v, when %s timed out", name, res.Duration.Round(time.Second), culprit)
+		case res.TimedOut:
+			con.Logf("%s: killed idle after %v", name, res.Duration.Round(time.Second))
+		default:
+			con.Logf("%s: exited with status %d after %v", name, res.ExitCode, res.Duration.Round(time.Second))
+		}
+		if res.TimedOut {
+			timedOut = true
+		} else if res.ExitCode != 0 && code == 0 {
+			code = res.ExitCode
+		}
+	}
+	if timedOut {
+		return watchdog.ExitTimedOut
+	}
+	return code
+}
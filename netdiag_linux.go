@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sock_diag constants from <linux/sock_diag.h> and <linux/inet_diag.h>
+const (
+	netlinkSockDiag  = 4  // NETLINK_SOCK_DIAG
+	sockDiagByFamily = 20 // SOCK_DIAG_BY_FAMILY
+	inetDiagInfo     = 2  // INET_DIAG_INFO, carrying a struct tcp_info
+
+	inetDiagMsgLen   = 72  // struct inet_diag_msg
+	inetDiagInodeOff = 68  // its idiag_inode
+	tcpiBytesAcked   = 120 // offsets in struct tcp_info
+	tcpiBytesRecv    = 128
+)
+
+// checkNetActivity reports whether TCP socket counters can be read
+func checkNetActivity() error {
+	_, err := tcpCounters()
+	return err
+}
+
+// newNetProbe returns a probe of the bytes sent and received over the TCP
+// sockets a process has open. The kernel's socket table is fetched once
+// per poll, not once per process.
+func newNetProbe() counterProbe {
+	var fetched time.Time
+	var table map[uint64]uint64
+	return func(pid int) (uint64, bool) {
+		if time.Since(fetched) > activityPoll/2 {
+			table, _ = tcpCounters()
+			fetched = time.Now()
+		}
+		dir := "/proc/" + strconv.Itoa(pid) + "/fd"
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, false
+		}
+		var total uint64
+		for _, e := range entries {
+			link, err := os.Readlink(dir + "/" + e.Name())
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, _ := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			total += table[inode]
+		}
+		return total, true
+	}
+}
+
+// tcpCounters returns the bytes acknowledged plus received for every TCP
+// socket in this network namespace, by inode, as sock_diag reports them
+func tcpCounters() (map[uint64]uint64, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkSockDiag)
+	if err != nil {
+		return nil, fmt.Errorf("sock_diag: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	counters := map[uint64]uint64{}
+	for seq, family := range []byte{syscall.AF_INET, syscall.AF_INET6} {
+		// struct nlmsghdr followed by struct inet_diag_req_v2
+		req := make([]byte, syscall.NLMSG_HDRLEN+56)
+		binary.NativeEndian.PutUint32(req[0:], uint32(len(req)))
+		binary.NativeEndian.PutUint16(req[4:], sockDiagByFamily)
+		binary.NativeEndian.PutUint16(req[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+		binary.NativeEndian.PutUint32(req[8:], uint32(seq+1))
+		body := req[syscall.NLMSG_HDRLEN:]
+		body[0], body[1], body[2] = family, syscall.IPPROTO_TCP, 1<<(inetDiagInfo-1)
+		binary.NativeEndian.PutUint32(body[4:], ^uint32(0)) // every state
+		if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+			return nil, fmt.Errorf("sock_diag: %w", err)
+		}
+		if err := readDiagDump(fd, counters); err != nil {
+			return nil, fmt.Errorf("sock_diag: %w", err)
+		}
+	}
+	return counters, nil
+}
+
+// readDiagDump reads the replies to a dump request into counters
+func readDiagDump(fd int, counters map[uint64]uint64) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+						return syscall.Errno(-errno)
+					}
+				}
+				return nil
+			}
+			if len(m.Data) < inetDiagMsgLen {
+				continue
+			}
+			inode := uint64(binary.NativeEndian.Uint32(m.Data[inetDiagInodeOff:]))
+			// Attributes follow the message, each a struct rtattr and its
+			// payload, padded to 4 bytes
+			for attrs := m.Data[inetDiagMsgLen:]; len(attrs) >= 4; {
+				l := int(binary.NativeEndian.Uint16(attrs))
+				if l < 4 || l > len(attrs) {
+					break
+				}
+				if binary.NativeEndian.Uint16(attrs[2:]) == inetDiagInfo {
+					if info := attrs[4:l]; len(info) >= tcpiBytesRecv+8 {
+						counters[inode] = binary.NativeEndian.Uint64(info[tcpiBytesAcked:]) + binary.NativeEndian.Uint64(info[tcpiBytesRecv:])
+					}
+				}
+				attrs = attrs[min((l+3)&^3, len(attrs)):]
+			}
+		}
+	}
+}
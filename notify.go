@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifyDesktop pops up a desktop notification, best effort: notify-send or
+// the freedesktop D-Bus service on Linux, osascript on macOS
+func notifyDesktop(title, body string) {
+	var err error
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", strconv.Quote(body), strconv.Quote(title))
+		err = exec.Command("osascript", "-e", script).Run()
+	default:
+		if _, lookErr := exec.LookPath("notify-send"); lookErr == nil {
+			err = exec.Command("notify-send", "--app-name=idle-timeout", title, body).Run()
+		} else {
+			err = exec.Command("gdbus", "call", "--session",
+				"--dest", "org.freedesktop.Notifications",
+				"--object-path", "/org/freedesktop/Notifications",
+				"--method", "org.freedesktop.Notifications.Notify",
+				"idle-timeout", "0", "", title, body, "[]", "{}", "-1").Run()
+		}
+	}
+	if err != nil {
+		con.Logf("Desktop notification failed: %v", err)
+	}
+}
+
+// checkNotifier reports whether notifyDesktop has a way to notify
+func checkNotifier() error {
+	tools := []string{"notify-send", "gdbus"}
+	if runtime.GOOS == "darwin" {
+		tools = []string{"osascript"}
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of %s found", strings.Join(tools, ", "))
+}
+
+// notifyOutcome summarizes the final attempt for --notify
+func notifyOutcome(command []string, history []attempt, timeout time.Duration) {
+	final := history[len(history)-1]
+	elapsed := time.Since(history[0].Started).Round(time.Second)
+
+	title := "idle-timeout: " + strings.Join(command, " ")
+	var body string
+	if final.TimedOut {
+		body = fmt.Sprintf("Killed after no output for %v (ran %v)", timeout, elapsed)
+	} else {
+		body = fmt.Sprintf("Exited with status %d (ran %v)", final.ExitCode, elapsed)
+	}
+	if len(history) > 1 {
+		body += fmt.Sprintf(", %d attempts", len(history))
+	}
+	notifyDesktop(title, body)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// parseSend decodes the input of --on-timeout send:..., which takes Go
+// string escapes such as \x03 for Ctrl-C or \r for Enter, quoted or not
+func parseSend(text string) ([]byte, error) {
+	if !strings.HasPrefix(text, `"`) {
+		text = `"` + strings.ReplaceAll(text, `"`, `\"`) + `"`
+	}
+	s, err := strconv.Unquote(text)
+	return []byte(s), err
+}
+
+// nudgeEcho is how long after a nudge output may just be the terminal
+// echoing it
+const nudgeEcho = time.Second
+
+// nudger types input into an idle command for --on-timeout send:..., up to
+// max times in a row before letting the kill go ahead. Output later than
+// the echo of a nudge shows it worked and starts the count over.
+type nudger struct {
+	input []byte
+	max   int
+	count int
+	last  time.Time
+}
+
+func newNudger(input []byte, max int) *nudger {
+	return &nudger{input: input, max: max}
+}
+
+// nudge sends the input unless the nudges so far have all failed,
+// reporting whether it did
+func (n *nudger) nudge(r *watchdog.Runner) bool {
+	if r.LastActivity().Sub(n.last) > nudgeEcho {
+		n.count = 0
+	}
+	if n.count >= n.max {
+		return false
+	}
+	if _, err := r.Write(n.input); err != nil {
+		return false
+	}
+	n.count++
+	n.last = time.Now()
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// patternRule changes the idle budget when a line of output matches: extend
+// lets the silence after the line last up to budget, while timeout makes
+// budget the idle timeout from then on
+type patternRule struct {
+	pattern *regexp.Regexp
+	extend  bool
+	budget  time.Duration
+}
+
+// patternRules is a flag.Value for --on-pattern, given once per rule as
+// 'pattern:extend=10m' or 'pattern:timeout=2m'
+type patternRules []patternRule
+
+// patternAction splits the action off the end of an --on-pattern rule
+var patternAction = regexp.MustCompile(`^(.+):(extend|timeout)=([^:]+)$`)
+
+func (p *patternRules) String() string {
+	var parts []string
+	for _, r := range *p {
+		action := "timeout"
+		if r.extend {
+			action = "extend"
+		}
+		parts = append(parts, fmt.Sprintf("%s:%s=%v", r.pattern, action, r.budget))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p *patternRules) Set(s string) error {
+	m := patternAction.FindStringSubmatch(s)
+	if m == nil {
+		return fmt.Errorf("expected pattern:extend=duration or pattern:timeout=duration, e.g. 'Compiling:extend=10m'")
+	}
+	re, err := regexp.Compile(m[1])
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", m[1], err)
+	}
+	budget, err := parseDuration(m[3])
+	if err != nil || budget < watchdog.Resolution {
+		return fmt.Errorf("invalid duration %q: expected at least %v", m[3], watchdog.Resolution)
+	}
+	*p = append(*p, patternRule{pattern: re, extend: m[2] == "extend", budget: budget})
+	return nil
+}
+
+// phaseWatcher applies --on-pattern rules to the output of one run, cleaned
+// of escape sequences: the rule whose pattern matches first applies, once
+// a line, and one with \n in it can match across lines
+type phaseWatcher struct {
+	mu      sync.Mutex
+	rules   patternRules
+	matcher *streamMatcher
+	timeout time.Duration // the idle timeout as last set
+	runner  *watchdog.Runner
+}
+
+func newPhaseWatcher(rules patternRules, timeout time.Duration) *phaseWatcher {
+	patterns := make([]*regexp.Regexp, len(rules))
+	for i, r := range rules {
+		patterns[i] = r.pattern
+	}
+	return &phaseWatcher{rules: rules, matcher: newStreamMatcher(false, patterns...), timeout: timeout}
+}
+
+func (w *phaseWatcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.matcher.feed(p, w.apply)
+	return len(p), nil
+}
+
+func (w *phaseWatcher) apply(rule int, _ [][]byte) {
+	if w.runner == nil {
+		return
+	}
+	r := w.rules[rule]
+	if r.extend {
+		w.runner.Extend(r.budget)
+	} else if r.budget != w.timeout {
+		w.timeout = r.budget
+		w.runner.SetTimeout(r.budget)
+		con.Logf("Idle timeout now %v (%s)", r.budget, r.pattern)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// otelExportTimeout bounds the final span export
+const otelExportTimeout = 10 * time.Second
+
+// otelAttr and friends mirror the OTLP/HTTP JSON encoding
+type otelAttr struct {
+	Key   string    `json:"key"`
+	Value otelValue `json:"value"`
+}
+
+type otelValue struct {
+	String *string  `json:"stringValue,omitempty"`
+	Int    *string  `json:"intValue,omitempty"` // int64 is a string in OTLP JSON
+	Double *float64 `json:"doubleValue,omitempty"`
+	Bool   *bool    `json:"boolValue,omitempty"`
+}
+
+func strAttr(k, v string) otelAttr { return otelAttr{k, otelValue{String: &v}} }
+func intAttr(k string, v int) otelAttr {
+	s := strconv.Itoa(v)
+	return otelAttr{k, otelValue{Int: &s}}
+}
+func floatAttr(k string, v float64) otelAttr { return otelAttr{k, otelValue{Double: &v}} }
+func boolAttr(k string, v bool) otelAttr     { return otelAttr{k, otelValue{Bool: &v}} }
+
+type otelEvent struct {
+	Time       string     `json:"timeUnixNano"`
+	Name       string     `json:"name"`
+	Attributes []otelAttr `json:"attributes,omitempty"`
+}
+
+type otelSpan struct {
+	TraceID      string      `json:"traceId"`
+	SpanID       string      `json:"spanId"`
+	ParentSpanID string      `json:"parentSpanId,omitempty"`
+	Name         string      `json:"name"`
+	Kind         int         `json:"kind"`
+	Start        string      `json:"startTimeUnixNano"`
+	End          string      `json:"endTimeUnixNano"`
+	Attributes   []otelAttr  `json:"attributes"`
+	Events       []otelEvent `json:"events,omitempty"`
+	Status       otelStatus  `json:"status"`
+}
+
+type otelStatus struct {
+	Code    int    `json:"code"` // 1 = OK, 2 = ERROR
+	Message string `json:"message,omitempty"`
+}
+
+// trace records one span covering the wrapped command's lifetime, all
+// attempts included, and exports it over OTLP/HTTP when the wrapper exits.
+// It is configured through the standard OTEL_* environment variables and
+// joins the caller's trace when TRACEPARENT is set.
+type trace struct {
+	endpoint string
+	headers  map[string]string
+	resource []otelAttr
+
+	mu   sync.Mutex
+	span otelSpan
+}
+
+// newTrace returns nil unless an OTLP traces endpoint is configured
+func newTrace(command []string, session string, timeout time.Duration) *trace {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return nil
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "idle-timeout"
+	}
+	t := &trace{
+		endpoint: endpoint,
+		headers:  parseOtelList(firstEnv("OTEL_EXPORTER_OTLP_TRACES_HEADERS", "OTEL_EXPORTER_OTLP_HEADERS")),
+		resource: []otelAttr{strAttr("service.name", service), strAttr("host.name", hostname)},
+	}
+	for k, v := range parseOtelList(os.Getenv("OTEL_RESOURCE_ATTRIBUTES")) {
+		if k != "service.name" {
+			t.resource = append(t.resource, strAttr(k, v))
+		}
+	}
+
+	traceID, parentID := randomHex(16), ""
+	// traceparent: version-traceid-parentid-flags
+	if parts := strings.Split(os.Getenv("TRACEPARENT"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		traceID, parentID = parts[1], parts[2]
+	}
+	t.span = otelSpan{
+		TraceID:      traceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: parentID,
+		Name:         "idle-timeout " + command[0],
+		Kind:         1, // internal
+		Start:        unixNano(time.Now()),
+		Attributes: []otelAttr{
+			strAttr("process.command", command[0]),
+			strAttr("process.command_line", strings.Join(command, " ")),
+			floatAttr("idle_timeout.limit_seconds", timeout.Seconds()),
+			strAttr("idle_timeout.session", session),
+		},
+	}
+	return t
+}
+
+// traceparent is exported to the child so its own spans nest under ours
+func (t *trace) traceparent() string {
+	return "TRACEPARENT=00-" + t.span.TraceID + "-" + t.span.SpanID + "-01"
+}
+
+// observe adds span events for an attempt's lifecycle
+func (t *trace) observe(e watchdog.Event, inv invocation) {
+	ev := otelEvent{Time: unixNano(e.Time), Attributes: []otelAttr{intAttr("idle_timeout.attempt", inv.seq)}}
+	switch e.Kind {
+	case watchdog.Started:
+		ev.Name = "started"
+		ev.Attributes = append(ev.Attributes, intAttr("process.pid", e.PID))
+	case watchdog.Warned:
+		ev.Name = "idle_warning"
+		ev.Attributes = append(ev.Attributes, floatAttr("idle_timeout.idle_seconds", e.Idle.Seconds()))
+	case watchdog.TimedOut:
+		ev.Name = "idle_timeout"
+		ev.Attributes = append(ev.Attributes, floatAttr("idle_timeout.idle_seconds", e.Idle.Seconds()))
+	case watchdog.Exited:
+		ev.Name = "exited"
+		ev.Attributes = append(ev.Attributes, intAttr("process.exit_code", e.ExitCode), boolAttr("idle_timeout.timed_out", e.TimedOut))
+	default:
+		return
+	}
+	t.mu.Lock()
+	t.span.Events = append(t.span.Events, ev)
+	t.mu.Unlock()
+}
+
+// end closes the span with the final outcome and exports it
+func (t *trace) end(final attempt, attempts int) {
+	t.mu.Lock()
+	span := t.span
+	t.mu.Unlock()
+
+	span.End = unixNano(time.Now())
+	span.Attributes = append(span.Attributes,
+		intAttr("process.exit_code", final.ExitCode),
+		boolAttr("idle_timeout.timed_out", final.TimedOut),
+		intAttr("idle_timeout.attempts", attempts),
+	)
+	span.Status = otelStatus{Code: 1}
+	if final.TimedOut {
+		span.Status = otelStatus{Code: 2, Message: "killed after idle timeout"}
+	} else if final.ExitCode != 0 {
+		span.Status = otelStatus{Code: 2, Message: fmt.Sprintf("exit status %d", final.ExitCode)}
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": t.resource},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/gavlooth/idle-timeout"},
+				"spans": []otelSpan{span},
+			}},
+		}},
+	})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		con.Logf("OpenTelemetry export failed: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := (&http.Client{Timeout: otelExportTimeout}).Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("%s", resp.Status)
+		}
+	}
+	if err != nil {
+		con.Logf("OpenTelemetry export failed: %v", err)
+	}
+}
+
+// parseOtelList parses the "k1=v1,k2=v2" form used by OTEL_* variables
+func parseOtelList(s string) map[string]string {
+	m := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		if uv, err := url.QueryUnescape(strings.TrimSpace(v)); err == nil {
+			v = uv
+		}
+		m[strings.TrimSpace(k)] = v
+	}
+	return m
+}
+
+func firstEnv(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
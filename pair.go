@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// flowWriter passes one stream of a pair along, counting it as activity of
+// both commands
+type flowWriter struct {
+	w       io.Writer
+	touch   func()
+	onError func() // called once if w fails, e.g. when the consumer is gone
+	once    sync.Once
+}
+
+func (f *flowWriter) Write(p []byte) (int, error) {
+	f.touch()
+	n, err := f.w.Write(p)
+	if err != nil && f.onError != nil {
+		f.once.Do(f.onError)
+	}
+	return n, err
+}
+
+// pairMain runs a producer piped into a consumer, replacing mkfifo-based
+// plumbing: the flow between them and both stderr streams count as
+// activity, and when all of it stalls both are killed
+func pairMain(args []string) int {
+	fset := flag.NewFlagSet("pair", flag.ExitOnError)
+	producer := fset.String("producer", "", "shell `command` whose stdout feeds the consumer")
+	consumer := fset.String("consumer", "", "shell `command` reading the producer's output")
+	var warnAt warnThreshold
+	fset.Var(&warnAt, "warn-at", "warn once per stall after this much inactivity, as a `percentage` of the timeout (80%) or a duration")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout pair <duration> --producer <command> --consumer <command>\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout pair 5m --producer 'pg_dump mydb' --consumer 'gzip > dump.gz'\n")
+		fmt.Fprintf(os.Stderr, "\nThe exit status is 124 after a stall, else the consumer's if it failed, else the producer's.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() > 0 {
+		// Options may follow the duration
+		durationArg := fset.Arg(0)
+		fset.Parse(fset.Args()[1:])
+		args = append([]string{durationArg}, fset.Args()...)
+	}
+	if len(args) != 1 || *producer == "" || *consumer == "" {
+		fset.Usage()
+		return 1
+	}
+	timeout, err := parseDuration(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", args[0], err)
+		return 1
+	}
+	if timeout < watchdog.Resolution {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: below the watchdog's %v resolution\n", args[0], watchdog.Resolution)
+		return 1
+	}
+
+	inv := newInvocation("")
+	env := append(os.Environ(), inv.env()...)
+	// A real pipe, so the consumer reads it directly and a write fails once
+	// the consumer is gone
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create pipe: %v\n", err)
+		return 1
+	}
+	var prod, cons *watchdog.Runner
+	touchBoth := func() {
+		prod.Touch()
+		cons.Touch()
+	}
+
+	// A stall times out both at once; whichever notices first takes the
+	// other down with it
+	var stall sync.Once
+	onEvent := func(e watchdog.Event) {
+		switch e.Kind {
+		case watchdog.Started:
+			if e.PID == cons.PID() {
+				pr.Close() // the consumer has its copy
+			}
+		case watchdog.Warned:
+			con.Logf("No flow for %v, killing both in %v...", idleFor(e.Idle), timeLeft(e.Timeout-e.Idle))
+		case watchdog.TimedOut:
+			stall.Do(func() {
+				con.Logf("No flow for %v, killing producer and consumer...", timeout)
+				prod.Expire()
+				cons.Expire()
+			})
+		}
+	}
+	// Both idle clocks see the same activity, so only the consumer's warns
+	newRunner := func(line string, stdin io.Reader, stdout, stderr io.Writer, warn time.Duration) *watchdog.Runner {
+		return watchdog.New(watchdog.Config{
+			Path:    shellCommand[0],
+			Args:    append(shellCommand[1:], line),
+			Env:     env,
+			Timeout: timeout,
+			WarnAt:  warn,
+			Stdin:   stdin,
+			Stdout:  stdout,
+			Stderr:  stderr,
+			OnEvent: onEvent,
+		})
+	}
+	// Like a shell pipeline, the producer gets SIGPIPE once the consumer is
+	// gone
+	var brokePipe bool
+	prod = newRunner(*producer, os.Stdin,
+		&flowWriter{w: pw, touch: touchBoth, onError: func() {
+			brokePipe = true
+			prod.SignalGroup(brokenPipe)
+		}},
+		&flowWriter{w: con.stderr(), touch: touchBoth}, 0)
+	cons = newRunner(*consumer, pr,
+		&flowWriter{w: con, touch: touchBoth},
+		&flowWriter{w: con.stderr(), touch: touchBoth}, warnAt.resolve(timeout))
+	con.Printf("spawn %s | %s\n", *producer, *consumer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, forwardedSignals...)
+	defer signal.Stop(sigChan)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigChan:
+				prod.Signal(sig)
+				cons.Signal(sig)
+			}
+		}
+	}()
+
+	var prodRes, consRes watchdog.Result
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		prodRes = prod.Run(ctx)
+		pw.Close() // end of input for the consumer
+	}()
+	go func() {
+		defer wg.Done()
+		consRes = cons.Run(ctx)
+	}()
+	wg.Wait()
+
+	for _, res := range []watchdog.Result{prodRes, consRes} {
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run command: %v\n", res.Err)
+			return 1
+		}
+	}
+	switch {
+	case prodRes.TimedOut || consRes.TimedOut:
+		return watchdog.ExitTimedOut
+	case consRes.ExitCode != 0 || brokePipe:
+		return consRes.ExitCode
+	}
+	return prodRes.ExitCode
+}
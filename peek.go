@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// peekMain, the attach subcommand, retrofits a watchdog onto a process that is already running by
+// tracing its writes to one file descriptor, or with --io by watching its
+// I/O counters
+func peekMain(args []string) int {
+	fset := flag.NewFlagSet("attach", flag.ExitOnError)
+	pid := fset.Int("pid", 0, "`PID` of the process to watch")
+	fd := fset.Int("fd", 1, "file `descriptor` whose writes count as activity")
+	useIO := fset.Bool("io", false, "count any change of the process's read/write byte counters in /proc/PID/io as activity instead of tracing writes; needs no ptrace permission, but the exit status is unknown")
+	noKill := fset.Bool("no-kill", false, "only report stalls (and run -on-timeout) instead of killing the process")
+	onTimeout := fset.String("on-timeout", "", "run shell `command` when the process stalls, before it is killed")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout attach --pid N [--fd 1 | --io] [options] <duration>\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout attach --pid 4242 --fd 1 10m\n")
+		fmt.Fprintf(os.Stderr, "         idle-timeout attach 10m --pid 4242 --io\n")
+		fmt.Fprintf(os.Stderr, "\nTracing another process needs ptrace permission: the same user with\n")
+		fmt.Fprintf(os.Stderr, "kernel.yama.ptrace_scope=0, or CAP_SYS_PTRACE.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() > 0 {
+		// Options may follow the duration
+		durationArg := fset.Arg(0)
+		fset.Parse(fset.Args()[1:])
+		args = append([]string{durationArg}, fset.Args()...)
+	} else {
+		args = nil
+	}
+	if len(args) != 1 || *pid <= 0 {
+		fset.Usage()
+		return 1
+	}
+	timeout, err := parseDuration(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", args[0], err)
+		return 1
+	}
+
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	exited := make(chan int, 1)
+	traceErr := make(chan error, 1)
+	watch, activity := traceWrites, fmt.Sprintf("write to fd %d of PID %d", *fd, *pid)
+	if *useIO {
+		watch = func(pid, _ int, active func()) (int, error) { return watchIO(pid, active) }
+		activity = fmt.Sprintf("I/O by PID %d", *pid)
+	}
+	go func() {
+		code, err := watch(*pid, *fd, func() { last.Store(time.Now().UnixNano()) })
+		if err != nil {
+			traceErr <- err
+			return
+		}
+		exited <- code
+	}()
+	con.Logf("Watching %s", activity)
+
+	inv := newInvocation("")
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	reported := false
+	for {
+		select {
+		case err := <-traceErr:
+			fmt.Fprintf(os.Stderr, "Failed to watch PID %d: %v\n", *pid, err)
+			return 1
+		case code := <-exited:
+			if code < 0 {
+				con.Logf("PID %d exited", *pid)
+				code = 0
+			} else {
+				con.Logf("PID %d exited with status %d", *pid, code)
+			}
+			if reported {
+				return watchdog.ExitTimedOut
+			}
+			return code
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, last.Load()))
+			if idle < timeout {
+				reported = false
+				continue
+			}
+			if reported {
+				continue
+			}
+			reported = true
+			if *noKill {
+				con.Logf("No %s for %v", activity, timeout)
+			} else {
+				con.Logf("No %s for %v, killing process...", activity, timeout)
+			}
+			if *onTimeout != "" {
+				runHook("on-timeout", *onTimeout, hookEnv(inv, *pid, idle, timeout))
+			}
+			if !*noKill {
+				if p, err := os.FindProcess(*pid); err == nil {
+					p.Kill()
+				}
+				return watchdog.ExitTimedOut
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// traceWrites attaches to every thread of pid with ptrace and calls active
+// whenever one of them completes a write to fd, or to another descriptor
+// open on the same file. It returns the process's exit status once it is
+// gone. Exiting the tracer detaches it, so the process carries on untouched.
+func traceWrites(pid, fd int, active func()) (int, error) {
+	// Every ptrace request must come from the thread that attached
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	target, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+	if err != nil {
+		return 0, err
+	}
+	sameFile := func(f int) bool {
+		if f == fd {
+			return true
+		}
+		link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, f))
+		return err == nil && link == target
+	}
+
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range tasks {
+		tid, _ := strconv.Atoi(t.Name())
+		if err := syscall.PtraceAttach(tid); err != nil {
+			if errors.Is(err, syscall.EPERM) {
+				err = fmt.Errorf("%w (needs CAP_SYS_PTRACE or kernel.yama.ptrace_scope=0)", err)
+			}
+			return 0, err
+		}
+	}
+
+	var (
+		attached = map[int]bool{} // threads past their initial SIGSTOP
+		inCall   = map[int]bool{} // between syscall entry and exit
+		pending  = map[int]bool{} // inside a write to the watched file
+	)
+	for {
+		// WNOTHREAD limits the wait to tracees of this locked thread, so it
+		// never reaps a hook the main goroutine started and waits for
+		var ws syscall.WaitStatus
+		tid, err := syscall.Wait4(-1, &ws, syscall.WALL|syscall.WNOTHREAD, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch {
+		case ws.Exited():
+			if tid == pid {
+				return ws.ExitStatus(), nil
+			}
+			continue
+		case ws.Signaled():
+			if tid == pid {
+				return 128 + int(ws.Signal()), nil
+			}
+			continue
+		case !ws.Stopped():
+			continue
+		}
+
+		sig := ws.StopSignal()
+		switch {
+		case sig == syscall.SIGTRAP|0x80: // syscall stop, see PTRACE_O_TRACESYSGOOD
+			sig = 0
+			var regs syscall.PtraceRegs
+			if syscall.PtraceGetRegs(tid, &regs) != nil {
+				break
+			}
+			nr, arg0, ret := syscallRegs(&regs)
+			if inCall[tid] = !inCall[tid]; inCall[tid] {
+				pending[tid] = writeSyscalls[nr] && sameFile(int(arg0))
+			} else if pending[tid] {
+				pending[tid] = false
+				if int64(ret) > 0 {
+					active()
+				}
+			}
+		case sig == syscall.SIGTRAP && ws.TrapCause() == syscall.PTRACE_EVENT_CLONE:
+			sig = 0
+		case sig == syscall.SIGSTOP && !attached[tid]:
+			// Initial stop after attaching, or of a newly cloned thread
+			attached[tid] = true
+			sig = 0
+			syscall.PtraceSetOptions(tid, syscall.PTRACE_O_TRACESYSGOOD|syscall.PTRACE_O_TRACECLONE)
+		}
+		syscall.PtraceSyscall(tid, int(sig))
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import "syscall"
+
+// writeSyscalls are the calls whose first argument is a descriptor written to
+var writeSyscalls = map[uint64]bool{
+	1:   true, // write
+	18:  true, // pwrite64
+	20:  true, // writev
+	40:  true, // sendfile
+	296: true, // pwritev
+	328: true, // pwritev2
+}
+
+// syscallRegs extracts the syscall number, first argument and return value
+func syscallRegs(r *syscall.PtraceRegs) (nr, arg0, ret uint64) {
+	return r.Orig_rax, r.Rdi, r.Rax
+}
@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// writeSyscalls are the calls whose first argument is a descriptor written to
+var writeSyscalls = map[uint64]bool{
+	64:  true, // write
+	66:  true, // writev
+	68:  true, // pwrite64
+	70:  true, // pwritev
+	71:  true, // sendfile
+	287: true, // pwritev2
+}
+
+// syscallRegs extracts the syscall number, first argument and return value.
+// x0 holds the first argument on entry and the return value on exit.
+func syscallRegs(r *syscall.PtraceRegs) (nr, arg0, ret uint64) {
+	return r.Regs[8], r.Regs[0], r.Regs[0]
+}
@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import "errors"
+
+// traceWrites needs ptrace syscall tracing, implemented for Linux on amd64
+// and arm64 only
+func traceWrites(pid, fd int, active func()) (int, error) {
+	return 0, errors.New("peek is only supported on Linux (amd64, arm64)")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// perfRounds is how often each measurement is repeated; the best round
+// counts, which filters out most of the noise of a busy machine
+const perfRounds = 3
+
+// percentFlag is a percentage such as 20%
+type percentFlag float64
+
+func (p *percentFlag) String() string {
+	return strconv.FormatFloat(float64(*p), 'g', -1, 64) + "%"
+}
+
+func (p *percentFlag) Set(v string) error {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+	if err != nil || f < 0 {
+		return errors.New("expected a percentage such as 20%")
+	}
+	*p = percentFlag(f)
+	return nil
+}
+
+// perfCheckMain measures what the watchdog's passthrough costs against a
+// bare pipe on this machine, failing if the overhead exceeds the limits.
+// Both sides read the same child, a copy of this binary running perf-emit.
+func perfCheckMain(args []string) int {
+	fset := flag.NewFlagSet("perf-check", flag.ExitOnError)
+	megabytes := fset.Int("size", 256, "`MiB` of output for the throughput test")
+	lines := fset.Int("lines", 200, "`number` of timestamped lines for the latency test")
+	maxSlowdown := percentFlag(20)
+	fset.Var(&maxSlowdown, "max-slowdown", "fail if throughput drops by more than this `percentage`")
+	maxLatency := durationFlag(5 * time.Millisecond)
+	fset.Var(&maxLatency, "max-latency", "fail if the 99th percentile latency grows by more than this `duration`")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout perf-check [options]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout perf-check --max-slowdown 10%% --max-latency 2ms\n")
+		fmt.Fprintf(os.Stderr, "\nCompares output passed through the watchdog with a bare pipe; exits 1 if the\n")
+		fmt.Fprintf(os.Stderr, "overhead is over either limit.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() != 0 || *megabytes <= 0 || *lines <= 0 {
+		fset.Usage()
+		return 1
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find own executable: %v\n", err)
+		return 1
+	}
+
+	size := int64(*megabytes) << 20
+	emitBytes := []string{"perf-emit", "bytes", strconv.FormatInt(size, 10)}
+	var bare, wrapped time.Duration
+	for range perfRounds {
+		start := time.Now()
+		if err := runBare(self, emitBytes, io.Discard); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run bare pipe: %v\n", err)
+			return 1
+		}
+		bare = minDuration(bare, time.Since(start))
+		start = time.Now()
+		if err := runWatched(self, emitBytes, io.Discard); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run through the watchdog: %v\n", err)
+			return 1
+		}
+		wrapped = minDuration(wrapped, time.Since(start))
+	}
+	bareRate, wrappedRate := float64(size)/bare.Seconds(), float64(size)/wrapped.Seconds()
+	slowdown := max(0, 100*(1-wrappedRate/bareRate))
+
+	emitLines := []string{"perf-emit", "lines", strconv.Itoa(*lines)}
+	var bareP99, wrappedP99 time.Duration
+	for range perfRounds {
+		lat := &latencies{}
+		if err := runBare(self, emitLines, lat); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run bare pipe: %v\n", err)
+			return 1
+		}
+		bareP99 = minDuration(bareP99, lat.percentile(99))
+		lat = &latencies{}
+		if err := runWatched(self, emitLines, lat); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run through the watchdog: %v\n", err)
+			return 1
+		}
+		wrappedP99 = minDuration(wrappedP99, lat.percentile(99))
+	}
+	added := max(0, wrappedP99-bareP99)
+
+	fmt.Printf("%-12s %12s %12s %12s\n", "", "bare pipe", "watchdog", "overhead")
+	fmt.Printf("%-12s %8.0f MB/s %8.0f MB/s %11.1f%%\n", "throughput", bareRate/1e6, wrappedRate/1e6, slowdown)
+	fmt.Printf("%-12s %12v %12v %12v\n", "p99 latency", bareP99.Round(time.Microsecond), wrappedP99.Round(time.Microsecond), added.Round(time.Microsecond))
+
+	status := 0
+	if slowdown > float64(maxSlowdown) {
+		fmt.Fprintf(os.Stderr, "Throughput overhead %.1f%% is over the %v limit\n", slowdown, &maxSlowdown)
+		status = 1
+	}
+	if added > time.Duration(maxLatency) {
+		fmt.Fprintf(os.Stderr, "Added latency %v is over the %v limit\n", added.Round(time.Microsecond), &maxLatency)
+		status = 1
+	}
+	return status
+}
+
+// perfEmitMain is the child side of perf-check: "bytes N" writes N bytes
+// as fast as it can, "lines N" writes N lines, each holding the time it
+// was written, a millisecond apart
+func perfEmitMain(args []string) int {
+	if len(args) != 2 {
+		return 1
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return 1
+	}
+	switch args[0] {
+	case "bytes":
+		buf := bytes.Repeat([]byte("idle-timeout\n"), 32<<10/13)
+		for n > 0 {
+			chunk := buf[:min(n, int64(len(buf)))]
+			if _, err := os.Stdout.Write(chunk); err != nil {
+				return 1
+			}
+			n -= int64(len(chunk))
+		}
+	case "lines":
+		for range n {
+			fmt.Fprintf(os.Stdout, "%d\n", time.Now().UnixNano())
+			time.Sleep(time.Millisecond)
+		}
+	default:
+		return 1
+	}
+	return 0
+}
+
+// runBare runs the emitter with its stdout copied straight into w, in
+// chunks as large as the watchdog's
+func runBare(self string, args []string, w io.Writer) error {
+	cmd := exec.Command(self, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Hiding the pipe's WriterTo keeps io.Copy from picking its own chunks
+	_, err = io.CopyBuffer(w, struct{ io.Reader }{stdout}, make([]byte, 32*1024))
+	if werr := cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// runWatched runs the emitter the way run does, minus the terminal
+func runWatched(self string, args []string, w io.Writer) error {
+	res := watchdog.New(watchdog.Config{
+		Path:    self,
+		Args:    args,
+		Timeout: time.Minute,
+		Stdout:  w,
+	}).Run(context.Background())
+	switch {
+	case res.Err != nil:
+		return res.Err
+	case res.ExitCode != 0:
+		return fmt.Errorf("emitter exited with status %d", res.ExitCode)
+	}
+	return nil
+}
+
+// minDuration is the smaller of best and d, where a zero best means none
+// yet
+func minDuration(best, d time.Duration) time.Duration {
+	if best == 0 || d < best {
+		return d
+	}
+	return best
+}
+
+// latencies collects how long each timestamped line took to arrive
+type latencies struct {
+	mu      sync.Mutex
+	partial []byte
+	samples []time.Duration
+}
+
+func (l *latencies) Write(p []byte) (int, error) {
+	now := time.Now().UnixNano()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		nl := bytes.IndexByte(l.partial, '\n')
+		if nl < 0 {
+			break
+		}
+		if sent, err := strconv.ParseInt(string(l.partial[:nl]), 10, 64); err == nil {
+			l.samples = append(l.samples, time.Duration(now-sent))
+		}
+		l.partial = l.partial[nl+1:]
+	}
+	return len(p), nil
+}
+
+func (l *latencies) percentile(p int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) == 0 {
+		return 0
+	}
+	sort.Slice(l.samples, func(i, j int) bool { return l.samples[i] < l.samples[j] })
+	return l.samples[(len(l.samples)*p+99)/100-1]
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// splitStages splits a command line into pipeline stages at each "--"
+func splitStages(args []string) [][]string {
+	stages := [][]string{nil}
+	for _, arg := range args {
+		if arg == "--" {
+			stages = append(stages, nil)
+			continue
+		}
+		stages[len(stages)-1] = append(stages[len(stages)-1], arg)
+	}
+	return stages
+}
+
+// pipeMain runs a pipeline of commands, each stage's output piped into
+// the next like a shell pipeline, under one idle clock: output of the last
+// stage and the stderr of any stage count as activity, and so does data
+// flowing between stages with -flow. A stall kills every stage, so a hang
+// upstream isn't missed the way wrapping only the last command misses it.
+func pipeMain(args []string) int {
+	fset := flag.NewFlagSet("pipe", flag.ExitOnError)
+	flow := fset.Bool("flow", false, "count data flowing between stages as activity too, for a last stage that is quiet until its input ends (e.g. sort or gzip)")
+	var warnAt warnThreshold
+	fset.Var(&warnAt, "warn-at", "warn once per stall after this much inactivity, as a `percentage` of the timeout (80%) or a duration")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout pipe [options] <duration> -- <command> [args...] -- <command> [args...] ...\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout pipe 60s -- pg_dump mydb -- gzip -- aws s3 cp - s3://bucket/dump.gz\n")
+		fmt.Fprintf(os.Stderr, "\nThe exit status is 124 after a stall, else that of the last stage to fail, like a shell with pipefail;\n")
+		fmt.Fprintf(os.Stderr, "a stage sent SIGPIPE because the next one was gone doesn't count as failing.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() == 0 {
+		fset.Usage()
+		return 1
+	}
+	// Options may follow the duration
+	durationArg := fset.Arg(0)
+	fset.Parse(fset.Args()[1:])
+	stages := splitStages(fset.Args())
+	if len(stages) < 2 {
+		fset.Usage()
+		return 1
+	}
+	for _, stage := range stages {
+		if len(stage) == 0 {
+			fmt.Fprintf(os.Stderr, "Empty pipeline stage: each \"--\" must be followed by a command\n")
+			return 1
+		}
+	}
+	timeout, err := parseDuration(durationArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", durationArg, err)
+		return 1
+	}
+	if timeout < watchdog.Resolution {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: below the watchdog's %v resolution\n", durationArg, watchdog.Resolution)
+		return 1
+	}
+
+	inv := newInvocation("")
+	env := append(os.Environ(), inv.env()...)
+	n := len(stages)
+	runners := make([]*watchdog.Runner, n)
+	touchAll := func() {
+		for _, r := range runners {
+			r.Touch()
+		}
+	}
+	nothing := func() {}
+
+	// A real pipe between each pair of stages, so the next stage reads it
+	// directly and a write fails once that stage is gone
+	readers := make([]*os.File, n-1)
+	writers := make([]*os.File, n-1)
+	for i := range readers {
+		if readers[i], writers[i], err = os.Pipe(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create pipe: %v\n", err)
+			return 1
+		}
+	}
+
+	// A stall times out every stage at once; whichever notices first
+	// takes the others down with it
+	var stall sync.Once
+	brokePipe := make([]atomic.Bool, n)
+	for i, argv := range stages {
+		var stdin io.Reader = os.Stdin
+		if i > 0 {
+			stdin = readers[i-1]
+		}
+		// Like a shell pipeline, a stage gets SIGPIPE once the next is gone
+		var stdout io.Writer = &flowWriter{w: con, touch: touchAll}
+		if i < n-1 {
+			touch := nothing
+			if *flow {
+				touch = touchAll
+			}
+			stdout = &flowWriter{w: writers[i], touch: touch, onError: func() {
+				brokePipe[i].Store(true)
+				runners[i].SignalGroup(brokenPipe)
+			}}
+		}
+		// All idle clocks see the same activity, so only the last stage's
+		// warns
+		var warn time.Duration
+		if i == n-1 {
+			warn = warnAt.resolve(timeout)
+		}
+		runners[i] = watchdog.New(watchdog.Config{
+			Path:    argv[0],
+			Args:    argv[1:],
+			Env:     env,
+			Timeout: timeout,
+			WarnAt:  warn,
+			Stdin:   stdin,
+			Stdout:  stdout,
+			Stderr:  &flowWriter{w: con.stderr(), touch: touchAll},
+			OnEvent: func(e watchdog.Event) {
+				switch e.Kind {
+				case watchdog.Started:
+					if i > 0 {
+						readers[i-1].Close() // the stage has its copy
+					}
+				case watchdog.Warned:
+					con.Logf("No output from the pipeline for %v, killing all %d stages in %v...", idleFor(e.Idle), n, timeLeft(e.Timeout-e.Idle))
+				case watchdog.TimedOut:
+					stall.Do(func() {
+						con.Logf("No output from the pipeline for %v, killing all %d stages...", timeout, n)
+						for _, r := range runners {
+							r.Expire()
+						}
+					})
+				}
+			},
+		})
+	}
+	var line []string
+	for _, argv := range stages {
+		line = append(line, strings.Join(argv, " "))
+	}
+	con.Printf("spawn %s\n", strings.Join(line, " | "))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, forwardedSignals...)
+	defer signal.Stop(sigChan)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigChan:
+				for _, r := range runners {
+					r.Signal(sig)
+				}
+			}
+		}
+	}()
+
+	results := make([]watchdog.Result, n)
+	var wg sync.WaitGroup
+	for i := range runners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runners[i].Run(ctx)
+			if i < n-1 {
+				writers[i].Close() // end of input for the next stage
+			}
+		}()
+	}
+	wg.Wait()
+
+	code, timedOut := 0, false
+	for i, res := range results {
+		if res.Err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run %s: %v\n", stages[i][0], res.Err)
+			return 1
+		}
+		if res.TimedOut {
+			timedOut = true
+		}
+		// A stage ended by SIGPIPE was only stopped early by the next one
+		if res.ExitCode != 0 && !brokePipe[i].Load() {
+			code = res.ExitCode
+		}
+	}
+	if timedOut {
+		return watchdog.ExitTimedOut
+	}
+	return code
+}
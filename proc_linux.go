@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// processDir returns the working directory of pid, or "" if unknown
+func processDir(pid int) string {
+	dir, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/cwd")
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// watchIO polls the read and write byte counters of pid in /proc/<pid>/io,
+// counting all of its threads, and calls active whenever they change. I/O
+// through any descriptor counts, terminals and pipes included, but not
+// that of the process's children. It returns once the process is gone;
+// the exit status of a process that isn't ours can't be known, so it is
+// reported as -1.
+func watchIO(pid int, active func()) (int, error) {
+	path := fmt.Sprintf("/proc/%d/io", pid)
+	var last []byte
+	for first := true; ; first = false {
+		counters, err := ioCounters(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !first:
+			return -1, nil
+		case err != nil:
+			return 0, err
+		case zombie(pid):
+			return -1, nil
+		}
+		if !first && !bytes.Equal(counters, last) {
+			active()
+		}
+		last = counters
+		time.Sleep(watchdog.Resolution)
+	}
+}
+
+// ioCounters returns the rchar and wchar lines of an io file, leaving out
+// the block-device counters, which lag behind the page cache
+func ioCounters(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var counters []byte
+	for line := range bytes.Lines(data) {
+		if bytes.HasPrefix(line, []byte("rchar:")) || bytes.HasPrefix(line, []byte("wchar:")) {
+			counters = append(counters, line...)
+		}
+	}
+	if counters == nil {
+		return nil, fmt.Errorf("%s: no byte counters", path)
+	}
+	return counters, nil
+}
+
+// diskIO returns the bytes pid has had read from and written to storage,
+// including those of its children once they have been waited for
+func diskIO(pid int) (uint64, bool) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/io")
+	if err != nil {
+		return 0, false
+	}
+	var total uint64
+	for line := range strings.Lines(string(data)) {
+		name, value, _ := strings.Cut(strings.TrimSpace(line), ": ")
+		if name == "read_bytes" || name == "write_bytes" {
+			n, _ := strconv.ParseUint(value, 10, 64)
+			total += n
+		}
+	}
+	return total, true
+}
+
+// zombie reports whether pid has exited but not been reaped yet
+func zombie(pid int) bool {
+	f := statFields(pid)
+	return len(f) > 0 && f[0] == "Z"
+}
+
+// checkProcTree reports whether the processes below a command can be
+// inspected
+func checkProcTree() error {
+	return nil
+}
+
+// processTree returns root and every process below it
+func processTree(root int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return []int{root}
+	}
+	children := map[int][]int{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if f := statFields(pid); len(f) > 1 {
+			ppid, _ := strconv.Atoi(f[1])
+			children[ppid] = append(children[ppid], pid)
+		}
+	}
+	tree := []int{root}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+// cpuTime returns the CPU time pid has used in clock ticks, including that
+// of its children once they have been waited for
+func cpuTime(pid int) (uint64, bool) {
+	f := statFields(pid)
+	if len(f) < 15 {
+		return 0, false
+	}
+	var total uint64
+	for _, v := range f[11:15] { // utime, stime, cutime, cstime
+		n, _ := strconv.ParseUint(v, 10, 64)
+		total += n
+	}
+	return total, true
+}
+
+// statFields returns the fields of /proc/<pid>/stat after the command
+// name, starting with the state
+func statFields(pid int) []string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil
+	}
+	// The command name is parenthesised and may itself contain ") "
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return nil
+	}
+	return strings.Fields(string(data[i+1:]))
+}
@@ -0,0 +1,42 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errNoProcTree = errors.New("inspecting a command's processes needs /proc, which only Linux has")
+
+// processDir returns "", meaning unknown
+func processDir(pid int) string {
+	return ""
+}
+
+// watchIO needs /proc/<pid>/io, which only Linux has
+func watchIO(pid int, active func()) (int, error) {
+	return 0, errors.New("I/O counters are only available on Linux")
+}
+
+// checkProcTree fails: only Linux has /proc
+func checkProcTree() error {
+	return errNoProcTree
+}
+
+// processTree returns just root
+func processTree(root int) []int {
+	return []int{root}
+}
+
+// cpuTime is unknown without /proc
+func cpuTime(pid int) (uint64, bool) {
+	return 0, false
+}
+
+// diskIO is unknown without /proc
+func diskIO(pid int) (uint64, bool) {
+	return 0, false
+}
+
+// zombie reports false, as it can't tell without /proc
+func zombie(pid int) bool {
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// repeatDetector spots a command stuck printing the same line over and
+// over for --kill-on-repeat, such as a client retrying forever: its output
+// keeps the idle clock from ever running out. Lines are compared cleaned
+// of escape sequences, and blank lines between the repeats don't count.
+type repeatDetector struct {
+	mu      sync.Mutex
+	limit   int
+	partial []byte
+	line    string
+	count   int
+	tripped bool
+	expire  func() // called once the limit is reached
+}
+
+func newRepeatDetector(limit int) *repeatDetector {
+	return &repeatDetector{limit: limit}
+}
+
+func (d *repeatDetector) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	d.partial = append(d.partial, p...)
+	for {
+		nl := bytes.IndexByte(d.partial, '\n')
+		if nl < 0 {
+			break
+		}
+		d.add(cleanLine(string(d.partial[:nl])))
+		d.partial = d.partial[nl+1:]
+	}
+	if len(d.partial) > maxTailLine {
+		d.partial = d.partial[len(d.partial)-maxTailLine:]
+	}
+	var expire func()
+	if d.tripped {
+		expire, d.expire = d.expire, nil
+	}
+	d.mu.Unlock()
+	if expire != nil {
+		expire()
+	}
+	return len(p), nil
+}
+
+func (d *repeatDetector) add(line string) {
+	switch {
+	case d.tripped || line == "":
+		return
+	case line == d.line:
+		d.count++
+	default:
+		d.line, d.count = line, 1
+	}
+	d.tripped = d.count >= d.limit
+}
+
+// repeated returns the line that reached the limit, if one did; a nil
+// detector never trips
+func (d *repeatDetector) repeated() (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.line, d.tripped
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// replayChunk is output to show after a delay
+type replayChunk struct {
+	delay time.Duration
+	data  []byte
+}
+
+// speedFlag is a playback speed factor such as 2x or 0.5
+type speedFlag float64
+
+func (s *speedFlag) String() string { return strconv.FormatFloat(float64(*s), 'g', -1, 64) + "x" }
+
+func (s *speedFlag) Set(v string) error {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(v, "x"), 64)
+	if err != nil || f <= 0 {
+		return errors.New("expected a positive factor such as 2x")
+	}
+	*s = speedFlag(f)
+	return nil
+}
+
+// replayMain plays back a --record typescript or a --cast recording in the
+// terminal with its original timing
+func replayMain(args []string) int {
+	fset := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := speedFlag(1)
+	fset.Var(&speed, "speed", "play back this many `times` faster (e.g. 2x, 0.5)")
+	var maxDelay durationFlag
+	fset.Var(&maxDelay, "max-delay", "shorten any pause to at most this `duration`, such as the silence before a kill")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout replay [options] <typescript> [<timing-file>]\n")
+		fmt.Fprintf(os.Stderr, "       idle-timeout replay [options] <recording.cast>\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout replay --speed 2x session.log session.tm\n")
+		fmt.Fprintf(os.Stderr, "The timing file defaults to the typescript's path with .tm appended.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	if fset.NArg() < 1 || fset.NArg() > 2 {
+		fset.Usage()
+		return 1
+	}
+
+	path := fset.Arg(0)
+	var chunks []replayChunk
+	var err error
+	if strings.HasSuffix(path, ".cast") && fset.NArg() == 1 {
+		chunks, err = readCastChunks(path)
+	} else {
+		timing := path + ".tm"
+		if fset.NArg() == 2 {
+			timing = fset.Arg(1)
+		}
+		chunks, err = readScriptChunks(path, timing)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", path, err)
+		return 1
+	}
+
+	for _, c := range chunks {
+		delay := time.Duration(float64(c.delay) / float64(speed))
+		if maxDelay > 0 && delay > time.Duration(maxDelay) {
+			delay = time.Duration(maxDelay)
+		}
+		time.Sleep(delay)
+		os.Stdout.Write(c.data)
+	}
+	return 0
+}
+
+// readScriptChunks reads a script(1) typescript and its timing file. Both
+// the classic timing format ("delay bytes") and the advanced one ("O delay
+// bytes", of which only output is replayed) are understood.
+func readScriptChunks(path, timing string) ([]replayChunk, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// The first line is the "Script started" header
+	if nl := bytes.IndexByte(data, '\n'); nl >= 0 {
+		data = data[nl+1:]
+	}
+	tf, err := os.Open(timing)
+	if err != nil {
+		return nil, err
+	}
+	defer tf.Close()
+
+	var chunks []replayChunk
+	var pending time.Duration // delays of entries that aren't output
+	sc := bufio.NewScanner(tf)
+	for num := 1; sc.Scan(); num++ {
+		fields := strings.Fields(sc.Text())
+		kind := "O"
+		if len(fields) == 3 {
+			kind, fields = fields[0], fields[1:]
+		}
+		if len(fields) != 2 {
+			continue // e.g. the advanced format's header entries
+		}
+		secs, err := strconv.ParseFloat(fields[0], 64)
+		n, nerr := strconv.Atoi(fields[1])
+		if err != nil || nerr != nil || secs < 0 || n < 0 {
+			return nil, fmt.Errorf("%s:%d: malformed timing entry", timing, num)
+		}
+		pending += time.Duration(secs * float64(time.Second))
+		if kind != "O" {
+			continue
+		}
+		n = min(n, len(data))
+		chunks = append(chunks, replayChunk{delay: pending, data: data[:n]})
+		data, pending = data[n:], 0
+	}
+	return chunks, sc.Err()
+}
+
+// readCastChunks reads the output events of an asciinema v2 recording
+func readCastChunks(path string) ([]replayChunk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var chunks []replayChunk
+	var last float64
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	sc.Scan() // the header
+	for sc.Scan() {
+		var ev []any
+		if json.Unmarshal(sc.Bytes(), &ev) != nil || len(ev) != 3 {
+			continue
+		}
+		t, _ := ev[0].(float64)
+		kind, _ := ev[1].(string)
+		text, _ := ev[2].(string)
+		if kind != "o" {
+			continue
+		}
+		chunks = append(chunks, replayChunk{delay: time.Duration((t - last) * float64(time.Second)), data: []byte(text)})
+		last = t
+	}
+	return chunks, sc.Err()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// requirement is a compiled --require condition: when the idle timeout is
+// reached, the command is only killed if it holds
+type requirement struct {
+	text    string
+	eval    func(r meterReading) bool
+	metrics map[string]bool // the meter metrics it refers to
+}
+
+// requireMetrics are the rates a condition can compare, each per second:
+// CPU use in percent of one CPU, disk and TCP traffic in bytes
+var requireMetrics = map[string]bool{"cpu": true, "io": true, "net": true}
+
+// parseRequirement compiles a condition such as 'idle && cpu<5%'. It is
+// made of idle (the timeout was reached), comparisons of cpu, io and net
+// with <, <=, >, >=, == or !=, and !, &&, || and parentheses.
+func parseRequirement(text string) (*requirement, error) {
+	toks, err := tokenizeRequirement(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &requireParser{toks: toks, metrics: map[string]bool{}}
+	eval, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos])
+	}
+	return &requirement{text: text, eval: eval, metrics: p.metrics}, nil
+}
+
+// tokenizeRequirement splits a condition into names, numbers with their
+// units, and operators
+func tokenizeRequirement(text string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(text) && (unicode.IsLetter(rune(text[j])) || unicode.IsDigit(rune(text[j])) || text[j] == '.' || text[j] == '%') {
+				j++
+			}
+			toks = append(toks, text[i:j])
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"&&", "||", "<=", ">=", "==", "!=", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(text[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q", text[i:i+1])
+			}
+			toks = append(toks, op)
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+type requireParser struct {
+	toks    []string
+	pos     int
+	metrics map[string]bool
+}
+
+func (p *requireParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *requireParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *requireParser) or() (func(meterReading) bool, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right func(meterReading) bool
+		if right, err = p.and(); err == nil {
+			l := left
+			left = func(r meterReading) bool { return l(r) || right(r) }
+		}
+	}
+	return left, err
+}
+
+func (p *requireParser) and() (func(meterReading) bool, error) {
+	left, err := p.unary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right func(meterReading) bool
+		if right, err = p.unary(); err == nil {
+			l := left
+			left = func(r meterReading) bool { return l(r) && right(r) }
+		}
+	}
+	return left, err
+}
+
+func (p *requireParser) unary() (func(meterReading) bool, error) {
+	switch t := p.next(); {
+	case t == "!":
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r meterReading) bool { return !inner(r) }, nil
+	case t == "(":
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return inner, nil
+	case t == "idle":
+		// Conditions are checked when the idle timeout is reached
+		return func(meterReading) bool { return true }, nil
+	case requireMetrics[t]:
+		return p.comparison(t)
+	case t == "":
+		return nil, fmt.Errorf("unexpected end")
+	default:
+		return nil, fmt.Errorf("unknown condition %q: expected idle, cpu, io or net", t)
+	}
+}
+
+func (p *requireParser) comparison(metric string) (func(meterReading) bool, error) {
+	op := p.next()
+	var cmp func(a, b float64) bool
+	switch op {
+	case "<":
+		cmp = func(a, b float64) bool { return a < b }
+	case "<=":
+		cmp = func(a, b float64) bool { return a <= b }
+	case ">":
+		cmp = func(a, b float64) bool { return a > b }
+	case ">=":
+		cmp = func(a, b float64) bool { return a >= b }
+	case "==":
+		cmp = func(a, b float64) bool { return a == b }
+	case "!=":
+		cmp = func(a, b float64) bool { return a != b }
+	default:
+		return nil, fmt.Errorf("expected a comparison after %s", metric)
+	}
+	text := p.next()
+	var limit float64
+	var err error
+	if metric == "cpu" {
+		limit, err = strconv.ParseFloat(strings.TrimSuffix(text, "%"), 64)
+	} else {
+		var n int64
+		n, err = parseByteSize(text)
+		limit = float64(n)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s limit %q", metric, text)
+	}
+	p.metrics[metric] = true
+	return func(r meterReading) bool { return cmp(r[metric], limit) }, nil
+}
+
+// parseByteSize parses a byte count such as 500M or 2GiB, with binary K,
+// M, G and T multipliers
+func parseByteSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	mult := int64(1)
+	if n := len(num); n > 0 {
+		if i := strings.IndexByte("KMGT", num[n-1]); i >= 0 {
+			mult = 1 << (10 * (i + 1))
+			num = num[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q: expected a byte count such as 500M", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// parseMinRate parses --min-rate, a byte count a second with an optional
+// window to measure it over, such as 100K/s@30s; the window is 0 if not
+// given
+func parseMinRate(s string) (float64, time.Duration, error) {
+	rate, window, hasWindow := strings.Cut(s, "@")
+	n, err := parseByteSize(strings.TrimSuffix(rate, "/s"))
+	if err != nil || n == 0 {
+		return 0, 0, fmt.Errorf("invalid rate %q: expected bytes a second such as 100K/s", rate)
+	}
+	var d time.Duration
+	if hasWindow {
+		if d, err = parseDuration(window); err != nil || d < watchdog.Resolution {
+			return 0, 0, fmt.Errorf("invalid window %q: expected a duration such as 30s", window)
+		}
+	}
+	return float64(n), d, nil
+}
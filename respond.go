@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// respondRule answers a prompt: when output matches pattern, reply is typed
+// into the command's terminal
+type respondRule struct {
+	pattern *regexp.Regexp
+	reply   []byte
+}
+
+// respondRules is a flag.Value for --respond, given once per rule as
+// 'pattern=reply'; the first = not escaped with a backslash ends the
+// pattern
+type respondRules []respondRule
+
+func (p *respondRules) String() string {
+	var parts []string
+	for _, r := range *p {
+		parts = append(parts, r.pattern.String()+"="+strings.TrimSuffix(string(r.reply), "\r"))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p *respondRules) Set(s string) error {
+	split := -1
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == '=' {
+			split = i
+			break
+		}
+	}
+	if split <= 0 {
+		return fmt.Errorf("expected pattern=reply, e.g. 'Continue\\? \\[y/N\\]=y'")
+	}
+	re, err := regexp.Compile(s[:split])
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", s[:split], err)
+	}
+	if re.MatchString("") {
+		return fmt.Errorf("pattern %q matches empty output", s[:split])
+	}
+	reply, err := parseSend(s[split+1:])
+	if err != nil {
+		return fmt.Errorf("malformed reply %q", s[split+1:])
+	}
+	*p = append(*p, respondRule{pattern: re, reply: append(reply, '\r')})
+	return nil
+}
+
+// responder watches the output of one run for --respond prompts, cleaned
+// of escape sequences, and types the reply of the rule that matches first.
+// Output up to the match is then done with, so a prompt is answered once
+// each time it appears.
+type responder struct {
+	mu      sync.Mutex
+	rules   respondRules
+	matcher *streamMatcher
+	runner  *watchdog.Runner
+}
+
+func newResponder(rules respondRules) *responder {
+	patterns := make([]*regexp.Regexp, len(rules))
+	for i, r := range rules {
+		patterns[i] = r.pattern
+	}
+	return &responder{rules: rules, matcher: newStreamMatcher(true, patterns...)}
+}
+
+func (a *responder) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.matcher.feed(p, a.answer)
+	return len(p), nil
+}
+
+func (a *responder) answer(rule int, _ [][]byte) {
+	if a.runner != nil {
+		con.Logf("Answering prompt %s", a.rules[rule].pattern)
+		a.runner.Write(a.rules[rule].reply)
+	}
+}
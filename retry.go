@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// attempt records the outcome of one spawn of the command
+type attempt struct {
+	Seq       int          `json:"seq"`
+	Started   time.Time    `json:"started"`
+	Duration  float64      `json:"duration_seconds"`
+	ExitCode  int          `json:"exit_code"`
+	TimedOut  bool         `json:"timed_out"`
+	OverLimit string       `json:"over_limit,omitempty"`      // the limit it was killed for, e.g. "rss"
+	Warnings  int          `json:"warnings,omitempty"`        // idle episodes that crossed --warn-at
+	MaxGap    float64      `json:"max_gap_seconds,omitempty"` // the longest silence in the output
+	Subjobs   *subjobStats `json:"subjobs,omitempty"`         // with --track-subjobs
+	Usage     *usageStats  `json:"usage,omitempty"`           // the command's resource usage
+	Backoff   float64      `json:"backoff_seconds,omitempty"` // delay before the next attempt
+	stoppedBy os.Signal    // a terminating signal the wrapper took itself, see config.signals
+	cleanup   []error      // what failed while tidying up after it, for the final message
+}
+
+// usageStats is what an attempt's command used; the fields Windows doesn't
+// account are left out there
+type usageStats struct {
+	UserSeconds   float64 `json:"user_cpu_seconds"`
+	SystemSeconds float64 `json:"system_cpu_seconds"`
+	MaxRSS        int64   `json:"max_rss_bytes,omitempty"`
+	MajorFaults   int64   `json:"major_page_faults,omitempty"`
+	MinorFaults   int64   `json:"minor_page_faults,omitempty"`
+}
+
+func newUsageStats(u *watchdog.Usage) *usageStats {
+	if u == nil {
+		return nil
+	}
+	return &usageStats{
+		UserSeconds:   u.User.Seconds(),
+		SystemSeconds: u.System.Seconds(),
+		MaxRSS:        u.MaxRSS,
+		MajorFaults:   u.MajorFaults,
+		MinorFaults:   u.MinorFaults,
+	}
+}
+
+// String sums the usage up for the --rusage exit message
+func (u *usageStats) String() string {
+	s := fmt.Sprintf("user %.2fs, sys %.2fs", u.UserSeconds, u.SystemSeconds)
+	if u.MaxRSS > 0 {
+		s += fmt.Sprintf(", max RSS %s, page faults %d major / %d minor", formatByteSize(u.MaxRSS), u.MajorFaults, u.MinorFaults)
+	}
+	return s
+}
+
+// retryRule matches a failure; a zero backoff means use --retry-backoff
+type retryRule struct {
+	timeout bool
+	code    int
+	backoff time.Duration
+}
+
+// retryPolicy is a flag.Value for --retry-on-exit, e.g. "1,75:30s,timeout"
+type retryPolicy []retryRule
+
+func (p *retryPolicy) String() string {
+	var parts []string
+	for _, r := range *p {
+		s := "timeout"
+		if !r.timeout {
+			s = strconv.Itoa(r.code)
+		}
+		if r.backoff > 0 {
+			s += ":" + r.backoff.String()
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *retryPolicy) Set(s string) error {
+	var rules retryPolicy
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var rule retryRule
+		name, delay, hasDelay := strings.Cut(item, ":")
+		if hasDelay {
+			d, err := parseDuration(delay)
+			if err != nil {
+				return fmt.Errorf("invalid backoff in %q: %v", item, err)
+			}
+			rule.backoff = d
+		}
+		if name == "timeout" {
+			rule.timeout = true
+		} else {
+			code, err := strconv.Atoi(name)
+			if err != nil || code < 0 || code > 255 {
+				return fmt.Errorf("invalid exit code %q: want 0-255 or \"timeout\"", name)
+			}
+			rule.code = code
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("no exit codes given")
+	}
+	*p = rules
+	return nil
+}
+
+// match returns the rule covering an attempt's outcome, if any
+func (p retryPolicy) match(a attempt) (retryRule, bool) {
+	for _, r := range p {
+		if r.timeout && a.TimedOut || !r.timeout && !a.TimedOut && r.code == a.ExitCode {
+			return r, true
+		}
+	}
+	return retryRule{}, false
+}
+
+// result is the summary written by --result-file
+type result struct {
+	ID       string    `json:"id"`
+	Session  string    `json:"session"`
+	Command  []string  `json:"command"`
+	ExitCode int       `json:"exit_code"`
+	TimedOut bool      `json:"timed_out"`
+	Attempts []attempt `json:"attempts"`
+}
+
+func writeResult(path string, r result) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Layout of a ring file: a header, a text region with the wrapper's state
+// as JSON, then the ring of output. Integers are little-endian.
+const (
+	ringMagic      = "ITRING01"
+	ringCapOff     = 8    // uint64: size of the ring
+	ringWrittenOff = 16   // uint64: output bytes written so far, ever
+	ringOutputOff  = 24   // int64: unix nanoseconds of the last output
+	ringStateOff   = 32   // JSON state, padded with newlines
+	ringDataOff    = 1024 // the ring itself
+)
+
+// ringSyncInterval is how often the ring is flushed to disk, bounding what
+// a power loss can take
+const ringSyncInterval = time.Second
+
+// ringState is the wrapper state kept next to the output
+type ringState struct {
+	WrapperPID int       `json:"wrapper_pid"`
+	Session    string    `json:"session"`
+	Command    []string  `json:"command"`
+	Attempt    int       `json:"attempt"`
+	ChildPID   int       `json:"child_pid,omitempty"`
+	Status     string    `json:"status"` // running, timed out or exited
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	Started    time.Time `json:"started"`
+	Updated    time.Time `json:"updated"`
+}
+
+// ringLog keeps the last output and the wrapper's state in a memory-mapped
+// file for --ring-file. Every write lands in the page cache at once, so
+// the file shows what the child printed last even if the wrapper is
+// SIGKILLed; a periodic fsync covers host crashes.
+type ringLog struct {
+	mu      sync.Mutex
+	f       *os.File
+	mem     []byte
+	data    []byte
+	written uint64
+	dirty   bool
+	state   ringState
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// openRing creates the ring file with room for size bytes of output
+func openRing(path string, size int, command []string, session string) (*ringLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(ringDataOff + size)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	mem, err := mapFile(f, ringDataOff+size)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &ringLog{
+		f:     f,
+		mem:   mem,
+		data:  mem[ringDataOff:],
+		state: ringState{WrapperPID: os.Getpid(), Session: session, Command: command, Status: "starting", Started: time.Now()},
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	copy(mem, ringMagic)
+	binary.LittleEndian.PutUint64(mem[ringCapOff:], uint64(size))
+	r.saveState()
+	go r.syncLoop()
+	return r, nil
+}
+
+func (r *ringLog) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(p)
+	if len(p) > len(r.data) {
+		r.written += uint64(len(p) - len(r.data))
+		p = p[len(p)-len(r.data):]
+	}
+	pos := int(r.written % uint64(len(r.data)))
+	c := copy(r.data[pos:], p)
+	copy(r.data, p[c:])
+	// The count is updated after the data, so a crash never exposes
+	// bytes that weren't copied
+	r.written += uint64(len(p))
+	binary.LittleEndian.PutUint64(r.mem[ringWrittenOff:], r.written)
+	binary.LittleEndian.PutUint64(r.mem[ringOutputOff:], uint64(time.Now().UnixNano()))
+	r.dirty = true
+	return n, nil
+}
+
+// update changes the recorded state
+func (r *ringLog) update(change func(*ringState)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	change(&r.state)
+	r.saveState()
+}
+
+func (r *ringLog) saveState() {
+	r.state.Updated = time.Now()
+	js, _ := json.Marshal(r.state)
+	region := r.mem[ringStateOff:ringDataOff]
+	if len(js) > len(region) {
+		s := r.state // a very long command line doesn't fit
+		s.Command = nil
+		js, _ = json.Marshal(s)
+	}
+	n := copy(region, js)
+	for i := n; i < len(region); i++ {
+		region[i] = '\n'
+	}
+	r.dirty = true
+}
+
+func (r *ringLog) syncLoop() {
+	defer close(r.done)
+	ticker := time.NewTicker(ringSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			dirty := r.dirty
+			r.dirty = false
+			r.mu.Unlock()
+			if dirty {
+				r.f.Sync()
+			}
+		}
+	}
+}
+
+func (r *ringLog) Close() error {
+	close(r.stop)
+	<-r.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.f.Sync()
+	if uerr := unmapFile(r.mem); err == nil {
+		err = uerr
+	}
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readRing returns the state and the output, oldest byte first, of a ring
+// file, along with when the last output arrived
+func readRing(path string) (state json.RawMessage, output []byte, last time.Time, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, last, err
+	}
+	if len(data) < ringDataOff || string(data[:len(ringMagic)]) != ringMagic {
+		return nil, nil, last, errors.New("not a ring file")
+	}
+	size := binary.LittleEndian.Uint64(data[ringCapOff:])
+	written := binary.LittleEndian.Uint64(data[ringWrittenOff:])
+	if size == 0 || uint64(len(data)) < ringDataOff+size {
+		return nil, nil, last, errors.New("truncated ring file")
+	}
+	if ns := int64(binary.LittleEndian.Uint64(data[ringOutputOff:])); ns != 0 {
+		last = time.Unix(0, ns)
+	}
+	ring := data[ringDataOff : ringDataOff+size]
+	if written <= size {
+		output = ring[:written]
+	} else {
+		pos := written % size
+		output = append(append([]byte(nil), ring[pos:]...), ring[:pos]...)
+	}
+	return bytes.TrimRight(data[ringStateOff:ringDataOff], "\n\x00"), output, last, nil
+}
+
+// ringMain shows what a ring file recorded, typically after the wrapper
+// died without cleaning up
+func ringMain(args []string) int {
+	fset := flag.NewFlagSet("ring", flag.ExitOnError)
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout ring <ring-file>\n")
+		fmt.Fprintf(os.Stderr, "Prints the recorded state to stderr and the last output to stdout.\n")
+	}
+	fset.Parse(args)
+	if fset.NArg() != 1 {
+		fset.Usage()
+		return 1
+	}
+	state, output, last, err := readRing(fset.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %v\n", fset.Arg(0), err)
+		return 1
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, state, "", "  ") != nil {
+		pretty.Write(state)
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", pretty.Bytes())
+	if !last.IsZero() {
+		fmt.Fprintf(os.Stderr, "Last output: %s (%v ago)\n", last.Format(time.RFC3339), time.Since(last).Round(time.Second))
+	}
+	os.Stdout.Write(output)
+	return 0
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mapFile maps the first size bytes of f into memory, shared with the file
+func mapFile(f *os.File, size int) ([]byte, error) {
+	h, err := syscall.CreateFileMapping(syscall.Handle(f.Fd()), nil, syscall.PAGE_READWRITE, 0, uint32(size), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The view keeps the mapping alive
+	defer syscall.CloseHandle(h)
+	addr, err := syscall.MapViewOfFile(h, syscall.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, err
+	}
+	return unsafe.Slice((*byte)(unsafe.Add(nil, addr)), size), nil
+}
+
+func unmapFile(mem []byte) error {
+	addr := uintptr(unsafe.Pointer(&mem[0]))
+	if err := syscall.FlushViewOfFile(addr, uintptr(len(mem))); err != nil {
+		return err
+	}
+	return syscall.UnmapViewOfFile(addr)
+}
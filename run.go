@@ -0,0 +1,757 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// config holds the settings shared by every attempt
+type config struct {
+	timeout     time.Duration
+	warnAt      time.Duration  // 0 disables the idle warning
+	first       time.Duration  // timeout until the first output, see --first-output
+	check       time.Duration  // how often the watchdog samples, see --check-interval
+	resetBytes  int            // output needed to fully reset the idle clock, 0 for any
+	cgroup      bool           // start each attempt in a fresh cgroup, see --cgroup
+	subreaper   bool           // supervise orphaned descendants too, see --subreaper
+	subjobs     *regexp.Regexp // sub-job marker pattern for --track-subjobs
+	foreground  bool           // pipes instead of a PTY, and the terminal left alone, see --foreground
+	drain       time.Duration  // output copied after the command exits, see --drain
+	linger      bool           // supervise descendants holding the output after the command exits, see --linger
+	logFile     string         // naming template, see invocation.expand
+	logRotate   *logRotation   // when to rotate the log file, see --log-rotate
+	castFile    string         // naming template for the asciinema recording
+	record      string         // naming template for the script(1) typescript
+	recordTime  string         // naming template for its timing file
+	snapFile    string         // naming template for --snapshot-every screens
+	snapEvery   time.Duration  // 0 disables screen snapshots
+	minSize     sizeFlag       // smallest terminal the command gets, see --min-size
+	fixedSize   sizeFlag       // the command's terminal size whatever the wrapper's, see --pty-size
+	noEcho      bool           // turn off the echo of the command's terminal
+	account     *account       // nil unless --user or --group is set
+	dir         string         // the command's working directory, see --chdir
+	env         []string       // set in the command's environment, see --env
+	clearEnv    bool           // start from an empty environment rather than the wrapper's
+	limits      rlimits        // kernel resource limits, see --limit-cpu and the like
+	nice        int            // the command's niceness, 0 to leave it
+	ioPrio      int            // the command's I/O priority as the kernel takes it, 0 to leave it
+	sandbox     sandbox        // what the command is confined to, see --landlock-ro and the like
+	tailLines   int            // lines of output shown on timeout, 0 for none
+	tailFile    string         // naming template for where they're saved instead
+	gapReport   bool           // summarize the silences between output on exit
+	history     bool           // record the invocation in the history store
+	rusage      bool           // report the command's resource usage on exit
+	cpuActive   bool           // CPU use by the command's processes counts as activity
+	ioActive    bool           // so does their disk I/O
+	netActive   bool           // and their TCP traffic
+	require     *requirement   // nil unless --require gates the idle kill
+	maxRSS      int64          // resident memory limit in bytes, 0 for none
+	maxOutput   int64          // output limit in bytes, 0 for none
+	maxLines    int64          // output limit in lines, 0 for none
+	minRate     float64        // output floor in bytes a second, 0 for none
+	rateWindow  time.Duration  // what minRate is measured over
+	repeats     int            // identical lines in a row that count as hung, 0 for no limit
+	dedupe      bool           // collapse runs of identical lines in the forwarded output
+	dedupeIdle  bool           // and don't count the repeats as activity
+	binary      bool           // output is binary: passed on untouched, see --binary
+	threshold   *activityFloor // output counts as activity only past it, nil for any
+	watch       string         // the stream whose output counts as activity, see --watch
+	onTimeout   string         // hook command run before the kill
+	dryRun      bool           // log idle kills rather than make them
+	freeze      bool           // stop the command at the timeout rather than kill it, see --on-timeout stop
+	send        []byte         // input typed into the command at the timeout, see --on-timeout send:
+	nudges      int            // times in a row send is tried before the kill
+	expect      []expectStep   // --expect-script steps, nil for none
+	respond     respondRules   // prompts answered automatically
+	onPattern   patternRules   // output lines that change the idle budget
+	onWarn      string         // hook command run at the warning threshold
+	notifyChild []byte         // typed into the command's terminal at the warning threshold
+	statusLine  bool           // show the idle clock in a footer, see --status-line
+	title       bool           // show the idle budget left in the terminal title
+	heartbeat   time.Duration  // silence between --heartbeat lines, 0 for none
+	summary     *stepSummary   // nil unless --ci github runs under GitHub Actions
+	webhook     *webhook       // nil unless --webhook-url is set
+	dbus        *dbusSignals   // nil unless --dbus is set
+	metrics     *metrics       // nil unless --metrics-addr is set
+	control     *control       // adjusts the idle budget on request
+	mirror      *mirror        // streams output to socket clients, nil without --mirror-socket
+	forward     []os.Signal    // signals passed on to the command's process group
+	signals     chan os.Signal // receives forward and terminatingSignals for the whole invocation
+	dumpSignal  os.Signal      // sent before the kill at the idle timeout, see --dump-signal
+	dumpWait    time.Duration  // between dumpSignal and the kill
+	killSignal  os.Signal      // what kills the command, see --signal
+	killGrace   time.Duration  // between killSignal and SIGKILL
+	trace       *trace         // nil unless an OTLP endpoint is configured
+	coord       *coordClient   // nil unless --coordinate is set
+	ring        *ringLog       // nil unless --ring-file is set
+	takeover    *takeover      // nil unless --takeover is set and someone is at the terminal
+	input       *input         // the wrapper's stdin, forwarded to the child's terminal
+	typeFirst   *stdinScript   // typed in before the wrapper's stdin, see --stdin-file
+	term        *termState     // the user's terminal settings, back while suspended; nil with -foreground
+	command     []string
+}
+
+// ptySize is the size for the command's terminal: --pty-size, or the
+// wrapper's own less the row of a --status-line, but at least --min-size
+func (cfg config) ptySize() (cols, rows int) {
+	if cfg.fixedSize.cols > 0 {
+		return cfg.fixedSize.cols, cfg.fixedSize.rows
+	}
+	cols, rows = terminalSize(uintptr(syscall.Stdin))
+	if cfg.statusLine {
+		rows--
+	}
+	return max(cols, cfg.minSize.cols), max(rows, cfg.minSize.rows)
+}
+
+// lifecyclePayload describes a watchdog event for --webhook-url, reporting
+// false for events that aren't delivered
+func lifecyclePayload(e watchdog.Event, cfg config, inv invocation) (webhookPayload, bool) {
+	p := webhookPayload{
+		Time:    e.Time,
+		ID:      inv.id,
+		Session: inv.session,
+		Seq:     inv.seq,
+		Command: cfg.command,
+		PID:     e.PID,
+		Timeout: cfg.timeout.Seconds(),
+	}
+	switch e.Kind {
+	case watchdog.Started:
+		p.Event = "start"
+	case watchdog.TimedOut:
+		p.Event = "timeout"
+		p.Idle = e.Idle.Seconds()
+	case watchdog.Exited:
+		p.Event = "exit"
+		p.ExitCode = &e.ExitCode
+		p.TimedOut = e.TimedOut
+	default:
+		return p, false
+	}
+	return p, true
+}
+
+// eventFields are the structured fields reported to --log-target
+func eventFields(e watchdog.Event, inv invocation) []string {
+	f := append(inv.env(), "IDLE_TIMEOUT_EVENT="+e.Kind.String(), "CHILD_PID="+strconv.Itoa(e.PID))
+	switch e.Kind {
+	case watchdog.Warned, watchdog.TimedOut:
+		f = append(f, "IDLE_SECONDS="+formatSeconds(e.Idle), "IDLE_LIMIT="+formatSeconds(e.Timeout))
+	case watchdog.OverLimit:
+		f = append(f, "LIMIT="+e.Limit, "USAGE="+strconv.FormatInt(e.Usage, 10), "MAX="+strconv.FormatInt(e.Max, 10))
+	case watchdog.Exited:
+		f = append(f, "EXIT_CODE="+strconv.Itoa(e.ExitCode), "TIMED_OUT="+strconv.FormatBool(e.TimedOut))
+	}
+	return f
+}
+
+// openLog opens the attempt's log file, rotated with --log-rotate. The
+// first attempt truncates; later attempts append unless {seq} gives each
+// of them a file of its own.
+func openLog(cfg config, inv invocation) (io.WriteCloser, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if inv.seq > 1 && !strings.Contains(cfg.logFile, "{seq}") {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	path := inv.expand(cfg.logFile)
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.logRotate == nil {
+		return f, nil
+	}
+	return newRotatingLog(f, path, *cfg.logRotate), nil
+}
+
+func run(cmdName string, cmdArgs []string, cfg config, inv invocation) (a attempt) {
+	a = attempt{Seq: inv.seq, Started: time.Now(), ExitCode: 1}
+
+	// Tee output to the log file and the other sinks if requested
+	var sinks []io.Writer
+	if cfg.logFile != "" {
+		f, err := openLog(cfg, inv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open log file: %v\n", err)
+			return a
+		}
+		defer func() {
+			// A full disk often only shows when the file is closed
+			if err := f.Close(); err != nil {
+				a.cleanup = append(a.cleanup, fmt.Errorf("log file: %w", err))
+			}
+		}()
+		sinks = append(sinks, f)
+	}
+	var cast *castRecorder
+	if cfg.castFile != "" {
+		var err error
+		if cast, err = openCast(cfg.castFile, inv, append([]string{cmdName}, cmdArgs...), cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open recording: %v\n", err)
+			return a
+		}
+		sinks = append(sinks, cast)
+	}
+	var typescript *scriptRecorder
+	if cfg.record != "" {
+		var err error
+		if typescript, err = openScript(cfg.record, cfg.recordTime, inv, append([]string{cmdName}, cmdArgs...), cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open recording: %v\n", err)
+			return a
+		}
+		sinks = append(sinks, typescript)
+	}
+	var snaps *snapshotter
+	if cfg.snapEvery > 0 {
+		var err error
+		cols, rows := cfg.ptySize()
+		if snaps, err = openSnapshots(cfg.snapFile, inv, cfg.snapEvery, cols, rows); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open snapshot file: %v\n", err)
+			return a
+		}
+		defer func() {
+			if err := snaps.Close(); err != nil {
+				a.cleanup = append(a.cleanup, fmt.Errorf("snapshot file: %w", err))
+			}
+		}()
+		sinks = append(sinks, snaps)
+	}
+	if cfg.ring != nil {
+		sinks = append(sinks, cfg.ring)
+	}
+	if cfg.metrics != nil {
+		sinks = append(sinks, cfg.metrics)
+	}
+	if cfg.mirror != nil {
+		sinks = append(sinks, cfg.mirror)
+	}
+	var jobs *subjobs
+	if cfg.subjobs != nil {
+		jobs = newSubjobs(cfg.subjobs)
+		sinks = append(sinks, jobs)
+	}
+	var tail *tailLines
+	if cfg.tailLines > 0 {
+		tail = newTailLines(cfg.tailLines)
+		sinks = append(sinks, tail)
+	}
+	var repeats *repeatDetector
+	if cfg.repeats > 0 {
+		repeats = newRepeatDetector(cfg.repeats)
+		sinks = append(sinks, repeats)
+	}
+	// Closed once the command runs, for --stdin-file to type into
+	started := make(chan struct{})
+	var script *expecter
+	if cfg.expect != nil {
+		script = newExpecter(cfg.expect)
+		defer script.stop()
+		sinks = append(sinks, script)
+	}
+	var answers *responder
+	if len(cfg.respond) > 0 {
+		answers = newResponder(cfg.respond)
+		sinks = append(sinks, answers)
+	}
+	var phases *phaseWatcher
+	if len(cfg.onPattern) > 0 {
+		phases = newPhaseWatcher(cfg.onPattern, cfg.timeout)
+		sinks = append(sinks, phases)
+	}
+	var gaps *gapStats
+	if cfg.gapReport || cfg.summary != nil || cfg.history {
+		gaps = newGapStats(a.Started)
+		sinks = append(sinks, gaps)
+	}
+	var display, errDisplay io.Writer = con, con.stderr()
+	var activity func([]byte) bool
+	var dedupes []*dedupe
+	if cfg.dedupe {
+		dedupes = []*dedupe{newDedupe(con), newDedupe(con.stderr())}
+		display, errDisplay = dedupes[0], dedupes[1]
+		if cfg.dedupeIdle {
+			activity = newDedupe(io.Discard).fresh
+		}
+	}
+	if cfg.threshold != nil {
+		fresh := activity
+		activity = func(p []byte) bool {
+			return (fresh == nil || fresh(p)) && cfg.threshold.counts(p)
+		}
+	}
+	// The echo of --notify-child input, or a full-screen tool showing it,
+	// doesn't end the idle episode it warns about
+	var notified atomic.Int64
+	if cfg.notifyChild != nil {
+		fresh := activity
+		activity = func(p []byte) bool {
+			counts := fresh == nil || fresh(p)
+			return counts && time.Since(time.Unix(0, notified.Load())) > nudgeEcho
+		}
+	}
+	out := io.MultiWriter(append([]io.Writer{display}, sinks...)...)
+	errOut := io.MultiWriter(append([]io.Writer{errDisplay}, sinks...)...)
+
+	// Print spawn line like expect does, unless it goes to the log target
+	spawn := "spawn " + strings.Join(append([]string{cmdName}, cmdArgs...), " ")
+	if con.target == nil && !con.quiet {
+		con.Printf("%s\n", spawn)
+	}
+
+	// Every goroutine started for this attempt is stopped through ctx and
+	// waited for before returning, so nothing leaks into the next attempt
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	var env []string
+	if !cfg.clearEnv {
+		env = os.Environ()
+	}
+	env = append(env, inv.env()...)
+	if cfg.trace != nil {
+		env = append(env, cfg.trace.traceparent())
+	}
+	var cred *watchdog.Credential
+	if cfg.account != nil {
+		env = append(env, cfg.account.env...)
+		cred = cfg.account.cred
+	}
+	env = append(env, cfg.env...)
+	var cgroup string
+	if cfg.cgroup {
+		var err error
+		if cgroup, err = newCgroup(fmt.Sprintf("idle-timeout.%d.%d", os.Getpid(), inv.seq)); err != nil {
+			con.Logf("Cgroup unavailable (%v), killing by process group instead", err)
+		} else {
+			defer func() {
+				if err := removeCgroup(cgroup); errors.Is(err, syscall.EBUSY) {
+					con.Logf("Leaving cgroup %s in place: processes the command started are still running", cgroup)
+				} else if err != nil {
+					a.cleanup = append(a.cleanup, fmt.Errorf("cgroup %s: %w", cgroup, err))
+				}
+			}()
+		}
+	}
+	path, args := cmdName, cmdArgs
+	if setup := cfg.childSetup(); setup != "" {
+		var err error
+		if path, args, err = limitedCommand(setup, cmdName, cmdArgs); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to run command: %v\n", err)
+			return a
+		}
+	}
+	cols, rows := cfg.ptySize()
+	var stdin io.Reader
+	if cfg.foreground {
+		stdin = os.Stdin // inherited as is, so the child can read the terminal
+	}
+	var runner *watchdog.Runner
+	// killReason says what a TimedOut or OverLimit event kills the command
+	// for
+	killReason := func(e watchdog.Event) string {
+		idle := e.Timeout
+		if e.Idle < idle { // expired early, e.g. from the -takeover menu
+			idle = e.Idle.Round(time.Second)
+		}
+		switch {
+		case e.Limit == "rss":
+			return fmt.Sprintf("Resident memory %s is over the %s limit", formatByteSize(e.Usage), formatByteSize(e.Max))
+		case e.Limit == "output":
+			return fmt.Sprintf("Output is over the %s limit", formatByteSize(e.Max))
+		case e.Limit == "lines":
+			return fmt.Sprintf("Output is over the %d line limit", e.Max)
+		case e.Slow:
+			return fmt.Sprintf("Output at %sB/s over the last %v is below the %sB/s minimum", formatByteSize(int64(e.Rate)), cfg.rateWindow, formatByteSize(int64(cfg.minRate)))
+		}
+		if line, ok := repeats.repeated(); ok {
+			return fmt.Sprintf("Same line printed %d times in a row (%q)", cfg.repeats, line)
+		}
+		if cfg.first > 0 && e.Timeout == cfg.first && cfg.first != cfg.timeout {
+			return fmt.Sprintf("No output within the first %v", idle)
+		}
+		if step, ok := script.failure(); ok {
+			return fmt.Sprintf("No output matching %q (expect script line %d) within %v", step.pattern, step.line, step.timeout)
+		}
+		return fmt.Sprintf("No output for %v", idle)
+	}
+	var sources []watchdog.ActivitySource
+	var probes []counterProbe
+	if cfg.cpuActive {
+		probes = append(probes, cpuTime)
+	}
+	if cfg.ioActive {
+		probes = append(probes, diskIO)
+	}
+	if cfg.netActive {
+		probes = append(probes, newNetProbe())
+	}
+	for _, probe := range probes {
+		src := counterSource(func() int { return runner.PID() }, probe)
+		defer src.Close()
+		sources = append(sources, src)
+	}
+	var nudges *nudger
+	if cfg.send != nil {
+		nudges = newNudger(cfg.send, cfg.nudges)
+	}
+	var meter *treeMeter
+	if cfg.require != nil {
+		meter = watchMeter(ctx, &wg, func() int { return runner.PID() }, cfg.require.metrics)
+	}
+	runner = watchdog.New(watchdog.Config{
+		Path:          path,
+		Args:          args,
+		Env:           env,
+		Dir:           cfg.dir,
+		Credential:    cred,
+		Timeout:       cfg.timeout,
+		WarnAt:        cfg.warnAt,
+		FirstOutput:   cfg.first,
+		CheckInterval: cfg.check,
+		DumpSignal:    cfg.dumpSignal,
+		DumpWait:      cfg.dumpWait,
+		KillSignal:    cfg.killSignal,
+		KillGrace:     cfg.killGrace,
+		ResetBytes:    cfg.resetBytes,
+		Cgroup:        cgroup,
+		Subreaper:     cfg.subreaper,
+		PTY:           !cfg.foreground,
+		NoEcho:        cfg.noEcho,
+		RawOutput:     cfg.binary,
+		Foreground:    cfg.foreground,
+		Drain:         cfg.drain,
+		Linger:        cfg.linger,
+		MaxRSS:        cfg.maxRSS,
+		MaxOutput:     cfg.maxOutput,
+		MaxLines:      cfg.maxLines,
+		MinRate:       cfg.minRate,
+		RateWindow:    cfg.rateWindow,
+		Sources:       sources,
+		Activity:      activity,
+		IgnoreStdout:  cfg.watch == "stderr",
+		IgnoreStderr:  cfg.watch == "stdout",
+		Cols:          cols,
+		Rows:          rows,
+		Stdin:         stdin,
+		Stdout:        out,
+		Stderr:        errOut,
+		Spare: func(e watchdog.Event) bool {
+			if e.Kind == watchdog.OverLimit || e.Forced {
+				// Only --dry-run holds back these kills
+				if cfg.dryRun {
+					then := "idle clock restarted"
+					if e.Kind == watchdog.OverLimit {
+						then = "the limit is no longer enforced"
+					}
+					con.Eventf(prioWarning, eventFields(e, inv), "Dry run: would have killed process: %s; %s", killReason(e), then)
+					return true
+				}
+				return false
+			}
+			if meter != nil {
+				if r := meter.read(); !cfg.require.eval(r) {
+					con.Eventf(prioWarning, eventFields(e, inv), "No output for %v, but %q doesn't hold (%s); not killing", e.Timeout, cfg.require.text, r)
+					return true
+				}
+			}
+			if cfg.coord != nil {
+				if breaker, err := cfg.coord.timedOut(inv.id); err != nil {
+					con.Logf("Coordinator unreachable (%v), timing out without it", err)
+				} else if breaker.Open {
+					con.Eventf(prioWarning, eventFields(e, inv), "No output for %v, but the circuit breaker is open until %s; not killing", e.Timeout, breaker.Until.Format(time.TimeOnly))
+					return true
+				}
+			}
+			if cfg.dryRun {
+				if e.Slow {
+					con.Eventf(prioWarning, eventFields(e, inv), "Dry run: would have killed process for output at %sB/s; rate window restarted", formatByteSize(int64(e.Rate)))
+				} else {
+					con.Eventf(prioWarning, eventFields(e, inv), "Dry run: would have killed process after %v idle; idle clock restarted", e.Timeout)
+				}
+				return true
+			}
+			if nudges != nil && nudges.nudge(runner) {
+				con.Eventf(prioWarning, eventFields(e, inv), "No output for %v, sending %q (%d of %d)", e.Timeout, cfg.send, nudges.count, cfg.nudges)
+				return true
+			}
+			if cfg.freeze {
+				self := os.Getpid()
+				con.Eventf(prioErr, eventFields(e, inv), "No output for %v, stopping process %d; resume it with 'kill -CONT %d', or kill it with 'kill %d'", e.Timeout, e.PID, self, self)
+				if freeze(runner, e.PID) {
+					con.Eventf(prioInfo, eventFields(e, inv), "Resumed, idle clock restarted")
+					return true
+				}
+			}
+			return false
+		},
+		OnEvent: func(e watchdog.Event) {
+			if cfg.metrics != nil {
+				cfg.metrics.observe(e)
+			}
+			if cfg.trace != nil {
+				cfg.trace.observe(e, inv)
+			}
+			if p, ok := lifecyclePayload(e, cfg, inv); ok && cfg.webhook != nil {
+				cfg.webhook.send(p)
+			}
+			if cfg.dbus != nil {
+				cfg.dbus.observe(e, cfg, inv, a.Started)
+			}
+			if cfg.ring != nil {
+				cfg.ring.update(func(s *ringState) {
+					switch e.Kind {
+					case watchdog.Started:
+						s.Attempt, s.ChildPID, s.Status, s.ExitCode = inv.seq, e.PID, "running", nil
+					case watchdog.TimedOut:
+						s.Status = "timed out"
+					case watchdog.Exited:
+						code := e.ExitCode
+						s.Status, s.ExitCode = "exited", &code
+					}
+				})
+			}
+			switch e.Kind {
+			case watchdog.Started:
+				close(started)
+				if script != nil {
+					script.start(runner)
+				}
+				if con.target != nil {
+					con.Eventf(prioInfo, append(eventFields(e, inv), "COMMAND="+strings.Join(cfg.command, " ")), "%s", spawn)
+				}
+			case watchdog.Exited:
+				if con.target != nil {
+					con.Eventf(prioInfo, eventFields(e, inv), "Exited with status %d", e.ExitCode)
+				}
+			case watchdog.OverLimit:
+				con.resetScreen()
+				con.Eventf(prioErr, eventFields(e, inv), "%s, killing process...", killReason(e))
+				if cast != nil {
+					cast.Mark("over the " + e.Limit + " limit")
+				}
+			case watchdog.Warned:
+				if cfg.dryRun {
+					con.Eventf(prioWarning, eventFields(e, inv), "No output for %v, timeout in %v (dry run)", idleFor(e.Idle), timeLeft(e.Timeout-e.Idle))
+				} else {
+					con.Eventf(prioWarning, eventFields(e, inv), "No output for %v, killing in %v...", idleFor(e.Idle), timeLeft(e.Timeout-e.Idle))
+				}
+				if cfg.onWarn != "" {
+					go runHook("on-warn", cfg.onWarn, hookEnv(inv, e.PID, e.Idle, e.Timeout))
+				}
+				if cfg.notifyChild != nil {
+					left := math.Ceil(max(e.Timeout-e.Idle, 0).Seconds())
+					r := strings.NewReplacer("{idle}", strconv.Itoa(int(e.Idle.Seconds())), "{left}", strconv.Itoa(int(left)))
+					notified.Store(time.Now().UnixNano())
+					if _, err := runner.Write([]byte(r.Replace(string(cfg.notifyChild)))); err != nil {
+						con.Logf("Failed to notify the command: %v", err)
+					}
+				}
+				if cfg.takeover != nil {
+					cfg.takeover.offer(runner, cfg.input, e)
+				}
+			case watchdog.TimedOut:
+				con.resetScreen()
+				progress := ""
+				if jobs != nil {
+					progress = " (" + jobs.summary() + ")"
+				}
+				con.Eventf(prioErr, eventFields(e, inv), "%s, killing process%s...", killReason(e), progress)
+				if cfg.dumpSignal != nil {
+					con.Logf("Sending %s for a stack dump, killing in %v...", signalName(cfg.dumpSignal), cfg.dumpWait)
+				}
+				if tail != nil {
+					path := ""
+					if cfg.tailFile != "" {
+						path = inv.expand(cfg.tailFile)
+					}
+					tail.report(path)
+				}
+				if cast != nil {
+					cast.Mark(fmt.Sprintf("idle timeout after %v", e.Timeout))
+				}
+				if snaps != nil {
+					snaps.Snap(fmt.Sprintf("idle timeout after %v", e.Timeout))
+				}
+				if cfg.onTimeout != "" {
+					runHook("on-timeout", cfg.onTimeout, hookEnv(inv, e.PID, e.Idle, e.Timeout))
+				}
+			}
+		},
+	})
+
+	if repeats != nil {
+		repeats.expire = runner.Expire
+	}
+	if answers != nil {
+		answers.runner = runner
+	}
+	if phases != nil {
+		phases.runner = runner
+	}
+	if cfg.metrics != nil {
+		cfg.metrics.attach(runner)
+		defer cfg.metrics.attach(nil)
+	}
+	if cfg.control != nil {
+		cfg.control.attach(runner)
+		defer cfg.control.attach(nil)
+	}
+
+	if cfg.statusLine {
+		showStatusLine(ctx, &wg, runner, filepath.Base(cmdName))
+	}
+	if cfg.title {
+		showTitle(ctx, &wg, runner, filepath.Base(cmdName))
+	}
+	if cfg.heartbeat > 0 {
+		heartbeat(ctx, &wg, runner, cfg.heartbeat)
+	}
+
+	// Forward signals and terminal resizes. A terminating signal that isn't
+	// forwarded ends the attempt, and with it the invocation.
+	var stoppedBy atomic.Value
+	resized := watchResize(ctx, &wg)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		suspended := false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-resized:
+				cols, rows := cfg.ptySize()
+				runner.Resize(cols, rows)
+				if cfg.statusLine {
+					_, termRows := terminalSize(uintptr(syscall.Stdout))
+					con.resizeFooter(termRows)
+				}
+				if snaps != nil {
+					snaps.resize(cols, rows)
+				}
+			case sig := <-cfg.signals:
+				switch {
+				case !slices.Contains(cfg.forward, sig):
+					stoppedBy.Store(sig)
+					cancel()
+				case sig == suspendSignal:
+					// Like a shell job on Ctrl-Z: the command stops, then
+					// the wrapper, with the idle clock paused and the
+					// user's terminal settings back until SIGCONT
+					runner.Pause()
+					runner.SignalGroup(stopSignal)
+					if cfg.term != nil {
+						setTermState(uintptr(syscall.Stdin), cfg.term)
+					}
+					suspended = true
+					stopSelf()
+				case sig == resumeSignal && suspended:
+					if cfg.term != nil {
+						makeRawInput(uintptr(syscall.Stdin), cfg.term)
+					}
+					runner.SignalGroup(sig)
+					// A pause asked for outlasts the suspension
+					if cfg.control == nil || cfg.control.pausedAt().IsZero() {
+						runner.Resume()
+					}
+					suspended = false
+				default:
+					runner.SignalGroup(sig)
+				}
+			}
+		}
+	}()
+
+	// Type the wrapper's stdin into the child's terminal
+	if cfg.input != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cfg.typeFirst != nil && !cfg.typeFirst.typeInto(ctx, runner, started) {
+				return
+			}
+			cfg.input.copy(ctx, runner)
+		}()
+	}
+
+	res := runner.Run(ctx)
+	for _, d := range dedupes {
+		d.Flush()
+	}
+	con.resetScreen()
+	if cast != nil {
+		cast.Mark(fmt.Sprintf("exit %d", res.ExitCode))
+	}
+	if typescript != nil {
+		typescript.exited(res.ExitCode)
+	}
+	end := time.Now()
+	nearMiss := cfg.warnAt
+	if nearMiss == 0 {
+		nearMiss = cfg.timeout * 8 / 10
+	}
+	if cfg.gapReport {
+		gaps.report(end, cfg.timeout, nearMiss)
+	}
+	if sig, ok := stoppedBy.Load().(os.Signal); ok {
+		a.stoppedBy = sig
+	} else if res.Err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run command: %v\n", res.Err)
+	}
+	a.Started = res.Started
+	a.Duration = res.Duration.Seconds()
+	a.ExitCode = res.ExitCode
+	a.TimedOut = res.TimedOut
+	a.OverLimit = res.OverLimit
+	a.Warnings = res.Warnings
+	a.Usage = newUsageStats(res.Usage)
+	if gaps != nil {
+		a.MaxGap = gaps.summary(end, cfg.timeout, nearMiss).longest.Seconds()
+	}
+	if cfg.rusage && a.Usage != nil {
+		con.Eventf(prioInfo, inv.env(), "Exited with status %d after %v: %s", res.ExitCode, res.Duration.Round(10*time.Millisecond), a.Usage)
+	}
+	if jobs != nil {
+		st := jobs.snapshot()
+		a.Subjobs = &st
+	}
+	if cfg.summary != nil {
+		cfg.summary.add(a, gaps.summary(end, cfg.timeout, nearMiss))
+	}
+	return a
+}
+
+// idleFor words how long a command has been silent in a warning, cut to the
+// second so it never reads as more than it is
+func idleFor(d time.Duration) time.Duration {
+	return d.Truncate(time.Second)
+}
+
+// timeLeft words how long a silence has left before the kill, rounded up so
+// it never reads as less than it is; under a second it is counted in
+// milliseconds rather than rounded to "0s" or "1s"
+func timeLeft(d time.Duration) time.Duration {
+	unit := time.Second
+	if d < time.Second {
+		unit = time.Millisecond
+	}
+	return (max(d, 0) + unit - 1).Truncate(unit)
+}
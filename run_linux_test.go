@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openFDs counts the test process's open file descriptors
+func openFDs(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fds)
+}
+
+func TestAttemptsLeakNoDescriptors(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		foreground bool
+		timeout    time.Duration
+		command    []string
+	}{
+		{"pty", false, 5 * time.Second, []string{"sh", "-c", "echo out; echo err >&2"}},
+		{"pipes", true, 5 * time.Second, []string{"sh", "-c", "echo out; echo err >&2"}},
+		{"pty timeout", false, 200 * time.Millisecond, []string{"sleep", "10"}},
+		{"pipes timeout", true, 200 * time.Millisecond, []string{"sleep", "10"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testConfig(tc.timeout, tc.command...)
+			cfg.foreground = tc.foreground
+			cfg.logFile = filepath.Join(t.TempDir(), "{seq}.log")
+			cfg.snapFile = filepath.Join(t.TempDir(), "{seq}.snap")
+			cfg.snapEvery = time.Hour
+			cfg.fixedSize = sizeFlag{cols: 80, rows: 24}
+			// The first attempt opens what stays open for good, such as
+			// the os/signal loop's and the runtime's descriptors
+			run(tc.command[0], tc.command[1:], cfg, invocation{id: "test", seq: 1})
+			before := openFDs(t)
+			for seq := 2; seq <= 6; seq++ {
+				a := run(tc.command[0], tc.command[1:], cfg, invocation{id: "test", seq: seq})
+				if len(a.cleanup) > 0 {
+					t.Fatalf("attempt %d failed to clean up: %v", seq, a.cleanup)
+				}
+			}
+			if after := openFDs(t); after != before {
+				t.Fatalf("%d descriptors open after the attempts, %d before", after, before)
+			}
+		})
+	}
+}
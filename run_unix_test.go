@@ -0,0 +1,167 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testConfig is the least config run needs for command
+func testConfig(timeout time.Duration, command ...string) config {
+	return config{
+		timeout:    timeout,
+		foreground: true,
+		forward:    []os.Signal{syscall.SIGCONT},
+		signals:    make(chan os.Signal, 1),
+		command:    command,
+	}
+}
+
+// settle waits for the goroutine count to drop back to want, reporting the
+// stacks of those left over
+func settle(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Fatalf("%d goroutines left running after the attempts, %d before:\n%s", runtime.NumGoroutine(), want, buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAttemptsLeakNoGoroutines(t *testing.T) {
+	for _, foreground := range []bool{false, true} {
+		cfg := testConfig(5*time.Second, "sh", "-c", "echo attempt")
+		cfg.foreground = foreground
+		// The first attempt starts the os/signal loop, which stays for good
+		run("sh", []string{"-c", "echo attempt"}, cfg, invocation{id: "test", seq: 1})
+		before := runtime.NumGoroutine()
+		for seq := 2; seq <= 6; seq++ {
+			a := run("sh", []string{"-c", "echo attempt"}, cfg, invocation{id: "test", seq: seq})
+			if a.ExitCode != 0 {
+				t.Fatalf("attempt %d (foreground %v) exited with status %d", seq, foreground, a.ExitCode)
+			}
+		}
+		settle(t, before)
+	}
+}
+
+func TestTimedOutAttemptsLeakNoGoroutines(t *testing.T) {
+	cfg := testConfig(200*time.Millisecond, "sleep", "10")
+	run("sleep", []string{"10"}, cfg, invocation{id: "test", seq: 1})
+	before := runtime.NumGoroutine()
+	for seq := 2; seq <= 4; seq++ {
+		if a := run("sleep", []string{"10"}, cfg, invocation{id: "test", seq: seq}); !a.TimedOut {
+			t.Fatalf("attempt %d didn't time out: %+v", seq, a)
+		}
+	}
+	settle(t, before)
+}
+
+// TestSignalsDuringAttempts forwards signals while attempts start and end,
+// for the race detector. SIGCONT leaves the command be.
+func TestSignalsDuringAttempts(t *testing.T) {
+	cfg := testConfig(5*time.Second, "sleep", "0.2")
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case cfg.signals <- syscall.SIGCONT:
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	for seq := 1; seq <= 3; seq++ {
+		a := run("sleep", []string{"0.2"}, cfg, invocation{id: "test", seq: seq})
+		if a.ExitCode != 0 || a.stoppedBy != nil {
+			t.Fatalf("attempt %d: exit status %d, stopped by %v", seq, a.ExitCode, a.stoppedBy)
+		}
+	}
+}
+
+func TestTerminatingSignalStopsAttempt(t *testing.T) {
+	cfg := testConfig(time.Minute, "sleep", "10")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cfg.signals <- syscall.SIGTERM
+	}()
+	start := time.Now()
+	a := run("sleep", []string{"10"}, cfg, invocation{id: "test", seq: 1})
+	if a.stoppedBy != syscall.SIGTERM {
+		t.Fatalf("attempt stopped by %v, want SIGTERM", a.stoppedBy)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("attempt took %v to stop", took)
+	}
+	if got := signalStatus(a.stoppedBy); got != 143 {
+		t.Fatalf("exit status %d, want 143", got)
+	}
+}
+
+func TestSleepBackoff(t *testing.T) {
+	sigs := make(chan os.Signal, 1)
+	if sig := sleepBackoff(10*time.Millisecond, sigs); sig != nil {
+		t.Fatalf("backoff ended by %v with no signal sent", sig)
+	}
+
+	// Signals with no command to go to don't cut it short
+	sigs <- syscall.SIGUSR1
+	start := time.Now()
+	if sig := sleepBackoff(100*time.Millisecond, sigs); sig != nil {
+		t.Fatalf("backoff ended by %v", sig)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Fatalf("backoff took %v, want 100ms", took)
+	}
+
+	sigs <- syscall.SIGINT
+	start = time.Now()
+	if sig := sleepBackoff(time.Hour, sigs); sig != syscall.SIGINT {
+		t.Fatalf("backoff ended by %v, want SIGINT", sig)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("backoff took %v to interrupt", took)
+	}
+}
+
+func TestSignalStatus(t *testing.T) {
+	for sig, want := range map[os.Signal]int{syscall.SIGINT: 130, syscall.SIGHUP: 129} {
+		if got := signalStatus(sig); got != want {
+			t.Errorf("signalStatus(%v) = %d, want %d", sig, got, want)
+		}
+	}
+	if name := signalName(syscall.SIGTERM); !strings.HasSuffix(name, "TERM") {
+		t.Errorf("signalName(SIGTERM) = %q", name)
+	}
+}
+
+func TestUnbufferOutputStopsFlushing(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	c := newConsole(w, w)
+	before := runtime.NumGoroutine()
+	c.bufferOutput(true, time.Hour)
+	c.Write([]byte("prompt> "))
+	c.unbufferOutput()
+	settle(t, before)
+
+	buf := make([]byte, 64)
+	if n, err := r.Read(buf); err != nil || string(buf[:n]) != "prompt> " {
+		t.Errorf("read %q, %v after unbuffering, want the held back prompt", buf[:n], err)
+	}
+}
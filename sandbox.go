@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// sandbox is what the command is confined to by --landlock-ro,
+// --landlock-rw, --seccomp-profile and --no-new-privs. limit-exec applies
+// it just before it execs the command, and it can't be undone from there.
+type sandbox struct {
+	readOnly   []string // the command may only read and run files beneath these
+	readWrite  []string // and also write beneath these
+	seccomp    string   // the seccomp profile, "" for none
+	noNewPrivs bool     // setuid and file capabilities don't raise privileges
+}
+
+// seccompProfiles are the profiles --seccomp-profile accepts
+var seccompProfiles = []string{"default"}
+
+// pathList is a flag.Value for --landlock-ro and --landlock-rw, given once
+// per path, which is made absolute as the command may start elsewhere
+type pathList []string
+
+func (l *pathList) String() string { return strings.Join(*l, " ") }
+
+func (l *pathList) Set(s string) error {
+	if s == "" {
+		return errors.New("expected a path")
+	}
+	path, err := filepath.Abs(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, path)
+	return nil
+}
+
+func (s sandbox) enabled() bool {
+	return s.landlock() || s.seccomp != "" || s.noNewPrivs
+}
+
+func (s sandbox) landlock() bool {
+	return len(s.readOnly) > 0 || len(s.readWrite) > 0
+}
+
+// settings encodes the sandbox for limit-exec, escaping the paths
+func (s sandbox) settings() []string {
+	var parts []string
+	for _, p := range s.readOnly {
+		parts = append(parts, "landlock-ro="+url.PathEscape(p))
+	}
+	for _, p := range s.readWrite {
+		parts = append(parts, "landlock-rw="+url.PathEscape(p))
+	}
+	if s.seccomp != "" {
+		parts = append(parts, "seccomp="+s.seccomp)
+	}
+	if s.noNewPrivs {
+		parts = append(parts, "no-new-privs=1")
+	}
+	return parts
+}
+
+// set adds a setting from limit-exec's argument, reporting whether it is
+// one of the sandbox's
+func (s *sandbox) set(name, value string) (bool, error) {
+	switch name {
+	case "landlock-ro", "landlock-rw":
+		path, err := url.PathUnescape(value)
+		if err != nil {
+			return true, err
+		}
+		if name == "landlock-ro" {
+			s.readOnly = append(s.readOnly, path)
+		} else {
+			s.readWrite = append(s.readWrite, path)
+		}
+	case "seccomp":
+		s.seccomp = value
+	case "no-new-privs":
+		s.noNewPrivs = true
+	default:
+		return false, nil
+	}
+	return true, nil
+}
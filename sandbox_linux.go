@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The Landlock system calls, numbered alike on every architecture
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 // ask for the ABI version
+	landlockRulePathBeneath      = 1
+)
+
+// Landlock's filesystem access rights; refer came with ABI 2 and truncate
+// with 3
+const (
+	landlockExecute = 1 << iota
+	landlockWriteFile
+	landlockReadFile
+	landlockReadDir
+	landlockRemoveDir
+	landlockRemoveFile
+	landlockMakeChar
+	landlockMakeDir
+	landlockMakeReg
+	landlockMakeSock
+	landlockMakeFifo
+	landlockMakeBlock
+	landlockMakeSym
+	landlockRefer
+	landlockTruncate
+
+	// landlockReadOnly is what --landlock-ro allows
+	landlockReadOnly = landlockExecute | landlockReadFile | landlockReadDir
+	// landlockFileRights are the rights that apply to a file, rather
+	// than to what is in a directory
+	landlockFileRights = landlockExecute | landlockWriteFile | landlockReadFile | landlockTruncate
+)
+
+const (
+	prSetNoNewPrivs   = 38
+	prGetSeccomp      = 21
+	prSetSeccomp      = 22
+	seccompModeFilter = 2
+
+	seccompRetKill  = 0x80000000 // the whole process
+	seccompRetErrno = 0x00050000
+	seccompRetAllow = 0x7fff0000
+
+	// oPath opens a file only to name it, which needs no permission on it
+	oPath = 0x200000
+)
+
+// checkSandbox reports whether the kernel can confine the command as s
+// asks, and whether the paths for Landlock exist
+func checkSandbox(s sandbox) error {
+	if s.landlock() {
+		if _, err := landlockABI(); err != nil {
+			return err
+		}
+		for _, path := range append(append([]string(nil), s.readOnly...), s.readWrite...) {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("landlock: %w", err)
+			}
+		}
+	}
+	if s.seccomp != "" {
+		if seccompArch == 0 {
+			return errors.New("seccomp profiles are only supported on amd64 and arm64")
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prGetSeccomp, 0, 0); errno != 0 {
+			return fmt.Errorf("seccomp: %w", errno)
+		}
+	}
+	return nil
+}
+
+// landlockABI returns the version of Landlock the kernel has
+func landlockABI() (int, error) {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	switch errno {
+	case 0:
+		return int(abi), nil
+	case syscall.ENOSYS:
+		return 0, errors.New("landlock needs Linux 5.13 or later")
+	case syscall.EOPNOTSUPP:
+		return 0, errors.New("landlock is turned off in this kernel (see the lsm= boot parameter)")
+	}
+	return 0, fmt.Errorf("landlock: %w", errno)
+}
+
+// apply confines this process, and so the command it is about to exec,
+// on the calling thread; the caller keeps to it until the exec
+func (s sandbox) apply() error {
+	// Setting up Landlock or seccomp unprivileged requires no_new_privs
+	if s.enabled() {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			return fmt.Errorf("no_new_privs: %w", errno)
+		}
+	}
+	if s.landlock() {
+		if err := s.applyLandlock(); err != nil {
+			return fmt.Errorf("landlock: %w", err)
+		}
+	}
+	if s.seccomp != "" {
+		if err := applySeccomp(seccompDefaultDenied); err != nil {
+			return fmt.Errorf("seccomp: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyLandlock keeps the command from touching files other than those
+// beneath the read-only and read-write paths, and from writing to the
+// former, but for /dev/null. Descriptors it inherits open, such as its
+// terminal, still work.
+func (s sandbox) applyLandlock() error {
+	abi, err := landlockABI()
+	if err != nil {
+		return err
+	}
+	handled := uint64(landlockMakeSym<<1 - 1)
+	if abi >= 2 {
+		handled |= landlockRefer
+	}
+	if abi >= 3 {
+		handled |= landlockTruncate
+	}
+	attr := handled // struct landlock_ruleset_attr, up to handled_access_fs
+	ruleset, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(int(ruleset))
+	add := func(path string, access uint64) error {
+		fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		defer syscall.Close(fd)
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			access &= landlockFileRights
+		}
+		// struct landlock_path_beneath_attr, which is packed
+		var rule [12]byte
+		binary.NativeEndian.PutUint64(rule[:8], access&handled)
+		binary.NativeEndian.PutUint32(rule[8:], uint32(fd))
+		if _, _, errno := syscall.Syscall6(sysLandlockAddRule, ruleset, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0); errno != 0 {
+			return fmt.Errorf("%s: %w", path, errno)
+		}
+		return nil
+	}
+	for _, path := range s.readOnly {
+		if err := add(path, landlockReadOnly); err != nil {
+			return err
+		}
+	}
+	for _, path := range s.readWrite {
+		if err := add(path, handled); err != nil {
+			return err
+		}
+	}
+	// Writing to /dev/null gives nothing away, and much breaks without it
+	if err := add("/dev/null", landlockReadFile|landlockWriteFile|landlockTruncate); err != nil && !errors.Is(err, syscall.ENOENT) {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, ruleset, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// applySeccomp installs a filter refusing the denied calls with EPERM.
+// Calls made through another architecture's interface, such as 32-bit
+// ones, would get past a filter by number, so they kill the process.
+func applySeccomp(denied []uint32) error {
+	const (
+		ldAbs = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+		jeq   = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jge   = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+		ret   = syscall.BPF_RET | syscall.BPF_K
+	)
+	// struct seccomp_data starts with the call's number and architecture
+	prog := []syscall.SockFilter{
+		{Code: ldAbs, K: 4},
+		{Code: jeq, K: seccompArch}, // Jf to the kill, set below
+		{Code: ldAbs, K: 0},
+	}
+	if seccompX32 != 0 {
+		prog = append(prog, syscall.SockFilter{Code: jge, K: seccompX32}) // Jt to the refusal
+	}
+	for _, nr := range denied {
+		prog = append(prog, syscall.SockFilter{Code: jeq, K: nr})
+	}
+	prog = append(prog,
+		syscall.SockFilter{Code: ret, K: seccompRetAllow},
+		syscall.SockFilter{Code: ret, K: seccompRetErrno | uint32(syscall.EPERM)},
+		syscall.SockFilter{Code: ret, K: seccompRetKill},
+	)
+	refuse, kill := len(prog)-2, len(prog)-1
+	prog[1].Jf = uint8(kill - 2)
+	for i := 3; i < refuse-1; i++ {
+		prog[i].Jt = uint8(refuse - i - 1)
+	}
+	fprog := syscall.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&fprog))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+// seccompArch is AUDIT_ARCH_X86_64, the architecture a seccomp filter
+// expects calls to come through
+const seccompArch = 0xc000003e
+
+// seccompX32 marks the calls of the x32 interface, all refused
+const seccompX32 = 0x40000000
+
+// seccompDefaultDenied are the calls --seccomp-profile default refuses,
+// much as container runtimes do by default: those that change the system
+// rather than the process, load kernel code, or reach into other processes
+var seccompDefaultDenied = []uint32{
+	101, // ptrace
+	103, // syslog
+	153, // vhangup
+	155, // pivot_root
+	159, // adjtimex
+	163, // acct
+	164, // settimeofday
+	165, // mount
+	166, // umount2
+	167, // swapon
+	168, // swapoff
+	169, // reboot
+	172, // iopl
+	173, // ioperm
+	175, // init_module
+	176, // delete_module
+	179, // quotactl
+	212, // lookup_dcookie
+	227, // clock_settime
+	246, // kexec_load
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	272, // unshare
+	298, // perf_event_open
+	303, // name_to_handle_at
+	304, // open_by_handle_at
+	305, // clock_adjtime
+	308, // setns
+	310, // process_vm_readv
+	311, // process_vm_writev
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+	323, // userfaultfd
+	428, // open_tree
+	429, // move_mount
+	430, // fsopen
+	431, // fsconfig
+	432, // fsmount
+	433, // fspick
+}
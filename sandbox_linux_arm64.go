@@ -0,0 +1,53 @@
+package main
+
+// seccompArch is AUDIT_ARCH_AARCH64, the architecture a seccomp filter
+// expects calls to come through
+const seccompArch = 0xc00000b7
+
+// seccompX32 is 0: arm64 has no second interface numbered apart
+const seccompX32 = 0
+
+// seccompDefaultDenied are the calls --seccomp-profile default refuses,
+// much as container runtimes do by default: those that change the system
+// rather than the process, load kernel code, or reach into other processes
+var seccompDefaultDenied = []uint32{
+	18,  // lookup_dcookie
+	39,  // umount2
+	40,  // mount
+	41,  // pivot_root
+	58,  // vhangup
+	60,  // quotactl
+	89,  // acct
+	97,  // unshare
+	104, // kexec_load
+	105, // init_module
+	106, // delete_module
+	112, // clock_settime
+	116, // syslog
+	117, // ptrace
+	142, // reboot
+	170, // settimeofday
+	171, // adjtimex
+	217, // add_key
+	218, // request_key
+	219, // keyctl
+	224, // swapon
+	225, // swapoff
+	241, // perf_event_open
+	264, // name_to_handle_at
+	265, // open_by_handle_at
+	266, // clock_adjtime
+	268, // setns
+	270, // process_vm_readv
+	271, // process_vm_writev
+	273, // finit_module
+	280, // bpf
+	282, // userfaultfd
+	294, // kexec_file_load
+	428, // open_tree
+	429, // move_mount
+	430, // fsopen
+	431, // fsconfig
+	432, // fsmount
+	433, // fspick
+}
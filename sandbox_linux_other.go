@@ -0,0 +1,11 @@
+//go:build linux && !(amd64 || arm64)
+
+package main
+
+// seccompArch is 0: the seccomp profiles are written for amd64 and arm64
+// only, and checkSandbox refuses them elsewhere
+const seccompArch = 0
+
+const seccompX32 = 0
+
+var seccompDefaultDenied []uint32
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// checkSandbox fails: Landlock, seccomp and no_new_privs are Linux's
+func checkSandbox(s sandbox) error {
+	return errors.New("sandboxing is only supported on Linux")
+}
+
+func (s sandbox) apply() error {
+	return errors.New("sandboxing is only supported on Linux")
+}
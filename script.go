@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scriptRecorder writes output as a script(1) typescript with a timing
+// file, so sessions can be replayed with scriptreplay
+type scriptRecorder struct {
+	mu       sync.Mutex
+	f, tf    *os.File
+	w, tw    *bufio.Writer
+	last     time.Time // when the previous chunk was written
+	exitCode *int
+}
+
+// scripts holds open recordings by typescript path, so attempts without
+// {seq} in the template keep appending to one continuous session
+var scripts = map[string]*scriptRecorder{}
+
+// scriptTimeFormat is how script(1) dates its header and footer
+const scriptTimeFormat = "2006-01-02 15:04:05-07:00"
+
+// openScript returns the recorder for the attempt's expanded paths. The
+// timing file defaults to the typescript's path with .tm appended.
+func openScript(tmpl, timingTmpl string, inv invocation, command []string, cfg config) (*scriptRecorder, error) {
+	path := inv.expand(tmpl)
+	if s, ok := scripts[path]; ok {
+		return s, nil
+	}
+	timing := path + ".tm"
+	if timingTmpl != "" {
+		timing = inv.expand(timingTmpl)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := os.Create(timing)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &scriptRecorder{f: f, tf: tf, w: bufio.NewWriter(f), tw: bufio.NewWriter(tf), last: time.Now()}
+	cols, rows := cfg.ptySize()
+	fmt.Fprintf(s.w, "Script started on %s [COMMAND=%s TERM=%s COLUMNS=\"%d\" LINES=\"%d\"]\n",
+		s.last.Format(scriptTimeFormat), strconv.Quote(strings.Join(command, " ")), strconv.Quote(os.Getenv("TERM")), cols, rows)
+	scripts[path] = s
+	return s, nil
+}
+
+// closeScripts writes the footers and closes every open recording,
+// returning what failed
+func closeScripts() []error {
+	var errs []error
+	for path, s := range scripts {
+		if err := s.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("recording %s: %w", path, err))
+		}
+		delete(scripts, path)
+	}
+	return errs
+}
+
+func (s *scriptRecorder) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if _, err := fmt.Fprintf(s.tw, "%.6f %d\n", now.Sub(s.last).Seconds(), len(p)); err != nil {
+		return 0, err
+	}
+	s.last = now
+	if _, err := s.w.Write(p); err != nil {
+		return 0, err
+	}
+	if err := s.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), s.tw.Flush()
+}
+
+// exited records the exit status for the footer
+func (s *scriptRecorder) exited(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.exitCode = &code
+}
+
+func (s *scriptRecorder) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "\nScript done on %s", time.Now().Format(scriptTimeFormat))
+	if s.exitCode != nil {
+		fmt.Fprintf(s.w, " [COMMAND_EXIT_CODE=\"%d\"]", *s.exitCode)
+	}
+	s.w.WriteString("\n")
+	err := s.w.Flush()
+	if terr := s.tw.Flush(); err == nil {
+		err = terr
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := s.tf.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
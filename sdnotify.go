@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdNotifier speaks the sd_notify protocol for --sd-notify: the wrapper
+// tells systemd it is ready, pings the unit's watchdog while it runs, and
+// says when it is stopping
+type sdNotifier struct {
+	socket   string
+	interval time.Duration // between watchdog pings, 0 without WatchdogSec
+	done     chan struct{}
+}
+
+// checkSDNotify returns the notifier for the service the wrapper runs as,
+// and takes its variables out of the environment, where the command would
+// only find that its own notifications are refused
+func checkSDNotify() (*sdNotifier, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil, errors.New("NOTIFY_SOCKET isn't set: not running as a Type=notify systemd service")
+	}
+	n := &sdNotifier{socket: socket, done: make(chan struct{})}
+	if strings.HasPrefix(socket, "@") {
+		n.socket = "\x00" + socket[1:] // abstract namespace
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if err == nil && usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		n.interval = time.Duration(usec) * time.Microsecond / 2
+	}
+	for _, v := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		os.Unsetenv(v)
+	}
+	return n, nil
+}
+
+// send sends a state change such as READY=1
+func (n *sdNotifier) send(state string) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// start reports the wrapper ready, and pings the watchdog until stop
+func (n *sdNotifier) start() {
+	if err := n.send("READY=1"); err != nil {
+		con.Logf("Failed to notify systemd: %v", err)
+	}
+	if n.interval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(n.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-n.done:
+				return
+			case <-ticker.C:
+				n.send("WATCHDOG=1")
+			}
+		}
+	}()
+}
+
+// status shows text in systemctl status
+func (n *sdNotifier) status(text string) {
+	n.send("STATUS=" + text)
+}
+
+// stop ends the pings and reports the wrapper stopping
+func (n *sdNotifier) stop() {
+	close(n.done)
+	n.send("STOPPING=1")
+}
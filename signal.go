@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// parseSignal looks up a signal by name, with or without the SIG prefix
+// and in any case, e.g. QUIT, sigquit
+func parseSignal(name string) (os.Signal, error) {
+	name = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(name)), "SIG")
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	known := make([]string, 0, len(signalNames))
+	for n := range signalNames {
+		known = append(known, n)
+	}
+	slices.Sort(known)
+	return nil, fmt.Errorf("unknown signal %q: expected one of %s", name, strings.Join(known, ", "))
+}
+
+// signalName is the conventional name of sig, e.g. SIGQUIT
+func signalName(sig os.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// signalList is a flag.Value for a comma-separated list of signal names
+type signalList []os.Signal
+
+func (l *signalList) String() string {
+	var names []string
+	for _, sig := range *l {
+		names = append(names, sig.String())
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *signalList) Set(s string) error {
+	for _, name := range strings.Split(s, ",") {
+		sig, err := parseSignal(name)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, sig)
+	}
+	return nil
+}
+
+// forwarding returns the forwardedSignals minus those in skip. A wrapper
+// that suspends always watches for resumeSignal, to resume too.
+func forwarding(skip []os.Signal) []os.Signal {
+	var sigs []os.Signal
+	for _, sig := range forwardedSignals {
+		if !slices.Contains(skip, sig) {
+			sigs = append(sigs, sig)
+		}
+	}
+	if slices.Contains(sigs, suspendSignal) && !slices.Contains(sigs, resumeSignal) {
+		sigs = append(sigs, resumeSignal)
+	}
+	return sigs
+}
+
+// watchSignals subscribes to the signals the wrapper handles for the whole
+// invocation: those it forwards, and the terminatingSignals, which would
+// otherwise end it with the terminal raw and its sockets left behind. The
+// returned function unsubscribes.
+func watchSignals(forward []os.Signal) (chan os.Signal, func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forward...)
+	signal.Notify(sigs, terminatingSignals...)
+	return sigs, func() { signal.Stop(sigs) }
+}
+
+// sleepBackoff waits out the backoff between attempts, reporting a
+// terminating signal that cuts it short. Ctrl-Z suspends the wrapper as it
+// would the command; other signals have no command to go to.
+func sleepBackoff(d time.Duration, sigs <-chan os.Signal) os.Signal {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return nil
+		case sig := <-sigs:
+			if slices.Contains(terminatingSignals, sig) {
+				return sig
+			}
+			if sig == suspendSignal {
+				stopSelf()
+			}
+		}
+	}
+}
+
+// signalStatus is the exit status of a wrapper ended by sig, 128 plus its
+// number as shells report it
+func signalStatus(sig os.Signal) int {
+	if n, ok := sig.(syscall.Signal); ok {
+		return 128 + int(n)
+	}
+	return 1
+}
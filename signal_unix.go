@@ -0,0 +1,111 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// forwardedSignals are passed on to the child's process group, less those
+// in --no-forward and controlSignals while they adjust the idle budget.
+// SIGHUP is among them, so a closed terminal ends the child while the
+// wrapper lives on to clean up after it.
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT,
+	syscall.SIGALRM, syscall.SIGCONT, syscall.SIGUSR1, syscall.SIGUSR2,
+	syscall.SIGTSTP,
+}
+
+// terminatingSignals end the wrapper, after it has cleaned up, when they
+// aren't forwarded or arrive between attempts
+var terminatingSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}
+
+// suspendSignal suspends the wrapper along with the command until
+// resumeSignal. The command gets stopSignal: in a session of its own its
+// process group is orphaned, and the kernel discards SIGTSTP for those.
+var (
+	suspendSignal, resumeSignal os.Signal = syscall.SIGTSTP, syscall.SIGCONT
+	stopSignal                  os.Signal = syscall.SIGSTOP
+)
+
+// signalNames are the signals options such as --no-forward accept
+var signalNames = map[string]os.Signal{
+	"HUP": syscall.SIGHUP, "INT": syscall.SIGINT, "QUIT": syscall.SIGQUIT,
+	"ABRT": syscall.SIGABRT, "KILL": syscall.SIGKILL, "USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2, "ALRM": syscall.SIGALRM, "TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT, "STOP": syscall.SIGSTOP, "TSTP": syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+}
+
+// controlSignals adjust the idle budget, see control.watchSignals
+var controlSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}
+
+// shellCommand runs a hook command line
+var shellCommand = []string{"/bin/sh", "-c"}
+
+// shellArgv runs line through the user's shell for -c; args become its
+// positional parameters $1, $2, ...
+func shellArgv(line string, args []string) []string {
+	sh := os.Getenv("SHELL")
+	if sh == "" {
+		sh = shellCommand[0]
+	}
+	return append([]string{sh, "-c", line, sh}, args...)
+}
+
+// watchResize reports terminal size changes until ctx is done
+func watchResize(ctx context.Context, wg *sync.WaitGroup) <-chan struct{} {
+	resized := make(chan struct{}, 1)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer signal.Stop(winch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-winch:
+				select {
+				case resized <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return resized
+}
+
+// stopSelf stops the wrapper until it gets SIGCONT, as SIGTSTP would
+// without a handler
+func stopSelf() {
+	syscall.Kill(os.Getpid(), syscall.SIGSTOP)
+}
+
+// brokenPipe is sent to the producer of a pair once its consumer is gone
+var brokenPipe os.Signal = syscall.SIGPIPE
+
+// processAlive reports whether a process with the given PID exists, ours
+// or not
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// signalGroup sends sig to the process group pid leads, or to the process
+// alone if it leads none
+func signalGroup(pid int, sig os.Signal) error {
+	if s, ok := sig.(syscall.Signal); ok && syscall.Kill(-pid, s) == nil {
+		return nil
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// forwardedSignals are passed on to the child. With the console in raw
+// mode Ctrl+C arrives as input; this covers an interrupt from elsewhere.
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+// terminatingSignals end the wrapper, after it has cleaned up, when they
+// aren't forwarded or arrive between attempts
+var terminatingSignals = []os.Signal{os.Interrupt}
+
+// suspendSignal, resumeSignal and stopSignal are nil: Windows has no job
+// control
+var suspendSignal, resumeSignal, stopSignal os.Signal
+
+func stopSelf() {}
+
+// signalNames are the signals options such as --no-forward accept
+var signalNames = map[string]os.Signal{"INT": os.Interrupt, "KILL": os.Kill}
+
+// controlSignals is empty: Windows has no user signals, leaving the
+// control socket
+var controlSignals []os.Signal
+
+// shellCommand runs a hook command line
+var shellCommand = []string{"cmd", "/C"}
+
+// shellArgv runs line through cmd.exe for -c, followed by args
+func shellArgv(line string, args []string) []string {
+	return append([]string{"cmd", "/C", line}, args...)
+}
+
+// resizePoll is how often the console size is checked, as Windows has no
+// SIGWINCH
+const resizePoll = 250 * time.Millisecond
+
+// watchResize reports console size changes until ctx is done
+func watchResize(ctx context.Context, wg *sync.WaitGroup) <-chan struct{} {
+	resized := make(chan struct{}, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(resizePoll)
+		defer ticker.Stop()
+		cols, rows := terminalSize(uintptr(syscall.Stdout))
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if c, r := terminalSize(uintptr(syscall.Stdout)); c != cols || r != rows {
+					cols, rows = c, r
+					select {
+					case resized <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}()
+	return resized
+}
+
+// brokenPipe ends the producer of a pair once its consumer is gone; Windows
+// has no SIGPIPE
+var brokenPipe os.Signal = os.Kill
+
+// stillActive is the exit code GetExitCodeProcess reports for a running
+// process
+const stillActive = 259
+
+// processAlive reports whether a process with the given PID exists, ours
+// or not
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	return syscall.GetExitCodeProcess(h, &code) == nil && code == stillActive
+}
+
+// signalGroup sends sig to the process: Windows has no process groups to
+// signal
+func signalGroup(pid int, sig os.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotter renders the child's output on a virtual screen and appends
+// what it shows to a file, at most once per interval and only when it
+// changed, so the last screens of a hung TUI survive for a post-mortem
+type snapshotter struct {
+	mu    sync.Mutex
+	f     *os.File
+	scr   *screen
+	every time.Duration
+	start time.Time
+	seq   int
+	taken time.Time // when the last snapshot was written
+	last  string    // its text
+	dirty bool      // output arrived that isn't in a snapshot yet
+}
+
+// openSnapshots opens the attempt's snapshot file for appending
+func openSnapshots(tmpl string, inv invocation, every time.Duration, cols, rows int) (*snapshotter, error) {
+	f, err := os.OpenFile(inv.expand(tmpl), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotter{f: f, scr: newScreen(cols, rows), every: every, start: time.Now(), seq: inv.seq}, nil
+}
+
+func (s *snapshotter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scr.Write(p)
+	s.dirty = true
+	if time.Since(s.taken) >= s.every {
+		s.take("")
+	}
+	return len(p), nil
+}
+
+// resize follows a terminal resize
+func (s *snapshotter) resize(cols, rows int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scr.resize(cols, rows)
+}
+
+// Snap writes the current screen now, e.g. on timeout, labelled with why
+func (s *snapshotter) Snap(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.take(label)
+}
+
+// take appends the screen if it changed since the last snapshot
+func (s *snapshotter) take(label string) {
+	if !s.dirty && label == "" {
+		return
+	}
+	s.dirty = false
+	text := s.scr.text()
+	if text == s.last && label == "" {
+		return
+	}
+	now := time.Now()
+	s.taken, s.last = now, text
+	header := fmt.Sprintf("=== %s +%.3fs attempt %d", now.Format(time.RFC3339Nano), now.Sub(s.start).Seconds(), s.seq)
+	if label != "" {
+		header += ": " + label
+	}
+	rule := strings.Repeat("-", s.scr.cols)
+	fmt.Fprintf(s.f, "%s ===\n%s\n%s\n%s\n\n", header, rule, text, rule)
+}
+
+func (s *snapshotter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.take("")
+	return s.f.Close()
+}
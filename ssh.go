@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// sshMain runs a command on another host over ssh, on a terminal there,
+// and watches the output that comes back for inactivity. Killing ssh
+// alone would leave the command running on the host, so a timeout kills
+// it there first, through a second session over the same connection.
+func sshMain(args []string) int {
+	fset := flag.NewFlagSet("ssh", flag.ExitOnError)
+	sshCmd := fset.String("ssh", "ssh", "the ssh `command` to use")
+	port := fset.Int("port", 0, "connect to this `port` (default: ssh's, 22 or from its config)")
+	identity := fset.String("identity", "", "authenticate with the private key in `file`, as ssh -i does")
+	var warnAt warnThreshold
+	fset.Var(&warnAt, "warn-at", "warn once per idle episode after this much inactivity, as a `percentage` of the timeout (80%) or a duration")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout ssh [options] <duration> <[user@]host> [--] <command> [args...]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout ssh 5m deploy@web1 -- ./migrate.sh --all\n")
+		fmt.Fprintf(os.Stderr, "\nThe command runs under sh on the host, which kill must be found in as well.\n")
+		fmt.Fprintf(os.Stderr, "The exit status is 124 after a timeout, else ssh's, which is the command's\n")
+		fmt.Fprintf(os.Stderr, "or 255 if ssh itself failed.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	var positional []string
+	for fset.NArg() > 0 && len(positional) < 2 {
+		positional = append(positional, fset.Arg(0))
+		fset.Parse(fset.Args()[1:])
+	}
+	command := fset.Args()
+	if len(positional) != 2 || len(command) == 0 {
+		fset.Usage()
+		return 1
+	}
+	timeout, err := parseDuration(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", positional[0], err)
+		return 1
+	}
+	if timeout < watchdog.Resolution {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: below the watchdog's %v resolution\n", positional[0], watchdog.Resolution)
+		return 1
+	}
+	if *port < 0 || *port > 65535 {
+		fmt.Fprintf(os.Stderr, "Invalid port %d: expected 1 to 65535\n", *port)
+		return 1
+	}
+	host := positional[1]
+
+	// The kill goes over the command's connection where ssh can share it,
+	// so it needs no second login
+	var shared []string
+	if runtime.GOOS != "windows" {
+		dir, err := os.MkdirTemp("", "idle-timeout-ssh")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create control directory: %v\n", err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		shared = []string{"-o", "ControlPath=" + filepath.Join(dir, "control")}
+	}
+	// ssh [options] -- <host> <command line>, for the command and for the
+	// kill; ssh hands the host's shell one line, so the words are quoted
+	sshArgs := func(extra []string, command ...string) []string {
+		a := append([]string{}, extra...)
+		if *port != 0 {
+			a = append(a, "-p", strconv.Itoa(*port))
+		}
+		if *identity != "" {
+			a = append(a, "-i", *identity)
+		}
+		return append(a, "--", host, shellJoin(command))
+	}
+	// With a terminal on the host, the PID comes back in the output
+	stdout := &pidCatcher{w: con}
+	signalRemote := func(sig string) error {
+		pid := stdout.remotePID()
+		if pid == 0 {
+			return fmt.Errorf("the command's PID on the host is unknown")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), remoteKillWait)
+		defer cancel()
+		script := fmt.Sprintf("kill -%s -%d 2>/dev/null || kill -%s %d", sig, pid, sig, pid)
+		extra := append([]string{"-T", "-o", "BatchMode=yes"}, shared...)
+		out, err := exec.CommandContext(ctx, *sshCmd, sshArgs(extra, "sh", "-c", script)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, bytes.TrimSpace(out))
+		}
+		return nil
+	}
+
+	inv := newInvocation("")
+	var master []string
+	if shared != nil {
+		master = append([]string{"-o", "ControlMaster=yes", "-o", "ControlPersist=no"}, shared...)
+	}
+	runner := watchdog.New(watchdog.Config{
+		Path:    *sshCmd,
+		Args:    sshArgs(append([]string{"-tt"}, master...), append([]string{"sh", "-c", remoteShim, "sh"}, command...)...),
+		Env:     append(os.Environ(), inv.env()...),
+		Timeout: timeout,
+		WarnAt:  warnAt.resolve(timeout),
+		Stdout:  stdout,
+		Stderr:  con.stderr(),
+		OnEvent: func(e watchdog.Event) {
+			switch e.Kind {
+			case watchdog.Warned:
+				con.Logf("No output for %v, killing in %v...", idleFor(e.Idle), timeLeft(e.Timeout-e.Idle))
+			case watchdog.TimedOut:
+				con.Logf("No output for %v, killing process on %s...", e.Timeout, host)
+				if err := signalRemote("KILL"); err != nil {
+					con.Logf("Failed to kill the command on %s (%v); it may still be running there", host, err)
+				}
+			}
+		},
+	})
+	con.Printf("spawn %s: %s\n", host, strings.Join(command, " "))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, forwardedSignals...)
+	defer signal.Stop(sigChan)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigChan:
+				name := strings.TrimPrefix(signalName(sig), "SIG")
+				if err := signalRemote(name); err != nil {
+					con.Logf("Failed to pass on %s to %s: %v", signalName(sig), host, err)
+				}
+			}
+		}
+	}()
+
+	res := runner.Run(ctx)
+	if res.Err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run %s: %v\n", *sshCmd, res.Err)
+		return 1
+	}
+	return res.ExitCode
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lastRun is the per-directory status cached for prompt-status
+type lastRun struct {
+	Dir      string    `json:"dir"`
+	Command  []string  `json:"command"`
+	Finished time.Time `json:"finished"`
+	Duration float64   `json:"duration_seconds"`
+	Timeout  float64   `json:"timeout_seconds"`
+	ExitCode int       `json:"exit_code"`
+	TimedOut bool      `json:"timed_out"`
+}
+
+// statusPath is where the last run started in dir is cached
+func statusPath(dir string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(cache, "idle-timeout", "status", hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// saveStatus records the outcome for the current directory. It is best
+// effort: a read-only cache must not change the wrapper's exit status, so
+// a failure to write it is only reported. Without a cache directory there
+// is nowhere to keep it, which isn't a failure.
+func saveStatus(command []string, history []attempt, timeout time.Duration) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	path, err := statusPath(dir)
+	if err != nil {
+		return nil
+	}
+	final := history[len(history)-1]
+	data, err := json.Marshal(lastRun{
+		Dir:      dir,
+		Command:  command,
+		Finished: time.Now(),
+		Duration: time.Since(history[0].Started).Seconds(),
+		Timeout:  timeout.Seconds(),
+		ExitCode: final.ExitCode,
+		TimedOut: final.TimedOut,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Rename so a prompt never reads a half-written file
+	tmp := fmt.Sprintf("%s.%d", path, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// promptStatusMain prints a one-line summary of the last watched run in the
+// current directory for a shell prompt segment, or nothing (status 1) if
+// there is none
+func promptStatusMain(args []string) int {
+	fset := flag.NewFlagSet("prompt-status", flag.ExitOnError)
+	maxAge := durationFlag(0)
+	fset.Var(&maxAge, "max-age", "ignore runs that finished longer than this `duration` ago (default: no limit)")
+	asJSON := fset.Bool("json", false, "print the cached record as JSON")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout prompt-status [options]\n")
+		fmt.Fprintf(os.Stderr, "Example: PS1='$(idle-timeout prompt-status --max-age 1h) \\$ '\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return 1
+	}
+	path, err := statusPath(dir)
+	if err != nil {
+		return 1
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 1
+	}
+	var r lastRun
+	if json.Unmarshal(data, &r) != nil || r.Dir != dir || len(r.Command) == 0 {
+		return 1
+	}
+	if maxAge > 0 && time.Since(r.Finished) > time.Duration(maxAge) {
+		return 1
+	}
+	if *asJSON {
+		fmt.Printf("%s\n", data)
+		return 0
+	}
+
+	ran := (time.Duration(r.Duration * float64(time.Second))).Round(time.Second)
+	name := filepath.Base(r.Command[0])
+	switch {
+	case r.TimedOut:
+		timeout := time.Duration(r.Timeout * float64(time.Second))
+		fmt.Printf("last watched %s: killed idle after %v\n", name, timeout)
+	case r.ExitCode == 0:
+		fmt.Printf("last watched %s: ok in %v\n", name, ran)
+	default:
+		fmt.Printf("last watched %s: exit %d after %v\n", name, r.ExitCode, ran)
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// statusPaint is how often the --status-line footer and the --title are
+// updated
+const statusPaint = 500 * time.Millisecond
+
+// showStatusLine keeps a footer under the command's output showing how long
+// it has been idle against its budget, until ctx is done
+func showStatusLine(ctx context.Context, wg *sync.WaitGroup, r *watchdog.Runner, name string) {
+	_, rows := terminalSize(uintptr(syscall.Stdout))
+	con.openFooter(rows)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer con.closeFooter()
+		ticker := time.NewTicker(statusPaint)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if r.PID() == 0 {
+				continue // not started yet
+			}
+			cols, _ := terminalSize(uintptr(syscall.Stdout))
+			text := fmt.Sprintf(" %s: idle %v / %v ", name, time.Since(r.LastActivity()).Truncate(time.Second), r.IdleLimit())
+			if len(text) > cols {
+				text = text[:cols]
+			}
+			con.paintFooter(text)
+		}
+	}()
+}
+
+// showTitle keeps the terminal's title showing the command and how much of
+// its idle budget is left, until ctx is done
+func showTitle(ctx context.Context, wg *sync.WaitGroup, r *watchdog.Runner, name string) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(statusPaint)
+		defer ticker.Stop()
+		shown := ""
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if r.PID() == 0 {
+				continue // not started yet
+			}
+			left := timeLeft(r.IdleLimit() - time.Since(r.LastActivity()))
+			title := fmt.Sprintf("%s: %v left", name, left)
+			if title != shown && con.setTitle(title) {
+				shown = title
+			}
+		}
+	}()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// defaultStdinDelay is the pause before each line of --stdin-file without
+// --stdin-delay
+const defaultStdinDelay = 200 * time.Millisecond
+
+// stdinScript is the input --stdin-file types into the command's terminal,
+// a line at a time, before handing it over to the user's typing
+type stdinScript struct {
+	lines [][]byte
+	delay time.Duration // before each line, so the command can take it in
+}
+
+// readStdinScript reads the lines of a --stdin-file; a blank line types
+// just Enter
+func readStdinScript(path string, delay time.Duration) (*stdinScript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &stdinScript{delay: delay}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	if len(data) == 0 {
+		return s, nil
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		s.lines = append(s.lines, append(bytes.TrimSuffix(line, []byte("\r")), '\r'))
+	}
+	return s, nil
+}
+
+// typeInto types the lines, each followed by Enter as a terminal sends it,
+// into r once started is closed. It reports false if ctx was done first.
+func (s *stdinScript) typeInto(ctx context.Context, r *watchdog.Runner, started <-chan struct{}) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-started:
+	}
+	pace := time.NewTimer(s.delay)
+	defer pace.Stop()
+	for _, line := range s.lines {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-pace.C:
+		}
+		if _, err := r.Write(line); err != nil {
+			return false
+		}
+		pace.Reset(s.delay)
+	}
+	return true
+}
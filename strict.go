@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// exitUnavailable is the exit status when -strict finds a requested
+// capability missing, the status GNU timeout uses for its own failures
+const exitUnavailable = 125
+
+// capability is an option that was asked for but can't work here
+type capability struct {
+	option string
+	err    error
+}
+
+// reportMissing tells about options that were asked for but can't work
+// here. With strict that is fatal and it returns false; otherwise the run
+// continues without them.
+func reportMissing(missing []capability, strict bool) bool {
+	for _, c := range missing {
+		if strict {
+			fmt.Fprintf(os.Stderr, "Unavailable: -%s: %v\n", c.option, c.err)
+		} else {
+			con.Logf("Continuing without -%s: %v", c.option, c.err)
+		}
+	}
+	return !strict || len(missing) == 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// subjobStats is the sub-job progress recorded for an attempt
+type subjobStats struct {
+	Started  int `json:"started,omitempty"`
+	Finished int `json:"finished"`
+	Total    int `json:"total,omitempty"`
+}
+
+// subjobs counts the sub-job markers a fan-out command prints, for
+// --track-subjobs. Every output line matching the pattern is a finished
+// sub-job, unless the pattern has "start" and "done" groups telling the
+// two apart; a "total" group announces how many there are.
+type subjobs struct {
+	start, done, total int // submatch indexes, -1 if the pattern lacks the group
+
+	mu      sync.Mutex
+	matcher *streamMatcher
+	stats   subjobStats
+}
+
+func newSubjobs(re *regexp.Regexp) *subjobs {
+	return &subjobs{
+		matcher: newStreamMatcher(false, re),
+		start:   re.SubexpIndex("start"),
+		done:    re.SubexpIndex("done"),
+		total:   re.SubexpIndex("total"),
+	}
+}
+
+// Write scans output for markers, line by line
+func (s *subjobs) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.matcher.feed(p, s.match)
+	return len(p), nil
+}
+
+func (s *subjobs) match(_ int, m [][]byte) {
+	if s.total >= 0 {
+		if n, err := strconv.Atoi(string(m[s.total])); err == nil && n > s.stats.Total {
+			s.stats.Total = n
+		}
+	}
+	switch {
+	case s.done >= 0 && len(m[s.done]) > 0:
+		s.stats.Finished++
+	case s.start >= 0 && len(m[s.start]) > 0:
+		s.stats.Started++
+	case s.done < 0:
+		s.stats.Finished++
+	}
+}
+
+// snapshot returns the counts so far
+func (s *subjobs) snapshot() subjobStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// summary describes the progress, e.g. "14 of 20 subjobs completed"
+func (s *subjobs) summary() string {
+	st := s.snapshot()
+	switch {
+	case st.Total > 0:
+		return fmt.Sprintf("%d of %d subjobs completed", st.Finished, st.Total)
+	case st.Started > st.Finished:
+		return fmt.Sprintf("%d subjobs completed, %d still running", st.Finished, st.Started-st.Finished)
+	}
+	return fmt.Sprintf("%d subjobs completed", st.Finished)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// systemdUnitMain prints a service unit that runs a command under the
+// wrapper: Type=notify with -sd-notify, so systemd's own watchdog covers
+// the wrapper while the wrapper's covers the command, a restart policy,
+// and lifecycle events in the journal with structured fields
+func systemdUnitMain(args []string) int {
+	fset := flag.NewFlagSet("systemd-unit", flag.ExitOnError)
+	name := fset.String("name", "", "the unit's `name`, also the journal's identifier for it")
+	description := fset.String("description", "", "the unit's `description` (default: the name)")
+	user := fset.String("user", "", "run the service as `user` (default: root, or the user manager's user)")
+	workdir := fset.String("workdir", "", "run the service in `directory` (default: the current directory)")
+	restart := fset.String("restart", "on-failure", "systemd's Restart= `policy`: no, on-failure, always, ...")
+	restartSec := durationFlag(5 * time.Second)
+	fset.Var(&restartSec, "restart-sec", "wait this `duration` before a restart")
+	watchdogSec := durationFlag(time.Minute)
+	fset.Var(&watchdogSec, "watchdog-sec", "have systemd restart the wrapper itself if it stops answering for this `duration`; 0 turns this off")
+	wantedBy := fset.String("wanted-by", "multi-user.target", "the `target` enabling the unit starts it with, default.target for a user unit")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout systemd-unit [options] [--] [run options] <duration> <command> [args...]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout systemd-unit --name sync -- --warn-at 80%% 10m rsync -a src/ dst/ > /etc/systemd/system/sync.service\n")
+		fmt.Fprintf(os.Stderr, "\nPrints the unit; the arguments after the options are for 'idle-timeout run'.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	runArgs := fset.Args()
+	if *name == "" || len(runArgs) < 2 {
+		fset.Usage()
+		return 1
+	}
+	if strings.ContainsAny(*name, "/ ") || strings.HasSuffix(*name, ".service") {
+		fmt.Fprintf(os.Stderr, "Invalid unit name %q: expected a name such as nightly-sync, without .service\n", *name)
+		return 1
+	}
+	if time.Duration(watchdogSec) < 0 || time.Duration(restartSec) < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid duration: -watchdog-sec and -restart-sec must not be negative\n")
+		return 1
+	}
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find own executable: %v\n", err)
+		return 1
+	}
+	if *workdir == "" {
+		if *workdir, err = os.Getwd(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to find the current directory: %v\n", err)
+			return 1
+		}
+	}
+	if *description == "" {
+		*description = *name + " under idle-timeout"
+	}
+	writeSystemdUnit(os.Stdout, systemdUnit{
+		name:        *name,
+		description: *description,
+		exec:        append([]string{self, "run", "--sd-notify", "--log-target", "journald"}, runArgs...),
+		user:        *user,
+		workdir:     *workdir,
+		restart:     *restart,
+		restartSec:  time.Duration(restartSec),
+		watchdogSec: time.Duration(watchdogSec),
+		wantedBy:    *wantedBy,
+	})
+	return 0
+}
+
+// systemdUnit is what systemd-unit puts in the unit
+type systemdUnit struct {
+	name, description string
+	exec              []string
+	user, workdir     string
+	restart           string
+	restartSec        time.Duration
+	watchdogSec       time.Duration
+	wantedBy          string
+}
+
+func writeSystemdUnit(w io.Writer, u systemdUnit) {
+	fmt.Fprintf(w, "# Generated by idle-timeout systemd-unit. Install as\n")
+	fmt.Fprintf(w, "# /etc/systemd/system/%s.service and run 'systemctl enable --now %s'.\n\n", u.name, u.name)
+	fmt.Fprintf(w, "[Unit]\nDescription=%s\nWants=network-online.target\nAfter=network-online.target\n", u.description)
+	fmt.Fprintf(w, "\n[Service]\nType=notify\nNotifyAccess=main\n")
+	quoted := make([]string, len(u.exec))
+	for i, a := range u.exec {
+		quoted[i] = systemdQuote(a)
+	}
+	fmt.Fprintf(w, "ExecStart=%s\n", strings.Join(quoted, " "))
+	if u.watchdogSec > 0 {
+		fmt.Fprintf(w, "WatchdogSec=%s\n", systemdTimespan(u.watchdogSec))
+	}
+	fmt.Fprintf(w, "Restart=%s\nRestartSec=%s\n", u.restart, systemdTimespan(u.restartSec))
+	// SIGTERM goes to the wrapper, which passes it on and reports the
+	// outcome; whatever is left after TimeoutStopSec is killed
+	fmt.Fprintf(w, "KillMode=mixed\n")
+	if u.user != "" {
+		fmt.Fprintf(w, "User=%s\n", u.user)
+	}
+	fmt.Fprintf(w, "WorkingDirectory=%s\n", systemdQuote(u.workdir))
+	fmt.Fprintf(w, "SyslogIdentifier=%s\n", u.name)
+	fmt.Fprintf(w, "\n[Install]\nWantedBy=%s\n", u.wantedBy)
+}
+
+// systemdQuote quotes an ExecStart= word for systemd, whose own expansion
+// of % specifiers and $ variables is escaped
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\;") {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// systemdTimespan formats d for a unit, as whole seconds if it is some
+func systemdTimespan(d time.Duration) string {
+	if d%time.Second == 0 {
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
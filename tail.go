@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+)
+
+// maxTailLine bounds the partial line held back for --tail-on-timeout
+const maxTailLine = 64 * 1024
+
+// tailLines keeps the last lines of output for --tail-on-timeout, cleaned
+// of escape sequences and carriage-return overwrites so they read well in
+// a CI log
+type tailLines struct {
+	mu      sync.Mutex
+	lines   []string // ring of the last complete lines
+	next    int      // where the next line goes once the ring is full
+	partial []byte
+}
+
+func newTailLines(n int) *tailLines {
+	return &tailLines{lines: make([]string, 0, n)}
+}
+
+func (t *tailLines) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		nl := bytes.IndexByte(t.partial, '\n')
+		if nl < 0 {
+			break
+		}
+		t.add(cleanLine(string(t.partial[:nl])))
+		t.partial = t.partial[nl+1:]
+	}
+	if len(t.partial) > maxTailLine {
+		t.partial = t.partial[len(t.partial)-maxTailLine:]
+	}
+	return len(p), nil
+}
+
+func (t *tailLines) add(line string) {
+	if len(t.lines) < cap(t.lines) {
+		t.lines = append(t.lines, line)
+		return
+	}
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+}
+
+// last returns the kept lines, oldest first, ending with an unfinished
+// line such as a prompt if there is one
+func (t *tailLines) last() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append(append([]string(nil), t.lines[t.next:]...), t.lines[:t.next]...)
+	if rest := cleanLine(string(t.partial)); rest != "" {
+		if len(lines) == cap(t.lines) {
+			lines = lines[1:]
+		}
+		lines = append(lines, rest)
+	}
+	return lines
+}
+
+// report shows the kept lines with the timeout message, or saves them to
+// path if one is given
+func (t *tailLines) report(path string) {
+	lines := t.last()
+	if len(lines) == 0 {
+		con.Logf("No output to show")
+		return
+	}
+	if path != "" {
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+			con.Logf("Failed to write tail file: %v", err)
+			return
+		}
+		con.Logf("Last %d lines of output saved to %s", len(lines), path)
+		return
+	}
+	con.Logf("Last %d lines of output:\n  | %s", len(lines), strings.Join(lines, "\n  | "))
+}
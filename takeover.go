@@ -0,0 +1,131 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// takeover offers an attended user a short menu on stderr when the warning
+// threshold fires. The child is stopped while the menu is up so its output
+// can't interleave; without an answer the timeout simply proceeds.
+type takeover struct {
+	wait     time.Duration // how long the menu waits for a key
+	debugger string        // command template, {pid} is the child's PID
+	initial  *termState    // terminal state before the child changed it
+}
+
+// newTakeover fails if the session isn't attended. initial is the
+// terminal state from before the wrapper switched it to raw mode.
+func newTakeover(wait time.Duration, debugger string, initial *termState) (*takeover, error) {
+	if initial == nil || !isTerminal(uintptr(syscall.Stderr)) {
+		return nil, errors.New("no terminal to show the menu on")
+	}
+	return &takeover{wait: wait, debugger: debugger, initial: initial}, nil
+}
+
+// offer shows the menu and carries out the chosen action, taking stdin away
+// from the child while it does
+func (t *takeover) offer(r *watchdog.Runner, in *input, e watchdog.Event) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer tty.Close()
+
+	resume := in.pause()
+	defer resume()
+	r.Signal(syscall.SIGSTOP)
+	defer r.Signal(syscall.SIGCONT)
+
+	wait := min(t.wait, e.Timeout-e.Idle)
+	choices := "[k]ill now, [e]xtend, [s]hell in its directory"
+	if t.debugger != "" {
+		choices += ", [d]ebugger"
+	}
+	con.Logf("No output for %v. %s, any other key continues (%v)...", e.Idle.Round(time.Second), choices, wait.Round(time.Second))
+
+	pid := e.PID
+	switch readKey(in.f, wait) {
+	case 'k':
+		r.Expire()
+	case 'e':
+		r.Touch()
+		con.Logf("Idle clock reset, %v granted", e.Timeout)
+	case 's':
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		cmd := exec.Command(shell)
+		cmd.Dir = processDir(pid)
+		con.Logf("Starting %s in %s; exit it to resume the command", shell, cmd.Dir)
+		t.interact(tty, cmd)
+		r.Touch()
+	case 'd':
+		if t.debugger == "" {
+			return
+		}
+		line := strings.ReplaceAll(t.debugger, "{pid}", strconv.Itoa(pid))
+		con.Logf("Starting %s", line)
+		t.interact(tty, exec.Command("/bin/sh", "-c", line))
+		r.Touch()
+	}
+}
+
+// interact runs cmd on the terminal in its original (cooked) mode
+func (t *takeover) interact(tty *os.File, cmd *exec.Cmd) {
+	if cur, err := getTermState(tty.Fd()); err == nil {
+		setTermState(tty.Fd(), t.initial)
+		defer setTermState(tty.Fd(), cur)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	if err := cmd.Run(); err != nil {
+		con.Logf("%s: %v", cmd.Path, err)
+	}
+}
+
+// readKey reads a single keypress from the raw terminal on f, returning 0
+// if none arrives within wait. Where the runtime can't poll the terminal,
+// VTIME provides the timeout instead.
+func readKey(f *os.File, wait time.Duration) byte {
+	buf := make([]byte, 1)
+	if f.SetReadDeadline(time.Now().Add(wait)) == nil {
+		defer f.SetReadDeadline(time.Time{})
+		if n, _ := f.Read(buf); n == 1 {
+			return buf[0]
+		}
+		return 0
+	}
+
+	fd := uintptr(syscall.Stdin)
+	saved, err := getTermState(fd)
+	if err != nil {
+		return 0
+	}
+	raw := *saved
+	raw.Cc[syscall.VMIN] = 0
+	raw.Cc[syscall.VTIME] = 1 // tenths of a second
+	if err := setTermState(fd, &raw); err != nil {
+		return 0
+	}
+	defer setTermState(fd, saved)
+
+	for deadline := time.Now().Add(wait); time.Now().Before(deadline); {
+		if n, err := f.Read(buf); n == 1 {
+			return buf[0]
+		} else if err != nil && err != io.EOF {
+			return 0
+		}
+	}
+	return 0
+}
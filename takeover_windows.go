@@ -0,0 +1,18 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// takeover is unavailable on Windows: a console process can't be stopped
+// while the menu is up
+type takeover struct{}
+
+func newTakeover(wait time.Duration, debugger string, initial *termState) (*takeover, error) {
+	return nil, errors.New("not supported on Windows")
+}
+
+func (t *takeover) offer(r *watchdog.Runner, in *input, e watchdog.Event) {}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML reads the subset of TOML the config file uses: tables with
+// dotted names, and keys whose values are strings, numbers, booleans or
+// arrays of them. Every value comes back as the text a flag would take;
+// array items are joined with commas. Root keys are in the "" table.
+func parseTOML(data string) (map[string]map[string]string, error) {
+	tables := map[string]map[string]string{"": {}}
+	table := ""
+	lines := strings.Split(data, "\n")
+	for i := 0; i < len(lines); i++ {
+		num := i + 1
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: malformed table header", num)
+			}
+			parts, err := splitKey(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", num, err)
+			}
+			table = strings.Join(parts, ".")
+			if _, ok := tables[table]; ok {
+				return nil, fmt.Errorf("line %d: table [%s] defined twice", num, table)
+			}
+			tables[table] = map[string]string{}
+			continue
+		}
+		key, value, ok := cutAssignment(line)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", num)
+		}
+		// A multi-line array continues until its brackets balance
+		for strings.HasPrefix(value, "[") && !balanced(value) && i+1 < len(lines) {
+			i++
+			value += " " + strings.TrimSpace(stripComment(lines[i]))
+		}
+		parts, err := splitKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", num, err)
+		}
+		v, err := parseValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", num, err)
+		}
+		name := table
+		if len(parts) > 1 {
+			name = strings.Trim(table+"."+strings.Join(parts[:len(parts)-1], "."), ".")
+			if tables[name] == nil {
+				tables[name] = map[string]string{}
+			}
+		}
+		k := parts[len(parts)-1]
+		if _, dup := tables[name][k]; dup {
+			return nil, fmt.Errorf("line %d: key %q defined twice", num, k)
+		}
+		tables[name][k] = v
+	}
+	return tables, nil
+}
+
+// stripComment cuts a # comment that isn't inside a string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// cutAssignment splits key = value at the first = outside quotes
+func cutAssignment(line string) (key, value string, ok bool) {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '=':
+			return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// splitKey splits a dotted key, unquoting quoted parts
+func splitKey(key string) ([]string, error) {
+	var parts []string
+	for key = strings.TrimSpace(key); ; {
+		var part string
+		if strings.HasPrefix(key, `"`) || strings.HasPrefix(key, "'") {
+			end := strings.IndexByte(key[1:], key[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted key")
+			}
+			part, key = key[1:end+1], strings.TrimSpace(key[end+2:])
+		} else {
+			dot := strings.IndexByte(key, '.')
+			if dot < 0 {
+				dot = len(key)
+			}
+			part, key = strings.TrimSpace(key[:dot]), key[dot:]
+			if part == "" || strings.ContainsAny(part, " \t\"'") {
+				return nil, fmt.Errorf("invalid key %q", part)
+			}
+		}
+		parts = append(parts, part)
+		if key == "" {
+			return parts, nil
+		}
+		if key[0] != '.' {
+			return nil, fmt.Errorf("invalid key")
+		}
+		key = strings.TrimSpace(key[1:])
+	}
+}
+
+// balanced reports whether an array's brackets are closed, ignoring any
+// inside strings
+func balanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth == 0
+}
+
+// parseValue converts a TOML value to flag text
+func parseValue(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(s, `"""`) || strings.HasPrefix(s, "'''"):
+		return "", fmt.Errorf("multi-line strings are not supported")
+	case s[0] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' || strings.Contains(s[1:len(s)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		if !strings.HasSuffix(s, "]") {
+			return "", fmt.Errorf("invalid array %s", s)
+		}
+		var items []string
+		for _, item := range splitArray(s[1 : len(s)-1]) {
+			v, err := parseValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	case s == "true" || s == "false":
+		return s, nil
+	}
+	n := strings.ReplaceAll(s, "_", "")
+	if _, err := strconv.ParseFloat(n, 64); err != nil {
+		return "", fmt.Errorf("invalid value %s (strings need quotes)", s)
+	}
+	return n, nil
+}
+
+// splitArray splits the items of an array at top-level commas
+func splitArray(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
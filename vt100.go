@@ -0,0 +1,357 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// screen is a minimal VT100/xterm model: enough cursor movement, erasing,
+// scrolling and alternate-screen handling to render what a TUI has drawn.
+// Colors and other attributes are dropped; every rune is one cell wide.
+type screen struct {
+	cols, rows int
+	main, alt  [][]rune
+	cells      [][]rune // main or alt, whichever is shown
+	altShown   bool
+	x, y       int
+	wrapNext   bool // the last column was written; the next rune wraps
+	top, bot   int  // scrolling region, inclusive
+	savedX     int
+	savedY     int
+
+	esc     int // parser state, as in console
+	params  []byte
+	pending []byte // incomplete UTF-8 sequence
+}
+
+func newScreen(cols, rows int) *screen {
+	if cols <= 0 {
+		cols = 80
+	}
+	if rows <= 0 {
+		rows = 24
+	}
+	s := &screen{cols: cols, rows: rows, bot: rows - 1}
+	s.main = blankCells(cols, rows)
+	s.alt = blankCells(cols, rows)
+	s.cells = s.main
+	return s
+}
+
+func blankCells(cols, rows int) [][]rune {
+	cells := make([][]rune, rows)
+	for i := range cells {
+		cells[i] = blankLine(cols)
+	}
+	return cells
+}
+
+func blankLine(cols int) []rune {
+	line := make([]rune, cols)
+	for i := range line {
+		line[i] = ' '
+	}
+	return line
+}
+
+// resize changes the screen size, keeping the top-left content
+func (s *screen) resize(cols, rows int) {
+	if cols <= 0 || rows <= 0 || cols == s.cols && rows == s.rows {
+		return
+	}
+	fit := func(old [][]rune) [][]rune {
+		cells := blankCells(cols, rows)
+		for y := 0; y < rows && y < len(old); y++ {
+			copy(cells[y], old[y])
+		}
+		return cells
+	}
+	s.main, s.alt = fit(s.main), fit(s.alt)
+	s.cells = s.main
+	if s.altShown {
+		s.cells = s.alt
+	}
+	s.cols, s.rows = cols, rows
+	s.top, s.bot = 0, rows-1
+	s.x, s.y = min(s.x, cols-1), min(s.y, rows-1)
+	s.wrapNext = false
+}
+
+// text renders the screen, without trailing blanks
+func (s *screen) text() string {
+	lines := make([]string, len(s.cells))
+	for i, line := range s.cells {
+		lines[i] = strings.TrimRight(string(line), " ")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+func (s *screen) Write(p []byte) (int, error) {
+	data := append(s.pending, p...)
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && !utf8.FullRune(data) {
+			break
+		}
+		s.feed(r)
+		data = data[size:]
+	}
+	s.pending = append(s.pending[:0], data...)
+	return len(p), nil
+}
+
+func (s *screen) feed(r rune) {
+	switch s.esc {
+	case escGround:
+		s.control(r)
+	case escEscape:
+		s.esc = escGround
+		switch r {
+		case '[':
+			s.esc = escCSI
+			s.params = s.params[:0]
+		case ']', 'P', 'X', '^', '_':
+			s.esc = escString
+		case '7':
+			s.savedX, s.savedY = s.x, s.y
+		case '8':
+			s.restoreCursor()
+		case 'D':
+			s.index()
+		case 'E':
+			s.x = 0
+			s.index()
+		case 'M':
+			s.reverseIndex()
+		case 'c':
+			*s = *newScreen(s.cols, s.rows)
+		}
+	case escCSI:
+		if r >= 0x40 && r <= 0x7e {
+			s.esc = escGround
+			s.csi(r)
+		} else if len(s.params) < 32 {
+			s.params = append(s.params, byte(r))
+		}
+	case escString:
+		if r == 0x07 {
+			s.esc = escGround
+		} else if r == 0x1b {
+			s.esc = escStringEscape
+		}
+	case escStringEscape:
+		if r == '\\' {
+			s.esc = escGround
+		} else {
+			s.esc = escString
+		}
+	}
+}
+
+// control handles a rune outside escape sequences
+func (s *screen) control(r rune) {
+	switch r {
+	case 0x1b:
+		s.esc = escEscape
+	case '\r':
+		s.x, s.wrapNext = 0, false
+	case '\n', 0x0b, 0x0c:
+		s.index()
+	case '\b':
+		if s.x > 0 {
+			s.x--
+		}
+		s.wrapNext = false
+	case '\t':
+		s.x = min((s.x/8+1)*8, s.cols-1)
+	default:
+		if r < 0x20 || r == 0x7f {
+			return
+		}
+		if s.wrapNext {
+			s.x = 0
+			s.index()
+		}
+		s.cells[s.y][s.x] = r
+		if s.x == s.cols-1 {
+			s.wrapNext = true
+		} else {
+			s.x++
+		}
+	}
+}
+
+// index moves the cursor down, scrolling at the bottom of the region
+func (s *screen) index() {
+	s.wrapNext = false
+	if s.y == s.bot {
+		s.scrollUp(s.top, 1)
+	} else if s.y < s.rows-1 {
+		s.y++
+	}
+}
+
+func (s *screen) reverseIndex() {
+	s.wrapNext = false
+	if s.y == s.top {
+		s.scrollDown(s.top, 1)
+	} else if s.y > 0 {
+		s.y--
+	}
+}
+
+// scrollUp moves lines from..bot up by n, blanking the bottom
+func (s *screen) scrollUp(from, n int) {
+	n = min(n, s.bot-from+1)
+	copy(s.cells[from:s.bot+1], s.cells[from+n:s.bot+1])
+	for i := s.bot - n + 1; i <= s.bot; i++ {
+		s.cells[i] = blankLine(s.cols)
+	}
+}
+
+// scrollDown moves lines from..bot down by n, blanking the top
+func (s *screen) scrollDown(from, n int) {
+	n = min(n, s.bot-from+1)
+	copy(s.cells[from+n:s.bot+1], s.cells[from:s.bot+1-n])
+	for i := from; i < from+n; i++ {
+		s.cells[i] = blankLine(s.cols)
+	}
+}
+
+// csi executes a control sequence
+func (s *screen) csi(final rune) {
+	private := len(s.params) > 0 && s.params[0] == '?'
+	var args []int
+	for _, f := range strings.Split(strings.TrimLeft(string(s.params), "?>="), ";") {
+		n, _ := strconv.Atoi(f)
+		args = append(args, n)
+	}
+	arg := func(i, def int) int {
+		if i < len(args) && args[i] > 0 {
+			return args[i]
+		}
+		return def
+	}
+	if private {
+		if final == 'h' || final == 'l' {
+			switch args[0] {
+			case 1049, 1047, 47:
+				s.setAlt(final == 'h')
+			}
+		}
+		return
+	}
+	s.wrapNext = false
+	switch final {
+	case 'A':
+		s.y = max(s.y-arg(0, 1), 0)
+	case 'B', 'e':
+		s.y = min(s.y+arg(0, 1), s.rows-1)
+	case 'C', 'a':
+		s.x = min(s.x+arg(0, 1), s.cols-1)
+	case 'D':
+		s.x = max(s.x-arg(0, 1), 0)
+	case 'E':
+		s.x, s.y = 0, min(s.y+arg(0, 1), s.rows-1)
+	case 'F':
+		s.x, s.y = 0, max(s.y-arg(0, 1), 0)
+	case 'G', '`':
+		s.x = min(arg(0, 1), s.cols) - 1
+	case 'd':
+		s.y = min(arg(0, 1), s.rows) - 1
+	case 'H', 'f':
+		s.y, s.x = min(arg(0, 1), s.rows)-1, min(arg(1, 1), s.cols)-1
+	case 'J':
+		switch arg(0, 0) {
+		case 0:
+			s.clear(s.y, s.x, s.rows-1, s.cols-1)
+		case 1:
+			s.clear(0, 0, s.y, s.x)
+		case 2, 3:
+			s.clear(0, 0, s.rows-1, s.cols-1)
+		}
+	case 'K':
+		switch arg(0, 0) {
+		case 0:
+			s.clear(s.y, s.x, s.y, s.cols-1)
+		case 1:
+			s.clear(s.y, 0, s.y, s.x)
+		case 2:
+			s.clear(s.y, 0, s.y, s.cols-1)
+		}
+	case 'X':
+		s.clear(s.y, s.x, s.y, min(s.x+arg(0, 1), s.cols)-1)
+	case '@':
+		line := s.cells[s.y]
+		n := min(arg(0, 1), s.cols-s.x)
+		copy(line[s.x+n:], line[s.x:])
+		s.clear(s.y, s.x, s.y, s.x+n-1)
+	case 'P':
+		line := s.cells[s.y]
+		n := min(arg(0, 1), s.cols-s.x)
+		copy(line[s.x:], line[s.x+n:])
+		s.clear(s.y, s.cols-n, s.y, s.cols-1)
+	case 'L':
+		if s.y >= s.top && s.y <= s.bot {
+			s.scrollDown(s.y, arg(0, 1))
+		}
+	case 'M':
+		if s.y >= s.top && s.y <= s.bot {
+			s.scrollUp(s.y, arg(0, 1))
+		}
+	case 'S':
+		s.scrollUp(s.top, arg(0, 1))
+	case 'T':
+		s.scrollDown(s.top, arg(0, 1))
+	case 'r':
+		top, bot := arg(0, 1)-1, min(arg(1, s.rows), s.rows)-1
+		if top < bot {
+			s.top, s.bot = top, bot
+			s.x, s.y = 0, 0
+		}
+	case 's':
+		s.savedX, s.savedY = s.x, s.y
+	case 'u':
+		s.restoreCursor()
+	}
+}
+
+// clear blanks the cells from (y1, x1) through (y2, x2) in reading order
+func (s *screen) clear(y1, x1, y2, x2 int) {
+	for y := y1; y <= y2; y++ {
+		from, to := 0, s.cols-1
+		if y == y1 {
+			from = x1
+		}
+		if y == y2 {
+			to = x2
+		}
+		for x := from; x <= to; x++ {
+			s.cells[y][x] = ' '
+		}
+	}
+}
+
+// setAlt switches between the main and the alternate screen
+func (s *screen) setAlt(on bool) {
+	if on == s.altShown {
+		return
+	}
+	s.altShown = on
+	if on {
+		s.savedX, s.savedY = s.x, s.y
+		s.alt = blankCells(s.cols, s.rows)
+		s.cells = s.alt
+		return
+	}
+	s.cells = s.main
+	s.restoreCursor()
+}
+
+// restoreCursor returns to the saved position, clamped in case the screen
+// shrank since
+func (s *screen) restoreCursor() {
+	s.x, s.y = min(s.savedX, s.cols-1), min(s.savedY, s.rows-1)
+	s.wrapNext = false
+}
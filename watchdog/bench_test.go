@@ -0,0 +1,42 @@
+package watchdog
+
+import (
+	"testing"
+	"time"
+)
+
+// startedRunner is a Runner whose idle clock runs as if its command had
+// started, for the activity tests and benchmarks
+func startedRunner(cfg Config) *Runner {
+	r := New(cfg)
+	r.activity.Store(r.stamp(r.clock.Now()))
+	r.timeout = cfg.Timeout
+	return r
+}
+
+// BenchmarkCredit measures the activity stamp every chunk of output sets
+func BenchmarkCredit(b *testing.B) {
+	r := startedRunner(Config{Timeout: time.Minute})
+	for b.Loop() {
+		r.credit(4096)
+	}
+}
+
+// BenchmarkCreditResetBytes measures the leaky-bucket stamp of ResetBytes
+func BenchmarkCreditResetBytes(b *testing.B) {
+	r := startedRunner(Config{Timeout: time.Minute, ResetBytes: 1 << 20})
+	for b.Loop() {
+		r.credit(4096)
+	}
+}
+
+// BenchmarkCreditParallel measures the stamp with stdout and stderr, and
+// activity sources, setting it at once
+func BenchmarkCreditParallel(b *testing.B) {
+	r := startedRunner(Config{Timeout: time.Minute, ResetBytes: 1 << 20})
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			r.credit(4096)
+		}
+	})
+}
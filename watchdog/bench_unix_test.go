@@ -0,0 +1,35 @@
+//go:build unix
+
+package watchdog
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// floodSize is how much output a copy benchmark streams per run, enough
+// that starting the command is a small part of it
+const floodSize = 64 << 20
+
+// benchmarkCopy measures the throughput of output through a Runner
+func benchmarkCopy(b *testing.B, pty bool) {
+	cfg := Config{
+		Path:    "head",
+		Args:    []string{"-c", strconv.Itoa(floodSize), "/dev/zero"},
+		Timeout: time.Minute,
+		PTY:     pty,
+		Stdout:  io.Discard,
+	}
+	b.SetBytes(floodSize)
+	for b.Loop() {
+		if res := Run(context.Background(), cfg); res.ExitCode != 0 || res.Err != nil {
+			b.Fatalf("exit status %d: %v", res.ExitCode, res.Err)
+		}
+	}
+}
+
+func BenchmarkCopyPTY(b *testing.B)  { benchmarkCopy(b, true) }
+func BenchmarkCopyPipe(b *testing.B) { benchmarkCopy(b, false) }
@@ -0,0 +1,20 @@
+package watchdog
+
+import (
+	"os"
+	"syscall"
+)
+
+// intoCgroup makes the command start directly inside the cgroup v2
+// directory dir (clone3 with CLONE_INTO_CGROUP), so not even its first
+// instructions run outside it. The returned file must stay open until the
+// command has started.
+func intoCgroup(attr *syscall.SysProcAttr, dir string) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	attr.UseCgroupFD = true
+	attr.CgroupFD = int(f.Fd())
+	return f, nil
+}
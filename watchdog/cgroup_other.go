@@ -0,0 +1,14 @@
+//go:build !linux
+
+package watchdog
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// intoCgroup fails: cgroups exist only on Linux
+func intoCgroup(attr *syscall.SysProcAttr, dir string) (*os.File, error) {
+	return nil, errors.New("cgroups are only supported on Linux")
+}
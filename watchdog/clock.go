@@ -0,0 +1,193 @@
+package watchdog
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time a Runner keeps its idle clock by. Config.Clock replaces
+// the real one, so tests of timeout behavior can step a FakeClock through
+// minutes of silence instead of sleeping. The events of ActivitySources
+// should carry times from the same clock, or zero times it stamps.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer of a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a time.Ticker of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the system clock, the default
+type realClock struct{}
+
+func (realClock) Now() time.Time                   { return time.Now() }
+func (realClock) NewTimer(d time.Duration) Timer   { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// sleep waits for d on c, or until stop is closed, and reports whether the
+// whole of d passed
+func sleep(c Clock, d time.Duration, stop <-chan struct{}) bool {
+	t := c.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// FakeClock is a Clock that only moves when told to. Timers and tickers
+// fire, in order, as Advance passes their deadlines; like the real ones,
+// their channels hold one pending time, and further ticks are dropped
+// while it isn't taken.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock set to now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the clock's time
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, firing what falls due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		// The earliest deadline up to end, so a ticker fires once per period
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		next.fire()
+	}
+	c.now = end
+}
+
+// Timers returns how many timers and tickers are pending, so a test can
+// wait for a Runner to arm its timer before advancing the clock past it
+func (c *FakeClock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, 0)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("watchdog: non-positive interval for FakeClock.NewTicker")
+	}
+	return fakeTicker{c.add(d, d)}
+}
+
+func (c *FakeClock) add(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), period: period}
+	c.schedule(t, d)
+	return t
+}
+
+// schedule arms t to fire d from now, firing it at once if d isn't positive
+func (c *FakeClock) schedule(t *fakeTimer, d time.Duration) {
+	t.when = c.now.Add(d)
+	if d <= 0 && t.period == 0 {
+		t.fire()
+		return
+	}
+	c.timers = append(c.timers, t)
+}
+
+// unschedule disarms t and reports whether it was armed
+func (c *FakeClock) unschedule(t *fakeTimer) bool {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTimer is a timer or, with a period, a ticker of a FakeClock
+type fakeTimer struct {
+	clock  *FakeClock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+// fire sends the time, dropping it if the last one wasn't taken, and
+// rearms a ticker or disarms a timer; the clock's lock is held
+func (t *fakeTimer) fire() {
+	select {
+	case t.c <- t.when:
+	default:
+	}
+	if t.period > 0 {
+		t.when = t.when.Add(t.period)
+		return
+	}
+	t.clock.unschedule(t)
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.unschedule(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	armed := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+	return armed
+}
+
+// fakeTicker is a fakeTimer with a period, whose Stop returns nothing
+type fakeTicker struct{ t *fakeTimer }
+
+func (t fakeTicker) C() <-chan time.Time { return t.t.c }
+func (t fakeTicker) Stop()               { t.t.Stop() }
@@ -0,0 +1,53 @@
+package watchdog
+
+import "time"
+
+// EventKind identifies a lifecycle event
+type EventKind int
+
+const (
+	Started       EventKind = iota // the command was spawned
+	Warned                         // inactivity crossed Config.WarnAt
+	TimedOut                       // inactivity reached Config.Timeout; the kill follows
+	Exited                         // the command exited
+	Restarting                     // a Supervisor is about to re-spawn a job
+	OverLimit                      // the command exceeded a resource limit; the kill follows
+	OutputChunk                    // the command wrote output; only on Runner.Events
+	ActivityReset                  // activity ended an idle episode that crossed Config.WarnAt
+)
+
+var eventNames = [...]string{"started", "warned", "timed_out", "exited", "restarting", "over_limit", "output", "activity_reset"}
+
+func (k EventKind) String() string {
+	if int(k) < len(eventNames) {
+		return eventNames[k]
+	}
+	return "unknown"
+}
+
+// Event describes something that happened to a supervised command
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	Job  string // job name when delivered by a Supervisor
+	PID  int
+
+	Idle    time.Duration // Warned, TimedOut: time since the last output
+	Timeout time.Duration // Warned, TimedOut: the idle limit
+	Slow    bool          // TimedOut: the output rate fell below Config.MinRate
+	Rate    float64       // TimedOut: with Slow, that rate in bytes a second
+	Forced  bool          // TimedOut: Runner.Expire called it, not the idle clock
+
+	ExitCode  int    // Exited
+	TimedOut  bool   // Exited: the command was killed for inactivity
+	OverLimit string // Exited: the limit the command was killed for, if any
+
+	Limit      string // OverLimit: which limit: "rss", "output" or "lines"
+	Usage, Max int64  // OverLimit: what the command used, and the limit
+
+	Attempt int           // Restarting: the attempt about to start, from 2
+	Backoff time.Duration // Restarting: delay before the restart
+
+	Data   []byte // OutputChunk: the output, a copy the receiver may keep
+	Stderr bool   // OutputChunk: it came from stderr in pipe mode
+}
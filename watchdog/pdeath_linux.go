@@ -0,0 +1,14 @@
+package watchdog
+
+import "syscall"
+
+// killOnParentDeath has the kernel SIGKILL the command if the supervising
+// process dies, even from a SIGKILL of its own that leaves no chance to
+// clean up. Descendants sharing the command's PTY get SIGHUP when it goes.
+//
+// Linux ties the signal to the thread that started the command rather
+// than the process, but the Go runtime only retires threads whose
+// goroutine exits while locked to it.
+func killOnParentDeath(attr *syscall.SysProcAttr) {
+	attr.Pdeathsig = syscall.SIGKILL
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package watchdog
+
+import "syscall"
+
+// killOnParentDeath does nothing: only Linux has a parent-death signal
+func killOnParentDeath(attr *syscall.SysProcAttr) {}
@@ -0,0 +1,58 @@
+package watchdog
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY allocates a pseudo-terminal pair through /dev/ptmx
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, req := range []uintptr{syscall.TIOCPTYGRANT, syscall.TIOCPTYUNLK} {
+		if err := ioctl(master, req, 0); err != nil {
+			master.Close()
+			return nil, nil, err
+		}
+	}
+	name := make([]byte, 128)
+	if err := ioctl(master, syscall.TIOCPTYGNAME, uintptr(unsafe.Pointer(&name[0]))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+
+	slave, err = os.OpenFile(string(name), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// disableEcho turns off the echo of typed input on the PTY slave
+func disableEcho(slave *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(slave, syscall.TIOCGETA, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+	t.Lflag &^= syscall.ECHO
+	return ioctl(slave, syscall.TIOCSETA, uintptr(unsafe.Pointer(&t)))
+}
+
+// disableOutputProcessing passes output written to the PTY slave on as is,
+// without turning \n into \r\n and the like
+func disableOutputProcessing(slave *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(slave, syscall.TIOCGETA, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+	t.Oflag &^= syscall.OPOST
+	return ioctl(slave, syscall.TIOCSETA, uintptr(unsafe.Pointer(&t)))
+}
@@ -0,0 +1,54 @@
+package watchdog
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// openPTY allocates a pseudo-terminal pair through /dev/ptmx
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var n uint32
+	if err := ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+// disableEcho turns off the echo of typed input on the PTY slave
+func disableEcho(slave *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(slave, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+	t.Lflag &^= syscall.ECHO
+	return ioctl(slave, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
+
+// disableOutputProcessing passes output written to the PTY slave on as is,
+// without turning \n into \r\n and the like
+func disableOutputProcessing(slave *os.File) error {
+	var t syscall.Termios
+	if err := ioctl(slave, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return err
+	}
+	t.Oflag &^= syscall.OPOST
+	return ioctl(slave, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+}
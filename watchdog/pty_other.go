@@ -0,0 +1,16 @@
+//go:build unix && !linux && !darwin
+
+package watchdog
+
+import (
+	"errors"
+	"os"
+)
+
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, errors.New("watchdog: PTY mode is not supported on this platform")
+}
+
+func disableEcho(slave *os.File) error { return nil }
+
+func disableOutputProcessing(slave *os.File) error { return nil }
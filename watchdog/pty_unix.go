@@ -0,0 +1,71 @@
+//go:build unix
+
+package watchdog
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// unixPTY is a PTY master
+type unixPTY struct {
+	*os.File
+}
+
+func (p unixPTY) resize(cols, rows int) error {
+	return setWinsize(p.File, cols, rows)
+}
+
+// startPTY starts cmd with a new PTY as its controlling terminal. The PTY
+// is cols x rows unless either is 0, echoes typed input unless noEcho, and
+// passes output on unprocessed with rawOutput.
+func startPTY(cmd *exec.Cmd, cols, rows int, noEcho, rawOutput bool) (terminal, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, fmt.Errorf("open pty: %w", err)
+	}
+	if cols > 0 && rows > 0 {
+		setWinsize(master, cols, rows)
+	}
+	if noEcho {
+		if err := disableEcho(slave); err != nil {
+			master.Close()
+			slave.Close()
+			return nil, fmt.Errorf("disable echo: %w", err)
+		}
+	}
+	if rawOutput {
+		if err := disableOutputProcessing(slave); err != nil {
+			master.Close()
+			slave.Close()
+			return nil, fmt.Errorf("disable output processing: %w", err)
+		}
+	}
+	// A command run as another user owns its terminal, as after a login,
+	// so it can open /dev/tty to prompt
+	if c := cmd.SysProcAttr.Credential; c != nil {
+		if err := slave.Chown(int(c.Uid), int(c.Gid)); err != nil {
+			master.Close()
+			slave.Close()
+			return nil, fmt.Errorf("chown pty: %w", err)
+		}
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("start command: %w", err)
+	}
+	return unixPTY{master}, nil
+}
+
+// endOfInput is what CloseInput types: ^D, which sends a partial line
+// without ending the input, hence a second one after it
+func endOfInput(midLine bool) []byte {
+	if midLine {
+		return []byte{0x04, 0x04}
+	}
+	return []byte{0x04}
+}
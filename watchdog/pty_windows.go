@@ -0,0 +1,197 @@
+package watchdog
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+var (
+	procCreatePseudoConsole               = kernel32.NewProc("CreatePseudoConsole")
+	procResizePseudoConsole               = kernel32.NewProc("ResizePseudoConsole")
+	procClosePseudoConsole                = kernel32.NewProc("ClosePseudoConsole")
+	procInitializeProcThreadAttributeList = kernel32.NewProc("InitializeProcThreadAttributeList")
+	procUpdateProcThreadAttribute         = kernel32.NewProc("UpdateProcThreadAttribute")
+	procDeleteProcThreadAttributeList     = kernel32.NewProc("DeleteProcThreadAttributeList")
+)
+
+const (
+	extendedStartupInfoPresent       = 0x00080000
+	procThreadAttributePseudoConsole = 0x00020016
+)
+
+// startupInfoEx is STARTUPINFOEXW
+type startupInfoEx struct {
+	syscall.StartupInfo
+	attributeList *byte
+}
+
+// conPTY is a Windows pseudo console (ConPTY, Windows 10 1809 and later)
+// with the pipes that carry its input and output
+type conPTY struct {
+	console uintptr // HPCON
+	in      *os.File
+	out     *os.File
+	once    sync.Once
+}
+
+func (c *conPTY) Read(p []byte) (int, error)  { return c.out.Read(p) }
+func (c *conPTY) Write(p []byte) (int, error) { return c.in.Write(p) }
+
+func (c *conPTY) resize(cols, rows int) error {
+	if r, _, _ := procResizePseudoConsole.Call(c.console, coord(cols, rows)); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// closeConsole ends the console, which ends the output pipe once it is
+// drained and closes the processes still attached
+func (c *conPTY) closeConsole() {
+	c.once.Do(func() { procClosePseudoConsole.Call(c.console) })
+}
+
+func (c *conPTY) Close() error {
+	c.closeConsole()
+	c.in.Close()
+	return c.out.Close()
+}
+
+// coord packs a COORD, which the console API takes by value
+func coord(cols, rows int) uintptr {
+	return uintptr(uint16(cols)) | uintptr(uint16(rows))<<16
+}
+
+// startPTY starts cmd attached to a new pseudo console. os/exec can't pass
+// the console to CreateProcess, so the process is created here and handed
+// to cmd as if cmd.Start had run, for cmd.Wait. Unlike a Unix PTY the
+// output pipe stays open after the command exits, so the console is closed
+// as soon as it does. There is no echo to turn off: console programs echo
+// input themselves, nor output processing: the console renders output anew.
+func startPTY(cmd *exec.Cmd, cols, rows int, _, _ bool) (terminal, error) {
+	if cols <= 0 || rows <= 0 {
+		cols, rows = 80, 24
+	}
+	var inRead, inWrite, outRead, outWrite syscall.Handle
+	if err := syscall.CreatePipe(&inRead, &inWrite, nil, 0); err != nil {
+		return nil, fmt.Errorf("open pty: %w", err)
+	}
+	if err := syscall.CreatePipe(&outRead, &outWrite, nil, 0); err != nil {
+		syscall.CloseHandle(inRead)
+		syscall.CloseHandle(inWrite)
+		return nil, fmt.Errorf("open pty: %w", err)
+	}
+	// The console keeps its own references to its ends of the pipes
+	defer syscall.CloseHandle(inRead)
+	defer syscall.CloseHandle(outWrite)
+
+	c := &conPTY{
+		in:  os.NewFile(uintptr(inWrite), "conpty-in"),
+		out: os.NewFile(uintptr(outRead), "conpty-out"),
+	}
+	if r, _, _ := procCreatePseudoConsole.Call(coord(cols, rows), uintptr(inRead), uintptr(outWrite), 0, uintptr(unsafe.Pointer(&c.console))); r != 0 {
+		c.in.Close()
+		c.out.Close()
+		return nil, fmt.Errorf("open pty: %w", syscall.Errno(r))
+	}
+
+	proc, err := createProcess(cmd, c.console)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("start command: %w", err)
+	}
+	// Holding the process handle until FindProcess has its own keeps the
+	// PID from being reused in between
+	cmd.Process, err = os.FindProcess(int(proc.ProcessId))
+	syscall.CloseHandle(proc.Thread)
+	if err != nil {
+		syscall.TerminateProcess(proc.Process, 1)
+		syscall.CloseHandle(proc.Process)
+		c.Close()
+		return nil, fmt.Errorf("start command: %w", err)
+	}
+	go func() {
+		syscall.WaitForSingleObject(proc.Process, syscall.INFINITE)
+		syscall.CloseHandle(proc.Process)
+		c.closeConsole()
+	}()
+	return c, nil
+}
+
+// createProcess runs CreateProcess for cmd with the pseudo console attached
+func createProcess(cmd *exec.Cmd, console uintptr) (*syscall.ProcessInformation, error) {
+	var size uintptr
+	procInitializeProcThreadAttributeList.Call(0, 1, 0, uintptr(unsafe.Pointer(&size)))
+	attrs := make([]byte, size)
+	if r, _, err := procInitializeProcThreadAttributeList.Call(uintptr(unsafe.Pointer(&attrs[0])), 1, 0, uintptr(unsafe.Pointer(&size))); r == 0 {
+		return nil, err
+	}
+	defer procDeleteProcThreadAttributeList.Call(uintptr(unsafe.Pointer(&attrs[0])))
+	if r, _, err := procUpdateProcThreadAttribute.Call(uintptr(unsafe.Pointer(&attrs[0])), 0,
+		procThreadAttributePseudoConsole, console, unsafe.Sizeof(console), 0, 0); r == 0 {
+		return nil, err
+	}
+
+	si := startupInfoEx{attributeList: &attrs[0]}
+	si.Cb = uint32(unsafe.Sizeof(si))
+
+	args := make([]string, len(cmd.Args))
+	for i, a := range cmd.Args {
+		args[i] = syscall.EscapeArg(a)
+	}
+	cmdline, err := syscall.UTF16PtrFromString(strings.Join(args, " "))
+	if err != nil {
+		return nil, err
+	}
+	app, err := syscall.UTF16PtrFromString(cmd.Path)
+	if err != nil {
+		return nil, err
+	}
+	var dir *uint16
+	if cmd.Dir != "" {
+		if dir, err = syscall.UTF16PtrFromString(cmd.Dir); err != nil {
+			return nil, err
+		}
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+
+	var pi syscall.ProcessInformation
+	err = syscall.CreateProcess(app, cmdline, nil, nil, false,
+		extendedStartupInfoPresent|syscall.CREATE_UNICODE_ENVIRONMENT,
+		environmentBlock(env), dir, &si.StartupInfo, &pi)
+	if err != nil {
+		return nil, err
+	}
+	return &pi, nil
+}
+
+// environmentBlock encodes env as NUL-separated UTF-16 strings ending in an
+// extra NUL
+func environmentBlock(env []string) *uint16 {
+	var block []uint16
+	for _, kv := range env {
+		block = append(block, utf16.Encode([]rune(kv))...)
+		block = append(block, 0)
+	}
+	if len(block) == 0 {
+		block = append(block, 0)
+	}
+	block = append(block, 0)
+	return &block[0]
+}
+
+// endOfInput is what CloseInput types: ^Z alone on a line, then Enter
+func endOfInput(midLine bool) []byte {
+	if midLine {
+		return []byte("\r\x1a\r")
+	}
+	return []byte("\x1a\r")
+}
@@ -0,0 +1,149 @@
+package watchdog
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ActivitySource is a sign of life other than the command's output, such
+// as its CPU use or a log file it writes. Every time received from Events
+// counts as activity at that time, resetting the idle clock like output
+// does; a zero time stands for the moment the Runner receives it, read
+// from its Config.Clock. Config.Sources lists the sources of a Runner; they are watched
+// while the command runs and stay open across runs, so a Supervisor's
+// restarts keep them. Whoever created a source closes it.
+//
+// A source shouldn't block on a send nobody takes: one pending event says
+// all that more of them would.
+type ActivitySource interface {
+	Events() <-chan time.Time
+	Close() error
+}
+
+// touchAt counts activity at t, never moving the idle clock backwards
+func (r *Runner) touchAt(t time.Time) {
+	at := r.stamp(t)
+	for {
+		a := r.activity.Load()
+		if at <= a || r.activity.CompareAndSwap(a, at) {
+			break
+		}
+	}
+	r.active()
+}
+
+// watchSources counts the events of the configured sources as activity
+// until done is closed
+func (r *Runner) watchSources(done <-chan struct{}) {
+	for _, src := range r.cfg.Sources {
+		go func() {
+			events := src.Events()
+			for {
+				select {
+				case <-done:
+					return
+				case t, ok := <-events:
+					if !ok {
+						return
+					}
+					if t.IsZero() {
+						t = r.clock.Now()
+					}
+					r.touchAt(t)
+				}
+			}
+		}()
+	}
+}
+
+// pending is the event channel of the stock sources: a buffer of one that
+// holds an event until it is taken. Their events are zero times, so each
+// Runner watching them stamps the activity by its own clock.
+type pending chan time.Time
+
+// send reports activity unless an event is already pending
+func (s pending) send() {
+	select {
+	case s <- time.Time{}:
+	default:
+	}
+}
+
+// ReaderSource passes reads through from an io.Reader, reporting each one
+// that returned data as activity. Wrapping Config.Stdin in one makes input
+// count, e.g. a user typing into an interactive command.
+type ReaderSource struct {
+	r      io.Reader
+	events pending
+}
+
+// NewReaderSource returns a source reporting the reads from r
+func NewReaderSource(r io.Reader) *ReaderSource {
+	return &ReaderSource{r: r, events: make(pending, 1)}
+}
+
+func (s *ReaderSource) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.events.send()
+	}
+	return n, err
+}
+
+func (s *ReaderSource) Events() <-chan time.Time { return s.events }
+
+// Close stops nothing, as reads drive the source; the reader stays open
+func (s *ReaderSource) Close() error { return nil }
+
+// PollSource calls a function every interval and reports activity when it
+// returns true, for signs of life that can only be sampled, such as
+// counters of the command's processes
+type PollSource struct {
+	events pending
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// NewPollSource starts calling poll, which reports whether there was
+// activity since its previous call
+func NewPollSource(interval time.Duration, poll func() bool) *PollSource {
+	s := &PollSource{events: make(pending, 1), stop: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				if poll() {
+					s.events.send()
+				}
+			}
+		}
+	}()
+	return s
+}
+
+func (s *PollSource) Events() <-chan time.Time { return s.events }
+
+// Close stops polling
+func (s *PollSource) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
+
+// NewFileSource watches the file at path, checked every interval: a change
+// of its size or modification time counts as activity, as do the file
+// appearing and being replaced by another, as when a log is rotated
+func NewFileSource(path string, interval time.Duration) *PollSource {
+	prev, _ := os.Stat(path)
+	return NewPollSource(interval, func() bool {
+		cur, _ := os.Stat(path)
+		changed := cur != nil && (prev == nil || !os.SameFile(prev, cur) || cur.Size() != prev.Size() || !cur.ModTime().Equal(prev.ModTime()))
+		prev = cur
+		return changed
+	})
+}
@@ -0,0 +1,181 @@
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RestartPolicy decides whether a Supervisor re-spawns a job that exited
+type RestartPolicy int
+
+const (
+	RestartNever     RestartPolicy = iota
+	RestartOnTimeout               // only after an idle kill
+	RestartOnFailure               // after an idle kill or a non-zero exit
+	RestartAlways                  // whenever the job exits
+)
+
+func (p RestartPolicy) shouldRestart(res Result) bool {
+	switch p {
+	case RestartOnTimeout:
+		return res.TimedOut
+	case RestartOnFailure:
+		return res.TimedOut || res.ExitCode != 0 || res.Err != nil
+	case RestartAlways:
+		return true
+	}
+	return false
+}
+
+// ErrDuplicateJob is the error of jobs sharing a name, which a Supervisor
+// refuses to run since their results and events couldn't be told apart
+var ErrDuplicateJob = errors.New("watchdog: duplicate job name")
+
+// Job is a named command managed by a Supervisor; names must be unique
+type Job struct {
+	Name        string
+	Config      Config
+	Restart     RestartPolicy
+	MaxRestarts int           // 0 means unlimited
+	Backoff     time.Duration // delay before the first restart, doubled after each; default 1s
+}
+
+// Supervisor runs several jobs concurrently, watchdogs each, restarts them
+// according to their policies, and publishes their events on a shared bus
+type Supervisor struct {
+	Jobs []Job
+
+	// FailFast stops every other job once any job finishes unsuccessfully
+	// without being restarted
+	FailFast bool
+
+	mu     sync.Mutex
+	subs   []chan Event
+	closed bool
+}
+
+// NewSupervisor returns a Supervisor for jobs
+func NewSupervisor(jobs ...Job) *Supervisor {
+	return &Supervisor{Jobs: jobs}
+}
+
+// Subscribe returns a channel receiving every job's events. Delivery never
+// blocks the jobs: events are dropped while the buffer is full. The channel
+// is closed when Run returns.
+func (s *Supervisor) Subscribe(buffer int) <-chan Event {
+	ch := make(chan Event, buffer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		close(ch)
+		return ch
+	}
+	s.subs = append(s.subs, ch)
+	return ch
+}
+
+func (s *Supervisor) publish(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Run starts every job and blocks until all of them have finished for good.
+// Cancelling ctx kills all jobs. The last result of each job is returned,
+// keyed by job name. If two jobs share a name none is started, and each
+// duplicated name gets a result with ErrDuplicateJob.
+func (s *Supervisor) Run(ctx context.Context) map[string]Result {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make(map[string]Result, len(s.Jobs))
+	)
+	for _, job := range s.Jobs {
+		if _, dup := results[job.Name]; dup {
+			results[job.Name] = Result{ExitCode: 1, Err: fmt.Errorf("%w %q", ErrDuplicateJob, job.Name)}
+		} else {
+			results[job.Name] = Result{}
+		}
+	}
+	for name, res := range results {
+		if res.Err == nil {
+			delete(results, name)
+		}
+	}
+	if len(results) > 0 {
+		s.close()
+		return results
+	}
+	for _, job := range s.Jobs {
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			res := s.runJob(ctx, job)
+			mu.Lock()
+			results[job.Name] = res
+			mu.Unlock()
+			if s.FailFast && ctx.Err() == nil && (res.TimedOut || res.ExitCode != 0 || res.Err != nil) {
+				cancel()
+			}
+		}(job)
+	}
+	wg.Wait()
+	s.close()
+	return results
+}
+
+// close closes the subscribers' channels once Run is done
+func (s *Supervisor) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for _, ch := range s.subs {
+		close(ch)
+	}
+	s.subs = nil
+}
+
+// runJob runs one job, restarting it per its policy
+func (s *Supervisor) runJob(ctx context.Context, job Job) Result {
+	cfg := job.Config
+	onEvent := cfg.OnEvent
+	cfg.OnEvent = func(e Event) {
+		e.Job = job.Name
+		if onEvent != nil {
+			onEvent(e)
+		}
+		s.publish(e)
+	}
+
+	clock := cfg.clock()
+	backoff := job.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		res := Run(ctx, cfg)
+		if ctx.Err() != nil || !job.Restart.shouldRestart(res) {
+			return res
+		}
+		if job.MaxRestarts > 0 && attempt > job.MaxRestarts {
+			return res
+		}
+
+		cfg.OnEvent(Event{Kind: Restarting, Time: clock.Now(), Attempt: attempt + 1, Backoff: backoff})
+		if !sleep(clock, backoff, ctx.Done()) {
+			return res
+		}
+		backoff *= 2
+	}
+}
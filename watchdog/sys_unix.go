@@ -0,0 +1,107 @@
+//go:build unix
+
+package watchdog
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// sysProcAttr puts the command in a process group of its own so the whole
+// group can be killed; under a PTY it also becomes a session leader with the
+// PTY as its controlling terminal (stdin, fd 0). A foreground command stays
+// in the caller's group.
+func sysProcAttr(pty, foreground bool) *syscall.SysProcAttr {
+	switch {
+	case pty:
+		return &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	case foreground:
+		return &syscall.SysProcAttr{}
+	}
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// setCredential makes the command run as c
+func setCredential(attr *syscall.SysProcAttr, c *Credential) error {
+	attr.Credential = &syscall.Credential{Uid: c.UID, Gid: c.GID, Groups: c.Groups}
+	return nil
+}
+
+// CheckCredential reports whether Config.Credential can work here
+func CheckCredential() error {
+	return nil
+}
+
+// killGroup kills the command's process group, falling back to the process
+// itself if the group is already gone
+func killGroup(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+	return p.Kill()
+}
+
+// signalProcess sends sig to the command
+func signalProcess(p *os.Process, _ terminal, sig os.Signal) error {
+	return p.Signal(sig)
+}
+
+// signalGroup sends sig to the command's process group, falling back to
+// the process itself if the group is already gone
+func signalGroup(p *os.Process, _ terminal, sig os.Signal) error {
+	if s, ok := sig.(syscall.Signal); ok {
+		if err := syscall.Kill(-p.Pid, s); err == nil {
+			return nil
+		}
+	}
+	return p.Signal(sig)
+}
+
+// exitStatus is the exit code reported for a command that didn't succeed;
+// one killed by a signal gets 128 plus its number, as shells report it
+func exitStatus(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
+
+// sysUsage adds what only the rusage of state tells to u
+func sysUsage(u *Usage, state *os.ProcessState) {
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return
+	}
+	u.MaxRSS = int64(ru.Maxrss) * 1024 // in KiB, except on Apple systems
+	if runtime.GOOS == "darwin" || runtime.GOOS == "ios" {
+		u.MaxRSS = int64(ru.Maxrss)
+	}
+	u.MajorFaults, u.MinorFaults = int64(ru.Majflt), int64(ru.Minflt)
+}
+
+// setWinsize sets the size of the PTY behind f
+func setWinsize(f *os.File, cols, rows int) error {
+	ws := struct{ Row, Col, Xpixel, Ypixel uint16 }{Row: uint16(rows), Col: uint16(cols)}
+	return ioctl(f, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+// ioctl issues an ioctl without f.Fd(), which would take f out of the
+// runtime poller and make its reads uninterruptible
+func ioctl(f *os.File, req, arg uintptr) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
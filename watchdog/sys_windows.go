@@ -0,0 +1,87 @@
+package watchdog
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procGenerateConsoleCtrlEvent = kernel32.NewProc("GenerateConsoleCtrlEvent")
+)
+
+const (
+	ctrlBreakEvent     = 1
+	statusControlCExit = 0xC000013A // exit status of a process ended by Ctrl+C
+)
+
+// sysProcAttr gives a pipe-mode command a process group of its own, so a
+// CTRL_BREAK can reach it without hitting the wrapper. PTY mode doesn't go
+// through os/exec, see startPTY. A foreground command stays in the caller's
+// group so Ctrl+C reaches it.
+func sysProcAttr(pty, foreground bool) *syscall.SysProcAttr {
+	if foreground {
+		return &syscall.SysProcAttr{}
+	}
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+var errNoCredential = errors.New("running as another user is not supported on Windows")
+
+// setCredential fails: Windows starts processes as another user with a
+// logon token, which a user and group ID don't give
+func setCredential(attr *syscall.SysProcAttr, c *Credential) error {
+	return errNoCredential
+}
+
+// CheckCredential reports whether Config.Credential can work here
+func CheckCredential() error {
+	return errNoCredential
+}
+
+// killGroup asks the command's process group to stop with CTRL_BREAK and
+// terminates the command itself. Under a pseudo console, closing the console
+// when the command is gone ends the other processes attached to it.
+func killGroup(p *os.Process) error {
+	procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(p.Pid))
+	return p.Kill()
+}
+
+// signalProcess delivers sig the Windows way: an interrupt is Ctrl+C typed
+// into the pseudo console, or CTRL_BREAK for a process group of its own;
+// os.Kill terminates the process. Nothing else can be delivered.
+func signalProcess(p *os.Process, pty terminal, sig os.Signal) error {
+	switch sig {
+	case os.Interrupt:
+		if pty != nil {
+			_, err := pty.Write([]byte{0x03})
+			return err
+		}
+		if ok, _, err := procGenerateConsoleCtrlEvent.Call(ctrlBreakEvent, uintptr(p.Pid)); ok == 0 {
+			return err
+		}
+		return nil
+	case os.Kill:
+		return p.Kill()
+	}
+	return syscall.EWINDOWS
+}
+
+// signalGroup is signalProcess: CTRL_BREAK already reaches the group
+func signalGroup(p *os.Process, pty terminal, sig os.Signal) error {
+	return signalProcess(p, pty, sig)
+}
+
+// exitStatus maps Windows exit statuses to their Unix-shell equivalents
+// where there is one, so scripts can test for an interrupted command
+func exitStatus(state *os.ProcessState) int {
+	code := state.ExitCode()
+	if uint32(code) == statusControlCExit {
+		return 128 + 2 // SIGINT
+	}
+	return code
+}
+
+// sysUsage adds nothing: Windows accounts only the CPU times
+func sysUsage(*Usage, *os.ProcessState) {}
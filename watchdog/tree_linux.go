@@ -0,0 +1,180 @@
+package watchdog
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// prSetChildSubreaper is PR_SET_CHILD_SUBREAPER from <linux/prctl.h>
+const prSetChildSubreaper = 36
+
+// descendants keeps a registry of every process below the command, so that
+// with the supervisor as subreaper the ones orphaned by an exiting parent
+// are still known, waited for, and killed. Processes are identified by PID
+// and start time, which guards against PID reuse.
+type descendants struct {
+	root int // the command itself, managed by os/exec
+
+	mu    sync.Mutex
+	known map[int]uint64 // pid -> start time
+}
+
+// CheckSubreaper reports whether Config.Subreaper can work here
+func CheckSubreaper() error {
+	return nil
+}
+
+// newDescendants makes the calling process a subreaper for the tree below
+// root. The setting is process-wide and stays on.
+func newDescendants(root int) (*descendants, error) {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return nil, errno
+	}
+	return &descendants{root: root, known: map[int]uint64{}}, nil
+}
+
+// procStat is the part of /proc/<pid>/stat the registry needs
+type procStat struct {
+	state           byte
+	ppid, pgrp, sid int
+	start           uint64
+}
+
+func readStat(pid int) (procStat, bool) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return procStat{}, false
+	}
+	// The command name is parenthesised and may itself contain ") "
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return procStat{}, false
+	}
+	f := strings.Fields(string(data[i+1:]))
+	if len(f) < 20 {
+		return procStat{}, false
+	}
+	var s procStat
+	s.state = f[0][0]
+	s.ppid, _ = strconv.Atoi(f[1])
+	s.pgrp, _ = strconv.Atoi(f[2])
+	s.sid, _ = strconv.Atoi(f[3])
+	s.start, _ = strconv.ParseUint(f[19], 10, 64)
+	return s, true
+}
+
+// scan adds new descendants, forgets exited ones, and reaps those that were
+// re-parented to this process. It reports how many are still alive.
+func (d *descendants) scan() int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	self := os.Getpid()
+	stats := map[int]procStat{}
+	children := map[int][]int{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if s, ok := readStat(pid); ok {
+			stats[pid] = s
+			children[s.ppid] = append(children[s.ppid], pid)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for pid, start := range d.known {
+		if s, ok := stats[pid]; !ok || s.start != start {
+			delete(d.known, pid)
+		}
+	}
+	// Orphans can be adopted before a scan sees them. They carry the
+	// command's session or process group, unless they started a session of
+	// their own; everything else this process starts stays in its session.
+	queue := []int{d.root}
+	for _, pid := range children[self] {
+		s := stats[pid]
+		if _, other := running.Load(pid); !other && (s.sid == d.root || s.pgrp == d.root || s.sid != stats[self].sid) {
+			queue = append(queue, pid)
+		}
+	}
+	for pid := range d.known {
+		queue = append(queue, pid)
+	}
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		if pid != d.root {
+			if _, ok := d.known[pid]; !ok {
+				d.known[pid] = stats[pid].start
+			}
+		}
+		for _, c := range children[pid] {
+			if _, ok := d.known[c]; !ok {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	for pid := range d.known {
+		if s := stats[pid]; s.state == 'Z' {
+			if s.ppid == self {
+				syscall.Wait4(pid, nil, syscall.WNOHANG, nil)
+			}
+			delete(d.known, pid)
+		}
+	}
+	return len(d.known)
+}
+
+// kill sends SIGKILL to every known descendant
+func (d *descendants) kill() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for pid := range d.known {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// CheckMaxRSS reports whether Config.MaxRSS can work here
+func CheckMaxRSS() error {
+	return nil
+}
+
+// treeRSS returns the resident memory of root and every process below it,
+// in bytes
+func treeRSS(root int) int64 {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	children := map[int][]int{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if s, ok := readStat(pid); ok {
+			children[s.ppid] = append(children[s.ppid], pid)
+		}
+	}
+	var total int64
+	page := int64(os.Getpagesize())
+	for tree := []int{root}; len(tree) > 0; tree = tree[1:] {
+		pid := tree[0]
+		tree = append(tree, children[pid]...)
+		// statm: size resident shared ..., in pages
+		data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/statm")
+		if f := strings.Fields(string(data)); err == nil && len(f) > 1 {
+			n, _ := strconv.ParseInt(f[1], 10, 64)
+			total += n * page
+		}
+	}
+	return total
+}
@@ -0,0 +1,29 @@
+//go:build !linux
+
+package watchdog
+
+import "errors"
+
+var errNoSubreaper = errors.New("subreaper mode is only supported on Linux")
+
+// CheckSubreaper reports whether Config.Subreaper can work here
+func CheckSubreaper() error {
+	return errNoSubreaper
+}
+
+// descendants is only implemented on Linux
+type descendants struct{}
+
+func newDescendants(root int) (*descendants, error) {
+	return nil, errNoSubreaper
+}
+
+func (d *descendants) scan() int { return 0 }
+func (d *descendants) kill()     {}
+
+// CheckMaxRSS reports whether Config.MaxRSS can work here
+func CheckMaxRSS() error {
+	return errors.New("memory limits are only supported on Linux")
+}
+
+func treeRSS(root int) int64 { return 0 }
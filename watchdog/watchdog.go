@@ -0,0 +1,1078 @@
+// Package watchdog runs a command and kills it if it stops producing output
+// for longer than an idle timeout. It is the supervision core of the
+// idle-timeout CLI, usable on its own by Go programs that embed watched
+// helpers.
+package watchdog
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ExitTimedOut is the exit code reported for a command killed for
+// inactivity, matching GNU timeout
+const ExitTimedOut = 124
+
+// ExitOverLimit is the exit code reported for a command killed for
+// exceeding a resource limit such as Config.MaxRSS or Config.MaxOutput
+const ExitOverLimit = 123
+
+// Resolution is the finest timeout granularity the watchdog is meant for,
+// and how often it samples state that gives no notice of changes, such as
+// the descendants in Subreaper mode, unless Config.CheckInterval says
+// otherwise. The idle clock itself runs on a timer set for the next
+// deadline, so it costs no wakeups in between.
+const Resolution = 100 * time.Millisecond
+
+// DefaultDrain is how long output is still copied after the command exits
+// when Config.Drain is 0, enough for descendants flushing their last lines
+const DefaultDrain = time.Second
+
+// eventBuffer is how many events Runner.Events holds for a slow receiver
+const eventBuffer = 256
+
+// rssPoll is how often Config.MaxRSS is checked
+const rssPoll = time.Second
+
+// Output is read minRead bytes at a time, growing up to maxRead while reads
+// fill the buffer, so a command writing tens of MB/s costs few wakeups
+const (
+	minRead = 32 << 10
+	maxRead = 1 << 20
+)
+
+// running holds the PIDs of the commands this package has started, so a
+// subreaper scan never takes another Runner's command for an orphan
+var running sync.Map
+
+// Config describes a command to supervise
+type Config struct {
+	Path string   // command to run, looked up in PATH
+	Args []string // arguments, not including the command itself
+	Env  []string // environment; nil means the current process environment
+	Dir  string   // working directory; empty means the current one
+
+	// Credential, if set, runs the command as another user, for a caller
+	// running as root that drops the command's privileges but keeps its
+	// own to kill it (not on Windows)
+	Credential *Credential
+
+	// Cgroup is an existing, empty cgroup v2 directory to start the command
+	// in (Linux only). Killing the command then writes cgroup.kill, which
+	// takes down every descendant, including daemons that left the process
+	// group. The caller creates and removes the directory.
+	Cgroup string
+
+	// Subreaper makes the supervising process adopt the command's orphaned
+	// descendants (Linux only) and tracks every process below the command.
+	// The run then lasts until the last of them exits, not just the command,
+	// and a timeout kills all of them. The subreaper setting is process-wide.
+	Subreaper bool
+
+	// MaxRSS kills the command once the resident memory of it and its
+	// descendants exceeds this many bytes, checked every second (Linux
+	// only). 0 means no limit.
+	MaxRSS int64
+
+	// MaxOutput and MaxLines kill a command that floods its output, such as
+	// a logger stuck in an error loop, once it has written more than this
+	// many bytes or lines in total; the output is cut off at the limit.
+	// 0 means no limit.
+	MaxOutput int64
+	MaxLines  int64
+
+	// MinRate times the command out like inactivity once its output over
+	// the last RateWindow comes to less than MinRate bytes a second, for
+	// output that slows to a trickle rather than stopping, such as the
+	// progress of a stalled download. It is first checked once the command
+	// has run for a RateWindow. 0 means no floor.
+	MinRate    float64
+	RateWindow time.Duration
+
+	Timeout time.Duration // kill after this long without output
+	WarnAt  time.Duration // emit Warned after this long without output; 0 disables
+
+	// DumpSignal, if set, is sent to the command's process group when it
+	// times out, DumpWait before it is killed, so runtimes that dump their
+	// stacks on a signal (SIGQUIT for Go and Java) leave them in the output.
+	// A command that exits meanwhile isn't waited for.
+	DumpSignal os.Signal
+	DumpWait   time.Duration
+
+	// KillSignal, if set, is what a kill sends the command's process group
+	// instead of SIGKILL, so it can clean up; KillGrace later SIGKILL
+	// follows unless the command has exited
+	KillSignal os.Signal
+	KillGrace  time.Duration
+
+	// CheckInterval is how often state that gives no notice of changes is
+	// sampled: the descendants in Subreaper mode, and MaxRSS at most every
+	// rssPoll. Longer saves wakeups, shorter finds a runaway sooner. 0
+	// means Resolution.
+	CheckInterval time.Duration
+
+	// FirstOutput, if set, replaces Timeout until the command's first
+	// output, for a startup phase with a budget of its own: a short one
+	// catches a command hanging on connect, a long one lets a slow starter
+	// warm up. Activity from Sources doesn't end it.
+	FirstOutput time.Duration
+
+	// ResetBytes switches the idle clock to a leaky-bucket model: a chunk of
+	// n bytes winds it back by Timeout*n/ResetBytes instead of resetting it,
+	// with the Timeout SetTimeout set if it was called, so only sustained
+	// output buys the full timeout and a lone keep-alive byte barely moves
+	// the deadline. 0 means any output resets the clock.
+	ResetBytes int
+
+	// Activity, if set, decides whether a chunk of output counts as
+	// activity. Output it turns down is forwarded all the same, but leaves
+	// the idle clock alone, such as a line the command keeps repeating.
+	Activity func(chunk []byte) bool
+
+	// IgnoreStdout and IgnoreStderr keep output on that stream from
+	// counting as activity, or ending FirstOutput, in pipe mode, for a
+	// command that shows it is alive on the other one; it is forwarded all
+	// the same. In PTY mode the streams are one and always count.
+	IgnoreStdout, IgnoreStderr bool
+
+	// PTY runs the command under a pseudo-terminal so it keeps colors and
+	// progress output; its stderr is merged into Stdout. Input can be
+	// typed into the terminal with Runner.Write.
+	PTY        bool
+	Cols, Rows int  // initial PTY size; 0 keeps the kernel default
+	NoEcho     bool // turn off the PTY's echo of typed input (not on Windows)
+
+	// RawOutput turns off the PTY's output processing, so the command's
+	// bytes arrive exactly as written, a newline without the \r the
+	// terminal adds, for binary output. Not on Windows, whose console
+	// re-renders output; pipes pass it unchanged anyway.
+	RawOutput bool
+
+	// The command is reaped as soon as it exits, but descendants it left
+	// behind may still hold its terminal or pipes. Output is then copied
+	// for at most Drain, DefaultDrain if 0, without the idle clock running,
+	// so their trailing lines aren't cut off; the output is closed on them
+	// after that, and the run reports the command's own exit status.
+	Drain time.Duration
+
+	// Linger instead keeps supervising those descendants once the command
+	// exits: output is copied, under the idle timeout, until the last of
+	// them closes it, and a timeout kills the command's process group.
+	// Subreaper mode always lingers.
+	Linger bool
+
+	// Foreground leaves a pipe-mode command in the caller's process group
+	// and session, like GNU timeout --foreground: it can use the controlling
+	// terminal and receives the terminal's signals, but a timeout kills only
+	// the command, not processes it started. Ignored in PTY mode.
+	Foreground bool
+
+	// Sources are signs of life besides output, each resetting the idle
+	// clock like output does; see ActivitySource
+	Sources []ActivitySource
+
+	// Stdin is the command's input. In PTY mode it is copied into the
+	// terminal until it is exhausted, which types ^D as in CloseInput, or
+	// the run ends; a copy blocked in Read finishes after that Read
+	// returns, unless Stdin has a SetReadDeadline method to interrupt it.
+	Stdin  io.Reader
+	Stdout io.Writer // receives the command's output; nil discards it
+	Stderr io.Writer // receives stderr in pipe mode; nil discards it
+
+	// OnEvent, if set, is called synchronously for every lifecycle event.
+	// TimedOut is delivered before the child is killed, so a handler may
+	// still inspect the process. Output is on Stdout and Stderr, not here;
+	// OutputChunk events only go to Runner.Events.
+	OnEvent func(Event)
+
+	// Clock is the time the idle clock runs on; nil means the system's.
+	// A FakeClock makes timeouts testable without waiting for them.
+	Clock Clock
+
+	// Spare, if set, is asked before the command is killed, with the
+	// TimedOut or OverLimit event that would be emitted; Expire asks too,
+	// with Forced set. Returning true keeps it running: after a timeout the
+	// idle clock restarts, turning it into a warning, and a limit it went
+	// over is no longer enforced for the run. It is called from the
+	// goroutine that finds the timeout or the limit.
+	Spare func(Event) bool
+}
+
+// clock returns the Clock to run on
+func (cfg *Config) clock() Clock {
+	if cfg.Clock == nil {
+		return realClock{}
+	}
+	return cfg.Clock
+}
+
+// Credential is a user and groups to run a command as
+type Credential struct {
+	UID, GID uint32
+	Groups   []uint32 // supplementary groups
+}
+
+// Result is the outcome of one run of a command
+type Result struct {
+	Started   time.Time
+	Duration  time.Duration
+	ExitCode  int    // ExitTimedOut when killed for inactivity, ExitOverLimit over a limit
+	TimedOut  bool   // killed for inactivity
+	OverLimit string // the limit the command was killed for, such as "rss"
+	Warnings  int    // idle episodes that crossed WarnAt
+	Usage     *Usage // what the command used, nil if it wasn't waited for
+	Err       error
+}
+
+// Usage is the resources a command and the descendants it waited for used,
+// as the kernel accounted them
+type Usage struct {
+	User, System time.Duration // CPU time
+	MaxRSS       int64         // peak resident memory in bytes (not on Windows)
+	MajorFaults  int64         // page faults that read from disk (not on Windows)
+	MinorFaults  int64         // page faults served from memory (not on Windows)
+}
+
+// terminal is the controlling side of the pseudo-terminal a command runs
+// on: reading it yields the command's output, writing types input
+type terminal interface {
+	io.ReadWriteCloser
+	resize(cols, rows int) error
+}
+
+// Runner supervises a single run of a command
+type Runner struct {
+	cfg   Config
+	clock Clock
+
+	// The idle clock is kept without a lock, as output updates it for
+	// every chunk: activity is when the command was last active, as a
+	// stamp (see stamp), or 0 before it started
+	epoch    time.Time
+	activity atomic.Int64
+
+	mu         sync.Mutex
+	proc       *os.Process
+	pty        terminal      // controlling side of the PTY while running in PTY mode
+	timeout    time.Duration // the idle limit, Config.Timeout unless SetTimeout changed it
+	extend     time.Duration // limit of the current silence from Extend, 0 for none
+	extendFrom int64         // activity when Extend was called
+	paused     time.Time     // when Pause stopped the idle clock, zero while it runs
+	midLine    atomic.Bool   // input typed with Write ends in a partial line
+	warned     atomic.Bool   // the current silence crossed WarnAt, so activity ends the episode
+	extended   atomic.Bool   // Extend lengthened the current silence, so activity ends the extension
+	rearm      chan struct{} // wakes the checker to recompute its deadline
+	expire     chan struct{}
+	events     chan Event // from Events, nil until asked for
+	ended      bool       // Run returned, so events is closed
+	listening  atomic.Bool
+}
+
+// New returns a Runner for cfg
+func New(cfg Config) *Runner {
+	clock := cfg.clock()
+	return &Runner{cfg: cfg, clock: clock, epoch: clock.Now(), expire: make(chan struct{}, 1), rearm: make(chan struct{}, 1)}
+}
+
+// Run starts a command and supervises it until it exits
+func Run(ctx context.Context, cfg Config) Result {
+	return New(cfg).Run(ctx)
+}
+
+// PID returns the process ID of the running command, or 0 if not running
+func (r *Runner) PID() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.proc == nil {
+		return 0
+	}
+	return r.proc.Pid
+}
+
+// LastActivity returns when the command last produced output (or started),
+// or the zero time if it hasn't been started
+func (r *Runner) LastActivity() time.Time {
+	a := r.activity.Load()
+	if a == 0 {
+		return time.Time{}
+	}
+	return r.epoch.Add(time.Duration(a - 1))
+}
+
+// stamp is t as a point on the idle clock: the monotonic time since the
+// Runner was made, plus 1 as 0 means not started. The offset is exact, so
+// a FakeClock's times come back unchanged from LastActivity.
+func (r *Runner) stamp(t time.Time) int64 {
+	return max(1, int64(t.Sub(r.epoch))+1)
+}
+
+func (r *Runner) resetTimer() {
+	r.activity.Store(r.stamp(r.clock.Now()))
+	r.active()
+}
+
+// active follows activity: the checker sleeps until the deadline it knew
+// of, which activity only postpones, but after a warning it must notice
+// that a new idle episode began to warn about that one in time, and the
+// end of an extension brings the deadline forward
+func (r *Runner) active() {
+	if r.extended.Swap(false) || r.warned.Load() {
+		r.wake()
+	}
+}
+
+// wake makes the checker recompute its deadline, for changes that may
+// bring it forward
+func (r *Runner) wake() {
+	select {
+	case r.rearm <- struct{}{}:
+	default:
+	}
+}
+
+// credit winds the idle clock back for n bytes of output, see ResetBytes,
+// in proportion to the idle limit in force
+func (r *Runner) credit(n int) {
+	if r.cfg.ResetBytes <= 0 || n >= r.cfg.ResetBytes {
+		r.resetTimer()
+		return
+	}
+	back := int64(float64(r.Timeout()) * float64(n) / float64(r.cfg.ResetBytes))
+	now := r.stamp(r.clock.Now())
+	for {
+		a := r.activity.Load()
+		if r.activity.CompareAndSwap(a, min(a+back, now)) {
+			break
+		}
+	}
+	r.active()
+}
+
+// Touch resets the idle clock as if the command had produced output
+func (r *Runner) Touch() {
+	r.resetTimer()
+}
+
+// SetTimeout changes the idle limit of the running command from now on,
+// such as for a phase of its work known to have longer silences
+func (r *Runner) SetTimeout(d time.Duration) {
+	r.mu.Lock()
+	r.timeout = d
+	r.mu.Unlock()
+	r.wake()
+}
+
+// Extend lets the current silence of the running command last up to d, if
+// that is longer than its idle limit; its next output ends the extension
+func (r *Runner) Extend(d time.Duration) {
+	r.mu.Lock()
+	r.extend, r.extendFrom = d, r.activity.Load()
+	r.mu.Unlock()
+	r.extended.Store(true)
+	r.wake()
+}
+
+// Timeout returns the idle limit of the running command, as configured or
+// changed by SetTimeout
+func (r *Runner) Timeout() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.timeout
+}
+
+// IdleLimit returns how long the command's current silence may last: its
+// idle limit, or longer after Extend
+func (r *Runner) IdleLimit() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.extend > r.timeout && r.activity.Load() == r.extendFrom {
+		return r.extend
+	}
+	return r.timeout
+}
+
+// Pause stops the idle clock, such as while the command is suspended, so
+// the time until Resume doesn't count as silence
+func (r *Runner) Pause() {
+	r.mu.Lock()
+	if r.paused.IsZero() {
+		r.paused = r.clock.Now()
+	}
+	r.mu.Unlock()
+	r.wake()
+}
+
+// Resume restarts the idle clock stopped by Pause where it left off
+func (r *Runner) Resume() {
+	r.mu.Lock()
+	defer r.wake()
+	defer r.mu.Unlock()
+	if r.paused.IsZero() {
+		return
+	}
+	paused, d := r.stamp(r.paused), int64(r.clock.Now().Sub(r.paused))
+	for {
+		a := r.activity.Load()
+		if a >= paused {
+			break // output meanwhile
+		}
+		if r.activity.CompareAndSwap(a, a+d) {
+			if a == r.extendFrom {
+				r.extendFrom += d
+			}
+			break
+		}
+	}
+	r.paused = time.Time{}
+}
+
+func (r *Runner) isPaused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.paused.IsZero()
+}
+
+// Expire makes the running command time out now, as if its idle limit had
+// been reached. It is safe to call from an OnEvent handler.
+func (r *Runner) Expire() {
+	select {
+	case r.expire <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Runner) checkInterval() time.Duration {
+	if r.cfg.CheckInterval > 0 {
+		return r.cfg.CheckInterval
+	}
+	return Resolution
+}
+
+// drain is how long output is copied after the command exits
+func (r *Runner) drain() time.Duration {
+	if r.cfg.Drain > 0 {
+		return r.cfg.Drain
+	}
+	return DefaultDrain
+}
+
+// ErrNotRunning is returned when controlling a command that isn't running
+var ErrNotRunning = errors.New("watchdog: process not running")
+
+// Signal sends sig to the running command
+func (r *Runner) Signal(sig os.Signal) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.proc == nil {
+		return ErrNotRunning
+	}
+	return signalProcess(r.proc, r.pty, sig)
+}
+
+// SignalGroup sends sig to the command's whole process group, reaching
+// children a shell started too. A foreground pipe-mode command shares the
+// caller's group, so only the command itself is signalled.
+func (r *Runner) SignalGroup(sig os.Signal) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.proc == nil {
+		return ErrNotRunning
+	}
+	if r.cfg.Foreground && !r.cfg.PTY {
+		return signalProcess(r.proc, r.pty, sig)
+	}
+	return signalGroup(r.proc, r.pty, sig)
+}
+
+// Write types p into the command's terminal. It fails unless the command
+// is running in PTY mode.
+func (r *Runner) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	pty := r.pty
+	r.mu.Unlock()
+	if pty == nil {
+		return 0, ErrNotRunning
+	}
+	if len(p) > 0 {
+		r.midLine.Store(p[len(p)-1] != '\n' && p[len(p)-1] != '\r')
+	}
+	return pty.Write(p)
+}
+
+// CloseInput signals the end of input, as closing its stdin would: it
+// types the terminal's end-of-file key, ^D (^Z and Enter on Windows),
+// ending a partial line first. Like Write it fails unless the command is
+// running in PTY mode, and a command that put its terminal in raw mode
+// reads it as a key.
+func (r *Runner) CloseInput() error {
+	_, err := r.Write(endOfInput(r.midLine.Load()))
+	return err
+}
+
+// copyInput types in into the command's terminal until it is exhausted,
+// then signals the end of input. stop ends the copy with the run,
+// interrupting a Read if in supports deadlines as pipes do.
+func (r *Runner) copyInput(in io.Reader, stop <-chan struct{}) {
+	if d, ok := in.(interface{ SetReadDeadline(time.Time) error }); ok {
+		copied := make(chan struct{})
+		defer close(copied)
+		go func() {
+			select {
+			case <-stop:
+				d.SetReadDeadline(time.Now())
+			case <-copied:
+			}
+		}()
+		defer d.SetReadDeadline(time.Time{})
+	}
+	if _, err := io.Copy(r, in); err == nil {
+		r.CloseInput()
+	}
+}
+
+// Resize changes the size of the command's terminal in PTY mode
+func (r *Runner) Resize(cols, rows int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pty == nil {
+		return ErrNotRunning
+	}
+	return r.pty.resize(cols, rows)
+}
+
+// kill kills the command with everything it started: the whole cgroup if
+// there is one, otherwise its process group. A foreground command shares
+// the caller's group, so only the command itself is killed.
+func (r *Runner) kill(p *os.Process) {
+	if r.cfg.Cgroup != "" && os.WriteFile(filepath.Join(r.cfg.Cgroup, "cgroup.kill"), []byte("1"), 0) == nil {
+		return
+	}
+	if r.cfg.Foreground && !r.cfg.PTY {
+		p.Kill()
+		return
+	}
+	killGroup(p)
+}
+
+// Events returns a channel receiving the run's events, OutputChunk
+// included, for applications building their own UI or policy on the
+// Runner. Delivery never blocks the command: events are dropped while the
+// buffer is full. The channel is closed when Run returns; ask for it
+// before Run to see every event.
+func (r *Runner) Events() <-chan Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.events == nil {
+		r.events = make(chan Event, eventBuffer)
+		if r.ended {
+			close(r.events)
+		}
+		r.listening.Store(!r.ended)
+	}
+	return r.events
+}
+
+func (r *Runner) emit(e Event) {
+	e.Time = r.clock.Now()
+	if r.cfg.OnEvent != nil && e.Kind != OutputChunk {
+		r.cfg.OnEvent(e)
+	}
+	if !r.listening.Load() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ended {
+		return
+	}
+	select {
+	case r.events <- e:
+	default:
+	}
+}
+
+// endEvents closes the channel from Events once the run is over
+func (r *Runner) endEvents() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ended = true
+	if r.events != nil {
+		close(r.events)
+	}
+}
+
+// Run starts the command and supervises it until it exits. Cancelling ctx
+// kills the command.
+func (r *Runner) Run(ctx context.Context) (res Result) {
+	res = Result{Started: r.clock.Now(), ExitCode: 1}
+	defer func() { res.Duration = r.clock.Now().Sub(res.Started) }()
+	defer r.endEvents()
+
+	cmd := exec.Command(r.cfg.Path, r.cfg.Args...)
+	cmd.Env = r.cfg.Env
+	cmd.Dir = r.cfg.Dir
+	cmd.SysProcAttr = sysProcAttr(r.cfg.PTY, r.cfg.Foreground)
+	killOnParentDeath(cmd.SysProcAttr)
+	if r.cfg.Credential != nil {
+		if err := setCredential(cmd.SysProcAttr, r.cfg.Credential); err != nil {
+			res.Err = err
+			return res
+		}
+	}
+	if r.cfg.Cgroup != "" {
+		f, err := intoCgroup(cmd.SysProcAttr, r.cfg.Cgroup)
+		if err != nil {
+			res.Err = fmt.Errorf("open cgroup: %w", err)
+			return res
+		}
+		defer f.Close()
+	}
+
+	// Output sources: the PTY master, or separate stdout/stderr pipes
+	var stdout, stderr io.ReadCloser
+	var pty terminal
+	if r.cfg.PTY {
+		var err error
+		if pty, err = startPTY(cmd, r.cfg.Cols, r.cfg.Rows, r.cfg.NoEcho, r.cfg.RawOutput); err != nil {
+			res.Err = err
+			return res
+		}
+		defer pty.Close()
+		stdout = pty
+	} else {
+		// Pipes of its own rather than cmd.StdoutPipe, which Wait would
+		// close while descendants may still be writing to them
+		cmd.Stdin = r.cfg.Stdin
+		outR, outW, err := os.Pipe()
+		if err != nil {
+			res.Err = fmt.Errorf("create stdout pipe: %w", err)
+			return res
+		}
+		errR, errW, err := os.Pipe()
+		if err != nil {
+			outR.Close()
+			outW.Close()
+			res.Err = fmt.Errorf("create stderr pipe: %w", err)
+			return res
+		}
+		cmd.Stdout, cmd.Stderr = outW, errW
+		err = cmd.Start()
+		outW.Close()
+		errW.Close()
+		if err != nil {
+			outR.Close()
+			errR.Close()
+			res.Err = fmt.Errorf("start command: %w", err)
+			return res
+		}
+		defer outR.Close()
+		defer errR.Close()
+		stdout, stderr = outR, errR
+	}
+
+	running.Store(cmd.Process.Pid, true)
+	defer running.Delete(cmd.Process.Pid)
+	r.mu.Lock()
+	r.proc = cmd.Process
+	r.pty = pty
+	r.activity.Store(r.stamp(r.clock.Now()))
+	r.timeout, r.extend = r.cfg.Timeout, 0
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.proc = nil
+		r.pty = nil
+		r.mu.Unlock()
+	}()
+	r.emit(Event{Kind: Started, PID: cmd.Process.Pid})
+
+	var tree *descendants
+	if r.cfg.Subreaper {
+		var err error
+		if tree, err = newDescendants(cmd.Process.Pid); err != nil {
+			killGroup(cmd.Process)
+			cmd.Wait()
+			res.Err = fmt.Errorf("become subreaper: %w", err)
+			return res
+		}
+	}
+	done := make(chan struct{}) // closed once the command and its output have ended
+	kill := func() {
+		if r.cfg.KillSignal != nil && r.cfg.KillSignal != os.Kill && r.SignalGroup(r.cfg.KillSignal) == nil {
+			if !sleep(r.clock, r.cfg.KillGrace, done) {
+				return
+			}
+		}
+		r.kill(cmd.Process)
+		if tree != nil {
+			tree.scan()
+			tree.kill()
+		}
+	}
+
+	sourcesDone := make(chan struct{})
+	defer close(sourcesDone)
+	if pty != nil && r.cfg.Stdin != nil {
+		go r.copyInput(r.cfg.Stdin, sourcesDone)
+	}
+	r.watchSources(sourcesDone)
+
+	// The command is reaped as soon as it exits, whoever else still holds
+	// its output. Unless lingering, the output that follows gets the drain
+	// time to end before it is closed on them.
+	var waitErr error
+	exited := make(chan struct{}) // closed once the command has exited
+	copied := make(chan struct{}) // closed once the output has ended
+	linger := r.cfg.Linger || tree != nil
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+		if !linger && sleep(r.clock, r.drain(), copied) {
+			if pty != nil {
+				pty.Close()
+			} else {
+				stdout.Close()
+				stderr.Close()
+			}
+		}
+	}()
+	var draining <-chan struct{} // the command's exit, ending the checker
+	if !linger {
+		draining = exited
+	}
+
+	// Timeout checker, warning once per idle episode
+	overLimit := make(chan Event, 1) // output past MaxOutput or MaxLines
+	var written atomic.Int64         // output so far, for MinRate
+	var spoke atomic.Bool            // whether there was output, ending FirstOutput
+	stopped := make(chan struct{})   // closed once the checker has given up or killed
+	timedOut := func() {
+		if r.cfg.DumpSignal != nil && r.SignalGroup(r.cfg.DumpSignal) == nil {
+			if !sleep(r.clock, r.cfg.DumpWait, done) {
+				return
+			}
+		}
+		kill()
+	}
+	var checker sync.WaitGroup
+	checker.Add(1)
+	go func() {
+		defer checker.Done()
+		defer close(stopped)
+		// The timer is set for the next warning or timeout as things stand;
+		// whatever postpones them is noticed when it fires, and whatever
+		// brings them forward wakes the checker through rearm
+		deadline := r.clock.NewTimer(0)
+		defer deadline.Stop()
+		var poll <-chan time.Time // for the descendants, MaxRSS and MinRate, which give no notice
+		slowness := r.cfg.MinRate > 0 && r.cfg.RateWindow > 0
+		if tree != nil || r.cfg.MaxRSS > 0 || slowness {
+			ticker := r.clock.NewTicker(r.checkInterval())
+			defer ticker.Stop()
+			poll = ticker.C()
+		}
+		r.warned.Store(false)
+		var lastRSS time.Time
+		maxRSS := r.cfg.MaxRSS
+		var rate rateWindow
+		for {
+			select {
+			case <-done:
+				return
+			case <-draining:
+				return // the exit status stands
+			case <-ctx.Done():
+				kill()
+				return
+			case <-r.expire:
+				e := Event{Kind: TimedOut, PID: cmd.Process.Pid, Idle: r.clock.Now().Sub(r.LastActivity()), Timeout: r.IdleLimit(), Forced: true}
+				if r.cfg.Spare == nil || !r.cfg.Spare(e) {
+					res.TimedOut = true
+					r.emit(e)
+					timedOut()
+					return
+				}
+				r.warned.Store(false)
+				r.resetTimer()
+			case e := <-overLimit:
+				res.OverLimit = e.Limit
+				e.PID = cmd.Process.Pid
+				r.emit(e)
+				kill()
+				return
+			case now := <-poll:
+				if tree != nil {
+					tree.scan()
+				}
+				if maxRSS > 0 && now.Sub(lastRSS) >= rssPoll {
+					lastRSS = now
+					if rss := treeRSS(cmd.Process.Pid); rss > maxRSS {
+						e := Event{Kind: OverLimit, PID: cmd.Process.Pid, Limit: "rss", Usage: rss, Max: maxRSS}
+						if r.cfg.Spare == nil || !r.cfg.Spare(e) {
+							res.OverLimit = "rss"
+							r.emit(e)
+							kill()
+							return
+						}
+						maxRSS = 0
+					}
+				}
+				if slowness {
+					if r.isPaused() {
+						rate = rateWindow{}
+					} else if bps, full := rate.add(now, written.Load(), r.cfg.RateWindow); full && bps < r.cfg.MinRate {
+						e := Event{Kind: TimedOut, PID: cmd.Process.Pid, Idle: now.Sub(r.LastActivity()), Timeout: r.IdleLimit(), Slow: true, Rate: bps}
+						if r.cfg.Spare == nil || !r.cfg.Spare(e) {
+							res.TimedOut = true
+							r.emit(e)
+							timedOut()
+							return
+						}
+						rate = rateWindow{}
+					}
+				}
+				continue
+			case <-r.rearm:
+			case <-deadline.C():
+			}
+
+			deadline.Stop()
+			if r.isPaused() {
+				continue // until Resume wakes it
+			}
+			elapsed := r.clock.Now().Sub(r.LastActivity())
+			limit := r.IdleLimit()
+			if r.cfg.FirstOutput > 0 && !spoke.Load() {
+				limit = r.cfg.FirstOutput
+			}
+
+			warn := r.cfg.WarnAt > 0 && r.cfg.WarnAt < limit
+			if warn {
+				if elapsed < r.cfg.WarnAt {
+					if r.warned.Swap(false) {
+						r.emit(Event{Kind: ActivityReset, PID: cmd.Process.Pid, Idle: elapsed, Timeout: limit})
+					}
+				} else if !r.warned.Load() {
+					r.warned.Store(true)
+					res.Warnings++
+					r.emit(Event{Kind: Warned, PID: cmd.Process.Pid, Idle: elapsed, Timeout: limit})
+				}
+			}
+
+			if elapsed >= limit {
+				e := Event{Kind: TimedOut, PID: cmd.Process.Pid, Idle: elapsed, Timeout: limit}
+				if r.cfg.Spare == nil || !r.cfg.Spare(e) {
+					res.TimedOut = true
+					r.emit(e)
+					timedOut()
+					return
+				}
+				r.warned.Store(false)
+				r.resetTimer()
+				elapsed = 0
+			}
+
+			next := limit - elapsed
+			if warn && elapsed < r.cfg.WarnAt {
+				next = r.cfg.WarnAt - elapsed
+			}
+			deadline.Reset(next)
+		}
+	}()
+
+	// Forward output as it arrives, crediting the idle clock for every chunk.
+	// Reading the PTY master ends with EIO once every holder of the slave
+	// side has exited, which may come before or after the command is
+	// reaped; either way the output is read to its end or the drain's.
+	var copiers sync.WaitGroup
+	var volume outputVolume
+	forward := func(src io.Reader, dst io.Writer, isStderr bool) {
+		defer copiers.Done()
+		if dst == nil {
+			dst = io.Discard
+		}
+		ignored := !r.cfg.PTY && (isStderr && r.cfg.IgnoreStderr || !isStderr && r.cfg.IgnoreStdout)
+		buf := make([]byte, minRead)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 && !ignored {
+				if !spoke.Swap(true) && r.cfg.FirstOutput > 0 {
+					r.wake() // the first output may bring the timeout forward
+				}
+				if r.cfg.Activity == nil || r.cfg.Activity(buf[:n]) {
+					r.credit(n)
+				}
+			}
+			if n > 0 {
+				written.Add(int64(n))
+				chunk, e, over := volume.add(buf[:n], r.cfg.MaxOutput, r.cfg.MaxLines)
+				if over && r.cfg.Spare != nil {
+					e.PID = cmd.Process.Pid
+					if r.cfg.Spare(e) {
+						volume.lifted.Store(true)
+						chunk, over = buf[:n], false
+					}
+				}
+				dst.Write(chunk)
+				if len(chunk) > 0 && r.listening.Load() {
+					r.emit(Event{Kind: OutputChunk, PID: cmd.Process.Pid, Data: bytes.Clone(chunk), Stderr: isStderr})
+				}
+				if over {
+					select {
+					case overLimit <- e:
+					default:
+					}
+				}
+			}
+			if err != nil {
+				return
+			}
+			if n == len(buf) && n < maxRead {
+				buf = make([]byte, 2*n) // a flood: fewer, larger reads
+			}
+		}
+	}
+	copiers.Add(1)
+	if stderr != nil {
+		copiers.Add(1)
+		go forward(stderr, r.cfg.Stderr, true)
+	}
+	forward(stdout, r.cfg.Stdout, false)
+	copiers.Wait()
+	close(copied)
+
+	// Wait for command to finish, and in subreaper mode for everything it
+	// started; the checker keeps running meanwhile and kills stragglers
+	<-exited
+	err := waitErr
+	for tree != nil && tree.scan() > 0 {
+		select {
+		case <-stopped:
+			tree.kill() // already timed out or cancelled
+		default:
+		}
+		sleep(r.clock, r.checkInterval(), nil)
+	}
+	close(done)
+	checker.Wait()
+	select {
+	case e := <-overLimit:
+		// The flood ended with the command, before the checker saw it
+		if !res.TimedOut && res.OverLimit == "" {
+			res.OverLimit = e.Limit
+			e.PID = cmd.Process.Pid
+			r.emit(e)
+		}
+	default:
+	}
+
+	switch {
+	case res.TimedOut:
+		res.ExitCode = ExitTimedOut
+	case res.OverLimit != "":
+		res.ExitCode = ExitOverLimit
+	case err == nil:
+		res.ExitCode = 0
+	default:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			res.ExitCode = exitStatus(exitErr.ProcessState)
+		} else {
+			res.Err = err
+		}
+		if ctx.Err() != nil {
+			res.Err = ctx.Err()
+		}
+	}
+	if cmd.ProcessState != nil {
+		res.Usage = &Usage{User: cmd.ProcessState.UserTime(), System: cmd.ProcessState.SystemTime()}
+		sysUsage(res.Usage, cmd.ProcessState)
+	}
+	r.emit(Event{Kind: Exited, PID: cmd.Process.Pid, ExitCode: res.ExitCode, TimedOut: res.TimedOut, OverLimit: res.OverLimit})
+	return res
+}
+
+// rateWindow samples the output total for MinRate
+type rateWindow struct {
+	samples []rateSample
+}
+
+type rateSample struct {
+	at    time.Time
+	total int64
+}
+
+// add records the total at now and returns the output rate in bytes a
+// second over the last window, and whether that much time is covered yet
+func (w *rateWindow) add(now time.Time, total int64, window time.Duration) (float64, bool) {
+	w.samples = append(w.samples, rateSample{now, total})
+	// Keep the newest sample at or before the window's start
+	from := now.Add(-window)
+	i := 0
+	for i+1 < len(w.samples) && !w.samples[i+1].at.After(from) {
+		i++
+	}
+	w.samples = w.samples[i:]
+	first := w.samples[0]
+	span := now.Sub(first.at)
+	if span < window {
+		return 0, false
+	}
+	return float64(total-first.total) / span.Seconds(), true
+}
+
+// outputVolume counts the output of a run across its stdout and stderr
+// copiers, for MaxOutput and MaxLines
+type outputVolume struct {
+	bytes, lines atomic.Int64
+	over         atomic.Bool
+	lifted       atomic.Bool // Spare kept the command running past the limit
+}
+
+// add counts chunk and returns the part of it within the limits. The chunk
+// that crosses one also returns the OverLimit event to report; anything
+// after it is dropped.
+func (v *outputVolume) add(chunk []byte, maxBytes, maxLines int64) ([]byte, Event, bool) {
+	if v.lifted.Load() {
+		return chunk, Event{}, false
+	}
+	if v.over.Load() {
+		return nil, Event{}, false
+	}
+	var e Event
+	if maxLines > 0 {
+		n := int64(bytes.Count(chunk, []byte{'\n'}))
+		if total := v.lines.Add(n); total > maxLines {
+			// Keep the output through the last allowed newline
+			keep := maxLines - (total - n)
+			cut := 0
+			for ; keep > 0; keep-- {
+				cut += bytes.IndexByte(chunk[cut:], '\n') + 1
+			}
+			chunk = chunk[:cut]
+			e = Event{Kind: OverLimit, Limit: "lines", Usage: total, Max: maxLines}
+		}
+	}
+	if maxBytes > 0 {
+		n := int64(len(chunk))
+		if total := v.bytes.Add(n); total > maxBytes {
+			chunk = chunk[:max(0, maxBytes-(total-n))]
+			if e.Limit == "" {
+				e = Event{Kind: OverLimit, Limit: "output", Usage: total, Max: maxBytes}
+			}
+		}
+	}
+	if e.Limit == "" || v.over.Swap(true) {
+		return chunk, Event{}, false
+	}
+	return chunk, e, true
+}
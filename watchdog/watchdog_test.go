@@ -0,0 +1,57 @@
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreditAfterSetTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := startedRunner(Config{Timeout: 10 * time.Second, ResetBytes: 1000, Clock: clock})
+	r.SetTimeout(100 * time.Second)
+	clock.Advance(60 * time.Second)
+
+	// A tenth of ResetBytes is worth a tenth of the new limit
+	r.credit(100)
+	if idle := clock.Now().Sub(r.LastActivity()); idle != 50*time.Second {
+		t.Fatalf("idle %v after the credit, want 50s", idle)
+	}
+}
+
+func TestSourceStampedByClock(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	src := NewReaderSource(strings.NewReader("typed"))
+	r := startedRunner(Config{Timeout: time.Minute, Clock: clock, Sources: []ActivitySource{src}})
+	done := make(chan struct{})
+	defer close(done)
+	r.watchSources(done)
+
+	clock.Advance(30 * time.Second)
+	src.Read(make([]byte, 8))
+	deadline := time.Now().Add(5 * time.Second)
+	for r.LastActivity() != clock.Now() {
+		if time.Now().After(deadline) {
+			t.Fatalf("last activity %v, want the read at %v", r.LastActivity(), clock.Now())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSupervisorDuplicateNames(t *testing.T) {
+	s := NewSupervisor(
+		Job{Name: "a", Config: Config{Path: "no-such-command"}},
+		Job{Name: "b", Config: Config{Path: "no-such-command"}},
+		Job{Name: "a", Config: Config{Path: "no-such-command"}},
+	)
+	events := s.Subscribe(1)
+	results := s.Run(context.Background())
+	if len(results) != 1 || !errors.Is(results["a"].Err, ErrDuplicateJob) {
+		t.Fatalf("results %+v, want only a duplicate name error for a", results)
+	}
+	if _, ok := <-events; ok {
+		t.Error("a job ran despite the duplicate names")
+	}
+}
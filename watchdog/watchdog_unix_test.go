@@ -0,0 +1,290 @@
+//go:build unix
+
+package watchdog
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// harness runs a silent command on a FakeClock, collecting its events
+type harness struct {
+	t      *testing.T
+	clock  *FakeClock
+	runner *Runner
+	start  time.Time
+	events chan Event
+	result Result
+	done   chan struct{} // closed once Run has returned result
+}
+
+// startRunner runs a silent command with cfg on a FakeClock and waits for
+// it to start
+func startRunner(t *testing.T, cfg Config) *harness {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := &harness{
+		t:      t,
+		clock:  NewFakeClock(start),
+		start:  start,
+		events: make(chan Event, 64),
+		done:   make(chan struct{}),
+	}
+	cfg.Path, cfg.Args = "sleep", []string{"60"}
+	cfg.Clock = h.clock
+	cfg.OnEvent = func(e Event) { h.events <- e }
+	h.runner = New(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		defer close(h.done)
+		h.result = h.runner.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-h.done
+	})
+	h.expect(Started)
+	return h
+}
+
+// expect returns the next event, which must be of kind
+func (h *harness) expect(kind EventKind) Event {
+	h.t.Helper()
+	select {
+	case e := <-h.events:
+		if e.Kind != kind {
+			h.t.Fatalf("got a %v event, want %v: %+v", e.Kind, kind, e)
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		h.t.Fatalf("no %v event", kind)
+	}
+	return Event{}
+}
+
+// quiet checks that no event is pending
+func (h *harness) quiet() {
+	h.t.Helper()
+	select {
+	case e := <-h.events:
+		h.t.Fatalf("unexpected %v event: %+v", e.Kind, e)
+	default:
+	}
+}
+
+// armed waits for a timer to be set for d after the start, so the clock is
+// advanced only once the runner has taken in the latest change
+func (h *harness) armed(d time.Duration) {
+	h.t.Helper()
+	at := h.start.Add(d)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		h.clock.mu.Lock()
+		for _, t := range h.clock.timers {
+			if t.when.Equal(at) {
+				h.clock.mu.Unlock()
+				return
+			}
+		}
+		h.clock.mu.Unlock()
+		if time.Now().After(deadline) {
+			h.t.Fatalf("no timer set for %v", d)
+		}
+	}
+}
+
+// idle waits for the runner to disarm its timer, as while paused
+func (h *harness) idle() {
+	h.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); h.clock.Timers() > 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("%d timers still set", h.clock.Timers())
+		}
+	}
+}
+
+// timedOut checks that the command times out after idle, with limit as its
+// idle limit, and is killed
+func (h *harness) timedOut(idle, limit time.Duration) {
+	h.t.Helper()
+	e := h.expect(TimedOut)
+	if e.Idle != idle || e.Timeout != limit {
+		h.t.Fatalf("timed out after %v of %v, want %v of %v", e.Idle, e.Timeout, idle, limit)
+	}
+	if e := h.expect(Exited); !e.TimedOut {
+		h.t.Fatalf("exit not reported as a timeout: %+v", e)
+	}
+	<-h.done
+	if !h.result.TimedOut {
+		h.t.Fatalf("result not a timeout: %+v", h.result)
+	}
+}
+
+func TestTimeoutFiresAtLimit(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second})
+	h.armed(10 * time.Second)
+	h.clock.Advance(10*time.Second - time.Nanosecond)
+	h.quiet()
+	h.clock.Advance(time.Nanosecond)
+	h.timedOut(10*time.Second, 10*time.Second)
+}
+
+func TestActivityPostponesTimeout(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second})
+	h.armed(10 * time.Second)
+	h.clock.Advance(6 * time.Second)
+	h.runner.Touch()
+	h.clock.Advance(4 * time.Second) // the timer set at the start fires
+	h.armed(16 * time.Second)
+	h.quiet()
+	h.clock.Advance(6 * time.Second)
+	h.timedOut(10*time.Second, 10*time.Second)
+}
+
+func TestWarnAt(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second, WarnAt: 4 * time.Second})
+	h.armed(4 * time.Second)
+	h.clock.Advance(4 * time.Second)
+	if e := h.expect(Warned); e.Idle != 4*time.Second || e.Timeout != 10*time.Second {
+		t.Fatalf("warned after %v of %v, want 4s of 10s", e.Idle, e.Timeout)
+	}
+	h.armed(10 * time.Second)
+
+	// Activity ends the episode, and the next one is warned about too
+	h.runner.Touch()
+	h.expect(ActivityReset)
+	h.armed(8 * time.Second)
+	h.clock.Advance(4 * time.Second)
+	if e := h.expect(Warned); e.Idle != 4*time.Second {
+		t.Fatalf("warned after %v, want 4s", e.Idle)
+	}
+	h.armed(14 * time.Second)
+	h.clock.Advance(6 * time.Second)
+	h.timedOut(10*time.Second, 10*time.Second)
+	if h.result.Warnings != 2 {
+		t.Fatalf("%d warnings, want 2", h.result.Warnings)
+	}
+}
+
+func TestExtend(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second})
+	h.armed(10 * time.Second)
+	h.clock.Advance(5 * time.Second)
+	h.runner.Extend(30 * time.Second)
+	h.armed(30 * time.Second)
+	if got := h.runner.IdleLimit(); got != 30*time.Second {
+		t.Fatalf("idle limit %v after Extend, want 30s", got)
+	}
+	h.clock.Advance(25*time.Second - time.Nanosecond)
+	h.quiet()
+	h.clock.Advance(time.Nanosecond)
+	h.timedOut(30*time.Second, 30*time.Second)
+}
+
+func TestExtendEndsWithActivity(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second})
+	h.armed(10 * time.Second)
+	h.runner.Extend(30 * time.Second)
+	h.armed(30 * time.Second)
+	h.clock.Advance(5 * time.Second)
+	h.runner.Touch()
+	if got := h.runner.IdleLimit(); got != 10*time.Second {
+		t.Fatalf("idle limit %v after activity, want 10s", got)
+	}
+	h.armed(15 * time.Second)
+	h.clock.Advance(10 * time.Second)
+	h.timedOut(10*time.Second, 10*time.Second)
+}
+
+func TestSetTimeout(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second})
+	h.armed(10 * time.Second)
+	h.clock.Advance(3 * time.Second)
+
+	h.runner.SetTimeout(20 * time.Second)
+	h.armed(20 * time.Second)
+	h.clock.Advance(7 * time.Second) // past the old limit
+	h.quiet()
+
+	h.runner.SetTimeout(15 * time.Second)
+	h.armed(15 * time.Second)
+	if got := h.runner.Timeout(); got != 15*time.Second {
+		t.Fatalf("timeout %v, want 15s", got)
+	}
+	h.clock.Advance(5 * time.Second)
+	h.timedOut(15*time.Second, 15*time.Second)
+}
+
+func TestSetTimeoutBelowIdle(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second})
+	h.armed(10 * time.Second)
+	h.clock.Advance(6 * time.Second)
+	h.runner.SetTimeout(5 * time.Second)
+	h.timedOut(6*time.Second, 5*time.Second)
+}
+
+func TestPauseResume(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second})
+	h.armed(10 * time.Second)
+	h.clock.Advance(4 * time.Second)
+	h.runner.Pause()
+	h.idle()
+	h.clock.Advance(time.Hour)
+	h.quiet()
+
+	// The clock picks up where it stopped, with 6s to go
+	h.runner.Resume()
+	h.armed(time.Hour + 10*time.Second)
+	if idle := h.clock.Now().Sub(h.runner.LastActivity()); idle != 4*time.Second {
+		t.Fatalf("idle %v after Resume, want 4s", idle)
+	}
+	h.clock.Advance(6*time.Second - time.Nanosecond)
+	h.quiet()
+	h.clock.Advance(time.Nanosecond)
+	h.timedOut(10*time.Second, 10*time.Second)
+}
+
+func TestExpire(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second})
+	h.armed(10 * time.Second)
+	h.clock.Advance(2 * time.Second)
+	h.runner.Expire()
+	h.timedOut(2*time.Second, 10*time.Second)
+}
+
+func TestSpareExpire(t *testing.T) {
+	spared := make(chan Event, 1)
+	h := startRunner(t, Config{Timeout: 10 * time.Second, Spare: func(e Event) bool {
+		if e.Forced {
+			spared <- e
+		}
+		return e.Forced
+	}})
+	h.armed(10 * time.Second)
+	h.clock.Advance(2 * time.Second)
+	h.runner.Expire()
+	select {
+	case e := <-spared:
+		if e.Kind != TimedOut || e.Idle != 2*time.Second {
+			t.Fatalf("spared %v after %v, want a timeout after 2s", e.Kind, e.Idle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expire didn't ask Spare")
+	}
+
+	// Sparing it restarts the idle clock
+	h.armed(12 * time.Second)
+	h.quiet()
+	h.clock.Advance(10 * time.Second)
+	h.timedOut(10*time.Second, 10*time.Second)
+}
+
+// TestKillSignal times out a command that exits on KillSignal, so the kill
+// needs no SIGKILL, and no time passes for KillGrace
+func TestKillSignal(t *testing.T) {
+	h := startRunner(t, Config{Timeout: 10 * time.Second, KillSignal: syscall.SIGTERM, KillGrace: time.Hour})
+	h.armed(10 * time.Second)
+	h.clock.Advance(10 * time.Second)
+	h.timedOut(10*time.Second, 10*time.Second)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gavlooth/idle-timeout/watchdog"
+)
+
+// watchFileMain waits for a log file to go quiet, for daemons that report
+// progress there rather than on stdout; what counts as a change is up to
+// watchdog.NewFileSource
+func watchFileMain(args []string) int {
+	fset := flag.NewFlagSet("watch-file", flag.ExitOnError)
+	pid := fset.Int("then-kill-pid", 0, "kill the process with this `PID` when the file goes quiet; watching ends if it exits first")
+	thenRun := fset.String("then-run", "", "run shell `command` when the file goes quiet (before the kill)")
+	fset.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: idle-timeout watch-file <duration> <path> [--then-kill-pid N] [--then-run <command>]\n")
+		fmt.Fprintf(os.Stderr, "Example: idle-timeout watch-file 5m /var/log/job.log --then-kill-pid 1234\n")
+		fmt.Fprintf(os.Stderr, "\nExits with 124 once the file has been quiet for the duration.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fset.PrintDefaults()
+	}
+	fset.Parse(args)
+	var positional []string
+	for fset.NArg() > 0 {
+		// Options may follow the duration and the path
+		positional = append(positional, fset.Arg(0))
+		fset.Parse(fset.Args()[1:])
+	}
+	if len(positional) != 2 || *pid < 0 {
+		fset.Usage()
+		return 1
+	}
+	timeout, err := parseDuration(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid duration %q: %v\n", positional[0], err)
+		return 1
+	}
+	path := positional[1]
+
+	if *pid > 0 && !processAlive(*pid) {
+		fmt.Fprintf(os.Stderr, "Failed to find PID %d\n", *pid)
+		return 1
+	}
+
+	last := time.Now()
+	if _, err := os.Stat(path); err != nil {
+		con.Logf("Waiting for %s to appear", path)
+	} else {
+		con.Logf("Watching %s", path)
+	}
+	file := watchdog.NewFileSource(path, watchdog.Resolution)
+	defer file.Close()
+	ticker := time.NewTicker(watchdog.Resolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case last = <-file.Events():
+			continue
+		case <-ticker.C:
+		}
+		if *pid > 0 && !processAlive(*pid) {
+			con.Logf("PID %d exited", *pid)
+			return 0
+		}
+		if idle := time.Since(last); idle >= timeout {
+			if *pid > 0 {
+				con.Logf("No change to %s for %v, killing PID %d...", path, timeout, *pid)
+			} else {
+				con.Logf("No change to %s for %v", path, timeout)
+			}
+			if *thenRun != "" {
+				inv := newInvocation("")
+				runHook("then-run", *thenRun, append(hookEnv(inv, *pid, idle, timeout), "IDLE_TIMEOUT_FILE="+path))
+			}
+			if *pid > 0 {
+				if p, err := os.FindProcess(*pid); err == nil {
+					p.Kill()
+				}
+			}
+			return watchdog.ExitTimedOut
+		}
+	}
+}
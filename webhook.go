@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// webhookTimeout bounds each delivery so a dead endpoint can't hold up exit
+const webhookTimeout = 10 * time.Second
+
+// webhookPayload is the JSON body POSTed for each lifecycle event
+type webhookPayload struct {
+	Event    string    `json:"event"` // start, timeout or exit
+	Time     time.Time `json:"time"`
+	ID       string    `json:"id"`
+	Session  string    `json:"session"`
+	Seq      int       `json:"seq"`
+	Host     string    `json:"host"`
+	Command  []string  `json:"command"`
+	PID      int       `json:"pid,omitempty"`
+	Idle     float64   `json:"idle_seconds,omitempty"`
+	Timeout  float64   `json:"timeout_seconds"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	TimedOut bool      `json:"timed_out,omitempty"`
+}
+
+// webhook delivers lifecycle events in the background; wait blocks until
+// every delivery has finished so nothing is lost when the wrapper exits
+type webhook struct {
+	url    string
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+var hostname, _ = os.Hostname()
+
+func newWebhook(url string) *webhook {
+	return &webhook{url: url, client: &http.Client{Timeout: webhookTimeout}}
+}
+
+func (w *webhook) send(p webhookPayload) {
+	p.Host = hostname
+	body, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("%s", resp.Status)
+			}
+		}
+		if err != nil {
+			con.Logf("Webhook %s delivery failed: %v", p.Event, err)
+		}
+	}()
+}
+
+func (w *webhook) wait() {
+	w.wg.Wait()
+}